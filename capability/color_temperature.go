@@ -0,0 +1,85 @@
+package capability
+
+import (
+	"fmt"
+)
+
+// ColorTemperatureRange is the range of color temperatures, in Kelvin, that a
+// light supports.
+type ColorTemperatureRange struct {
+	Min int
+	Max int
+}
+
+// DefaultColorTemperatureRange is the widest range supported by Yeelight
+// lights, used for models without a known range.
+var DefaultColorTemperatureRange = ColorTemperatureRange{Min: 1700, Max: 6500}
+
+// ColorTemperatureRanges are the ranges supported by known models.
+var ColorTemperatureRanges = map[string]ColorTemperatureRange{
+	"yeelink.light.color1":   {Min: 1700, Max: 6500},
+	"yeelink.light.color2":   {Min: 1700, Max: 6500},
+	"yeelink.light.strip1":   {Min: 1700, Max: 6500},
+	"yeelink.light.ceiling1": {Min: 2700, Max: 6500},
+	"yeelink.light.ct2":      {Min: 2700, Max: 6500},
+}
+
+// ColorTemperatureRangeForModel returns the range supported by the model, or
+// DefaultColorTemperatureRange if it is not known.
+func ColorTemperatureRangeForModel(model string) ColorTemperatureRange {
+	if r, ok := ColorTemperatureRanges[model]; ok {
+		return r
+	}
+	return DefaultColorTemperatureRange
+}
+
+// ColorTemperature reads and writes the color temperature of a light. The
+// color temperature is recorded and published by the light, as part of its
+// state and EventUpdateLight, so that writes also switch its color mode.
+type ColorTemperature struct {
+	light          *Light
+	supportedRange ColorTemperatureRange
+}
+
+func NewColorTemperature(light *Light, supportedRange ColorTemperatureRange) *ColorTemperature {
+	return &ColorTemperature{
+		light:          light,
+		supportedRange: supportedRange,
+	}
+}
+
+// Range returns the range of color temperatures the light supports.
+func (c *ColorTemperature) Range() ColorTemperatureRange {
+	return c.supportedRange
+}
+
+// SetColorTemperature sets the color temperature in Kelvin, which switches
+// the light to color temperature mode. The given transition is used if any,
+// or the light's default transition otherwise. Writes are confirmed if the
+// light confirms writes.
+func (c *ColorTemperature) SetColorTemperature(kelvin int, transition ...Transition) error {
+	if kelvin < c.supportedRange.Min || kelvin > c.supportedRange.Max {
+		return fmt.Errorf("Color temperature %dK is outside of the supported range %d-%dK", kelvin,
+			c.supportedRange.Min, c.supportedRange.Max)
+	}
+	return c.light.setColorTemperature(kelvin, transition)
+}
+
+func (c *ColorTemperature) Update() error {
+	return UpdateProperties(c.light.outbound, 0, c)
+}
+
+// Properties implements PropertyReader.
+func (c *ColorTemperature) Properties() []string {
+	return []string{"ct"}
+}
+
+// ApplyProperties implements PropertyReader. The color temperature is left
+// unchanged if the device does not support it.
+func (c *ColorTemperature) ApplyProperties(values PropertyValues) error {
+	decoded, err := c.light.decode(values, c.Properties())
+	if err != nil {
+		return err
+	}
+	return c.light.set(decoded, false)
+}
@@ -0,0 +1,101 @@
+package capability
+
+import (
+	"testing"
+
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/common"
+	transportMocks "github.com/nickw444/miio-go/protocol/transport/mocks"
+	subscriptionMocks "github.com/nickw444/miio-go/subscription/common/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func ColorTemperature_SetUp() (tt struct {
+	colorTemperature *ColorTemperature
+	outbound         *transportMocks.Outbound
+	target           *subscriptionMocks.SubscriptionTarget
+	light            *Light
+}) {
+	tt.target = new(subscriptionMocks.SubscriptionTarget)
+	tt.outbound = new(transportMocks.Outbound)
+	tt.light = NewLightWithClock(tt.target, tt.outbound, clock.NewMock())
+	tt.colorTemperature = NewColorTemperature(tt.light, ColorTemperatureRangeForModel("yeelink.light.ceiling1"))
+	return
+}
+
+func TestColorTemperatureRangeForModel(t *testing.T) {
+	assert.Equal(t, ColorTemperatureRange{Min: 2700, Max: 6500}, ColorTemperatureRangeForModel("yeelink.light.ct2"))
+	assert.Equal(t, DefaultColorTemperatureRange, ColorTemperatureRangeForModel("yeelink.light.unknown"))
+}
+
+// The color temperature is recorded and published by the light.
+func TestColorTemperature_Update(t *testing.T) {
+	tt := ColorTemperature_SetUp()
+	tt.outbound.On("CallAndDeserialize", "get_prop", []string{"ct"}, mock.Anything).
+		Return(nil).
+		Run(respondWith("4000"))
+	tt.target.On("Publish", common.EventUpdateLight{ColorTemperature: 4000}).Return(nil).Once()
+
+	err := tt.colorTemperature.Update()
+	assert.NoError(t, err)
+	assert.Equal(t, 4000, tt.light.State().ColorTemperature.Value)
+	tt.target.AssertExpectations(t)
+}
+
+// Lights without color temperature support report an empty value.
+func TestColorTemperature_UpdateUnsupported(t *testing.T) {
+	tt := ColorTemperature_SetUp()
+	tt.outbound.On("CallAndDeserialize", "get_prop", []string{"ct"}, mock.Anything).
+		Return(nil).
+		Run(respondWith(""))
+
+	err := tt.colorTemperature.Update()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, tt.light.State().ColorTemperature.Value)
+	tt.target.AssertNotCalled(t, "Publish", mock.Anything)
+}
+
+// Writes switch the light to color temperature mode, publishing a single
+// event.
+func TestColorTemperature_SetColorTemperature(t *testing.T) {
+	tt := ColorTemperature_SetUp()
+	tt.outbound.On("Call", "set_ct_abx", []interface{}{3000, "sudden", 0}).Return(ack, nil)
+	tt.target.On("Publish", common.EventUpdateLight{ColorMode: ColorModeTemperature, ColorTemperature: 3000}).
+		Return(nil).Once()
+
+	err := tt.colorTemperature.SetColorTemperature(3000)
+	assert.NoError(t, err)
+	assert.Equal(t, 3000, tt.light.State().ColorTemperature.Value)
+	assert.Equal(t, ColorModeTemperature, tt.light.State().ColorMode.Value)
+	tt.target.AssertExpectations(t)
+}
+
+// Values outside of the model's range are rejected without contacting the
+// device.
+func TestColorTemperature_SetColorTemperatureOutOfRange(t *testing.T) {
+	tt := ColorTemperature_SetUp()
+
+	err := tt.colorTemperature.SetColorTemperature(1700)
+	assert.EqualError(t, err, "Color temperature 1700K is outside of the supported range 2700-6500K")
+	tt.outbound.AssertNotCalled(t, "Call", mock.Anything, mock.Anything)
+}
+
+// Writes are confirmed if the light confirms writes, leaving the color mode
+// unchanged if they did not take effect.
+func TestColorTemperature_SetColorTemperatureNotConfirmed(t *testing.T) {
+	tt := ColorTemperature_SetUp()
+	tt.light.SetConfirmWrites(true)
+
+	tt.outbound.On("Call", "set_ct_abx", []interface{}{3000, "sudden", 0}).Return(ack, nil)
+	tt.outbound.On("CallAndDeserialize", "get_prop", []string{"ct"}, mock.Anything).
+		Return(nil).
+		Run(respondWith("2700"))
+	tt.target.On("Publish", common.EventUpdateLight{ColorTemperature: 2700}).Return(nil).Once()
+
+	err := tt.colorTemperature.SetColorTemperature(3000)
+	assert.Equal(t, ErrNotConfirmed, err)
+	assert.Equal(t, 2700, tt.light.State().ColorTemperature.Value)
+	assert.Equal(t, 0, tt.light.State().ColorMode.Value)
+	tt.target.AssertExpectations(t)
+}
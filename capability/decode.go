@@ -0,0 +1,197 @@
+package capability
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/nickw444/miio-go/common"
+)
+
+// ErrPropertyUnsupported is returned when the device reports an empty value
+// for a property, which devices do for properties they do not support, e.g.
+// rgb on a white-only bulb.
+var ErrPropertyUnsupported = errors.New("Property is not supported by the device.")
+
+// PropertyError describes a property value which could not be decoded.
+type PropertyError struct {
+	Property string
+	Value    interface{}
+	Err      error
+}
+
+func (e *PropertyError) Error() string {
+	return fmt.Sprintf("Unable to decode property %s from %#v: %s", e.Property, e.Value, e.Err)
+}
+
+// isUnsupported reports whether err is due to the device not supporting a
+// property.
+func isUnsupported(err error) bool {
+	if e, ok := err.(*PropertyError); ok {
+		err = e.Err
+	}
+	return err == ErrPropertyUnsupported
+}
+
+// PropertyValues are the values of a get_prop response, by property name.
+// Devices report values as strings or numbers depending on the firmware, so
+// the accessors accept either form.
+type PropertyValues struct {
+	props  []string
+	values []interface{}
+}
+
+// NewPropertyValues pairs the requested properties with the values from a
+// get_prop result, which must be an array with a value for each property.
+func NewPropertyValues(props []string, result interface{}) (PropertyValues, error) {
+	values, ok := result.([]interface{})
+	if !ok {
+		return PropertyValues{}, fmt.Errorf("Expected an array of property values, got %#v", result)
+	}
+	if len(values) != len(props) {
+		return PropertyValues{}, ErrPropertyCount
+	}
+	return PropertyValues{props: props, values: values}, nil
+}
+
+// Value returns the raw value of a property.
+func (v PropertyValues) Value(prop string) (interface{}, error) {
+	for i, p := range v.props {
+		if p == prop {
+			return v.values[i], nil
+		}
+	}
+	return nil, &PropertyError{Property: prop, Err: errors.New("Property was not requested")}
+}
+
+// Int decodes an integer property.
+func (v PropertyValues) Int(prop string) (int, error) {
+	value, err := v.Value(prop)
+	if err != nil {
+		return 0, err
+	}
+	i, err := DecodeInt(value)
+	if err != nil {
+		return 0, &PropertyError{Property: prop, Value: value, Err: err}
+	}
+	return i, nil
+}
+
+// String decodes a string property.
+func (v PropertyValues) String(prop string) (string, error) {
+	value, err := v.Value(prop)
+	if err != nil {
+		return "", err
+	}
+	s, err := DecodeString(value)
+	if err != nil {
+		return "", &PropertyError{Property: prop, Value: value, Err: err}
+	}
+	return s, nil
+}
+
+// PowerState decodes a power property.
+func (v PropertyValues) PowerState(prop string) (common.PowerState, error) {
+	value, err := v.Value(prop)
+	if err != nil {
+		return common.PowerStateUnknown, err
+	}
+	state, err := DecodePowerState(value)
+	if err != nil {
+		return common.PowerStateUnknown, &PropertyError{Property: prop, Value: value, Err: err}
+	}
+	return state, nil
+}
+
+// DecodeInt decodes an integer from a string such as "100" or a number.
+func DecodeInt(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, ErrPropertyUnsupported
+	case string:
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return 0, ErrPropertyUnsupported
+		}
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not an integer", v)
+		}
+		return i, nil
+	case float64:
+		if v != math.Trunc(v) || v > math.MaxInt32 || v < math.MinInt32 {
+			return 0, fmt.Errorf("%v is not an integer", v)
+		}
+		return int(v), nil
+	case int:
+		return v, nil
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("%s is not an integer", v)
+		}
+		return int(i), nil
+	default:
+		return 0, fmt.Errorf("Unexpected type %T", value)
+	}
+}
+
+// DecodeString decodes a string, formatting numbers if the device reported
+// one.
+func DecodeString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", ErrPropertyUnsupported
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", fmt.Errorf("Unexpected type %T", value)
+	}
+}
+
+// DecodePowerState decodes a power state, which devices report as "on" or
+// "off", a boolean, or 1 or 0.
+func DecodePowerState(value interface{}) (common.PowerState, error) {
+	switch v := value.(type) {
+	case nil:
+		return common.PowerStateUnknown, ErrPropertyUnsupported
+	case bool:
+		if v {
+			return common.PowerStateOn, nil
+		}
+		return common.PowerStateOff, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "on", "true", "1":
+			return common.PowerStateOn, nil
+		case "off", "false", "0":
+			return common.PowerStateOff, nil
+		case "":
+			return common.PowerStateUnknown, ErrPropertyUnsupported
+		}
+		return common.PowerStateUnknown, fmt.Errorf("%q is not a power state", v)
+	default:
+		i, err := DecodeInt(value)
+		if err != nil {
+			return common.PowerStateUnknown, err
+		}
+		switch i {
+		case 1:
+			return common.PowerStateOn, nil
+		case 0:
+			return common.PowerStateOff, nil
+		}
+		return common.PowerStateUnknown, fmt.Errorf("%d is not a power state", i)
+	}
+}
@@ -0,0 +1,241 @@
+package capability
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nickw444/miio-go/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// respondWithJSON deserializes a raw device response, as the outbound does.
+func respondWithJSON(data string) func(mock.Arguments) {
+	return func(args mock.Arguments) {
+		if err := json.Unmarshal([]byte(data), args.Get(2)); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestDecodeInt(t *testing.T) {
+	for _, tc := range []struct {
+		value    interface{}
+		expected int
+		err      bool
+	}{
+		{"100", 100, false},
+		{" 42 ", 42, false},
+		{"-1", -1, false},
+		{float64(16711680), 16711680, false},
+		{json.Number("7"), 7, false},
+		{"1.5", 0, true},
+		{float64(1.5), 0, true},
+		{"abc", 0, true},
+		{true, 0, true},
+		{[]interface{}{}, 0, true},
+	} {
+		i, err := DecodeInt(tc.value)
+		if tc.err {
+			assert.Error(t, err, "%#v", tc.value)
+		} else {
+			assert.NoError(t, err, "%#v", tc.value)
+			assert.Equal(t, tc.expected, i, "%#v", tc.value)
+		}
+	}
+
+	_, err := DecodeInt("")
+	assert.Equal(t, ErrPropertyUnsupported, err)
+	_, err = DecodeInt(nil)
+	assert.Equal(t, ErrPropertyUnsupported, err)
+}
+
+func TestDecodeString(t *testing.T) {
+	s, err := DecodeString("yeelink")
+	assert.NoError(t, err)
+	assert.Equal(t, "yeelink", s)
+
+	s, err = DecodeString(float64(26.5))
+	assert.NoError(t, err)
+	assert.Equal(t, "26.5", s)
+
+	_, err = DecodeString(map[string]interface{}{})
+	assert.Error(t, err)
+}
+
+func TestDecodePowerState(t *testing.T) {
+	for value, expected := range map[interface{}]common.PowerState{
+		"on":       common.PowerStateOn,
+		"off":      common.PowerStateOff,
+		"ON":       common.PowerStateOn,
+		true:       common.PowerStateOn,
+		false:      common.PowerStateOff,
+		float64(1): common.PowerStateOn,
+		float64(0): common.PowerStateOff,
+		"1":        common.PowerStateOn,
+		"0":        common.PowerStateOff,
+		"true":     common.PowerStateOn,
+		"false":    common.PowerStateOff,
+		" on ":     common.PowerStateOn,
+	} {
+		state, err := DecodePowerState(value)
+		assert.NoError(t, err, "%#v", value)
+		assert.EqualValues(t, expected, state, "%#v", value)
+	}
+
+	_, err := DecodePowerState("standby")
+	assert.Error(t, err)
+	_, err = DecodePowerState(float64(2))
+	assert.Error(t, err)
+	_, err = DecodePowerState("")
+	assert.Equal(t, ErrPropertyUnsupported, err)
+}
+
+func TestNewPropertyValues(t *testing.T) {
+	_, err := NewPropertyValues([]string{"power"}, []interface{}{})
+	assert.Equal(t, ErrPropertyCount, err)
+
+	_, err = NewPropertyValues([]string{"power"}, "ok")
+	assert.Error(t, err)
+
+	values, err := NewPropertyValues([]string{"power", "bright"}, []interface{}{"on", "abc"})
+	assert.NoError(t, err)
+	_, err = values.Int("bright")
+	assert.EqualError(t, err, `Unable to decode property bright from "abc": "abc" is not an integer`)
+	_, err = values.Int("rgb")
+	assert.Error(t, err)
+}
+
+// Responses from devices with different firmware are decoded into the same
+// state.
+func TestUpdateProperties_Variants(t *testing.T) {
+	for name, tc := range map[string]struct {
+		response string
+		power    common.PowerState
+		light    common.LightSnapshot
+		err      string
+	}{
+		// Yeelight firmware reports all values as strings.
+		"strings": {
+			response: `{"id":1,"result":["on","100","2","16711680","359","100"]}`,
+			power:    common.PowerStateOn,
+			light: common.LightSnapshot{
+				Brightness: common.IntValue{Value: 100},
+				ColorMode:  common.IntValue{Value: 2},
+				RGB:        common.RGBValue{Red: 255},
+				Hue:        common.IntValue{Value: 359},
+				Saturation: common.IntValue{Value: 100},
+			},
+		},
+		// Other firmware reports numbers as numbers.
+		"numbers": {
+			response: `{"id":1,"result":["off",50,1,65280,120,80]}`,
+			power:    common.PowerStateOff,
+			light: common.LightSnapshot{
+				Brightness: common.IntValue{Value: 50},
+				ColorMode:  common.IntValue{Value: 1},
+				RGB:        common.RGBValue{Green: 255},
+				Hue:        common.IntValue{Value: 120},
+				Saturation: common.IntValue{Value: 80},
+			},
+		},
+		// White-only bulbs report empty values for colour properties.
+		"unsupported": {
+			response: `{"id":1,"result":["on","25","2","","",""]}`,
+			power:    common.PowerStateOn,
+			light: common.LightSnapshot{
+				Brightness: common.IntValue{Value: 25},
+				ColorMode:  common.IntValue{Value: 2},
+			},
+		},
+		"boolean power": {
+			response: `{"id":1,"result":[true,"100","2","0","0","0"]}`,
+			power:    common.PowerStateOn,
+			light: common.LightSnapshot{
+				Brightness: common.IntValue{Value: 100},
+				ColorMode:  common.IntValue{Value: 2},
+			},
+		},
+		"empty": {
+			response: `{"id":1,"result":[]}`,
+			err:      ErrPropertyCount.Error(),
+		},
+		"error": {
+			response: `{"id":1,"error":{"code":-5001,"message":"command argument error"}}`,
+			err:      "Device returned error -5001: command argument error",
+		},
+		"invalid": {
+			response: `{"id":1,"result":["on","bright","2","0","0","0"]}`,
+			err:      `Unable to decode property bright from "bright": "bright" is not an integer`,
+		},
+	} {
+		tt := Properties_SetUp()
+		tt.outbound.On("CallAndDeserialize", "get_prop", mock.Anything, mock.AnythingOfType("*transport.Response")).
+			Return(nil).
+			Run(respondWithJSON(tc.response))
+		tt.target.On("Publish", mock.Anything).Return(nil)
+
+		err := UpdateProperties(tt.outbound, 0, tt.power, tt.light)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, name)
+			assert.Equal(t, common.LightSnapshot{}, tt.light.State(), name)
+			continue
+		}
+		assert.NoError(t, err, name)
+		assert.EqualValues(t, tc.power, tt.power.State().Power.Value, name)
+
+		// Ignore update times.
+		light := tt.light.State()
+		light.Brightness.LastUpdated = tc.light.Brightness.LastUpdated
+		light.ColorMode.LastUpdated = tc.light.ColorMode.LastUpdated
+		light.RGB.LastUpdated = tc.light.RGB.LastUpdated
+		light.Hue.LastUpdated = tc.light.Hue.LastUpdated
+		light.Saturation.LastUpdated = tc.light.Saturation.LastUpdated
+		assert.Equal(t, tc.light, light, name)
+	}
+}
+
+// Power.Update accepts the same variants.
+func TestPower_UpdateVariants(t *testing.T) {
+	for data, expected := range map[string]common.PowerState{
+		`{"id":1,"result":["on"]}`:  common.PowerStateOn,
+		`{"id":1,"result":[false]}`: common.PowerStateOff,
+		`{"id":1,"result":[1]}`:     common.PowerStateOn,
+	} {
+		tt := Power_SetUp()
+		tt.outbound.On("CallAndDeserialize", "get_prop", []string{"power"}, mock.Anything).
+			Return(nil).
+			Run(respondWithJSON(data))
+		tt.target.On("Publish", common.EventUpdatePower{PowerState: expected}).Return(nil)
+
+		assert.NoError(t, tt.power.Update(), data)
+		assert.Equal(t, expected, tt.power.State().Power.Value, data)
+	}
+
+	for _, data := range []string{`{"id":1,"result":["standby"]}`, `{"id":1,"result":"on"}`} {
+		tt := Power_SetUp()
+		tt.outbound.On("CallAndDeserialize", "get_prop", []string{"power"}, mock.Anything).
+			Return(nil).
+			Run(respondWithJSON(data))
+
+		assert.Error(t, tt.power.Update(), data)
+		tt.target.AssertNotCalled(t, "Publish", mock.Anything)
+	}
+}
+
+// Power.Update returns errors reported by the device rather than panicking.
+func TestPower_UpdateErrors(t *testing.T) {
+	for data, expected := range map[string]string{
+		`{"id":1,"result":[]}`: ErrPropertyCount.Error(),
+		`{"id":1,"error":{"code":-5001,"message":"command argument error"}}`: "Device returned error -5001: command argument error",
+	} {
+		tt := Power_SetUp()
+		tt.outbound.On("CallAndDeserialize", "get_prop", []string{"power"}, mock.Anything).
+			Return(nil).
+			Run(respondWithJSON(data))
+
+		err := tt.power.Update()
+		assert.EqualError(t, err, expected, data)
+		tt.target.AssertNotCalled(t, "Publish", mock.Anything)
+	}
+}
@@ -1,111 +1,268 @@
 package capability
 
 import (
-	"strconv"
+	"sync"
 
+	"github.com/benbjohnson/clock"
 	"github.com/nickw444/miio-go/common"
 	"github.com/nickw444/miio-go/protocol/transport"
 	"github.com/nickw444/miio-go/subscription"
 )
 
+// Color modes reported in the color_mode property.
+const (
+	ColorModeRGB         = 1
+	ColorModeTemperature = 2
+	ColorModeHSV         = 3
+)
+
 type Light struct {
 	subscriptionTarget subscription.SubscriptionTarget
 	outbound           transport.Outbound
+	clock              clock.Clock
 
-	lastEvent common.EventUpdateLight
+	stateMutex    sync.RWMutex
+	state         common.LightSnapshot
+	confirmWrites bool
+	transition    Transition
 }
 
 func NewLight(target subscription.SubscriptionTarget, transport transport.Outbound) *Light {
+	return NewLightWithClock(target, transport, clock.New())
+}
+
+// NewLightWithClock creates a light which timestamps its state using the
+// given clock.
+func NewLightWithClock(target subscription.SubscriptionTarget, transport transport.Outbound, clk clock.Clock) *Light {
 	return &Light{
 		subscriptionTarget: target,
 		outbound:           transport,
+		clock:              clk,
 	}
 }
 
-func (l *Light) SetBrightness(brightness int) error {
-	_, err := l.outbound.Call("set_bright", []interface{}{brightness})
+// State returns a snapshot of the last known light state.
+func (l *Light) State() common.LightSnapshot {
+	l.stateMutex.RLock()
+	defer l.stateMutex.RUnlock()
+	return l.state
+}
+
+// SetConfirmWrites sets whether writes are confirmed by reading back the
+// affected properties, rather than assuming the acknowledged values.
+func (l *Light) SetConfirmWrites(confirm bool) {
+	l.stateMutex.Lock()
+	l.confirmWrites = confirm
+	l.stateMutex.Unlock()
+}
+
+// SetTransition sets the transition used by writes which do not specify one.
+func (l *Light) SetTransition(transition Transition) {
+	l.stateMutex.Lock()
+	l.transition = transition
+	l.stateMutex.Unlock()
+}
+
+// SetBrightness sets the brightness, using the given transition if any, or
+// the default transition otherwise. The same applies to the other setters.
+func (l *Light) SetBrightness(brightness int, transition ...Transition) error {
+	return l.write("set_bright", []interface{}{brightness}, transition, map[string]int{"bright": brightness}, 0)
+}
+
+func (l *Light) SetHSV(hue int, saturation int, transition ...Transition) error {
+	return l.write("set_hsv", []interface{}{hue, saturation}, transition,
+		map[string]int{"hue": hue, "sat": saturation}, ColorModeHSV)
+}
+
+func (l *Light) SetRGB(red int, green int, blue int, transition ...Transition) error {
+	rgb := miioRGB(0)
+	rgb.SetComponents(red, green, blue)
+	return l.write("set_rgb", []interface{}{int(rgb)}, transition, map[string]int{"rgb": int(rgb)}, ColorModeRGB)
+}
+
+// write sends a command and records the written property values once the
+// device has acknowledged it. If writes are confirmed, the properties are read
+// back and the values read are recorded instead, returning ErrNotConfirmed if
+// they do not match. The color mode is recorded along with the values if the
+// command switches it, unless the write was not confirmed.
+func (l *Light) write(method string, params []interface{}, transition []Transition,
+	expected map[string]int, colorMode int) error {
+	t, err := l.resolveTransition(transition)
 	if err != nil {
 		return err
 	}
-
-	l.lastEvent.Brightness = brightness
-	return l.subscriptionTarget.Publish(l.lastEvent)
+	return l.writeTransition(method, params, t, expected, colorMode)
 }
 
-func (l *Light) SetHSV(hue int, saturation int) error {
-	_, err := l.outbound.Call("set_hsv", []interface{}{hue, saturation})
+// setColorTemperature writes a color temperature on behalf of the color
+// temperature capability. set_ct_abx requires an effect, so writes without a
+// transition are sudden.
+func (l *Light) setColorTemperature(kelvin int, transition []Transition) error {
+	t, err := l.resolveTransition(transition)
 	if err != nil {
 		return err
 	}
+	if t.Effect == "" {
+		t = Sudden
+	}
+	return l.writeTransition("set_ct_abx", []interface{}{kelvin}, t, map[string]int{"ct": kelvin},
+		ColorModeTemperature)
+}
 
-	l.lastEvent.Hue = hue
-	return l.subscriptionTarget.Publish(l.lastEvent)
+// resolveTransition returns the given transition if any, or the default
+// transition otherwise.
+func (l *Light) resolveTransition(transition []Transition) (Transition, error) {
+	l.stateMutex.RLock()
+	defer l.stateMutex.RUnlock()
+	return resolveTransition(l.transition, transition)
 }
 
-func (l *Light) SetRGB(red int, green int, blue int) error {
-	rgb := miioRGB(0)
-	rgb.SetComponents(red, green, blue)
-	_, err := l.outbound.Call("set_rgb", []interface{}{int(rgb)})
+// writeTransition is write with the transition already resolved.
+func (l *Light) writeTransition(method string, params []interface{}, t Transition,
+	expected map[string]int, colorMode int) error {
+	l.stateMutex.RLock()
+	confirm := l.confirmWrites
+	l.stateMutex.RUnlock()
+
+	if err := call(l.outbound, method, t.appendTo(params)); err != nil {
+		return err
+	}
+	if !confirm {
+		return l.set(withColorMode(expected, colorMode), true)
+	}
+
+	// ct is read by the color temperature capability, but recorded here.
+	props := make([]string, 0, len(expected))
+	for _, prop := range append(l.Properties(), "ct") {
+		if _, ok := expected[prop]; ok {
+			props = append(props, prop)
+		}
+	}
+	values, err := readProperties(l.outbound, props)
 	if err != nil {
 		return err
 	}
+	actual, err := l.decode(values, props)
+	if err != nil {
+		return err
+	}
+	for prop, value := range expected {
+		if actual[prop] != value {
+			if err := l.set(actual, true); err != nil {
+				return err
+			}
+			return ErrNotConfirmed
+		}
+	}
+	return l.set(withColorMode(actual, colorMode), true)
+}
 
-	l.lastEvent.RGB.Red = red
-	l.lastEvent.RGB.Green = green
-	l.lastEvent.RGB.Blue = blue
-	return l.subscriptionTarget.Publish(l.lastEvent)
+// withColorMode adds the color mode to written values, unless it is 0.
+func withColorMode(values map[string]int, colorMode int) map[string]int {
+	if colorMode == 0 {
+		return values
+	}
+	withMode := map[string]int{"color_mode": colorMode}
+	for prop, value := range values {
+		withMode[prop] = value
+	}
+	return withMode
 }
 
 func (l *Light) Update() error {
-	var resp transport.Response
-	props := []string{"bright", "color_mode", "rgb", "hue", "sat"}
-	err := l.outbound.CallAndDeserialize("get_prop", props, &resp)
+	return UpdateProperties(l.outbound, 0, l)
+}
+
+// Properties implements PropertyReader.
+func (l *Light) Properties() []string {
+	return []string{"bright", "color_mode", "rgb", "hue", "sat"}
+}
+
+// ApplyProperties implements PropertyReader. Properties the device does not
+// support are left unchanged, and no state is updated if any value is
+// invalid.
+func (l *Light) ApplyProperties(values PropertyValues) error {
+	decoded, err := l.decode(values, l.Properties())
 	if err != nil {
 		return err
 	}
+	return l.set(decoded, false)
+}
+
+// decode decodes the given properties, skipping those the device does not
+// support.
+func (l *Light) decode(values PropertyValues, props []string) (map[string]int, error) {
+	decoded := make(map[string]int)
+	for _, prop := range props {
+		value, err := values.Int(prop)
+		if isUnsupported(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		decoded[prop] = value
+	}
+	return decoded, nil
+}
 
+// set records property values, publishing the state if it changed or always
+// is set.
+func (l *Light) set(values map[string]int, always bool) error {
+	l.stateMutex.Lock()
+	now := l.clock.Now()
 	didUpdate := false
-	for i, result := range resp.Result.([]interface{}) {
-		propName := props[i]
-		result, _ := strconv.Atoi(result.(string))
+	for propName, result := range values {
 		switch propName {
 		case "bright":
-			if l.lastEvent.Brightness != result {
-				didUpdate = true
-				l.lastEvent.Brightness = result
-			}
+			didUpdate = l.state.Brightness.Value != result || didUpdate
+			l.state.Brightness = common.IntValue{Value: result, LastUpdated: now}
 		case "color_mode":
-			if l.lastEvent.ColorMode != result {
-				didUpdate = true
-				l.lastEvent.ColorMode = result
-			}
+			didUpdate = l.state.ColorMode.Value != result || didUpdate
+			l.state.ColorMode = common.IntValue{Value: result, LastUpdated: now}
 		case "rgb":
 			rgb := miioRGB(result)
 			red, green, blue := rgb.GetComponents()
-			if l.lastEvent.RGB.Red != red || l.lastEvent.RGB.Green != green || l.lastEvent.RGB.Blue != blue {
+			if l.state.RGB.Red != red || l.state.RGB.Green != green || l.state.RGB.Blue != blue {
 				didUpdate = true
-				l.lastEvent.RGB.Red = red
-				l.lastEvent.RGB.Green = green
-				l.lastEvent.RGB.Blue = blue
 			}
+			l.state.RGB = common.RGBValue{Red: red, Green: green, Blue: blue, LastUpdated: now}
 		case "hue":
-			if l.lastEvent.Hue != result {
-				didUpdate = true
-				l.lastEvent.Hue = result
-			}
+			didUpdate = l.state.Hue.Value != result || didUpdate
+			l.state.Hue = common.IntValue{Value: result, LastUpdated: now}
 		case "sat":
-			if l.lastEvent.Saturation != result {
-				didUpdate = true
-				l.lastEvent.Saturation = result
-			}
+			didUpdate = l.state.Saturation.Value != result || didUpdate
+			l.state.Saturation = common.IntValue{Value: result, LastUpdated: now}
+		case "ct":
+			didUpdate = l.state.ColorTemperature.Value != result || didUpdate
+			l.state.ColorTemperature = common.IntValue{Value: result, LastUpdated: now}
 		}
 	}
-	if didUpdate {
-		return l.subscriptionTarget.Publish(l.lastEvent)
+	event := l.event()
+	l.stateMutex.Unlock()
+
+	if didUpdate || always {
+		return l.subscriptionTarget.Publish(event)
 	}
 	return nil
 }
 
+// event builds an update event from the current state. Callers must hold
+// stateMutex.
+func (l *Light) event() common.EventUpdateLight {
+	event := common.EventUpdateLight{
+		Brightness: l.state.Brightness.Value,
+		ColorMode:  l.state.ColorMode.Value,
+		Hue:        l.state.Hue.Value,
+		Saturation: l.state.Saturation.Value,
+
+		ColorTemperature: l.state.ColorTemperature.Value,
+	}
+	event.RGB.Red = l.state.RGB.Red
+	event.RGB.Green = l.state.RGB.Green
+	event.RGB.Blue = l.state.RGB.Blue
+	return event
+}
+
 type miioRGB int
 
 func (m *miioRGB) GetComponents() (red int, green int, blue int) {
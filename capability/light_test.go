@@ -3,6 +3,7 @@ package capability
 import (
 	"testing"
 
+	"github.com/benbjohnson/clock"
 	"github.com/nickw444/miio-go/protocol/transport"
 	transportMocks "github.com/nickw444/miio-go/protocol/transport/mocks"
 	subscriptionMocks "github.com/nickw444/miio-go/subscription/common/mocks"
@@ -45,7 +46,7 @@ func Light_SetUp() (tt struct {
 }) {
 	tt.target = new(subscriptionMocks.SubscriptionTarget)
 	tt.outbound = new(transportMocks.Outbound)
-	tt.light = NewLight(tt.target, tt.outbound)
+	tt.light = NewLightWithClock(tt.target, tt.outbound, clock.NewMock())
 	return
 }
 
@@ -81,7 +82,7 @@ func TestLight_UpdateNoChanges(t *testing.T) {
 
 func TestLight_SetRGB(t *testing.T) {
 	tt := Light_SetUp()
-	tt.outbound.On("Call", "set_rgb", []interface{}{16777215}).Return(nil, nil)
+	tt.outbound.On("Call", "set_rgb", []interface{}{16777215}).Return(ack, nil)
 	tt.target.On("Publish", mock.Anything).Return(nil).Once()
 
 	err := tt.light.SetRGB(255, 255, 255)
@@ -91,7 +92,7 @@ func TestLight_SetRGB(t *testing.T) {
 
 func TestLight_SetHSV(t *testing.T) {
 	tt := Light_SetUp()
-	tt.outbound.On("Call", "set_hsv", []interface{}{120, 77}).Return(nil, nil)
+	tt.outbound.On("Call", "set_hsv", []interface{}{120, 77}).Return(ack, nil)
 	tt.target.On("Publish", mock.Anything).Return(nil).Once()
 
 	err := tt.light.SetHSV(120, 77)
@@ -101,10 +102,47 @@ func TestLight_SetHSV(t *testing.T) {
 
 func TestLight_SetBrightness(t *testing.T) {
 	tt := Light_SetUp()
-	tt.outbound.On("Call", "set_bright", []interface{}{55}).Return(nil, nil)
+	tt.outbound.On("Call", "set_bright", []interface{}{55}).Return(ack, nil)
 	tt.target.On("Publish", mock.Anything).Return(nil).Once()
 
 	err := tt.light.SetBrightness(55)
 	assert.NoError(t, err)
 	tt.target.AssertExpectations(t)
 }
+
+// State reflects the values read from the device.
+func TestLight_State(t *testing.T) {
+	tt := Light_SetUp()
+
+	tt.outbound.On("CallAndDeserialize", mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.Anything).
+		Return(nil).
+		Run(func(args mock.Arguments) {
+			resp := args.Get(2).(*transport.Response)
+			resp.Result = []interface{}{"100", "3", "16744207", "128", "90"}
+		})
+	tt.target.On("Publish", mock.Anything).Return(nil).Once()
+
+	err := tt.light.Update()
+	assert.NoError(t, err)
+
+	state := tt.light.State()
+	assert.Equal(t, 100, state.Brightness.Value)
+	assert.Equal(t, 3, state.ColorMode.Value)
+	assert.Equal(t, 255, state.RGB.Red)
+	assert.Equal(t, 127, state.RGB.Green)
+	assert.Equal(t, 15, state.RGB.Blue)
+	assert.Equal(t, 128, state.Hue.Value)
+	assert.Equal(t, 90, state.Saturation.Value)
+	assert.False(t, state.Brightness.LastUpdated.IsZero())
+}
+
+// Setters update the cached state.
+func TestLight_SetBrightnessState(t *testing.T) {
+	tt := Light_SetUp()
+	tt.outbound.On("Call", "set_bright", []interface{}{55}).Return(ack, nil)
+	tt.target.On("Publish", mock.Anything).Return(nil).Once()
+
+	err := tt.light.SetBrightness(55)
+	assert.NoError(t, err)
+	assert.Equal(t, 55, tt.light.State().Brightness.Value)
+}
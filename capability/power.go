@@ -1,6 +1,9 @@
 package capability
 
 import (
+	"sync"
+
+	"github.com/benbjohnson/clock"
 	"github.com/nickw444/miio-go/common"
 	"github.com/nickw444/miio-go/protocol/transport"
 	"github.com/nickw444/miio-go/subscription"
@@ -9,42 +12,138 @@ import (
 type Power struct {
 	subscriptionTarget subscription.SubscriptionTarget
 	outbound           transport.Outbound
-	powerState         common.PowerState
-}
+	clock              clock.Clock
 
-type PowerResponse struct {
-	Result []common.PowerState `json:"result"`
+	stateMutex    sync.RWMutex
+	powerState    common.PowerValue
+	confirmWrites bool
+	transition    Transition
+	transitions   bool
 }
 
 func NewPower(target subscription.SubscriptionTarget, transport transport.Outbound) *Power {
+	return NewPowerWithClock(target, transport, clock.New())
+}
+
+// NewPowerWithClock creates a power capability which timestamps its state
+// using the given clock.
+func NewPowerWithClock(target subscription.SubscriptionTarget, transport transport.Outbound, clk clock.Clock) *Power {
 	return &Power{
 		subscriptionTarget: target,
 		outbound:           transport,
-		powerState:         common.PowerStateUnknown,
+		clock:              clk,
+		powerState:         common.PowerValue{Value: common.PowerStateUnknown},
 	}
 }
 
-func (p *Power) SetPower(state common.PowerState) error {
-	_, err := p.outbound.Call("set_power", []string{string(state)})
+// State returns a snapshot of the last known power state.
+func (p *Power) State() common.PowerSnapshot {
+	p.stateMutex.RLock()
+	defer p.stateMutex.RUnlock()
+	return common.PowerSnapshot{Power: p.powerState}
+}
+
+// SetConfirmWrites sets whether writes are confirmed by reading back the
+// power state, rather than assuming the acknowledged state.
+func (p *Power) SetConfirmWrites(confirm bool) {
+	p.stateMutex.Lock()
+	p.confirmWrites = confirm
+	p.stateMutex.Unlock()
+}
+
+// EnableTransitions marks the device as supporting transitions, as lights do.
+// Otherwise SetPower returns ErrTransitionUnsupported for smooth transitions.
+func (p *Power) EnableTransitions() {
+	p.stateMutex.Lock()
+	p.transitions = true
+	p.stateMutex.Unlock()
+}
+
+// SetTransition sets the transition used by writes which do not specify one.
+// Only lights support transitions, so it should be left unset for other
+// devices.
+func (p *Power) SetTransition(transition Transition) {
+	p.stateMutex.Lock()
+	p.transition = transition
+	p.stateMutex.Unlock()
+}
+
+// SetPower sets the power state once the device has acknowledged it, using
+// the given transition if any, or the default transition otherwise. If
+// writes are confirmed, the state read back from the device is published
+// instead, and ErrNotConfirmed is returned if it does not match.
+func (p *Power) SetPower(state common.PowerState, transition ...Transition) error {
+	p.stateMutex.RLock()
+	confirm := p.confirmWrites
+	transitions := p.transitions
+	t, err := resolveTransition(p.transition, transition)
+	p.stateMutex.RUnlock()
 	if err != nil {
 		return err
 	}
+	if !transitions {
+		if t.Effect == EffectSmooth {
+			return ErrTransitionUnsupported
+		}
+		// Devices without transitions don't accept an effect, even sudden.
+		t = Transition{}
+	}
+
+	var params interface{} = []string{string(state)}
+	if t.Effect != "" {
+		params = t.appendTo([]interface{}{string(state)})
+	}
+	if err := call(p.outbound, "set_power", params); err != nil {
+		return err
+	}
+	if !confirm {
+		return p.set(state, true)
+	}
 
-	// TODO NW: Use the value from the response here.
-	p.powerState = state
-	return p.subscriptionTarget.Publish(common.EventUpdatePower{p.powerState})
+	values, err := readProperties(p.outbound, p.Properties())
+	if err != nil {
+		return err
+	}
+	actual, err := values.PowerState("power")
+	if err != nil {
+		return err
+	}
+	if err := p.set(actual, true); err != nil {
+		return err
+	}
+	if actual != state {
+		return ErrNotConfirmed
+	}
+	return nil
 }
 
 func (p *Power) Update() error {
-	resp := PowerResponse{}
-	err := p.outbound.CallAndDeserialize("get_prop", []string{"power"}, &resp)
+	return UpdateProperties(p.outbound, 0, p)
+}
+
+// Properties implements PropertyReader.
+func (p *Power) Properties() []string {
+	return []string{"power"}
+}
+
+// ApplyProperties implements PropertyReader.
+func (p *Power) ApplyProperties(values PropertyValues) error {
+	state, err := values.PowerState("power")
 	if err != nil {
 		return err
 	}
+	return p.set(state, false)
+}
+
+// set records the power state, publishing it if it changed or always is set.
+func (p *Power) set(state common.PowerState, always bool) error {
+	p.stateMutex.Lock()
+	didUpdate := state != p.powerState.Value
+	p.powerState = common.PowerValue{Value: state, LastUpdated: p.clock.Now()}
+	p.stateMutex.Unlock()
 
-	if resp.Result[0] != p.powerState {
-		p.powerState = resp.Result[0]
-		p.subscriptionTarget.Publish(common.EventUpdatePower{p.powerState})
+	if didUpdate || always {
+		return p.subscriptionTarget.Publish(common.EventUpdatePower{PowerState: state})
 	}
 
 	return nil
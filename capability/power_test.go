@@ -3,6 +3,7 @@ package capability
 import (
 	"testing"
 
+	"github.com/benbjohnson/clock"
 	"github.com/nickw444/miio-go/common"
 	transportMocks "github.com/nickw444/miio-go/protocol/transport/mocks"
 	subscriptionMocks "github.com/nickw444/miio-go/subscription/common/mocks"
@@ -17,7 +18,7 @@ func Power_SetUp() (tt struct {
 }) {
 	tt.target = new(subscriptionMocks.SubscriptionTarget)
 	tt.outbound = new(transportMocks.Outbound)
-	tt.power = NewPower(tt.target, tt.outbound)
+	tt.power = NewPowerWithClock(tt.target, tt.outbound, clock.NewMock())
 	return
 }
 
@@ -27,10 +28,7 @@ func TestPower_Update(t *testing.T) {
 
 	tt.outbound.On("CallAndDeserialize", mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.Anything).
 		Return(nil).
-		Run(func(args mock.Arguments) {
-			resp := args.Get(2).(*PowerResponse)
-			resp.Result = []common.PowerState{common.PowerStateOn}
-		})
+		Run(respondWith("on"))
 	tt.target.On("Publish", mock.Anything).Return(nil).Once()
 
 	err := tt.power.Update()
@@ -53,7 +51,7 @@ func TestPower_Update2(t *testing.T) {
 func TestPower_SetPower(t *testing.T) {
 	tt := Power_SetUp()
 
-	tt.outbound.On("Call", mock.Anything, mock.Anything).Return(nil, nil)
+	tt.outbound.On("Call", mock.Anything, mock.Anything).Return(ack, nil)
 	tt.target.On("Publish", mock.Anything).Return(nil).Once()
 
 	err := tt.power.SetPower(common.PowerStateOn)
@@ -68,7 +66,7 @@ func TestPower_SetPower2(t *testing.T) {
 	tt.target.On("Publish", mock.Anything).Return(nil)
 	tt.outbound.
 		On("Call", "set_power", []string{common.PowerStateOn}).
-		Return(nil, nil)
+		Return(ack, nil)
 
 	err := tt.power.SetPower(common.PowerStateOn)
 	assert.NoError(t, err)
@@ -88,3 +86,21 @@ func TestPower_SetPower3(t *testing.T) {
 	err := tt.power.SetPower(common.PowerStateOn)
 	assert.Error(t, err)
 }
+
+// State reflects the last value read from the device.
+func TestPower_State(t *testing.T) {
+	tt := Power_SetUp()
+
+	tt.outbound.On("CallAndDeserialize", mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.Anything).
+		Return(nil).
+		Run(respondWith("on"))
+	tt.target.On("Publish", mock.Anything).Return(nil)
+
+	assert.Equal(t, common.PowerStateUnknown, tt.power.State().Power.Value)
+	assert.True(t, tt.power.State().Power.LastUpdated.IsZero())
+
+	err := tt.power.Update()
+	assert.NoError(t, err)
+	assert.EqualValues(t, common.PowerStateOn, tt.power.State().Power.Value)
+	assert.False(t, tt.power.State().Power.LastUpdated.IsZero())
+}
@@ -0,0 +1,62 @@
+package capability
+
+import (
+	"errors"
+
+	"github.com/nickw444/miio-go/protocol/transport"
+)
+
+// DefaultMaxProperties is the number of properties requested per get_prop
+// call when a device does not specify its own limit. Many devices reject
+// requests for more.
+const DefaultMaxProperties = 15
+
+var ErrPropertyCount = errors.New("Device returned a different number of properties than requested.")
+
+// PropertyReader is implemented by capabilities whose state is read with
+// get_prop, so that a device can batch the reads of all its capabilities.
+type PropertyReader interface {
+	// Properties returns the names of the properties the capability reads.
+	Properties() []string
+	// ApplyProperties updates the capability's state from values, which
+	// include at least the capability's Properties.
+	ApplyProperties(values PropertyValues) error
+}
+
+// UpdateProperties reads the properties of each reader with as few get_prop
+// calls as possible, requesting at most maxProperties per call, then hands the
+// values back to each reader. No state is updated unless all calls succeed. A
+// maxProperties of 0 uses DefaultMaxProperties.
+func UpdateProperties(outbound transport.Outbound, maxProperties int, readers ...PropertyReader) error {
+	if maxProperties <= 0 {
+		maxProperties = DefaultMaxProperties
+	}
+
+	var props []string
+	for _, r := range readers {
+		props = append(props, r.Properties()...)
+	}
+
+	values := PropertyValues{}
+	for start := 0; start < len(props); start += maxProperties {
+		end := start + maxProperties
+		if end > len(props) {
+			end = len(props)
+		}
+
+		batch, err := readProperties(outbound, props[start:end])
+		if err != nil {
+			return err
+		}
+		values.props = append(values.props, batch.props...)
+		values.values = append(values.values, batch.values...)
+	}
+
+	var firstErr error
+	for _, r := range readers {
+		if err := r.ApplyProperties(values); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
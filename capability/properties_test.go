@@ -0,0 +1,111 @@
+package capability
+
+import (
+	"testing"
+
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/common"
+	"github.com/nickw444/miio-go/protocol/transport"
+	transportMocks "github.com/nickw444/miio-go/protocol/transport/mocks"
+	subscriptionMocks "github.com/nickw444/miio-go/subscription/common/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Properties_SetUp() (tt struct {
+	power    *Power
+	light    *Light
+	outbound *transportMocks.Outbound
+	target   *subscriptionMocks.SubscriptionTarget
+}) {
+	tt.target = new(subscriptionMocks.SubscriptionTarget)
+	tt.outbound = new(transportMocks.Outbound)
+	clk := clock.NewMock()
+	tt.power = NewPowerWithClock(tt.target, tt.outbound, clk)
+	tt.light = NewLightWithClock(tt.target, tt.outbound, clk)
+	return
+}
+
+func respondWith(values ...interface{}) func(mock.Arguments) {
+	return func(args mock.Arguments) {
+		args.Get(2).(*transport.Response).Result = values
+	}
+}
+
+// All properties are read with a single get_prop call.
+func TestUpdateProperties(t *testing.T) {
+	tt := Properties_SetUp()
+
+	tt.outbound.
+		On("CallAndDeserialize", "get_prop", []string{"power", "bright", "color_mode", "rgb", "hue", "sat"}, mock.Anything).
+		Return(nil).
+		Run(respondWith("on", "100", "2", "16711680", "0", "0")).
+		Once()
+	tt.target.On("Publish", mock.Anything).Return(nil)
+
+	err := UpdateProperties(tt.outbound, 0, tt.power, tt.light)
+	assert.NoError(t, err)
+	tt.outbound.AssertExpectations(t)
+
+	assert.EqualValues(t, common.PowerStateOn, tt.power.State().Power.Value)
+	assert.Equal(t, 100, tt.light.State().Brightness.Value)
+	assert.Equal(t, 255, tt.light.State().RGB.Red)
+	tt.target.AssertNumberOfCalls(t, "Publish", 2)
+}
+
+// Requests are split when there are more properties than the device accepts.
+func TestUpdateProperties_Split(t *testing.T) {
+	tt := Properties_SetUp()
+
+	tt.outbound.
+		On("CallAndDeserialize", "get_prop", []string{"power", "bright", "color_mode", "rgb"}, mock.Anything).
+		Return(nil).
+		Run(respondWith("on", "100", "2", "16711680")).
+		Once()
+	tt.outbound.
+		On("CallAndDeserialize", "get_prop", []string{"hue", "sat"}, mock.Anything).
+		Return(nil).
+		Run(respondWith("120", "50")).
+		Once()
+	tt.target.On("Publish", mock.Anything).Return(nil)
+
+	err := UpdateProperties(tt.outbound, 4, tt.power, tt.light)
+	assert.NoError(t, err)
+	tt.outbound.AssertExpectations(t)
+
+	assert.EqualValues(t, common.PowerStateOn, tt.power.State().Power.Value)
+	assert.Equal(t, 120, tt.light.State().Hue.Value)
+	assert.Equal(t, 50, tt.light.State().Saturation.Value)
+}
+
+// No state is updated if any request fails.
+func TestUpdateProperties_Error(t *testing.T) {
+	tt := Properties_SetUp()
+
+	tt.outbound.
+		On("CallAndDeserialize", "get_prop", []string{"power", "bright", "color_mode", "rgb"}, mock.Anything).
+		Return(nil).
+		Run(respondWith("on", "100", "2", "16711680"))
+	tt.outbound.
+		On("CallAndDeserialize", "get_prop", []string{"hue", "sat"}, mock.Anything).
+		Return(assert.AnError)
+
+	err := UpdateProperties(tt.outbound, 4, tt.power, tt.light)
+	assert.Equal(t, assert.AnError, err)
+	assert.Equal(t, common.PowerStateUnknown, tt.power.State().Power.Value)
+	tt.target.AssertNotCalled(t, "Publish", mock.Anything)
+}
+
+// A response with the wrong number of values is rejected.
+func TestUpdateProperties_Count(t *testing.T) {
+	tt := Properties_SetUp()
+
+	tt.outbound.
+		On("CallAndDeserialize", "get_prop", []string{"power"}, mock.Anything).
+		Return(nil).
+		Run(respondWith("on", "off"))
+
+	err := UpdateProperties(tt.outbound, 0, tt.power)
+	assert.Equal(t, ErrPropertyCount, err)
+	tt.target.AssertNotCalled(t, "Publish", mock.Anything)
+}
@@ -0,0 +1,71 @@
+package capability
+
+import (
+	"errors"
+	"time"
+)
+
+type Effect string
+
+const (
+	EffectSudden Effect = "sudden"
+	EffectSmooth Effect = "smooth"
+)
+
+// MinTransitionDuration is the shortest smooth transition lights accept.
+const MinTransitionDuration = time.Millisecond * 30
+
+var (
+	ErrInvalidEffect         = errors.New("Transition effect must be sudden or smooth.")
+	ErrTransitionDuration    = errors.New("Smooth transitions must last at least 30ms.")
+	ErrTransitionUnsupported = errors.New("Device does not support smooth transitions.")
+)
+
+// Transition describes how a light changes to a new value. The zero value
+// sends commands without an effect, which devices apply suddenly.
+type Transition struct {
+	Effect   Effect
+	Duration time.Duration
+}
+
+// Sudden applies changes immediately.
+var Sudden = Transition{Effect: EffectSudden}
+
+// Smooth fades to the new value over the given duration.
+func Smooth(duration time.Duration) Transition {
+	return Transition{Effect: EffectSmooth, Duration: duration}
+}
+
+// Validate checks that the transition is one devices accept.
+func (t Transition) Validate() error {
+	switch t.Effect {
+	case "", EffectSudden:
+		return nil
+	case EffectSmooth:
+		if t.Duration < MinTransitionDuration {
+			return ErrTransitionDuration
+		}
+		return nil
+	default:
+		return ErrInvalidEffect
+	}
+}
+
+// appendTo appends the effect and duration in milliseconds to a command's
+// params, unless no effect is set.
+func (t Transition) appendTo(params []interface{}) []interface{} {
+	if t.Effect == "" {
+		return params
+	}
+	return append(params, string(t.Effect), int(t.Duration/time.Millisecond))
+}
+
+// resolveTransition returns the first of the given transitions, or the
+// default if none are given, once validated.
+func resolveTransition(def Transition, transition []Transition) (Transition, error) {
+	t := def
+	if len(transition) > 0 {
+		t = transition[0]
+	}
+	return t, t.Validate()
+}
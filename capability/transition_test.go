@@ -0,0 +1,88 @@
+package capability
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nickw444/miio-go/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestTransition_Validate(t *testing.T) {
+	assert.NoError(t, Transition{}.Validate())
+	assert.NoError(t, Sudden.Validate())
+	assert.NoError(t, Smooth(MinTransitionDuration).Validate())
+	assert.Equal(t, ErrTransitionDuration, Smooth(time.Millisecond*29).Validate())
+	assert.Equal(t, ErrInvalidEffect, Transition{Effect: "fade"}.Validate())
+}
+
+// Transitions are sent as the effect and duration in milliseconds.
+func TestLight_SetBrightnessTransition(t *testing.T) {
+	tt := Light_SetUp()
+	tt.outbound.On("Call", "set_bright", []interface{}{55, "smooth", 500}).Return(ack, nil)
+	tt.target.On("Publish", mock.Anything).Return(nil)
+
+	err := tt.light.SetBrightness(55, Smooth(time.Millisecond*500))
+	assert.NoError(t, err)
+	tt.outbound.AssertExpectations(t)
+}
+
+// The default transition is used unless one is given.
+func TestLight_SetTransition(t *testing.T) {
+	tt := Light_SetUp()
+	tt.light.SetTransition(Smooth(time.Second))
+	tt.outbound.On("Call", "set_rgb", []interface{}{0xff0000, "smooth", 1000}).Return(ack, nil)
+	tt.outbound.On("Call", "set_hsv", []interface{}{120, 77, "sudden", 0}).Return(ack, nil)
+	tt.target.On("Publish", mock.Anything).Return(nil)
+
+	assert.NoError(t, tt.light.SetRGB(255, 0, 0))
+	assert.NoError(t, tt.light.SetHSV(120, 77, Sudden))
+	tt.outbound.AssertExpectations(t)
+}
+
+// Invalid transitions are rejected without contacting the device.
+func TestLight_SetBrightnessInvalidTransition(t *testing.T) {
+	tt := Light_SetUp()
+
+	err := tt.light.SetBrightness(55, Smooth(time.Millisecond*10))
+	assert.Equal(t, ErrTransitionDuration, err)
+	tt.outbound.AssertNotCalled(t, "Call", mock.Anything, mock.Anything)
+}
+
+func TestPower_SetPowerTransition(t *testing.T) {
+	tt := Power_SetUp()
+	tt.power.EnableTransitions()
+	tt.outbound.On("Call", "set_power", []interface{}{"on", "smooth", 30}).Return(ack, nil)
+	tt.target.On("Publish", common.EventUpdatePower{PowerState: common.PowerStateOn}).Return(nil)
+
+	err := tt.power.SetPower(common.PowerStateOn, Smooth(MinTransitionDuration))
+	assert.NoError(t, err)
+	tt.outbound.AssertExpectations(t)
+}
+
+// Smooth transitions are rejected by devices without transitions, and sudden
+// transitions are sent without an effect.
+func TestPower_SetPowerTransitionUnsupported(t *testing.T) {
+	tt := Power_SetUp()
+
+	err := tt.power.SetPower(common.PowerStateOn, Smooth(time.Second))
+	assert.Equal(t, ErrTransitionUnsupported, err)
+	tt.outbound.AssertNotCalled(t, "Call", mock.Anything, mock.Anything)
+
+	tt.outbound.On("Call", "set_power", []string{"on"}).Return(ack, nil)
+	tt.target.On("Publish", common.EventUpdatePower{PowerState: common.PowerStateOn}).Return(nil)
+	assert.NoError(t, tt.power.SetPower(common.PowerStateOn, Sudden))
+	tt.outbound.AssertExpectations(t)
+}
+
+func TestColorTemperature_SetColorTemperatureTransition(t *testing.T) {
+	tt := ColorTemperature_SetUp()
+	tt.light.SetTransition(Smooth(time.Millisecond * 200))
+	tt.outbound.On("Call", "set_ct_abx", []interface{}{3000, "smooth", 200}).Return(ack, nil)
+	tt.target.On("Publish", mock.Anything).Return(nil)
+
+	err := tt.colorTemperature.SetColorTemperature(3000)
+	assert.NoError(t, err)
+	tt.outbound.AssertExpectations(t)
+}
@@ -0,0 +1,44 @@
+package capability
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/nickw444/miio-go/protocol/transport"
+)
+
+var (
+	ErrNotAcknowledged = errors.New("Device did not acknowledge the command.")
+	ErrNotConfirmed    = errors.New("Device state did not change to match the command.")
+)
+
+// call sends a command and checks that the device acknowledged it with "ok".
+func call(outbound transport.Outbound, method string, params interface{}) error {
+	data, err := outbound.Call(method, params)
+	if err != nil {
+		return err
+	}
+	resp := transport.Response{}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if !resp.IsOK() {
+		return ErrNotAcknowledged
+	}
+	return nil
+}
+
+// readProperties reads properties with a single get_prop call.
+func readProperties(outbound transport.Outbound, props []string) (PropertyValues, error) {
+	var resp transport.Response
+	if err := outbound.CallAndDeserialize("get_prop", props, &resp); err != nil {
+		return PropertyValues{}, err
+	}
+	if resp.Error != nil {
+		return PropertyValues{}, resp.Error
+	}
+	return NewPropertyValues(props, resp.Result)
+}
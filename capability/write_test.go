@@ -0,0 +1,154 @@
+package capability
+
+import (
+	"testing"
+
+	"github.com/nickw444/miio-go/common"
+	"github.com/nickw444/miio-go/protocol/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// ack is the response devices send to acknowledge a command.
+var ack = []byte(`{"id":1,"result":["ok"]}`)
+
+// Writes fail unless the device acknowledges them, leaving the state
+// unchanged.
+func TestPower_SetPowerNotAcknowledged(t *testing.T) {
+	for data, expected := range map[string]string{
+		`{"id":1,"result":["error"]}`:                             ErrNotAcknowledged.Error(),
+		`{"id":1,"result":null}`:                                  ErrNotAcknowledged.Error(),
+		`{"id":1,"error":{"code":-5001,"message":"invalid arg"}}`: "Device returned error -5001: invalid arg",
+	} {
+		tt := Power_SetUp()
+		tt.outbound.On("Call", "set_power", []string{common.PowerStateOn}).Return([]byte(data), nil)
+
+		err := tt.power.SetPower(common.PowerStateOn)
+		assert.EqualError(t, err, expected, data)
+		assert.Equal(t, common.PowerStateUnknown, tt.power.State().Power.Value, data)
+		tt.target.AssertNotCalled(t, "Publish", mock.Anything)
+	}
+}
+
+// Confirmed writes publish the state read back from the device.
+func TestPower_SetPowerConfirmed(t *testing.T) {
+	tt := Power_SetUp()
+	tt.power.SetConfirmWrites(true)
+
+	tt.outbound.On("Call", "set_power", []string{common.PowerStateOn}).Return(ack, nil)
+	tt.outbound.On("CallAndDeserialize", "get_prop", []string{"power"}, mock.Anything).
+		Return(nil).
+		Run(respondWith("on"))
+	tt.target.On("Publish", common.EventUpdatePower{PowerState: common.PowerStateOn}).Return(nil).Once()
+
+	err := tt.power.SetPower(common.PowerStateOn)
+	assert.NoError(t, err)
+	assert.EqualValues(t, common.PowerStateOn, tt.power.State().Power.Value)
+	tt.target.AssertExpectations(t)
+}
+
+// Confirmed writes which did not take effect return an error and publish the
+// actual state.
+func TestPower_SetPowerNotConfirmed(t *testing.T) {
+	tt := Power_SetUp()
+	tt.power.SetConfirmWrites(true)
+
+	tt.outbound.On("Call", "set_power", []string{common.PowerStateOn}).Return(ack, nil)
+	tt.outbound.On("CallAndDeserialize", "get_prop", []string{"power"}, mock.Anything).
+		Return(nil).
+		Run(respondWith("off"))
+	tt.target.On("Publish", common.EventUpdatePower{PowerState: common.PowerStateOff}).Return(nil).Once()
+
+	err := tt.power.SetPower(common.PowerStateOn)
+	assert.Equal(t, ErrNotConfirmed, err)
+	assert.EqualValues(t, common.PowerStateOff, tt.power.State().Power.Value)
+	tt.target.AssertExpectations(t)
+}
+
+// SetHSV records both hue and saturation.
+func TestLight_SetHSVState(t *testing.T) {
+	tt := Light_SetUp()
+	tt.outbound.On("Call", "set_hsv", []interface{}{120, 77}).Return(ack, nil)
+	tt.target.On("Publish", mock.MatchedBy(func(e common.EventUpdateLight) bool {
+		return e.Hue == 120 && e.Saturation == 77 && e.ColorMode == ColorModeHSV
+	})).Return(nil).Once()
+
+	err := tt.light.SetHSV(120, 77)
+	assert.NoError(t, err)
+	assert.Equal(t, 120, tt.light.State().Hue.Value)
+	assert.Equal(t, 77, tt.light.State().Saturation.Value)
+	assert.Equal(t, ColorModeHSV, tt.light.State().ColorMode.Value)
+	tt.target.AssertExpectations(t)
+}
+
+// SetRGB switches the color mode, which brightness writes leave unchanged.
+func TestLight_SetRGBColorMode(t *testing.T) {
+	tt := Light_SetUp()
+	tt.outbound.On("Call", "set_rgb", []interface{}{0xff0000}).Return(ack, nil)
+	tt.outbound.On("Call", "set_bright", []interface{}{55}).Return(ack, nil)
+	tt.target.On("Publish", mock.Anything).Return(nil).Twice()
+
+	assert.NoError(t, tt.light.SetRGB(255, 0, 0))
+	assert.Equal(t, ColorModeRGB, tt.light.State().ColorMode.Value)
+	assert.NoError(t, tt.light.SetBrightness(55))
+	assert.Equal(t, ColorModeRGB, tt.light.State().ColorMode.Value)
+}
+
+func TestLight_SetBrightnessNotAcknowledged(t *testing.T) {
+	tt := Light_SetUp()
+	tt.outbound.On("Call", "set_bright", []interface{}{55}).Return([]byte(`{"id":1,"result":[]}`), nil)
+
+	err := tt.light.SetBrightness(55)
+	assert.Equal(t, ErrNotAcknowledged, err)
+	assert.Equal(t, 0, tt.light.State().Brightness.Value)
+	tt.target.AssertNotCalled(t, "Publish", mock.Anything)
+}
+
+// Confirmed writes read back only the written properties.
+func TestLight_SetHSVConfirmed(t *testing.T) {
+	tt := Light_SetUp()
+	tt.light.SetConfirmWrites(true)
+
+	tt.outbound.On("Call", "set_hsv", []interface{}{120, 77}).Return(ack, nil)
+	tt.outbound.On("CallAndDeserialize", "get_prop", []string{"hue", "sat"}, mock.AnythingOfType("*transport.Response")).
+		Return(nil).
+		Run(func(args mock.Arguments) {
+			args.Get(2).(*transport.Response).Result = []interface{}{"120", "77"}
+		})
+	tt.target.On("Publish", mock.Anything).Return(nil).Once()
+
+	err := tt.light.SetHSV(120, 77)
+	assert.NoError(t, err)
+	assert.Equal(t, 77, tt.light.State().Saturation.Value)
+	tt.outbound.AssertExpectations(t)
+}
+
+func TestLight_SetRGBNotConfirmed(t *testing.T) {
+	tt := Light_SetUp()
+	tt.light.SetConfirmWrites(true)
+
+	tt.outbound.On("Call", "set_rgb", []interface{}{0xff0000}).Return(ack, nil)
+	tt.outbound.On("CallAndDeserialize", "get_prop", []string{"rgb"}, mock.Anything).
+		Return(nil).
+		Run(respondWith("255"))
+	tt.target.On("Publish", mock.Anything).Return(nil).Once()
+
+	err := tt.light.SetRGB(255, 0, 0)
+	assert.Equal(t, ErrNotConfirmed, err)
+	assert.Equal(t, common.RGBValue{Blue: 255, LastUpdated: tt.light.State().RGB.LastUpdated}, tt.light.State().RGB)
+	assert.Equal(t, 0, tt.light.State().ColorMode.Value)
+}
+
+// Confirmation fails if the properties cannot be read back.
+func TestLight_SetBrightnessConfirmError(t *testing.T) {
+	tt := Light_SetUp()
+	tt.light.SetConfirmWrites(true)
+
+	tt.outbound.On("Call", "set_bright", []interface{}{55}).Return(ack, nil)
+	tt.outbound.On("CallAndDeserialize", "get_prop", []string{"bright"}, mock.Anything).Return(assert.AnError)
+
+	err := tt.light.SetBrightness(55)
+	assert.Equal(t, assert.AnError, err)
+	assert.Equal(t, 0, tt.light.State().Brightness.Value)
+	tt.target.AssertNotCalled(t, "Publish", mock.Anything)
+}
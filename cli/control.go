@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -13,43 +15,59 @@ import (
 var sharedDevice common.Device
 
 func findDevice(deviceId uint32, timeout time.Duration) (common.Device, error) {
-	var timeoutCh <-chan time.Time
-	timeoutCh = time.After(timeout)
-	sub, err := sharedClient.NewSubscription()
-	if err != nil {
-		panic(err)
-	}
-	events := sub.Events()
-	defer sub.Close()
-
-	for {
-		select {
-		case event := <-events:
-			switch event.(type) {
-			case common.EventNewDevice:
-				dev := event.(common.EventNewDevice).Device
-				if dev.ID() == deviceId {
-					return dev, nil
-				}
-			}
-		case <-timeoutCh:
-			return nil, fmt.Errorf("Timed out whilst connecting to device with id %d", deviceId)
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	dev, err := sharedClient.WaitForDevice(ctx, deviceId)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("Timed out whilst connecting to device with id %d", deviceId)
+	} else if err != nil {
+		return nil, err
 	}
+	return dev, nil
 }
 
 func installControl(app *kingpin.Application) {
 	controlCmd := app.Command("control", "Control lights")
 	deviceId := controlCmd.Flag("device-id", "The ID of the device to control").Required().Uint32()
+	confirm := controlCmd.Flag("confirm", "Read back properties after writing them to confirm the change").Bool()
+	smooth := controlCmd.Flag("smooth", "Fade lights to the new value over the given duration (at least 30ms)").
+		Duration()
 
 	controlCmd.Action(func(ctx *kingpin.ParseContext) (err error) {
 		sharedDevice, err = findDevice(*deviceId, time.Second*5)
+		if err != nil {
+			return
+		}
+		switch dev := sharedDevice.(type) {
+		case *device.Yeelight:
+			if *confirm {
+				dev.Power.SetConfirmWrites(true)
+				dev.Light.SetConfirmWrites(true)
+			}
+			if *smooth != 0 {
+				dev.Power.SetTransition(capability.Smooth(*smooth))
+				dev.Light.SetTransition(capability.Smooth(*smooth))
+			}
+		case *device.PowerPlug:
+			if *confirm {
+				dev.Power.SetConfirmWrites(true)
+			}
+			if *smooth != 0 {
+				return fmt.Errorf("Device with type %T does not support smooth transitions", sharedDevice)
+			}
+		default:
+			if *smooth != 0 {
+				return fmt.Errorf("Device with type %T does not support smooth transitions", sharedDevice)
+			}
+		}
 		return
 	})
 
 	installBrightness(controlCmd)
 	installPower(controlCmd)
 	installColor(controlCmd)
+	installOTA(controlCmd)
 }
 
 func installBrightness(parent *kingpin.CmdClause) {
@@ -100,7 +118,11 @@ func installColor(parent *kingpin.CmdClause) {
 	green := rgb.Arg("green", "Green value to set (0-255)").Required().Int()
 	blue := rgb.Arg("blue", "Blue value to set (0-255)").Required().Int()
 
+	ct := cmd.Command("ct", "Set color temperature")
+	kelvin := ct.Arg("kelvin", "Color temperature to set in Kelvin (1700-6500)").Required().Int()
+
 	var light *capability.Light
+	var colorTemperature *capability.ColorTemperature
 
 	rgb.Action(func(ctx *kingpin.ParseContext) error {
 		return light.SetRGB(*red, *green, *blue)
@@ -110,10 +132,15 @@ func installColor(parent *kingpin.CmdClause) {
 		return light.SetHSV(*hue, *sat)
 	})
 
+	ct.Action(func(ctx *kingpin.ParseContext) error {
+		return colorTemperature.SetColorTemperature(*kelvin)
+	})
+
 	cmd.Action(func(ctx *kingpin.ParseContext) error {
 		switch sharedDevice.(type) {
 		case *device.Yeelight:
 			light = sharedDevice.(*device.Yeelight).Light
+			colorTemperature = sharedDevice.(*device.Yeelight).ColorTemperature
 		default:
 			return fmt.Errorf("Device with type %T cannot have brightness adjusted", sharedDevice)
 		}
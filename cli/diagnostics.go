@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+)
+
+func installDiagnostics(app *kingpin.Application) {
+	cmd := app.Command("diagnostics", "Show Wi-Fi signal and uptime of devices on the local network")
+	wait := cmd.Flag("wait", "How long to discover devices for").Default("5s").Duration()
+	cmd.Action(func(ctx *kingpin.ParseContext) error {
+		sharedClient.SetDiscoveryInterval(time.Second * 2)
+		time.Sleep(*wait)
+
+		results, err := sharedClient.Diagnostics()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+
+		ids := make([]uint32, 0, len(results))
+		for id := range results {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tMODEL\tFIRMWARE\tIP\tSSID\tRSSI\tWIFI\tUPTIME")
+		for _, id := range ids {
+			d := results[id]
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", id, d.Info.Model, d.Info.FirmwareVersion,
+				d.Info.Network.LocalIP, d.Info.AccessPoint.SSID, d.Info.AccessPoint.RSSI, d.WiFi.State,
+				d.Info.Uptime())
+		}
+		return w.Flush()
+	})
+}
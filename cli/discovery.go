@@ -35,13 +35,18 @@ func installDiscovery(app *kingpin.Application) {
 
 func writeDeviceInfo(dev common.Device) {
 	deviceInfo, _ := dev.GetInfo()
+	label, _ := dev.GetLabel()
 	fmt.Println("-------------")
 	fmt.Println("Discovered new device:")
 	fmt.Printf("ID: %d\n", dev.ID())
+	fmt.Printf("Label: %s\n", label)
+	fmt.Printf("Address: %s\n", dev.Addr())
 	fmt.Printf("Firmware Version: %s\n", deviceInfo.FirmwareVersion)
 	fmt.Printf("Hardware Version: %s\n", deviceInfo.HardwareVersion)
 	fmt.Printf("Mac Address: %s\n", deviceInfo.MacAddress)
 	fmt.Printf("Model: %s\n", deviceInfo.Model)
+	fmt.Printf("Wi-Fi: %s (%d dBm)\n", deviceInfo.AccessPoint.SSID, deviceInfo.AccessPoint.RSSI)
+	fmt.Printf("Uptime: %s\n", deviceInfo.Uptime())
 	fmt.Printf("Token: %s\n", hex.EncodeToString(dev.GetToken()))
 	fmt.Println("-------------")
 }
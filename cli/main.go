@@ -3,46 +3,45 @@ package main
 import (
 	"net"
 	"os"
+	"strings"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/nickw444/miio-go"
 	"github.com/nickw444/miio-go/common"
-	"github.com/nickw444/miio-go/protocol"
 	"github.com/nickw444/miio-go/protocol/tokens"
 	"github.com/sirupsen/logrus"
 )
 
 var sharedClient *miio.Client
 
-func createClient(local bool) (*miio.Client, error) {
+func createClient(local bool, opts ...miio.Option) (*miio.Client, error) {
 	addr := net.IPv4bcast
 	if local {
 		addr = net.IPv4(127, 0, 0, 1)
 	}
 
-	tokenStore, err := tokens.FromFile("tokens.txt")
-	if err != nil {
-		panic(err)
-	}
-
-	proto, err := protocol.NewProtocol(protocol.ProtocolConfig{
-		BroadcastIP: addr,
-		TokenStore:  tokenStore,
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	return miio.NewClientWithProtocol(proto)
+	return miio.NewClient(append([]miio.Option{miio.WithBroadcastIPs(addr)}, opts...)...)
 }
 
 func main() {
 	app := kingpin.New("miio-go CLI", "CLI application to manually test miio-go functionality")
 	local := app.Flag("local", "Send broadcast to 127.0.0.1 instead of 255.255.255.255 (For use with locally hosted simulator)").Bool()
 	logLevel := app.Flag("log-level", "Set MiiO to a specific log level").Default("warn").Enum("debug", "warn", "info", "error")
+	tokenFile := app.Flag("token-file", "Path to the token store").Default(miio.DefaultTokenFile).String()
+	passphrase := app.Flag("token-passphrase", "Passphrase for an encrypted token store").Envar("MIIO_TOKEN_PASSPHRASE").String()
+	keyFile := app.Flag("token-key-file", "Path to the key file for an encrypted token store").String()
+	tokenEnv := app.Flag("token-env", "Also read tokens from "+tokens.DefaultEnvPrefix+"<id> environment variables").Bool()
+	tokenDir := app.Flag("token-dir", "Also read tokens from files named by device ID in this directory").String()
+	tokenCommand := app.Flag("token-command", "Also read tokens from this command, which is passed the device ID").String()
+	secret := func() ([]byte, error) {
+		return tokenSecret(*passphrase, *keyFile)
+	}
 
 	installControl(app)
 	installDiscovery(app)
+	installDiagnostics(app)
+	installTokens(app, tokenFile, secret)
+	installProvision(app, local, tokenFile, secret)
 
 	app.Action(func(ctx *kingpin.ParseContext) error {
 		level, _ := logrus.ParseLevel(*logLevel)
@@ -50,8 +49,33 @@ func main() {
 		l.SetLevel(level)
 		common.SetLogger(l)
 
-		var err error
-		sharedClient, err = createClient(*local)
+		if ctx.SelectedCommand != nil {
+			command := ctx.SelectedCommand.FullCommand()
+			if strings.HasPrefix(command, "tokens") || command == "provision" {
+				// Token store management and provisioning do not need a client.
+				return nil
+			}
+		}
+
+		opts := []miio.Option{miio.WithTokenFile(*tokenFile)}
+		s, err := secret()
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			opts = append(opts, miio.WithTokenSecret(s))
+		}
+		if *tokenEnv {
+			opts = append(opts, miio.WithTokenSources(tokens.NewEnvSource(tokens.DefaultEnvPrefix)))
+		}
+		if *tokenDir != "" {
+			opts = append(opts, miio.WithTokenSources(tokens.NewDirSource(*tokenDir)))
+		}
+		if *tokenCommand != "" {
+			opts = append(opts, miio.WithTokenSources(tokens.NewCommandSource("sh", "-c", *tokenCommand+` "$0"`)))
+		}
+
+		sharedClient, err = createClient(*local, opts...)
 		return err
 	})
 
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/nickw444/miio-go/common"
+	"github.com/nickw444/miio-go/device"
+	"github.com/nickw444/miio-go/ota"
+)
+
+func installOTA(parent *kingpin.CmdClause) {
+	cmd := parent.Command("ota", "Install a firmware update")
+	firmware := cmd.Arg("firmware", "Path to the firmware file").Required().ExistingFile()
+	model := cmd.Flag("model", "The model the firmware is for").String()
+	version := cmd.Flag("version", "The version of the firmware").String()
+	allowDowngrade := cmd.Flag("allow-downgrade", "Allow installing older firmware").Bool()
+	force := cmd.Flag("force", "Skip the model and version checks").Bool()
+	listen := cmd.Flag("listen", "Address to serve the firmware on (defaults to the address used to reach the device)").String()
+
+	cmd.Action(func(ctx *kingpin.ParseContext) error {
+		dev, ok := sharedDevice.(device.Device)
+		if !ok {
+			return fmt.Errorf("Device with type %T cannot be updated", sharedDevice)
+		}
+
+		sub, err := dev.NewSubscription()
+		if err != nil {
+			return err
+		}
+		defer sub.Close()
+		go func() {
+			for event := range sub.Events() {
+				if progress, ok := event.(common.EventOTAProgress); ok {
+					fmt.Printf("%s %d%%\n", progress.State, progress.Progress)
+				}
+			}
+		}()
+
+		return ota.Update(dev, ota.Config{
+			Firmware:       *firmware,
+			Model:          *model,
+			Version:        *version,
+			AllowDowngrade: *allowDowngrade,
+			Force:          *force,
+			ListenAddr:     *listen,
+		})
+	})
+}
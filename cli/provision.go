@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/nickw444/miio-go/protocol/provision"
+	"github.com/nickw444/miio-go/protocol/transport"
+)
+
+func installProvision(app *kingpin.Application, local *bool, tokenFile *string, secret func() ([]byte, error)) {
+	cmd := app.Command("provision", "Configure a device in AP mode to join a Wi-Fi network. Join the device's Wi-Fi network first.")
+	ssid := cmd.Flag("ssid", "SSID of the network the device should join").Required().String()
+	password := cmd.Flag("password", "Password of the network").Envar("MIIO_WIFI_PASSWORD").String()
+	timezone := cmd.Flag("timezone", "Timezone of the device, e.g. Australia/Sydney").String()
+	country := cmd.Flag("country", "Two letter country code of the device, e.g. AU").String()
+	ip := cmd.Flag("ip", "IP address of the device (defaults to 192.168.13.1 on the device's network)").IP()
+	confirm := cmd.Flag("confirm", "Wait for the device to appear on the network once this host has rejoined it").
+		Default("true").Bool()
+	confirmTimeout := cmd.Flag("confirm-timeout", "How long to wait for the device to appear on the network").
+		Default(provision.DefaultConfirmTimeout.String()).Duration()
+
+	cmd.Action(func(ctx *kingpin.ParseContext) error {
+		store, err := loadTokenStore(*tokenFile, secret)
+		if err != nil {
+			return err
+		}
+
+		config := provision.Config{
+			SSID:       *ssid,
+			Password:   *password,
+			Timezone:   *timezone,
+			Country:    *country,
+			TokenStore: store,
+		}
+		confirmConfig := provision.ConfirmConfig{Timeout: *confirmTimeout}
+		if *ip == nil && *local {
+			*ip = net.IPv4(127, 0, 0, 1)
+			confirmConfig.Addr = &net.UDPAddr{IP: *ip, Port: transport.DevicePort}
+		}
+		if *ip != nil {
+			config.Addr = &net.UDPAddr{IP: *ip, Port: transport.DevicePort}
+		}
+
+		result, err := provision.Provision(config)
+		if err != nil {
+			return err
+		}
+		if err := store.WriteFile(*tokenFile); err != nil {
+			return err
+		}
+		fmt.Printf("Device %d acknowledged the configuration to join %s. Its token has been saved to %s\n", result.DeviceID, *ssid, *tokenFile)
+		if !*confirm {
+			fmt.Printf("Only the acknowledgement was received. Run discover on %s to confirm the device has joined it.\n", *ssid)
+			return nil
+		}
+
+		fmt.Printf("Rejoin %s. Waiting up to %s for the device to appear there...\n", *ssid, *confirmTimeout)
+		addr, err := provision.Confirm(result.DeviceID, confirmConfig)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Device %d has joined %s at %s\n", result.DeviceID, *ssid, addr)
+		return nil
+	})
+}
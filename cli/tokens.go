@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/nickw444/miio-go/protocol/tokens"
+	"github.com/nickw444/miio-go/protocol/tokens/cloud"
+	"github.com/nickw444/miio-go/protocol/tokens/mihome"
+)
+
+// tokenSecret returns the secret used to encrypt the token store, or nil if
+// the token store is not encrypted.
+func tokenSecret(passphrase string, keyFile string) ([]byte, error) {
+	if passphrase != "" && keyFile != "" {
+		return nil, fmt.Errorf("Only one of a passphrase or key file may be provided")
+	}
+	if keyFile != "" {
+		return tokens.ReadKeyFile(keyFile)
+	}
+	if passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return nil, nil
+}
+
+func installTokens(app *kingpin.Application, tokenFile *string, secret func() ([]byte, error)) {
+	cmd := app.Command("tokens", "Manage the token store")
+
+	encryptCmd := cmd.Command("encrypt", "Encrypt a plaintext token store using the provided passphrase or key file")
+	encryptCmd.Action(func(ctx *kingpin.ParseContext) error {
+		s, err := secret()
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			return fmt.Errorf("A passphrase or key file is required to encrypt the token store")
+		}
+		return tokens.Encrypt(*tokenFile, *tokenFile, s)
+	})
+
+	rotateCmd := cmd.Command("rotate-key", "Re-encrypt the token store with a new passphrase or key file")
+	newPassphrase := rotateCmd.Flag("new-passphrase", "The new passphrase").Envar("MIIO_NEW_TOKEN_PASSPHRASE").String()
+	newKeyFile := rotateCmd.Flag("new-key-file", "Path to the new key file").String()
+	rotateCmd.Action(func(ctx *kingpin.ParseContext) error {
+		s, err := secret()
+		if err != nil {
+			return err
+		}
+		if s == nil {
+			return fmt.Errorf("The current passphrase or key file is required to rotate keys")
+		}
+		newSecret, err := tokenSecret(*newPassphrase, *newKeyFile)
+		if err != nil {
+			return err
+		}
+		if newSecret == nil {
+			return fmt.Errorf("A new passphrase or key file is required to rotate keys")
+		}
+		return tokens.RotateKey(*tokenFile, *tokenFile, s, newSecret)
+	})
+
+	migrateCmd := cmd.Command("migrate", "Convert a plaintext token store to the JSON format")
+	migrateCmd.Action(func(ctx *kingpin.ParseContext) error {
+		return tokens.Migrate(*tokenFile, *tokenFile)
+	})
+
+	importCmd := cmd.Command("import", "Import tokens from a Mi Home app backup (Android miio2.db or iOS _mihome.sqlite)")
+	backup := importCmd.Arg("backup", "Path to the backup database").Required().ExistingFile()
+	importCmd.Action(func(ctx *kingpin.ParseContext) error {
+		devices, err := mihome.Read(*backup)
+		if err != nil {
+			return err
+		}
+
+		store, err := loadTokenStore(*tokenFile, secret)
+		if err != nil {
+			return err
+		}
+		imported, err := tokens.Import(store, devices)
+		if err != nil {
+			return err
+		}
+		if err := store.WriteFile(*tokenFile); err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d of %d tokens into %s\n", imported, len(devices), *tokenFile)
+		return nil
+	})
+
+	cloudCmd := cmd.Command("cloud", "Import tokens from a Xiaomi account")
+	username := cloudCmd.Flag("username", "Xiaomi account username or email").Required().String()
+	password := cloudCmd.Flag("password", "Xiaomi account password").Envar("MIIO_CLOUD_PASSWORD").Required().String()
+	regions := cloudCmd.Flag("region", "Server region to list devices from, may be repeated (defaults to all regions)").Enums(cloud.Regions...)
+	cloudCmd.Action(func(ctx *kingpin.ParseContext) error {
+		client, err := cloud.NewClient(cloud.Config{Username: *username, Password: *password})
+		if err != nil {
+			return err
+		}
+		if err := client.Login(); err != nil {
+			return err
+		}
+
+		if len(*regions) == 0 {
+			*regions = cloud.Regions
+		}
+		var devices []cloud.Device
+		for _, region := range *regions {
+			d, err := client.Devices(region)
+			if err != nil {
+				return fmt.Errorf("Unable to list devices in region %s: %s", region, err)
+			}
+			devices = append(devices, d...)
+		}
+
+		store, err := loadTokenStore(*tokenFile, secret)
+		if err != nil {
+			return err
+		}
+		imported, err := tokens.Import(store, devices)
+		if err != nil {
+			return err
+		}
+		if err := store.WriteFile(*tokenFile); err != nil {
+			return err
+		}
+		fmt.Printf("Imported %d of %d tokens into %s\n", imported, len(devices), *tokenFile)
+		return nil
+	})
+}
+
+// loadTokenStore loads the token store for modification.
+func loadTokenStore(tokenFile string, secret func() ([]byte, error)) (tokens.TokenStore, error) {
+	s, err := secret()
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		return tokens.EncryptedFromFile(tokenFile, s)
+	}
+	return tokens.FromFile(tokenFile)
+}
@@ -1,36 +1,131 @@
 package miio
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/nickw444/miio-go/common"
+	"github.com/nickw444/miio-go/device"
 	"github.com/nickw444/miio-go/protocol"
+	"github.com/nickw444/miio-go/protocol/devicecache"
 	"github.com/nickw444/miio-go/protocol/tokens"
 	"github.com/nickw444/miio-go/subscription"
 )
 
+var (
+	ErrDeviceNotFound   = errors.New("Device not found.")
+	ErrClosed           = errors.New("Client is already closed.")
+	ErrExpiryMultiplier = errors.New("Expiry multiplier must be at least 1.")
+	ErrOfflineExpiry    = errors.New("Offline expiry must not be negative.")
+)
+
 type Client struct {
 	sync.RWMutex
 	subscription.SubscriptionTarget
 
 	protocol          protocol.Protocol
+	tokenWatcher      tokens.Watcher
+	fileStore         tokens.TokenStore
+	tokenFile         string
+	clock             clock.Clock
 	discoveryInterval time.Duration
+	expiryMultiplier  int
 	quitChan          chan struct{}
+	closed            bool
+	wg                sync.WaitGroup
 	events            chan interface{}
 }
 
-// NewClient creates a new default Client with the protocol.
-func NewClient() (*Client, error) {
-	tokenStore, err := tokens.FromFile("tokens.txt")
-	if err != nil {
+// NewClient creates a new Client with the given options. Without options, the
+// token store is loaded from tokens.txt and discovery is broadcast to
+// 255.255.255.255 every 15 seconds.
+func NewClient(opts ...Option) (client *Client, err error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validate(); err != nil {
 		return nil, err
 	}
 
+	if o.clock == nil {
+		// Share a single clock between the client and protocol.
+		o.clock = clock.New()
+	}
+	if o.logger != nil {
+		common.SetLogger(o.logger)
+	}
+
+	// Release anything started so far if setup fails.
+	defer func() {
+		if err != nil && o.tokenWatcher != nil {
+			o.tokenWatcher.Close()
+		}
+	}()
+
+	tokenStore := o.tokenStore
+	if tokenStore == nil {
+		if o.tokenSecret != nil {
+			tokenStore, err = tokens.EncryptedFromFile(o.tokenFile, o.tokenSecret)
+		} else {
+			tokenStore, err = tokens.FromFile(o.tokenFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Tokens added at runtime are written back to the token file.
+		o.fileStore = tokenStore
+
+		if o.tokenReload > 0 {
+			o.tokenWatcher, err = tokens.Watch(tokenStore, o.tokenFile, o.tokenReload, o.clock)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(o.tokenSources) > 0 {
+		tokenStore = tokens.NewChain(tokenStore, o.tokenSources...)
+	}
+
+	var deviceCache devicecache.DeviceCache
+	if o.deviceCacheFile != "" {
+		deviceCache, err = devicecache.FromFile(o.deviceCacheFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	broadcastIPs := o.broadcastIPs
+	if len(broadcastIPs) == 0 {
+		broadcastIPs = []net.IP{net.IPv4bcast}
+	}
+
 	protocolConfig := protocol.ProtocolConfig{
-		BroadcastIP: net.IPv4bcast,
-		TokenStore:  tokenStore,
+		BroadcastIPs:    broadcastIPs,
+		TokenStore:      tokenStore,
+		ListenPort:      o.listenPort,
+		RefreshInterval: o.refreshInterval,
+		RefreshPolicy:   o.refreshPolicy,
+		AlwaysRefresh:   o.alwaysRefresh,
+		ConfirmWrites:   o.confirmWrites,
+		RetryPolicy:     o.retryPolicy,
+		Clock:           o.clock,
+
+		ModelRefreshPolicies:  o.modelPolicies,
+		DeviceRefreshPolicies: o.devicePolicies,
+
+		Transition:        o.transition,
+		DeviceTransitions: o.deviceTransitions,
+
+		DeviceCache:       deviceCache,
+		DeviceCacheMaxAge: o.deviceCacheMaxAge,
 	}
 
 	p, err := protocol.NewProtocol(protocolConfig)
@@ -38,17 +133,45 @@ func NewClient() (*Client, error) {
 		return nil, err
 	}
 
-	return NewClientWithProtocol(p)
+	client, err = newClient(p, o)
+	if err != nil {
+		// Closing the client also closes the protocol.
+		client.Close(context.Background())
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewClientWithProtocol creates a new Client using an existing protocol.
+// Options which configure the protocol are ignored.
+func NewClientWithProtocol(protocol protocol.Protocol, opts ...Option) (*Client, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	return newClient(protocol, o)
 }
 
-func NewClientWithProtocol(protocol protocol.Protocol) (*Client, error) {
+func newClient(protocol protocol.Protocol, o options) (*Client, error) {
+	if o.clock == nil {
+		o.clock = clock.New()
+	}
 	c := &Client{
-		SubscriptionTarget: subscription.NewTarget(),
+		SubscriptionTarget: subscription.NewTargetWithClock(o.clock),
 		protocol:           protocol,
+		tokenWatcher:       o.tokenWatcher,
+		fileStore:          o.fileStore,
+		tokenFile:          o.tokenFile,
+		clock:              o.clock,
+		expiryMultiplier:   o.expiryMultiplier,
 		quitChan:           make(chan struct{}),
 	}
 
-	c.SetDiscoveryInterval(time.Second * 15)
+	c.SetDiscoveryInterval(o.discoveryInterval)
+	c.protocol.SetOfflineExpiryTime(o.offlineExpiry)
 
 	return c, c.init()
 }
@@ -57,12 +180,34 @@ func (c *Client) init() error {
 	if err := c.subscribe(); err != nil {
 		return err
 	}
+	// Cached devices are announced once the client is subscribed.
+	if err := c.protocol.Start(); err != nil {
+		return err
+	}
+	c.watchTokens()
 	return c.discover()
 }
 
+// watchTokens applies changes from reloading the token store.
+func (c *Client) watchTokens() {
+	if c.tokenWatcher == nil {
+		return
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for change := range c.tokenWatcher.Changes() {
+			if err := c.protocol.ApplyTokenChange(change); err != nil {
+				common.Log.Warnf("Unable to apply token change for device %d: %s", change.DeviceID, err)
+			}
+		}
+	}()
+}
+
 func (c *Client) SetDiscoveryInterval(interval time.Duration) {
 	c.discoveryInterval = interval
-	c.protocol.SetExpiryTime(interval * 2)
+	c.protocol.SetExpiryTime(interval * time.Duration(c.expiryMultiplier))
 }
 
 func (c *Client) discover() error {
@@ -73,10 +218,14 @@ func (c *Client) discover() error {
 
 	_ = c.protocol.Discover()
 
+	c.RLock()
+	ticker := c.clock.Ticker(c.discoveryInterval)
+	c.RUnlock()
+
+	c.wg.Add(1)
 	go func() {
-		c.RLock()
-		tick := time.Tick(c.discoveryInterval)
-		c.RUnlock()
+		defer c.wg.Done()
+		defer ticker.Stop()
 		for {
 			select {
 			case <-c.quitChan:
@@ -88,7 +237,7 @@ func (c *Client) discover() error {
 			case <-c.quitChan:
 				common.Log.Debugf("Quitting discovery loop")
 				return
-			case <-tick:
+			case <-ticker.C:
 				common.Log.Debugf("Performing discovery")
 				_ = c.protocol.Discover()
 			}
@@ -98,6 +247,184 @@ func (c *Client) discover() error {
 	return nil
 }
 
+// Devices returns all classified devices currently known to the client.
+func (c *Client) Devices() []common.Device {
+	var devices []common.Device
+	for _, dev := range c.devices() {
+		devices = append(devices, dev)
+	}
+	return devices
+}
+
+// Device returns the device with the given ID, or ErrDeviceNotFound if it
+// has not been discovered.
+func (c *Client) Device(id uint32) (common.Device, error) {
+	dev := c.protocol.Device(id)
+	if dev == nil || dev.Provisional() {
+		return nil, ErrDeviceNotFound
+	}
+	return dev, nil
+}
+
+// DevicesByModel returns all known devices reporting the given model, e.g.
+// "yeelink.light.color1".
+func (c *Client) DevicesByModel(model string) []common.Device {
+	var devices []common.Device
+	for _, dev := range c.devices() {
+		if dev.Info().Model == model {
+			devices = append(devices, dev)
+		}
+	}
+	return devices
+}
+
+// DeviceByIP returns the device communicating from the given IP address.
+func (c *Client) DeviceByIP(ip net.IP) (common.Device, error) {
+	for _, dev := range c.devices() {
+		if addr, ok := dev.Addr().(*net.UDPAddr); ok && addr.IP.Equal(ip) {
+			return dev, nil
+		}
+	}
+	return nil, ErrDeviceNotFound
+}
+
+// DeviceByMAC returns the device with the given MAC address. The comparison
+// is case insensitive.
+func (c *Client) DeviceByMAC(mac string) (common.Device, error) {
+	for _, dev := range c.devices() {
+		if strings.EqualFold(dev.Info().MacAddress, mac) {
+			return dev, nil
+		}
+	}
+	return nil, ErrDeviceNotFound
+}
+
+// DeviceByLabel returns the device with the given label, as set by the device
+// name in the token store. The comparison is case insensitive.
+func (c *Client) DeviceByLabel(label string) (common.Device, error) {
+	for _, dev := range c.devices() {
+		if devLabel, err := dev.GetLabel(); err == nil && strings.EqualFold(devLabel, label) {
+			return dev, nil
+		}
+	}
+	return nil, ErrDeviceNotFound
+}
+
+// WaitForDevice returns the device with the given ID, waiting for it to be
+// discovered if necessary. Devices discovered before the call are returned
+// immediately.
+func (c *Client) WaitForDevice(ctx context.Context, id uint32) (common.Device, error) {
+	// Subscribe before checking the registry so a device discovered in
+	// between is not missed.
+	sub, err := c.NewSubscription()
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Close()
+
+	if dev, err := c.Device(id); err == nil {
+		return dev, nil
+	}
+
+	events := sub.Events()
+	for {
+		select {
+		case event := <-events:
+			if e, ok := event.(common.EventNewDevice); ok && e.Device.ID() == id {
+				return e.Device, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// AddToken adds a token for the given device. A device previously ignored for
+// hiding its token is contacted immediately, and appears via an EventNewDevice
+// once classified. The token must be 16 bytes. If the token store was loaded
+// from a file, the file is rewritten so that the token is kept when it is
+// reloaded.
+func (c *Client) AddToken(deviceID uint32, token []byte) error {
+	if err := c.protocol.AddToken(deviceID, token); err != nil {
+		return err
+	}
+	if c.fileStore == nil {
+		return nil
+	}
+	return c.fileStore.WriteFile(c.tokenFile)
+}
+
+// devices returns all classified devices from the protocol.
+func (c *Client) devices() []device.Device {
+	var devices []device.Device
+	for _, dev := range c.protocol.Devices() {
+		if dev.Provisional() {
+			continue
+		}
+		devices = append(devices, dev)
+	}
+	return devices
+}
+
+// DiagnosticsError reports the devices which failed to return diagnostics,
+// keyed by device ID.
+type DiagnosticsError map[uint32]error
+
+func (e DiagnosticsError) Error() string {
+	ids := make([]uint32, 0, len(e))
+	for id := range e {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var failures []string
+	for _, id := range ids {
+		failures = append(failures, fmt.Sprintf("%d: %s", id, e[id]))
+	}
+	return "Unable to collect diagnostics from devices " + strings.Join(failures, ", ")
+}
+
+// Diagnostics collects the info and Wi-Fi state of every known device
+// concurrently, keyed by device ID. Devices which fail to respond are omitted
+// from the result and reported by a DiagnosticsError.
+func (c *Client) Diagnostics() (map[uint32]common.Diagnostics, error) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[uint32]common.Diagnostics)
+	failures := make(DiagnosticsError)
+
+	for _, dev := range c.devices() {
+		wg.Add(1)
+		go func(dev device.Device) {
+			defer wg.Done()
+			diagnostics, err := dev.GetDiagnostics()
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				failures[dev.ID()] = err
+			} else {
+				results[dev.ID()] = diagnostics
+			}
+		}(dev)
+	}
+	wg.Wait()
+
+	if len(failures) > 0 {
+		return results, failures
+	}
+	return results, nil
+}
+
+// States returns the cached state of every known device, keyed by device ID.
+// No network calls are made.
+func (c *Client) States() map[uint32]common.DeviceState {
+	states := make(map[uint32]common.DeviceState)
+	for _, dev := range c.devices() {
+		states[dev.ID()] = dev.State()
+	}
+	return states
+}
+
 // Proxy events from protocol level
 func (c *Client) subscribe() error {
 	sub, err := c.protocol.NewSubscription()
@@ -105,10 +432,48 @@ func (c *Client) subscribe() error {
 		return err
 	}
 
+	c.wg.Add(1)
 	go func() {
+		defer c.wg.Done()
 		for event := range sub.Events() {
 			c.Publish(event)
 		}
 	}()
 	return nil
 }
+
+// Close gracefully shuts down the client. Discovery is stopped, in-flight
+// calls are given until the context is done to complete, and then every
+// device, subscription and the underlying transport is closed. A closed
+// client cannot be reused; create a new one instead.
+func (c *Client) Close(ctx context.Context) error {
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	close(c.quitChan)
+	c.Unlock()
+
+	if c.tokenWatcher != nil {
+		c.tokenWatcher.Close()
+	}
+
+	drainErr := c.protocol.Drain(ctx)
+	if drainErr != nil {
+		common.Log.Warnf("Timed out whilst draining in-flight calls: %s", drainErr)
+	}
+
+	err := c.protocol.Close()
+
+	// The event proxy exits once the protocol has closed its subscriptions.
+	c.wg.Wait()
+	if subErr := c.CloseAllSubscriptions(); err == nil {
+		err = subErr
+	}
+	if err == nil {
+		err = drainErr
+	}
+	return err
+}
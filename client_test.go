@@ -1 +1,208 @@
 package miio
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/nickw444/miio-go/common"
+	"github.com/nickw444/miio-go/device"
+	deviceMocks "github.com/nickw444/miio-go/device/mocks"
+	"github.com/nickw444/miio-go/protocol"
+	protocolMocks "github.com/nickw444/miio-go/protocol/mocks"
+	"github.com/nickw444/miio-go/protocol/tokens"
+	"github.com/nickw444/miio-go/subscription"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func Client_SetUp() (tt struct {
+	protocol *protocolMocks.Protocol
+	client   *Client
+}) {
+	tt.protocol = new(protocolMocks.Protocol)
+	tt.protocol.On("SetExpiryTime", mock.Anything)
+	tt.protocol.On("SetOfflineExpiryTime", mock.Anything)
+	tt.protocol.On("NewSubscription").Return(subscription.NewTarget().NewSubscription())
+	tt.protocol.On("Start").Return(nil)
+	tt.protocol.On("Discover").Return(nil)
+
+	client, err := NewClientWithProtocol(tt.protocol)
+	if err != nil {
+		panic(err)
+	}
+	tt.client = client
+	return
+}
+
+// States returns the state of classified devices only.
+func TestClient_States(t *testing.T) {
+	tt := Client_SetUp()
+
+	dev := &deviceMocks.Device{}
+	dev.On("ID").Return(uint32(10))
+	dev.On("Provisional").Return(false)
+	dev.On("State").Return(common.DeviceState{DeviceID: 10})
+
+	provisional := &deviceMocks.Device{}
+	provisional.On("Provisional").Return(true)
+
+	tt.protocol.On("Devices").Return([]device.Device{dev, provisional})
+
+	states := tt.client.States()
+	assert.Len(t, states, 1)
+	assert.Equal(t, uint32(10), states[10].DeviceID)
+}
+
+// AddToken passes the token through to the protocol.
+func TestClient_AddToken(t *testing.T) {
+	tt := Client_SetUp()
+	token := []byte("0123456789abcdef")
+	tt.protocol.On("AddToken", uint32(10), token).Return(nil).Once()
+
+	assert.NoError(t, tt.client.AddToken(10, token))
+	tt.protocol.AssertExpectations(t)
+}
+
+// Diagnostics are collected from all devices, reporting those which fail.
+func TestClient_Diagnostics(t *testing.T) {
+	tt := Client_SetUp()
+	light := Client_DeviceMock(10, common.DeviceInfo{}, nil)
+	plug := Client_DeviceMock(11, common.DeviceInfo{}, nil)
+	tt.protocol.On("Devices").Return([]device.Device{light, plug})
+
+	diagnostics := common.Diagnostics{DeviceID: 10, WiFi: common.WiFiAssocState{State: "ONLINE"}}
+	light.On("GetDiagnostics").Return(diagnostics, nil)
+	plug.On("GetDiagnostics").Return(common.Diagnostics{}, errors.New("Max retries exceeded"))
+
+	results, err := tt.client.Diagnostics()
+	assert.Equal(t, map[uint32]common.Diagnostics{10: diagnostics}, results)
+	assert.Equal(t, DiagnosticsError{11: errors.New("Max retries exceeded")}, err)
+	assert.Equal(t, "Unable to collect diagnostics from devices 11: Max retries exceeded", err.Error())
+}
+
+func Client_DeviceMock(id uint32, info common.DeviceInfo, addr net.Addr) *deviceMocks.Device {
+	dev := &deviceMocks.Device{}
+	dev.On("ID").Return(id)
+	dev.On("Provisional").Return(false)
+	dev.On("Info").Return(info)
+	dev.On("Addr").Return(addr)
+	return dev
+}
+
+// Device returns known devices and ErrDeviceNotFound otherwise.
+func TestClient_Device(t *testing.T) {
+	tt := Client_SetUp()
+	dev := Client_DeviceMock(10, common.DeviceInfo{}, nil)
+	tt.protocol.On("Device", uint32(10)).Return(dev)
+	tt.protocol.On("Device", uint32(11)).Return(nil)
+
+	found, err := tt.client.Device(10)
+	assert.NoError(t, err)
+	assert.Equal(t, dev, found)
+
+	_, err = tt.client.Device(11)
+	assert.Equal(t, ErrDeviceNotFound, err)
+}
+
+// Devices can be looked up by model, IP, MAC address and label.
+func TestClient_DeviceLookups(t *testing.T) {
+	tt := Client_SetUp()
+	light := Client_DeviceMock(10, common.DeviceInfo{Model: "yeelink.light.color1", MacAddress: "AA:BB:CC:DD:EE:FF"},
+		&net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 54321})
+	plug := Client_DeviceMock(11, common.DeviceInfo{Model: "chuangmi.plug.m1", MacAddress: "00:11:22:33:44:55"},
+		&net.UDPAddr{IP: net.IPv4(192, 168, 1, 11), Port: 54321})
+	tt.protocol.On("Devices").Return([]device.Device{light, plug})
+	light.On("GetLabel").Return("Lamp", nil)
+	plug.On("GetLabel").Return("", nil)
+
+	assert.Equal(t, []common.Device{plug}, tt.client.DevicesByModel("chuangmi.plug.m1"))
+
+	dev, err := tt.client.DeviceByIP(net.IPv4(192, 168, 1, 10))
+	assert.NoError(t, err)
+	assert.Equal(t, light, dev)
+
+	dev, err = tt.client.DeviceByMAC("aa:bb:cc:dd:ee:ff")
+	assert.NoError(t, err)
+	assert.Equal(t, light, dev)
+
+	dev, err = tt.client.DeviceByLabel("lamp")
+	assert.NoError(t, err)
+	assert.Equal(t, light, dev)
+
+	_, err = tt.client.DeviceByIP(net.IPv4(192, 168, 1, 12))
+	assert.Equal(t, ErrDeviceNotFound, err)
+}
+
+// WaitForDevice returns a device that was discovered before the call.
+func TestClient_WaitForDevice(t *testing.T) {
+	tt := Client_SetUp()
+	dev := Client_DeviceMock(10, common.DeviceInfo{}, nil)
+	tt.protocol.On("Device", uint32(10)).Return(dev)
+
+	found, err := tt.client.WaitForDevice(context.Background(), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, dev, found)
+}
+
+// WaitForDevice waits for the device to be discovered.
+func TestClient_WaitForDevice2(t *testing.T) {
+	tt := Client_SetUp()
+	dev := Client_DeviceMock(10, common.DeviceInfo{}, nil)
+	tt.protocol.On("Device", uint32(10)).Return(nil)
+
+	go func() {
+		for !tt.client.HasSubscribers() {
+			time.Sleep(time.Millisecond)
+		}
+		tt.client.Publish(common.EventNewDevice{Device: dev})
+	}()
+
+	found, err := tt.client.WaitForDevice(context.Background(), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, dev, found)
+}
+
+// WaitForDevice gives up when the context is done.
+func TestClient_WaitForDevice3(t *testing.T) {
+	tt := Client_SetUp()
+	tt.protocol.On("Device", uint32(10)).Return(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	_, err := tt.client.WaitForDevice(ctx, 10)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+// Close stops all goroutines started by the client and protocol, and
+// releases the socket.
+func TestClient_Close(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	p, err := protocol.NewProtocol(protocol.ProtocolConfig{
+		BroadcastIP: net.IPv4(127, 0, 0, 1),
+		TokenStore:  tokens.New(),
+	})
+	assert.NoError(t, err)
+	client, err := NewClientWithProtocol(p)
+	assert.NoError(t, err)
+	_, err = client.NewSubscription()
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, client.Close(ctx))
+	assert.False(t, client.HasSubscribers())
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, before, runtime.NumGoroutine(), "Goroutines leaked after Close")
+
+	assert.Equal(t, ErrClosed, client.Close(ctx))
+}
@@ -1,12 +1,82 @@
 package common
 
-import "github.com/nickw444/miio-go/subscription"
+import (
+	"net"
+	"time"
 
+	"github.com/nickw444/miio-go/subscription"
+)
+
+// DeviceInfo is the payload of miIO.info. Devices omit fields they do not
+// support.
 type DeviceInfo struct {
-	FirmwareVersion string `json:"fw_ver"`
-	HardwareVersion string `json:"hw_ver"`
-	MacAddress      string `json:"mac"`
-	Model           string `json:"model"`
+	FirmwareVersion     string `json:"fw_ver"`
+	HardwareVersion     string `json:"hw_ver"`
+	MacAddress          string `json:"mac"`
+	Model               string `json:"model"`
+	MCUFirmwareVersion  string `json:"mcu_fw_ver,omitempty"`
+	WiFiFirmwareVersion string `json:"wifi_fw_ver,omitempty"`
+
+	// UID is the Xiaomi account the device is bound to.
+	UID int64 `json:"uid,omitempty"`
+	// Life is the device uptime in seconds.
+	Life int64 `json:"life,omitempty"`
+	// ConfigTime is when the device was configured, in seconds since the
+	// epoch.
+	ConfigTime int64 `json:"cfg_time,omitempty"`
+	// Token is the hex token, which only some devices report.
+	Token string `json:"token,omitempty"`
+	// MemoryFree is the free memory in bytes.
+	MemoryFree int `json:"mmfree,omitempty"`
+
+	AccessPoint AccessPointInfo `json:"ap"`
+	Network     NetworkInfo     `json:"netif"`
+
+	// OT is the cloud transport in use, e.g. otu (UDP) or ott (TCP), and the
+	// stats are counters for each transport.
+	OT      string `json:"ot,omitempty"`
+	OTUStat []int  `json:"otu_stat,omitempty"`
+	OTTStat []int  `json:"ott_stat,omitempty"`
+}
+
+// Uptime returns how long the device has been running.
+func (i DeviceInfo) Uptime() time.Duration {
+	return time.Duration(i.Life) * time.Second
+}
+
+// AccessPointInfo describes the Wi-Fi network a device has joined.
+type AccessPointInfo struct {
+	SSID  string `json:"ssid"`
+	BSSID string `json:"bssid"`
+	// RSSI is the signal strength in dBm.
+	RSSI    int `json:"rssi"`
+	Primary int `json:"primary,omitempty"`
+}
+
+// NetworkInfo describes a device's IP configuration.
+type NetworkInfo struct {
+	LocalIP string `json:"localIp"`
+	Mask    string `json:"mask"`
+	Gateway string `json:"gw"`
+}
+
+// WiFiAssocState is the payload of miIO.wifi_assoc_state.
+type WiFiAssocState struct {
+	// State is e.g. ONLINE or OFFLINE.
+	State            string `json:"state"`
+	AuthFailCount    int    `json:"auth_fail_count"`
+	ConnSuccessCount int    `json:"conn_success_count"`
+	ConnFailCount    int    `json:"conn_fail_count"`
+	DHCPFailCount    int    `json:"dhcp_fail_count"`
+}
+
+// Diagnostics is a snapshot of a device's health.
+type Diagnostics struct {
+	DeviceID uint32
+	Info     DeviceInfo
+	WiFi     WiFiAssocState
+	// Time is when the diagnostics were collected.
+	Time time.Time
 }
 
 type Device interface {
@@ -16,4 +86,7 @@ type Device interface {
 	GetLabel() (string, error)
 	GetInfo() (DeviceInfo, error)
 	GetToken() []byte
+	State() DeviceState
+	// Addr returns the address the device is currently communicating from.
+	Addr() net.Addr
 }
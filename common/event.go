@@ -1,5 +1,7 @@
 package common
 
+import "net"
+
 type EventNewDevice struct {
 	Device Device
 }
@@ -12,6 +14,43 @@ type EventExpiredDevice struct {
 	Device Device
 }
 
+// EventDeviceOffline is published when a device stops responding to discovery
+// and pings. The device remains known, and its subscriptions remain open.
+type EventDeviceOffline struct {
+	Device Device
+}
+
+// EventDeviceOnline is published when an offline device responds again.
+type EventDeviceOnline struct {
+	Device Device
+}
+
+// EventDeviceAddressChanged is published when a known device responds from a
+// new address, e.g. after being assigned a new IP by DHCP.
+type EventDeviceAddressChanged struct {
+	Device  Device
+	OldAddr net.Addr
+	NewAddr net.Addr
+}
+
+// EventTokenChanged is published when a token is added or changed by
+// reloading the token store.
+type EventTokenChanged struct {
+	DeviceID uint32
+}
+
+// EventTokenRemoved is published when a token is removed by reloading the
+// token store. Known devices continue to use their existing token.
+type EventTokenRemoved struct {
+	DeviceID uint32
+}
+
+// EventDeviceRekeyed is published when a known device's token has changed and
+// its crypto has been rebuilt.
+type EventDeviceRekeyed struct {
+	Device Device
+}
+
 type EventUpdatePower struct {
 	PowerState PowerState
 }
@@ -19,12 +58,27 @@ type EventUpdatePower struct {
 type EventUpdateLight struct {
 	Brightness int
 
-	ColorMode int // 1: rgb mode, 2: color temperature mode, 3: hsv mode
+	// ColorMode is 1 for RGB, 2 for color temperature and 3 for HSV.
+	ColorMode int
 	RGB       struct {
 		Red   int
 		Green int
 		Blue  int
 	}
-	Hue        int
-	Saturation int
+	Hue              int
+	Saturation       int
+	ColorTemperature int // Kelvin, or 0 if the light does not support it
+}
+
+// EventOTAProgress is published as a firmware update progresses.
+type EventOTAProgress struct {
+	Device   Device
+	State    OTAState
+	Progress int
+}
+
+// EventOTAComplete is published when a firmware update has been installed.
+type EventOTAComplete struct {
+	Device          Device
+	FirmwareVersion string
 }
@@ -0,0 +1,53 @@
+package common
+
+import "time"
+
+// IntValue is an integer property along with the time it was last read from
+// or written to the device.
+type IntValue struct {
+	Value       int
+	LastUpdated time.Time
+}
+
+// PowerValue is a power property along with the time it was last read from
+// or written to the device.
+type PowerValue struct {
+	Value       PowerState
+	LastUpdated time.Time
+}
+
+// RGBValue is an RGB color property along with the time it was last read
+// from or written to the device.
+type RGBValue struct {
+	Red         int
+	Green       int
+	Blue        int
+	LastUpdated time.Time
+}
+
+// PowerSnapshot is a point-in-time copy of the state held by the power
+// capability.
+type PowerSnapshot struct {
+	Power PowerValue
+}
+
+// LightSnapshot is a point-in-time copy of the state held by the light
+// capability.
+type LightSnapshot struct {
+	Brightness IntValue
+	ColorMode  IntValue
+	RGB        RGBValue
+	Hue        IntValue
+	Saturation IntValue
+
+	ColorTemperature IntValue // Kelvin
+}
+
+// DeviceState is a point-in-time copy of all cached state for a device.
+// Capabilities the device does not support are left nil.
+type DeviceState struct {
+	DeviceID uint32
+	Online   bool
+	Power    *PowerSnapshot
+	Light    *LightSnapshot
+}
@@ -7,3 +7,13 @@ const (
 	PowerStateOn                 = "on"
 	PowerStateOff                = "off"
 )
+
+// OTAState is the firmware update state reported by miIO.get_ota_state.
+type OTAState string
+
+const (
+	OTAStateIdle        OTAState = "idle"
+	OTAStateDownloading OTAState = "downloading"
+	OTAStateInstalling  OTAState = "installing"
+	OTAStateFailed      OTAState = "failed"
+)
@@ -1,8 +1,12 @@
 package device
 
 import (
+	"net"
+	"sync"
 	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/capability"
 	"github.com/nickw444/miio-go/common"
 	"github.com/nickw444/miio-go/device/product"
 	"github.com/nickw444/miio-go/device/rthrottle"
@@ -17,10 +21,24 @@ type baseDevice struct {
 
 	refreshThrottle rthrottle.RefreshThrottle
 	outbound        transport.Outbound
+	clock           clock.Clock
+	maxProperties   int
+	alwaysRefresh   bool
+	confirmWrites   bool
+	transition      capability.Transition
 
+	// modelRefreshPolicies are applied once the model is known, unless the
+	// policy has been set for this device specifically.
+	modelRefreshPolicies map[string]rthrottle.Policy
+	devicePolicy         bool
+
+	mutex       sync.RWMutex
 	product     product.Product
+	info        common.DeviceInfo
+	label       string
 	id          uint32
 	provisional bool
+	online      bool
 	seen        time.Time
 	token       []byte
 }
@@ -30,16 +48,94 @@ type InfoResponse struct {
 	ID     uint32            `json:"ID"`
 }
 
+type WiFiAssocStateResponse struct {
+	Result common.WiFiAssocState `json:"result"`
+}
+
+const DefaultRefreshInterval = time.Second * 5
+
+// DefaultRefreshPolicy polls every DefaultRefreshInterval, or every second
+// after the device changes or is written to.
+var DefaultRefreshPolicy = rthrottle.Policy{
+	Interval:    DefaultRefreshInterval,
+	MinInterval: time.Second,
+	Jitter:      0.1,
+}
+
+// Config holds optional device configuration.
+type Config struct {
+	RefreshInterval time.Duration // Defaults to DefaultRefreshInterval.
+	Clock           clock.Clock   // Defaults to the system clock.
+
+	// RefreshPolicy controls how often the device is polled. Defaults to
+	// DefaultRefreshPolicy with an Interval of RefreshInterval.
+	RefreshPolicy rthrottle.Policy
+	// ModelRefreshPolicies override RefreshPolicy by model name, once the
+	// device's model is known.
+	ModelRefreshPolicies map[string]rthrottle.Policy
+	// DeviceRefreshPolicies override all other policies by device ID.
+	DeviceRefreshPolicies map[uint32]rthrottle.Policy
+	// AlwaysRefresh polls the device even when it has no subscribers, so that
+	// State stays current.
+	AlwaysRefresh bool
+	// ConfirmWrites reads back properties after writing them, so that failed
+	// writes are detected rather than assumed to have succeeded.
+	ConfirmWrites bool
+	// Transition is the default transition for light commands, e.g. to fade
+	// smoothly rather than change suddenly.
+	Transition capability.Transition
+	// DeviceTransitions override Transition by device ID.
+	DeviceTransitions map[uint32]capability.Transition
+
+	// MaxProperties is the most properties the device accepts in a single
+	// get_prop request. Defaults to capability.DefaultMaxProperties.
+	MaxProperties int
+}
+
 func New(deviceId uint32, transport transport.Outbound, seen time.Time, token []byte) Device {
-	throttle := rthrottle.NewRefreshThrottle(time.Second * 5)
+	return NewWithConfig(deviceId, transport, seen, token, Config{})
+}
+
+// NewWithConfig creates a device which polls for state changes according to
+// the configured policy whilst it has subscribers.
+func NewWithConfig(deviceId uint32, transport transport.Outbound, seen time.Time, token []byte,
+	config Config) Device {
+	policy := DefaultRefreshPolicy
+	if config.RefreshPolicy.Interval != 0 {
+		policy = config.RefreshPolicy
+	} else if config.RefreshInterval != 0 {
+		policy.Interval = config.RefreshInterval
+	}
+	devicePolicy, ok := config.DeviceRefreshPolicies[deviceId]
+	if ok {
+		policy = devicePolicy
+	}
+	transition := config.Transition
+	if t, ok := config.DeviceTransitions[deviceId]; ok {
+		transition = t
+	}
+	if config.Clock == nil {
+		config.Clock = clock.New()
+	}
+	if config.MaxProperties == 0 {
+		config.MaxProperties = capability.DefaultMaxProperties
+	}
+	throttle := rthrottle.NewRefreshThrottleWithPolicy(policy, config.Clock)
 	b := &baseDevice{
-		SubscriptionTarget: subscription.NewTarget(),
+		SubscriptionTarget: subscription.NewTargetWithClock(config.Clock),
+		clock:              config.Clock,
 
-		refreshThrottle: throttle,
-		outbound:        transport,
-		id:              deviceId,
-		seen:            seen,
-		token:           token,
+		refreshThrottle:      throttle,
+		outbound:             transport,
+		maxProperties:        config.MaxProperties,
+		alwaysRefresh:        config.AlwaysRefresh,
+		confirmWrites:        config.ConfirmWrites,
+		transition:           transition,
+		modelRefreshPolicies: config.ModelRefreshPolicies,
+		devicePolicy:         ok,
+		id:                   deviceId,
+		seen:                 seen,
+		token:                token,
 	}
 	b.init()
 	return b
@@ -48,6 +144,7 @@ func New(deviceId uint32, transport transport.Outbound, seen time.Time, token []
 func (b *baseDevice) init() {
 	b.product = product.Unknown
 	b.provisional = true
+	b.online = true
 }
 
 func (b *baseDevice) ID() uint32 {
@@ -55,49 +152,164 @@ func (b *baseDevice) ID() uint32 {
 }
 
 func (b *baseDevice) GetLabel() (string, error) {
-	return "", nil
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.label, nil
+}
+
+func (b *baseDevice) SetLabel(label string) {
+	b.mutex.Lock()
+	b.label = label
+	b.mutex.Unlock()
 }
 
 func (b *baseDevice) Handle(pkt *packet.Packet) error {
 	common.Log.Debugf("Handling packet at base_device")
+	if err := b.outbound.Handle(pkt); err != nil {
+		// Packets which fail verification say nothing about the device.
+		return err
+	}
+	b.mutex.Lock()
 	b.seen = pkt.Meta.DecodeTime
-	return b.outbound.Handle(pkt)
+	b.mutex.Unlock()
+	return nil
 }
 
 func (b *baseDevice) Close() error {
 	err := b.SubscriptionTarget.CloseAllSubscriptions()
 	b.refreshThrottle.Close()
+	if outboundErr := b.outbound.Close(); err == nil {
+		err = outboundErr
+	}
 	return err
 }
 
 func (b *baseDevice) Seen() time.Time {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
 	return b.seen
 }
 
 func (b *baseDevice) Provisional() bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
 	return b.provisional
 }
 
 func (b *baseDevice) SetProvisional(provisional bool) {
+	b.mutex.Lock()
 	b.provisional = provisional
+	b.mutex.Unlock()
+}
+
+func (b *baseDevice) Online() bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.online
 }
 
+func (b *baseDevice) SetOnline(online bool) {
+	b.mutex.Lock()
+	b.online = online
+	b.mutex.Unlock()
+}
+
+// GetProduct determines the product from the device model. Info provided via
+// SetInfo is used if available, otherwise a miIO.info call is made.
 func (b *baseDevice) GetProduct() (product.Product, error) {
-	resp := InfoResponse{}
-	err := b.outbound.CallAndDeserialize("miIO.info", nil, &resp)
-	if err != nil {
-		return product.Unknown, err
+	info := b.Info()
+	if info.Model == "" {
+		var err error
+		info, err = b.GetInfo()
+		if err != nil {
+			return product.Unknown, err
+		}
 	}
 
-	return product.GetModel(resp.Result.Model)
+	return product.GetModel(info.Model)
 }
 
+// GetInfo performs a miIO.info call and caches the result, which is
+// subsequently available from Info.
 func (b *baseDevice) GetInfo() (common.DeviceInfo, error) {
 	resp := InfoResponse{}
 	err := b.outbound.CallAndDeserialize("miIO.info", nil, &resp)
+	if err == nil {
+		b.SetInfo(resp.Result)
+	}
 	return resp.Result, err
 }
 
+// GetDiagnostics fetches the device info and Wi-Fi association state.
+func (b *baseDevice) GetDiagnostics() (common.Diagnostics, error) {
+	info, err := b.GetInfo()
+	if err != nil {
+		return common.Diagnostics{}, err
+	}
+	resp := WiFiAssocStateResponse{}
+	if err := b.outbound.CallAndDeserialize("miIO.wifi_assoc_state", nil, &resp); err != nil {
+		return common.Diagnostics{}, err
+	}
+	return common.Diagnostics{
+		DeviceID: b.ID(),
+		Info:     info,
+		WiFi:     resp.Result,
+		Time:     b.clock.Now(),
+	}, nil
+}
+
+// Info returns the device info from the most recent call to GetInfo, without
+// making a network call.
+func (b *baseDevice) Info() common.DeviceInfo {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.info
+}
+
+func (b *baseDevice) SetInfo(info common.DeviceInfo) {
+	b.mutex.Lock()
+	b.info = info
+	policy, ok := b.modelRefreshPolicies[info.Model]
+	ok = ok && !b.devicePolicy
+	b.mutex.Unlock()
+
+	if ok {
+		if err := b.refreshThrottle.SetPolicy(policy); err != nil {
+			common.Log.Warnf("Ignoring refresh policy for model %s: %s", info.Model, err)
+		}
+	}
+}
+
+// SetRefreshPolicy overrides the refresh policy for this device, including
+// any policy configured for its model. An invalid policy is rejected and
+// leaves the current policy in place.
+func (b *baseDevice) SetRefreshPolicy(policy rthrottle.Policy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	b.devicePolicy = true
+	b.mutex.Unlock()
+	return b.refreshThrottle.SetPolicy(policy)
+}
+
+// Refresh requests that the device's state is refreshed as soon as possible,
+// whether or not it has subscribers.
+func (b *baseDevice) Refresh() {
+	b.refreshThrottle.Refresh()
+}
+
+// Publish publishes an event to subscribers. Events signal that the device
+// has changed or been written to, so it is polled more often for a while.
+func (b *baseDevice) Publish(event interface{}) error {
+	b.refreshThrottle.Activity()
+	return b.SubscriptionTarget.Publish(event)
+}
+
+func (b *baseDevice) Addr() net.Addr {
+	return b.outbound.Dest()
+}
+
 func (b *baseDevice) Discover() error {
 	return b.outbound.Send(packet.NewHello())
 }
@@ -110,20 +322,54 @@ func (b *baseDevice) NewSubscription() (subscription.Subscription, error) {
 
 func (b *baseDevice) RemoveSubscription(s subscription.Subscription) (err error) {
 	err = b.SubscriptionTarget.RemoveSubscription(s)
-	if !b.HasSubscribers() {
+	if !b.alwaysRefresh && !b.HasSubscribers() {
 		b.refreshThrottle.Stop()
 	}
 	return
 }
 
+// RefreshThrottle returns the channel on which refreshes are requested.
+// Devices configured to always refresh start polling once it is requested,
+// when the device has been classified.
 func (b *baseDevice) RefreshThrottle() <-chan struct{} {
+	if b.alwaysRefresh {
+		b.refreshThrottle.Start()
+	}
 	return b.refreshThrottle.Chan()
 }
 
+func (b *baseDevice) ConfirmWrites() bool {
+	return b.confirmWrites
+}
+
+func (b *baseDevice) Transition() capability.Transition {
+	return b.transition
+}
+
+func (b *baseDevice) MaxProperties() int {
+	return b.maxProperties
+}
+
+func (b *baseDevice) Clock() clock.Clock {
+	return b.clock
+}
+
 func (b *baseDevice) Outbound() transport.Outbound {
 	return b.outbound
 }
 
 func (b *baseDevice) GetToken() []byte {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
 	return b.token
 }
+
+func (b *baseDevice) SetToken(token []byte) {
+	b.mutex.Lock()
+	b.token = token
+	b.mutex.Unlock()
+}
+
+func (b *baseDevice) State() common.DeviceState {
+	return common.DeviceState{DeviceID: b.id, Online: b.Online()}
+}
@@ -2,12 +2,16 @@ package device
 
 import (
 	"bytes"
+	"encoding/json"
 	"testing"
 	"time"
 
 	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/capability"
+	"github.com/nickw444/miio-go/common"
 	deviceMocks "github.com/nickw444/miio-go/device/mocks"
 	"github.com/nickw444/miio-go/device/product"
+	"github.com/nickw444/miio-go/device/rthrottle"
 	"github.com/nickw444/miio-go/protocol/packet"
 	transportMocks "github.com/nickw444/miio-go/protocol/transport/mocks"
 	subscriptionMocks "github.com/nickw444/miio-go/subscription/common/mocks"
@@ -32,6 +36,7 @@ func BaseDevice_SetUp() (ret struct {
 		SubscriptionTarget: ret.subTgt,
 		refreshThrottle:    ret.rThrottle,
 		outbound:           ret.outbound,
+		clock:              ret.clk,
 		id:                 ret.deviceId,
 		seen:               ret.clk.Now(),
 	}
@@ -66,16 +71,32 @@ func TestBaseDevice_Handle2(t *testing.T) {
 	assert.EqualValues(t, pkt.Meta.DecodeTime, tt.device.seen)
 }
 
-// Closes subscriptions and refreshThrottle on close
+// Packets which fail verification do not update the seen time.
+func TestBaseDevice_Handle3(t *testing.T) {
+	tt := BaseDevice_SetUp()
+	pkt := packet.New(tt.deviceId, bytes.Repeat([]byte{0xfa}, 16), 0xAAA, bytes.Repeat([]byte{0xCA}, 10))
+	pkt.Meta.DecodeTime = tt.clk.Now().Add(time.Hour)
+	seen := tt.device.seen
+
+	tt.outbound.On("Handle", pkt).Return(assert.AnError)
+	err := tt.device.Handle(pkt)
+
+	assert.Equal(t, assert.AnError, err)
+	assert.Equal(t, seen, tt.device.seen)
+}
+
+// Closes subscriptions, refreshThrottle and outbound on close
 func TestBaseDevice_Close(t *testing.T) {
 	tt := BaseDevice_SetUp()
 
 	tt.subTgt.On("CloseAllSubscriptions").Return(nil)
 	tt.rThrottle.On("Close")
+	tt.outbound.On("Close").Return(nil)
 	tt.device.Close()
 
 	tt.subTgt.AssertExpectations(t)
 	tt.rThrottle.AssertExpectations(t)
+	tt.outbound.AssertExpectations(t)
 }
 
 // Sets / Gets Provisional value
@@ -89,6 +110,20 @@ func TestBaseDevice_Provisional(t *testing.T) {
 	assert.True(t, tt.device.provisional)
 }
 
+// GetLabel returns the label set by SetLabel
+func TestBaseDevice_Label(t *testing.T) {
+	tt := BaseDevice_SetUp()
+
+	label, err := tt.device.GetLabel()
+	assert.NoError(t, err)
+	assert.Equal(t, "", label)
+
+	tt.device.SetLabel("Lamp")
+	label, err = tt.device.GetLabel()
+	assert.NoError(t, err)
+	assert.Equal(t, "Lamp", label)
+}
+
 func BaseDevice_GetProduct_Setup(outbound *transportMocks.Outbound) {
 	outbound.On("CallAndDeserialize", "miIO.info", mock.Anything, mock.Anything).
 		Return(nil).
@@ -118,6 +153,28 @@ func TestBaseDevice_GetProduct2(t *testing.T) {
 	assert.Equal(t, product.PowerPlug, p)
 }
 
+// GetInfo caches the device info for Info
+func TestBaseDevice_Info(t *testing.T) {
+	tt := BaseDevice_SetUp()
+	BaseDevice_GetProduct_Setup(tt.outbound)
+
+	assert.Equal(t, "", tt.device.Info().Model)
+	_, err := tt.device.GetInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, "chuangmi.plug.m1", tt.device.Info().Model)
+}
+
+// GetProduct uses info provided by SetInfo without calling miIO.info
+func TestBaseDevice_GetProduct3(t *testing.T) {
+	tt := BaseDevice_SetUp()
+
+	tt.device.SetInfo(common.DeviceInfo{Model: "yeelink.light.color1"})
+	p, err := tt.device.GetProduct()
+	assert.NoError(t, err)
+	assert.Equal(t, product.Yeelight, p)
+	tt.outbound.AssertNotCalled(t, "CallAndDeserialize", "miIO.info", mock.Anything, mock.Anything)
+}
+
 // Discover sends a hello packet via outbound
 func TestBaseDevice_Discover(t *testing.T) {
 	tt := BaseDevice_SetUp()
@@ -171,3 +228,163 @@ func TestBaseDevice_RemoveSubscription(t *testing.T) {
 	tt.subTgt.AssertExpectations(t)
 	tt.rThrottle.AssertExpectations(t)
 }
+
+// keeps refreshing after the last subscription is closed if configured to
+func TestBaseDevice_RemoveSubscription_AlwaysRefresh(t *testing.T) {
+	tt := BaseDevice_SetUp()
+	tt.device.alwaysRefresh = true
+
+	tt.subTgt.On("RemoveSubscription", mock.Anything).Return(nil)
+	tt.subTgt.On("HasSubscribers").Return(false)
+
+	err := tt.device.RemoveSubscription(nil)
+	assert.NoError(t, err)
+	tt.rThrottle.AssertNotCalled(t, "Stop")
+}
+
+// starts refreshing when the refresh channel is requested if configured to
+func TestBaseDevice_RefreshThrottle_AlwaysRefresh(t *testing.T) {
+	tt := BaseDevice_SetUp()
+	tt.device.alwaysRefresh = true
+
+	tt.rThrottle.On("Start").Once()
+	tt.rThrottle.On("Chan").Return(nil)
+
+	tt.device.RefreshThrottle()
+	tt.rThrottle.AssertExpectations(t)
+}
+
+// requests an immediate refresh
+func TestBaseDevice_Refresh(t *testing.T) {
+	tt := BaseDevice_SetUp()
+
+	tt.rThrottle.On("Refresh").Once()
+
+	tt.device.Refresh()
+	tt.rThrottle.AssertExpectations(t)
+}
+
+// publishing an event signals activity to the refresh throttle
+func TestBaseDevice_Publish(t *testing.T) {
+	tt := BaseDevice_SetUp()
+
+	event := common.EventUpdatePower{PowerState: common.PowerStateOn}
+	tt.rThrottle.On("Activity").Once()
+	tt.subTgt.On("Publish", event).Return(nil).Once()
+
+	err := tt.device.Publish(event)
+	assert.NoError(t, err)
+	tt.rThrottle.AssertExpectations(t)
+	tt.subTgt.AssertExpectations(t)
+}
+
+// applies the refresh policy for the model once it is known
+func TestBaseDevice_SetInfo_ModelRefreshPolicy(t *testing.T) {
+	tt := BaseDevice_SetUp()
+	policy := rthrottle.Policy{Interval: time.Minute}
+	tt.device.modelRefreshPolicies = map[string]rthrottle.Policy{"chuangmi.plug.m1": policy}
+
+	tt.rThrottle.On("SetPolicy", policy).Return(nil).Once()
+
+	tt.device.SetInfo(common.DeviceInfo{Model: "yeelink.light.color1"})
+	tt.device.SetInfo(common.DeviceInfo{Model: "chuangmi.plug.m1"})
+	tt.rThrottle.AssertExpectations(t)
+}
+
+// a refresh policy for the device takes precedence over the model's
+func TestBaseDevice_SetInfo_DeviceRefreshPolicy(t *testing.T) {
+	tt := BaseDevice_SetUp()
+	policy := rthrottle.Policy{Interval: time.Second}
+	tt.device.modelRefreshPolicies = map[string]rthrottle.Policy{"chuangmi.plug.m1": {Interval: time.Minute}}
+
+	tt.rThrottle.On("SetPolicy", policy).Return(nil).Once()
+
+	assert.NoError(t, tt.device.SetRefreshPolicy(policy))
+	tt.device.SetInfo(common.DeviceInfo{Model: "chuangmi.plug.m1"})
+	tt.rThrottle.AssertExpectations(t)
+}
+
+// an invalid refresh policy is rejected and the model's policy still applies
+func TestBaseDevice_SetRefreshPolicy_Invalid(t *testing.T) {
+	tt := BaseDevice_SetUp()
+	policy := rthrottle.Policy{Interval: time.Minute}
+	tt.device.modelRefreshPolicies = map[string]rthrottle.Policy{"chuangmi.plug.m1": policy}
+
+	tt.rThrottle.On("SetPolicy", policy).Return(nil).Once()
+
+	err := tt.device.SetRefreshPolicy(rthrottle.Policy{Interval: time.Second, Jitter: 2})
+	assert.Equal(t, rthrottle.ErrPolicyJitter, err)
+	tt.device.SetInfo(common.DeviceInfo{Model: "chuangmi.plug.m1"})
+	tt.rThrottle.AssertExpectations(t)
+}
+
+// a transition for the device takes precedence over the default
+func TestNewWithConfig_DeviceTransition(t *testing.T) {
+	config := Config{
+		Clock:             clock.NewMock(),
+		Transition:        capability.Smooth(time.Second),
+		DeviceTransitions: map[uint32]capability.Transition{1234: capability.Sudden},
+	}
+
+	dev := NewWithConfig(1234, nil, time.Time{}, nil, config)
+	assert.Equal(t, capability.Sudden, dev.Transition())
+	dev = NewWithConfig(5678, nil, time.Time{}, nil, config)
+	assert.Equal(t, capability.Smooth(time.Second), dev.Transition())
+}
+
+// The full miIO.info payload is decoded
+func TestInfoResponse_Unmarshal(t *testing.T) {
+	data := `{"result":{"life":83371,"cfg_time":0,"token":"00112233445566778899aabbccddeeff",
+		"mac":"28:6C:07:AA:BB:CC","fw_ver":"1.2.4_43","hw_ver":"MW300","uid":1234567890,
+		"model":"chuangmi.plug.m1","mcu_fw_ver":"0001","wifi_fw_ver":"SD878x-14.76.36.p84-702.1.0-WM",
+		"ap":{"rssi":-45,"ssid":"home","bssid":"00:11:22:33:44:55","primary":1},
+		"netif":{"localIp":"192.168.1.21","mask":"255.255.255.0","gw":"192.168.1.1"},
+		"mmfree":31280,"ot":"otu","otu_stat":[101,74,5343,0,5327,407],"ott_stat":[0,0,0,0]},"id":1}`
+
+	resp := InfoResponse{}
+	assert.NoError(t, json.Unmarshal([]byte(data), &resp))
+	assert.Equal(t, common.DeviceInfo{
+		FirmwareVersion:     "1.2.4_43",
+		HardwareVersion:     "MW300",
+		MacAddress:          "28:6C:07:AA:BB:CC",
+		Model:               "chuangmi.plug.m1",
+		MCUFirmwareVersion:  "0001",
+		WiFiFirmwareVersion: "SD878x-14.76.36.p84-702.1.0-WM",
+		UID:                 1234567890,
+		Life:                83371,
+		Token:               "00112233445566778899aabbccddeeff",
+		MemoryFree:          31280,
+		AccessPoint:         common.AccessPointInfo{SSID: "home", BSSID: "00:11:22:33:44:55", RSSI: -45, Primary: 1},
+		Network:             common.NetworkInfo{LocalIP: "192.168.1.21", Mask: "255.255.255.0", Gateway: "192.168.1.1"},
+		OT:                  "otu",
+		OTUStat:             []int{101, 74, 5343, 0, 5327, 407},
+		OTTStat:             []int{0, 0, 0, 0},
+	}, resp.Result)
+	assert.Equal(t, time.Duration(83371)*time.Second, resp.Result.Uptime())
+}
+
+// GetDiagnostics combines miIO.info with miIO.wifi_assoc_state
+func TestBaseDevice_GetDiagnostics(t *testing.T) {
+	tt := BaseDevice_SetUp()
+
+	info := common.DeviceInfo{Model: "chuangmi.plug.m1", AccessPoint: common.AccessPointInfo{RSSI: -60}, Life: 30}
+	tt.outbound.On("CallAndDeserialize", "miIO.info", nil, mock.Anything).
+		Run(func(args mock.Arguments) {
+			args.Get(2).(*InfoResponse).Result = info
+		}).Return(nil)
+	wifi := common.WiFiAssocState{State: "ONLINE", ConnSuccessCount: 1}
+	tt.outbound.On("CallAndDeserialize", "miIO.wifi_assoc_state", nil, mock.Anything).
+		Run(func(args mock.Arguments) {
+			args.Get(2).(*WiFiAssocStateResponse).Result = wifi
+		}).Return(nil)
+
+	diagnostics, err := tt.device.GetDiagnostics()
+	assert.NoError(t, err)
+	assert.Equal(t, common.Diagnostics{
+		DeviceID: tt.deviceId,
+		Info:     info,
+		WiFi:     wifi,
+		Time:     tt.clk.Now(),
+	}, diagnostics)
+	assert.Equal(t, info, tt.device.Info())
+}
@@ -3,6 +3,9 @@ package device
 import (
 	"testing"
 
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/capability"
+	"github.com/nickw444/miio-go/common"
 	deviceMocks "github.com/nickw444/miio-go/device/mocks"
 	"github.com/nickw444/miio-go/device/product"
 	"github.com/stretchr/testify/assert"
@@ -35,6 +38,10 @@ func Classify_SetUp(product product.Product) *deviceMocks.Device {
 	dev.On("GetProduct").Return(product, nil)
 	dev.On("SetProvisional", false)
 	dev.On("Outbound").Return(nil)
+	dev.On("Clock").Return(clock.NewMock())
+	dev.On("ConfirmWrites").Return(false)
+	dev.On("Transition").Return(capability.Transition{})
+	dev.On("Info").Return(common.DeviceInfo{})
 	return dev
 }
 
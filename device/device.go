@@ -3,8 +3,11 @@ package device
 import (
 	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/capability"
 	"github.com/nickw444/miio-go/common"
 	"github.com/nickw444/miio-go/device/product"
+	"github.com/nickw444/miio-go/device/rthrottle"
 	"github.com/nickw444/miio-go/protocol/packet"
 	"github.com/nickw444/miio-go/protocol/transport"
 )
@@ -20,5 +23,36 @@ type Device interface {
 	GetProduct() (product.Product, error)
 	Discover() error
 	RefreshThrottle() <-chan struct{}
+	// Refresh requests that the device's state is refreshed as soon as
+	// possible, whether or not it has subscribers.
+	Refresh()
+	// SetRefreshPolicy overrides how often the device is polled.
+	SetRefreshPolicy(rthrottle.Policy) error
 	Outbound() transport.Outbound
+	Info() common.DeviceInfo
+	// GetDiagnostics fetches the device info and Wi-Fi association state,
+	// e.g. for monitoring signal strength and uptime.
+	GetDiagnostics() (common.Diagnostics, error)
+	// SetInfo seeds the device info, e.g. from a device cache, so that
+	// classification does not need to call miIO.info.
+	SetInfo(common.DeviceInfo)
+	// SetLabel sets the friendly name returned by GetLabel.
+	SetLabel(string)
+	// SetToken records a new token for the device. The outbound's crypto must
+	// be replaced separately.
+	SetToken([]byte)
+	// Clock returns the clock used for timing by the device and its
+	// capabilities.
+	Clock() clock.Clock
+	// MaxProperties returns the most properties the device accepts in a
+	// single get_prop request.
+	MaxProperties() int
+	// ConfirmWrites reports whether capabilities should read back properties
+	// after writing them.
+	ConfirmWrites() bool
+	// Transition returns the default transition for light commands.
+	Transition() capability.Transition
+	// Online reports whether the device is responding. Devices start online.
+	Online() bool
+	SetOnline(bool)
 }
@@ -3,19 +3,27 @@
 package mocks
 
 import (
+	clock "github.com/benbjohnson/clock"
+
+	capability "github.com/nickw444/miio-go/capability"
+
 	common "github.com/nickw444/miio-go/common"
 
-	mock "github.com/stretchr/testify/mock"
+	product "github.com/nickw444/miio-go/device/product"
+
+	rthrottle "github.com/nickw444/miio-go/device/rthrottle"
 
 	packet "github.com/nickw444/miio-go/protocol/packet"
 
-	product "github.com/nickw444/miio-go/device/product"
+	transport "github.com/nickw444/miio-go/protocol/transport"
 
 	subscriptioncommon "github.com/nickw444/miio-go/subscription/common"
 
-	time "time"
+	mock "github.com/stretchr/testify/mock"
 
-	transport "github.com/nickw444/miio-go/protocol/transport"
+	net "net"
+
+	time "time"
 )
 
 // Device is an autogenerated mock type for the Device type
@@ -23,6 +31,38 @@ type Device struct {
 	mock.Mock
 }
 
+// Addr provides a mock function with given fields:
+func (_m *Device) Addr() net.Addr {
+	ret := _m.Called()
+
+	var r0 net.Addr
+	if rf, ok := ret.Get(0).(func() net.Addr); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(net.Addr)
+		}
+	}
+
+	return r0
+}
+
+// Clock provides a mock function with given fields:
+func (_m *Device) Clock() clock.Clock {
+	ret := _m.Called()
+
+	var r0 clock.Clock
+	if rf, ok := ret.Get(0).(func() clock.Clock); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(clock.Clock)
+		}
+	}
+
+	return r0
+}
+
 // Close provides a mock function with given fields:
 func (_m *Device) Close() error {
 	ret := _m.Called()
@@ -51,6 +91,20 @@ func (_m *Device) CloseAllSubscriptions() error {
 	return r0
 }
 
+// ConfirmWrites provides a mock function with given fields:
+func (_m *Device) ConfirmWrites() bool {
+	ret := _m.Called()
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func() bool); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	return r0
+}
+
 // Discover provides a mock function with given fields:
 func (_m *Device) Discover() error {
 	ret := _m.Called()
@@ -65,6 +119,27 @@ func (_m *Device) Discover() error {
 	return r0
 }
 
+// GetDiagnostics provides a mock function with given fields:
+func (_m *Device) GetDiagnostics() (common.Diagnostics, error) {
+	ret := _m.Called()
+
+	var r0 common.Diagnostics
+	if rf, ok := ret.Get(0).(func() common.Diagnostics); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(common.Diagnostics)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetInfo provides a mock function with given fields:
 func (_m *Device) GetInfo() (common.DeviceInfo, error) {
 	ret := _m.Called()
@@ -186,6 +261,34 @@ func (_m *Device) ID() uint32 {
 	return r0
 }
 
+// Info provides a mock function with given fields:
+func (_m *Device) Info() common.DeviceInfo {
+	ret := _m.Called()
+
+	var r0 common.DeviceInfo
+	if rf, ok := ret.Get(0).(func() common.DeviceInfo); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(common.DeviceInfo)
+	}
+
+	return r0
+}
+
+// MaxProperties provides a mock function with given fields:
+func (_m *Device) MaxProperties() int {
+	ret := _m.Called()
+
+	var r0 int
+	if rf, ok := ret.Get(0).(func() int); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(int)
+	}
+
+	return r0
+}
+
 // NewSubscription provides a mock function with given fields:
 func (_m *Device) NewSubscription() (subscriptioncommon.Subscription, error) {
 	ret := _m.Called()
@@ -209,6 +312,20 @@ func (_m *Device) NewSubscription() (subscriptioncommon.Subscription, error) {
 	return r0, r1
 }
 
+// Online provides a mock function with given fields:
+func (_m *Device) Online() bool {
+	ret := _m.Called()
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func() bool); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	return r0
+}
+
 // Outbound provides a mock function with given fields:
 func (_m *Device) Outbound() transport.Outbound {
 	ret := _m.Called()
@@ -253,6 +370,11 @@ func (_m *Device) Publish(event interface{}) error {
 	return r0
 }
 
+// Refresh provides a mock function with given fields:
+func (_m *Device) Refresh() {
+	_m.Called()
+}
+
 // RefreshThrottle provides a mock function with given fields:
 func (_m *Device) RefreshThrottle() <-chan struct{} {
 	ret := _m.Called()
@@ -297,7 +419,69 @@ func (_m *Device) Seen() time.Time {
 	return r0
 }
 
+// SetInfo provides a mock function with given fields: _a0
+func (_m *Device) SetInfo(_a0 common.DeviceInfo) {
+	_m.Called(_a0)
+}
+
+// SetLabel provides a mock function with given fields: _a0
+func (_m *Device) SetLabel(_a0 string) {
+	_m.Called(_a0)
+}
+
+// SetOnline provides a mock function with given fields: _a0
+func (_m *Device) SetOnline(_a0 bool) {
+	_m.Called(_a0)
+}
+
 // SetProvisional provides a mock function with given fields: _a0
 func (_m *Device) SetProvisional(_a0 bool) {
 	_m.Called(_a0)
 }
+
+// SetRefreshPolicy provides a mock function with given fields: _a0
+func (_m *Device) SetRefreshPolicy(_a0 rthrottle.Policy) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(rthrottle.Policy) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// SetToken provides a mock function with given fields: _a0
+func (_m *Device) SetToken(_a0 []byte) {
+	_m.Called(_a0)
+}
+
+// State provides a mock function with given fields:
+func (_m *Device) State() common.DeviceState {
+	ret := _m.Called()
+
+	var r0 common.DeviceState
+	if rf, ok := ret.Get(0).(func() common.DeviceState); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(common.DeviceState)
+	}
+
+	return r0
+}
+
+// Transition provides a mock function with given fields:
+func (_m *Device) Transition() capability.Transition {
+	ret := _m.Called()
+
+	var r0 capability.Transition
+	if rf, ok := ret.Get(0).(func() capability.Transition); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(capability.Transition)
+	}
+
+	return r0
+}
@@ -13,15 +13,25 @@ type PowerPlug struct {
 func NewPowerPlug(device Device) *PowerPlug {
 	dev := &PowerPlug{
 		Device: device,
-		Power:  capability.NewPower(device, device.Outbound()),
+		Power:  capability.NewPowerWithClock(device, device.Outbound(), device.Clock()),
 	}
+	dev.Power.SetConfirmWrites(device.ConfirmWrites())
 	go dev.refresh()
 	return dev
 }
 
+func (p *PowerPlug) State() common.DeviceState {
+	state := p.Device.State()
+	power := p.Power.State()
+	state.Power = &power
+	return state
+}
+
 func (p *PowerPlug) refresh() {
 	for range p.RefreshThrottle() {
-		_ = p.Power.Update()
+		if err := capability.UpdateProperties(p.Outbound(), p.MaxProperties(), p.Power); err != nil {
+			common.Log.Debugf("Unable to refresh device %d: %s", p.ID(), err)
+		}
 	}
 
 	common.Log.Debug("Device refresh closed.")
@@ -2,13 +2,22 @@
 
 package mocks
 
-import mock "github.com/stretchr/testify/mock"
+import (
+	rthrottle "github.com/nickw444/miio-go/device/rthrottle"
+
+	mock "github.com/stretchr/testify/mock"
+)
 
 // RefreshThrottle is an autogenerated mock type for the RefreshThrottle type
 type RefreshThrottle struct {
 	mock.Mock
 }
 
+// Activity provides a mock function with given fields:
+func (_m *RefreshThrottle) Activity() {
+	_m.Called()
+}
+
 // Chan provides a mock function with given fields:
 func (_m *RefreshThrottle) Chan() <-chan struct{} {
 	ret := _m.Called()
@@ -30,6 +39,25 @@ func (_m *RefreshThrottle) Close() {
 	_m.Called()
 }
 
+// Refresh provides a mock function with given fields:
+func (_m *RefreshThrottle) Refresh() {
+	_m.Called()
+}
+
+// SetPolicy provides a mock function with given fields: _a0
+func (_m *RefreshThrottle) SetPolicy(_a0 rthrottle.Policy) error {
+	ret := _m.Called(_a0)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(rthrottle.Policy) error); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Start provides a mock function with given fields:
 func (_m *RefreshThrottle) Start() {
 	_m.Called()
@@ -1,6 +1,9 @@
 package rthrottle
 
 import (
+	"errors"
+	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/benbjohnson/clock"
@@ -11,23 +14,108 @@ type RefreshThrottle interface {
 	Stop()
 	Start()
 	Close()
+	// Refresh requests a refresh as soon as possible, even if the throttle
+	// has not been started.
+	Refresh()
+	// Activity signals that the device has changed or been written to, so
+	// refreshes are made at the policy's MinInterval until it is stable again.
+	Activity()
+	// SetPolicy replaces the policy, taking effect from the next refresh. The
+	// policy is left unchanged if it is invalid.
+	SetPolicy(Policy) error
 }
 
-type TickerFactory func() *clock.Ticker
+var (
+	ErrPolicyInterval = errors.New("Refresh interval must be positive.")
+	ErrPolicyBounds   = errors.New("Refresh interval must be between the minimum and maximum intervals.")
+	ErrPolicyJitter   = errors.New("Refresh jitter must be between 0 and 1.")
+)
+
+// Policy controls how often a RefreshThrottle ticks. A policy with only an
+// Interval ticks at a fixed rate.
+type Policy struct {
+	// Interval is the time between refreshes.
+	Interval time.Duration
+	// MinInterval is the time until the next refresh after Activity. The time
+	// between refreshes then doubles after each refresh until it reaches
+	// MaxInterval. Defaults to Interval.
+	MinInterval time.Duration
+	// MaxInterval is the time between refreshes once the device is stable.
+	// Defaults to Interval.
+	MaxInterval time.Duration
+	// Jitter varies each delay randomly by up to this fraction, e.g. 0.1 for
+	// ±10%, so that devices are not all polled at once.
+	Jitter float64
+}
+
+// Validate checks that the interval is positive and within the minimum and
+// maximum intervals, if they are set, and that the jitter is between 0 and 1.
+func (p Policy) Validate() error {
+	if p.Interval <= 0 {
+		return ErrPolicyInterval
+	}
+	if p.MinInterval < 0 || p.MinInterval > p.Interval || (p.MaxInterval != 0 && p.MaxInterval < p.Interval) {
+		return ErrPolicyBounds
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return ErrPolicyJitter
+	}
+	return nil
+}
+
+func (p Policy) withDefaults() Policy {
+	if p.MinInterval == 0 || p.MinInterval > p.Interval {
+		p.MinInterval = p.Interval
+	}
+	if p.MaxInterval < p.Interval {
+		p.MaxInterval = p.Interval
+	}
+	return p
+}
 
 type refreshThrottle struct {
-	tickerFactory TickerFactory
-	ch            chan struct{}
+	clock   clock.Clock
+	ch      chan struct{}
+	wake    chan struct{}
+	closing chan struct{}
 
-	quitChan chan struct{}
-	ticker   *clock.Ticker
+	mutex     sync.Mutex
+	wg        sync.WaitGroup
+	refreshWg sync.WaitGroup
+	quitChan  chan struct{}
+	policy    Policy
+	interval  time.Duration
+	deadline  time.Time
+	running   bool
+	pending   bool
+	closed    bool
 }
 
 func NewRefreshThrottle(refreshInterval time.Duration) RefreshThrottle {
-	c := clock.New()
+	return NewRefreshThrottleWithClock(refreshInterval, clock.New())
+}
+
+// NewRefreshThrottleWithClock creates a throttle which times refreshes using
+// the given clock.
+func NewRefreshThrottleWithClock(refreshInterval time.Duration, c clock.Clock) RefreshThrottle {
+	return NewRefreshThrottleWithPolicy(Policy{Interval: refreshInterval}, c)
+}
+
+// NewRefreshThrottleWithPolicy creates a throttle which adapts its rate
+// according to the policy.
+func NewRefreshThrottleWithPolicy(policy Policy, c clock.Clock) RefreshThrottle {
+	return newRefreshThrottle(policy, c)
+}
+
+func newRefreshThrottle(policy Policy, c clock.Clock) *refreshThrottle {
+	policy = policy.withDefaults()
 	return &refreshThrottle{
-		tickerFactory: func() *clock.Ticker { return c.Ticker(refreshInterval) },
-		ch:            make(chan struct{}),
+		clock:    c,
+		ch:       make(chan struct{}),
+		wake:     make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+		policy:   policy,
+		interval: policy.Interval,
 	}
 }
 
@@ -36,42 +124,161 @@ func (r *refreshThrottle) Chan() <-chan struct{} {
 }
 
 func (r *refreshThrottle) Start() {
-	if r.ticker == nil {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.running && !r.closed {
+		r.running = true
 		r.quitChan = make(chan struct{})
-		r.ticker = r.tickerFactory()
-		go r.refresh()
+		// The first timer is created here rather than in the refresh goroutine
+		// so that it starts from the time Start was called.
+		timer := r.clock.Timer(r.next())
+		r.wg.Add(1)
+		go r.refresh(timer, r.quitChan)
 	}
 }
 
 func (r *refreshThrottle) Stop() {
-	if r.ticker != nil {
-		r.ticker.Stop()
-		r.ticker = nil
+	r.mutex.Lock()
+	r.stop()
+	r.mutex.Unlock()
+	// Wait outside of the lock, the refresh goroutine may be blocked on a
+	// consumer that is itself calling Start or Stop.
+	r.wg.Wait()
+}
+
+func (r *refreshThrottle) stop() {
+	if r.running {
+		r.running = false
 		close(r.quitChan)
 	}
 }
 
+// Close stops the throttle and closes Chan once the refresh goroutine has
+// exited. The throttle cannot be restarted after it has been closed.
 func (r *refreshThrottle) Close() {
-	r.Stop()
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return
+	}
+	r.closed = true
+	r.stop()
+	close(r.closing)
+	r.mutex.Unlock()
+	r.wg.Wait()
+	r.refreshWg.Wait()
 	close(r.ch)
 }
 
-func (r *refreshThrottle) refresh() {
+func (r *refreshThrottle) Refresh() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed || r.pending {
+		return
+	}
+	r.pending = true
+	r.refreshWg.Add(1)
+	go func() {
+		defer r.refreshWg.Done()
+		select {
+		case <-r.closing:
+		case r.ch <- struct{}{}:
+		}
+		r.mutex.Lock()
+		r.pending = false
+		r.mutex.Unlock()
+	}()
+}
+
+func (r *refreshThrottle) Activity() {
+	r.mutex.Lock()
+	r.interval = r.policy.MinInterval
+	wake := r.running && r.deadline.After(r.clock.Now().Add(r.interval))
+	r.mutex.Unlock()
+	if wake {
+		r.wakeUp()
+	}
+}
+
+func (r *refreshThrottle) SetPolicy(policy Policy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.policy = policy.withDefaults()
+	r.interval = r.policy.Interval
+	running := r.running
+	r.mutex.Unlock()
+	if running {
+		r.wakeUp()
+	}
+	return nil
+}
+
+// wakeUp asks the refresh goroutine to reschedule the next refresh.
+func (r *refreshThrottle) wakeUp() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the delay until the next refresh and backs off the interval
+// for the refresh after. Callers must hold mutex.
+func (r *refreshThrottle) next() time.Duration {
+	delay := r.interval
+	if r.policy.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * r.policy.Jitter * float64(delay))
+	}
+	if r.interval < r.policy.MaxInterval {
+		r.interval *= 2
+		if r.interval > r.policy.MaxInterval {
+			r.interval = r.policy.MaxInterval
+		}
+	}
+	r.deadline = r.clock.Now().Add(delay)
+	return delay
+}
+
+func (r *refreshThrottle) schedule() *clock.Timer {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.clock.Timer(r.next())
+}
+
+func (r *refreshThrottle) refresh(timer *clock.Timer, quitChan chan struct{}) {
+	defer r.wg.Done()
+	defer func() { timer.Stop() }()
+
 	// Request a refresh immediately.
-	r.ch <- struct{}{}
+	select {
+	case <-quitChan:
+		return
+	case r.ch <- struct{}{}:
+	}
 
 	for {
 		select {
-		case <-r.quitChan:
+		case <-quitChan:
 			return
 		default:
 		}
 
 		select {
-		case <-r.quitChan:
+		case <-quitChan:
 			return
-		case <-r.ticker.C:
-			r.ch <- struct{}{}
+		case <-r.wake:
+			timer.Stop()
+			timer = r.schedule()
+		case <-timer.C:
+			// Schedule the next refresh before publishing this one, so that
+			// the schedule does not depend on how long the consumer takes.
+			timer = r.schedule()
+			select {
+			case <-quitChan:
+				return
+			case r.ch <- struct{}{}:
+			}
 		}
 	}
 }
@@ -16,15 +16,13 @@ func RefreshThrottle_Setup() (tt struct {
 }) {
 	tt.refreshInterval = 5 * time.Second
 	tt.clk = clock.NewMock()
-	tt.throttle = &refreshThrottle{
-		tickerFactory: func() *clock.Ticker { return tt.clk.Ticker(tt.refreshInterval) },
-		ch:            make(chan struct{}, 2),
-	}
+	tt.throttle = newRefreshThrottle(Policy{Interval: tt.refreshInterval}, tt.clk)
+	tt.throttle.ch = make(chan struct{}, 2)
 
 	return
 }
 
-//does not close Chan until Close is called
+// does not close Chan until Close is called
 func TestRefreshThrottle_ChanDoesNotCloseUntilClose(t *testing.T) {
 	tt := RefreshThrottle_Setup()
 
@@ -124,6 +122,123 @@ func TestRefreshThrottle_StartAfterStop(t *testing.T) {
 	assert.Len(t, ch, 1)
 }
 
+// Test to ensure that Close does not panic whilst a refresh is blocked on
+// an unread channel, and that the channel is closed afterwards.
+func TestRefreshThrottle_CloseWhilstBlocked(t *testing.T) {
+	tt := RefreshThrottle_Setup()
+	tt.throttle.ch = make(chan struct{})
+
+	tt.throttle.Start()
+	tt.clk.Add(tt.refreshInterval)
+	tt.throttle.Close()
+
+	_, ok := <-tt.throttle.Chan()
+	assert.False(t, ok)
+
+	// Starting after close is a no-op.
+	tt.throttle.Start()
+	assert.False(t, tt.throttle.running)
+}
+
+// Activity polls at the minimum interval, then backs off to the maximum.
+func TestRefreshThrottle_Activity(t *testing.T) {
+	tt := RefreshThrottle_Setup()
+	tt.throttle.SetPolicy(Policy{
+		Interval:    2 * time.Second,
+		MinInterval: time.Second,
+		MaxInterval: 8 * time.Second,
+	})
+
+	ch := tt.throttle.Chan()
+	tt.throttle.Start()
+	<-ch // Clear initial tick.
+
+	// The first refresh is at Interval, after which it backs off to
+	// MaxInterval.
+	tt.clk.Add(2 * time.Second)
+	race(t, ch)
+	tt.clk.Add(3 * time.Second)
+	assert.Len(t, ch, 0)
+	tt.clk.Add(time.Second)
+	race(t, ch)
+
+	// Activity reschedules the pending refresh sooner.
+	tt.throttle.Activity()
+	time.Sleep(10 * time.Millisecond)
+	tt.clk.Add(time.Second)
+	race(t, ch)
+	tt.clk.Add(2 * time.Second)
+	race(t, ch)
+	tt.clk.Add(3 * time.Second)
+	assert.Len(t, ch, 0)
+	tt.clk.Add(time.Second)
+	race(t, ch)
+	tt.clk.Add(7 * time.Second)
+	assert.Len(t, ch, 0)
+	tt.clk.Add(time.Second)
+	race(t, ch)
+
+	tt.throttle.Close()
+}
+
+// Refresh ticks immediately, even when the throttle is stopped.
+func TestRefreshThrottle_Refresh(t *testing.T) {
+	tt := RefreshThrottle_Setup()
+
+	ch := tt.throttle.Chan()
+	tt.throttle.Refresh()
+	race(t, ch)
+
+	// Refreshes which have not been consumed are coalesced.
+	tt.throttle.ch = make(chan struct{})
+	ch = tt.throttle.Chan()
+	tt.throttle.Refresh()
+	tt.throttle.Refresh()
+	race(t, ch)
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-ch:
+		t.Error("Expected a single refresh.")
+	default:
+	}
+
+	tt.throttle.Close()
+	tt.throttle.Refresh()
+	_, ok := <-ch
+	assert.False(t, ok)
+}
+
+// Jitter varies the delay within the configured fraction.
+func TestRefreshThrottle_Jitter(t *testing.T) {
+	tt := RefreshThrottle_Setup()
+	tt.throttle.SetPolicy(Policy{Interval: 10 * time.Second, Jitter: 0.2})
+
+	for i := 0; i < 100; i++ {
+		delay := tt.throttle.next()
+		assert.True(t, delay >= 8*time.Second && delay <= 12*time.Second, "Delay %s out of range", delay)
+	}
+}
+
+func TestPolicy_Validate(t *testing.T) {
+	assert.NoError(t, Policy{Interval: time.Second}.Validate())
+	assert.NoError(t, Policy{Interval: time.Second, MinInterval: time.Second, MaxInterval: time.Minute, Jitter: 1}.Validate())
+	assert.Equal(t, ErrPolicyInterval, Policy{}.Validate())
+	assert.Equal(t, ErrPolicyInterval, Policy{Interval: -time.Second}.Validate())
+	assert.Equal(t, ErrPolicyBounds, Policy{Interval: time.Second, MinInterval: time.Minute}.Validate())
+	assert.Equal(t, ErrPolicyBounds, Policy{Interval: time.Minute, MaxInterval: time.Second}.Validate())
+	assert.Equal(t, ErrPolicyJitter, Policy{Interval: time.Second, Jitter: -0.1}.Validate())
+	assert.Equal(t, ErrPolicyJitter, Policy{Interval: time.Second, Jitter: 1.5}.Validate())
+}
+
+// An invalid policy leaves the current policy in place.
+func TestRefreshThrottle_SetPolicyInvalid(t *testing.T) {
+	tt := RefreshThrottle_Setup()
+
+	err := tt.throttle.SetPolicy(Policy{Interval: 0})
+	assert.Equal(t, ErrPolicyInterval, err)
+	assert.Equal(t, tt.refreshInterval, tt.throttle.next())
+}
+
 func race(t *testing.T, ch <-chan struct{}) {
 	select {
 	case <-ch:
@@ -9,22 +9,41 @@ type Yeelight struct {
 	Device
 	*capability.Light
 	*capability.Power
+	*capability.ColorTemperature
 }
 
 func NewYeelight(device Device) *Yeelight {
 	dev := &Yeelight{
 		Device: device,
-		Power:  capability.NewPower(device, device.Outbound()),
-		Light:  capability.NewLight(device, device.Outbound()),
+		Power:  capability.NewPowerWithClock(device, device.Outbound(), device.Clock()),
+		Light:  capability.NewLightWithClock(device, device.Outbound(), device.Clock()),
 	}
+	dev.ColorTemperature = capability.NewColorTemperature(dev.Light,
+		capability.ColorTemperatureRangeForModel(device.Info().Model))
+	dev.Power.SetConfirmWrites(device.ConfirmWrites())
+	dev.Light.SetConfirmWrites(device.ConfirmWrites())
+	dev.Power.EnableTransitions()
+	dev.Power.SetTransition(device.Transition())
+	dev.Light.SetTransition(device.Transition())
 	go dev.refresh()
 	return dev
 }
 
+func (p *Yeelight) State() common.DeviceState {
+	state := p.Device.State()
+	power := p.Power.State()
+	light := p.Light.State()
+	state.Power = &power
+	state.Light = &light
+	return state
+}
+
 func (p *Yeelight) refresh() {
 	for range p.RefreshThrottle() {
-		_ = p.Power.Update()
-		_ = p.Light.Update()
+		if err := capability.UpdateProperties(p.Outbound(), p.MaxProperties(), p.Power, p.Light,
+			p.ColorTemperature); err != nil {
+			common.Log.Debugf("Unable to refresh device %d: %s", p.ID(), err)
+		}
 	}
 
 	common.Log.Debug("Device refresh closed.")
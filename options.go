@@ -0,0 +1,294 @@
+package miio
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/capability"
+	"github.com/nickw444/miio-go/device/rthrottle"
+	"github.com/nickw444/miio-go/protocol/tokens"
+	"github.com/nickw444/miio-go/protocol/transport"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultTokenFile         = "tokens.txt"
+	DefaultDiscoveryInterval = time.Second * 15
+	DefaultExpiryMultiplier  = 2
+	DefaultOfflineExpiry     = time.Hour
+)
+
+// Option configures a Client created by NewClient.
+type Option func(*options)
+
+type options struct {
+	tokenStore        tokens.TokenStore
+	tokenFile         string
+	tokenSecret       []byte
+	tokenSources      []tokens.TokenSource
+	tokenReload       time.Duration
+	tokenWatcher      tokens.Watcher
+	fileStore         tokens.TokenStore
+	broadcastIPs      []net.IP
+	listenPort        int
+	discoveryInterval time.Duration
+	expiryMultiplier  int
+	offlineExpiry     time.Duration
+	refreshInterval   time.Duration
+	refreshPolicy     rthrottle.Policy
+	modelPolicies     map[string]rthrottle.Policy
+	devicePolicies    map[uint32]rthrottle.Policy
+	alwaysRefresh     bool
+	confirmWrites     bool
+	transition        capability.Transition
+	deviceTransitions map[uint32]capability.Transition
+	logger            *logrus.Logger
+	clock             clock.Clock
+	retryPolicy       transport.RetryPolicy
+	deviceCacheFile   string
+	deviceCacheMaxAge time.Duration
+}
+
+func defaultOptions() options {
+	return options{
+		tokenFile:         DefaultTokenFile,
+		discoveryInterval: DefaultDiscoveryInterval,
+		expiryMultiplier:  DefaultExpiryMultiplier,
+		offlineExpiry:     DefaultOfflineExpiry,
+	}
+}
+
+// validate checks options which cannot be rejected when they are applied.
+func (o *options) validate() error {
+	if o.expiryMultiplier < 1 {
+		return ErrExpiryMultiplier
+	}
+	if o.offlineExpiry < 0 {
+		return ErrOfflineExpiry
+	}
+	if o.refreshInterval < 0 {
+		return rthrottle.ErrPolicyInterval
+	}
+	if o.refreshPolicy != (rthrottle.Policy{}) {
+		if err := o.refreshPolicy.Validate(); err != nil {
+			return err
+		}
+	}
+	for model, policy := range o.modelPolicies {
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("Invalid refresh policy for model %s: %s", model, err)
+		}
+	}
+	for deviceID, policy := range o.devicePolicies {
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("Invalid refresh policy for device %d: %s", deviceID, err)
+		}
+	}
+	if err := o.transition.Validate(); err != nil {
+		return err
+	}
+	for deviceID, transition := range o.deviceTransitions {
+		if err := transition.Validate(); err != nil {
+			return fmt.Errorf("Invalid transition for device %d: %s", deviceID, err)
+		}
+	}
+	return nil
+}
+
+// WithTokenStore uses the given token store instead of loading one from a
+// file.
+func WithTokenStore(store tokens.TokenStore) Option {
+	return func(o *options) {
+		o.tokenStore = store
+	}
+}
+
+// WithTokenFile loads the token store from the given path. Defaults to
+// tokens.txt in the working directory. Ignored if WithTokenStore is used.
+func WithTokenFile(path string) Option {
+	return func(o *options) {
+		o.tokenFile = path
+	}
+}
+
+// WithTokenSecret decrypts the token file with a key derived from the given
+// passphrase or key file contents. Plaintext token files are also accepted,
+// and are encrypted when next written. Ignored if WithTokenStore is used.
+func WithTokenSecret(secret []byte) Option {
+	return func(o *options) {
+		o.tokenSecret = secret
+	}
+}
+
+// WithTokenSources adds read only token sources, such as environment
+// variables or mounted secrets, which are consulted in order after the token
+// store. Tokens added at runtime are written to the token store.
+func WithTokenSources(sources ...tokens.TokenSource) Option {
+	return func(o *options) {
+		o.tokenSources = append(o.tokenSources, sources...)
+	}
+}
+
+// WithTokenReload polls the token file at the given interval and reloads it
+// when it changes. Devices with changed tokens are rekeyed, and devices which
+// were ignored for hiding their token are recovered. Ignored if
+// WithTokenStore is used.
+func WithTokenReload(interval time.Duration) Option {
+	return func(o *options) {
+		o.tokenReload = interval
+	}
+}
+
+// WithBroadcastIPs sets the addresses that discovery packets are sent to.
+// Defaults to 255.255.255.255.
+func WithBroadcastIPs(ips ...net.IP) Option {
+	return func(o *options) {
+		o.broadcastIPs = ips
+	}
+}
+
+// WithListenPort sets the local UDP port to listen on. Defaults to a random
+// system-assigned port.
+func WithListenPort(port int) Option {
+	return func(o *options) {
+		o.listenPort = port
+	}
+}
+
+// WithDiscoveryInterval sets how often discovery is performed. An interval of
+// zero performs discovery only once.
+func WithDiscoveryInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.discoveryInterval = interval
+	}
+}
+
+// WithExpiryMultiplier sets how many discovery intervals a device may go
+// without responding before it is pinged, and then marked offline if it does
+// not respond. Must be at least 1. Defaults to 2.
+func WithExpiryMultiplier(multiplier int) Option {
+	return func(o *options) {
+		o.expiryMultiplier = multiplier
+	}
+}
+
+// WithOfflineExpiry sets how long a device may go unseen before it is expired
+// and forgotten, having been marked offline. Defaults to DefaultOfflineExpiry.
+// Zero retains offline devices until they come back online.
+func WithOfflineExpiry(expiry time.Duration) Option {
+	return func(o *options) {
+		o.offlineExpiry = expiry
+	}
+}
+
+// WithRefreshInterval sets how often devices with subscribers are polled for
+// state changes. Zero uses device.DefaultRefreshInterval, and NewClient fails
+// if the interval is negative.
+func WithRefreshInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.refreshInterval = interval
+	}
+}
+
+// WithRefreshPolicy sets how often devices are polled for state changes,
+// including how quickly polling backs off once a device is stable. Overrides
+// WithRefreshInterval. NewClient fails if this or any other refresh policy is
+// invalid.
+func WithRefreshPolicy(policy rthrottle.Policy) Option {
+	return func(o *options) {
+		o.refreshPolicy = policy
+	}
+}
+
+// WithModelRefreshPolicy sets the refresh policy for devices of the given
+// model, e.g. yeelink.light.color1.
+func WithModelRefreshPolicy(model string, policy rthrottle.Policy) Option {
+	return func(o *options) {
+		if o.modelPolicies == nil {
+			o.modelPolicies = make(map[string]rthrottle.Policy)
+		}
+		o.modelPolicies[model] = policy
+	}
+}
+
+// WithDeviceRefreshPolicy sets the refresh policy for a single device,
+// overriding any policy for its model.
+func WithDeviceRefreshPolicy(deviceID uint32, policy rthrottle.Policy) Option {
+	return func(o *options) {
+		if o.devicePolicies == nil {
+			o.devicePolicies = make(map[uint32]rthrottle.Policy)
+		}
+		o.devicePolicies[deviceID] = policy
+	}
+}
+
+// WithAlwaysRefresh polls devices even when they have no subscribers, so that
+// their State stays current.
+func WithAlwaysRefresh() Option {
+	return func(o *options) {
+		o.alwaysRefresh = true
+	}
+}
+
+// WithConfirmWrites reads back properties after writing them, so that writes
+// which the device acknowledged but did not apply return an error.
+func WithConfirmWrites() Option {
+	return func(o *options) {
+		o.confirmWrites = true
+	}
+}
+
+// WithTransition sets the default transition for light commands, e.g.
+// capability.Smooth(time.Millisecond * 500) to fade between values. NewClient
+// fails if this or any device transition is invalid.
+func WithTransition(transition capability.Transition) Option {
+	return func(o *options) {
+		o.transition = transition
+	}
+}
+
+// WithDeviceTransition sets the default transition for a single device,
+// overriding WithTransition.
+func WithDeviceTransition(deviceID uint32, transition capability.Transition) Option {
+	return func(o *options) {
+		if o.deviceTransitions == nil {
+			o.deviceTransitions = make(map[uint32]capability.Transition)
+		}
+		o.deviceTransitions[deviceID] = transition
+	}
+}
+
+// WithLogger sets the logger used by the library. Note that the logger is
+// shared by all clients.
+func WithLogger(logger *logrus.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithClock sets the clock used for timing.
+func WithClock(clk clock.Clock) Option {
+	return func(o *options) {
+		o.clock = clk
+	}
+}
+
+// WithRetryPolicy sets how calls to devices are retried.
+func WithRetryPolicy(policy transport.RetryPolicy) Option {
+	return func(o *options) {
+		o.retryPolicy = policy
+	}
+}
+
+// WithDeviceCache persists known devices to the given path. On startup, cached
+// devices are registered immediately and can be controlled whilst discovery
+// confirms them. Entries not seen within maxAge are pruned; zero uses
+// protocol.DefaultDeviceCacheMaxAge.
+func WithDeviceCache(path string, maxAge time.Duration) Option {
+	return func(o *options) {
+		o.deviceCacheFile = path
+		o.deviceCacheMaxAge = maxAge
+	}
+}
@@ -0,0 +1,320 @@
+package miio
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/capability"
+	"github.com/nickw444/miio-go/common"
+	"github.com/nickw444/miio-go/device"
+	"github.com/nickw444/miio-go/device/rthrottle"
+	"github.com/nickw444/miio-go/protocol/devicecache"
+	protocolMocks "github.com/nickw444/miio-go/protocol/mocks"
+	"github.com/nickw444/miio-go/protocol/tokens"
+	"github.com/nickw444/miio-go/protocol/transport"
+	"github.com/nickw444/miio-go/subscription"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDefaultOptions(t *testing.T) {
+	o := defaultOptions()
+	assert.Equal(t, DefaultTokenFile, o.tokenFile)
+	assert.Equal(t, DefaultDiscoveryInterval, o.discoveryInterval)
+	assert.Equal(t, DefaultExpiryMultiplier, o.expiryMultiplier)
+}
+
+// Options are applied in order.
+func TestOptions(t *testing.T) {
+	store := tokens.New()
+	policy := transport.RetryPolicy{MaxRetries: 1, Timeout: time.Second}
+
+	o := defaultOptions()
+	for _, opt := range []Option{
+		WithTokenStore(store),
+		WithBroadcastIPs(net.IPv4(10, 0, 0, 255), net.IPv4(10, 0, 1, 255)),
+		WithListenPort(1234),
+		WithDiscoveryInterval(time.Second),
+		WithDiscoveryInterval(time.Minute),
+		WithExpiryMultiplier(3),
+		WithRefreshInterval(time.Second * 2),
+		WithRefreshPolicy(rthrottle.Policy{Interval: time.Second * 3}),
+		WithModelRefreshPolicy("chuangmi.plug.m1", rthrottle.Policy{Interval: time.Minute}),
+		WithDeviceRefreshPolicy(1234, rthrottle.Policy{Interval: time.Second}),
+		WithAlwaysRefresh(),
+		WithConfirmWrites(),
+		WithTransition(capability.Smooth(time.Second)),
+		WithDeviceTransition(1234, capability.Sudden),
+		WithRetryPolicy(policy),
+		WithDeviceCache("devices.json", time.Hour),
+		WithTokenSecret([]byte("secret")),
+		WithTokenSources(tokens.NewEnvSource(tokens.DefaultEnvPrefix)),
+		WithTokenSources(tokens.NewDirSource("/run/secrets")),
+	} {
+		opt(&o)
+	}
+
+	assert.Equal(t, store, o.tokenStore)
+	assert.Len(t, o.broadcastIPs, 2)
+	assert.Equal(t, 1234, o.listenPort)
+	assert.Equal(t, time.Minute, o.discoveryInterval)
+	assert.Equal(t, 3, o.expiryMultiplier)
+	assert.Equal(t, time.Second*2, o.refreshInterval)
+	assert.Equal(t, time.Second*3, o.refreshPolicy.Interval)
+	assert.Equal(t, time.Minute, o.modelPolicies["chuangmi.plug.m1"].Interval)
+	assert.Equal(t, time.Second, o.devicePolicies[1234].Interval)
+	assert.True(t, o.alwaysRefresh)
+	assert.True(t, o.confirmWrites)
+	assert.Equal(t, capability.Smooth(time.Second), o.transition)
+	assert.Equal(t, capability.Sudden, o.deviceTransitions[1234])
+	assert.Equal(t, policy, o.retryPolicy)
+	assert.Equal(t, "devices.json", o.deviceCacheFile)
+	assert.Equal(t, time.Hour, o.deviceCacheMaxAge)
+	assert.Equal(t, []byte("secret"), o.tokenSecret)
+	assert.Len(t, o.tokenSources, 2)
+}
+
+// The expiry time is derived from the discovery interval and multiplier, and
+// offline devices are expired after DefaultOfflineExpiry.
+func TestNewClientWithProtocol_Options(t *testing.T) {
+	p := new(protocolMocks.Protocol)
+	p.On("SetExpiryTime", time.Minute*3).Once()
+	p.On("SetOfflineExpiryTime", DefaultOfflineExpiry).Once()
+	p.On("NewSubscription").Return(subscription.NewTarget().NewSubscription())
+	p.On("Start").Return(nil)
+	p.On("Discover").Return(nil)
+
+	_, err := NewClientWithProtocol(p, WithDiscoveryInterval(0), WithDiscoveryInterval(time.Minute), WithExpiryMultiplier(3))
+	assert.NoError(t, err)
+	p.AssertExpectations(t)
+}
+
+// NewClient creates a working client without touching tokens.txt.
+func TestNewClient(t *testing.T) {
+	client, err := NewClient(
+		WithTokenStore(tokens.New()),
+		WithBroadcastIPs(net.IPv4(127, 0, 0, 1)),
+		WithDiscoveryInterval(0),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, client.Close(context.Background()))
+}
+
+// Cached devices are available as soon as NewClient returns, and the cache is
+// saved on Close.
+func TestNewClient_DeviceCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "miio")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "devices.json")
+
+	cache, err := devicecache.FromFile(path)
+	assert.NoError(t, err)
+	cache.Put(devicecache.Entry{DeviceID: 10, Model: "chuangmi.plug.m1", IP: "127.0.0.1", LastSeen: time.Now()})
+	assert.NoError(t, cache.Save())
+
+	store := tokens.New()
+	store.AddDevice(10, make([]byte, 16))
+	client, err := NewClient(
+		WithTokenStore(store),
+		WithBroadcastIPs(net.IPv4(127, 0, 0, 1)),
+		WithDiscoveryInterval(0),
+		WithDeviceCache(path, 0),
+	)
+	assert.NoError(t, err)
+
+	dev, err := client.Device(10)
+	assert.NoError(t, err)
+	assert.Equal(t, "chuangmi.plug.m1", dev.(device.Device).Info().Model)
+	assert.NoError(t, client.Close(context.Background()))
+
+	cache, err = devicecache.FromFile(path)
+	assert.NoError(t, err)
+	entry, ok := cache.Get(10)
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1", entry.IP)
+}
+
+// Changes to the token file are reloaded and published.
+func TestNewClient_TokenReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "miio")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.txt")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(""), 0600))
+
+	clk := clock.NewMock()
+	client, err := NewClient(
+		WithTokenFile(path),
+		WithTokenReload(time.Second),
+		WithClock(clk),
+		WithBroadcastIPs(net.IPv4(127, 0, 0, 1)),
+		WithDiscoveryInterval(0),
+	)
+	assert.NoError(t, err)
+	defer client.Close(context.Background())
+
+	sub, err := client.NewSubscription()
+	assert.NoError(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("10=ffffffffffffffffffffffffffffffff\n"), 0600))
+	clk.Add(time.Second)
+
+	select {
+	case event := <-sub.Events():
+		assert.Equal(t, common.EventTokenChanged{DeviceID: 10}, event)
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for token change")
+	}
+}
+
+// Tokens added at runtime are written to the token file, so reloading the
+// file keeps them.
+func TestNewClient_AddTokenPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "miio")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.txt")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(""), 0600))
+
+	clk := clock.NewMock()
+	client, err := NewClient(
+		WithTokenFile(path),
+		WithTokenReload(time.Second),
+		WithClock(clk),
+		WithBroadcastIPs(net.IPv4(127, 0, 0, 1)),
+		WithDiscoveryInterval(0),
+	)
+	assert.NoError(t, err)
+	defer client.Close(context.Background())
+
+	sub, err := client.NewSubscription()
+	assert.NoError(t, err)
+
+	token := []byte("0123456789abcdef")
+	assert.NoError(t, client.AddToken(10, token))
+
+	store, err := tokens.FromFile(path)
+	assert.NoError(t, err)
+	stored, err := store.GetToken(10)
+	assert.NoError(t, err)
+	assert.Equal(t, token, stored)
+
+	// Reloading the rewritten file does not remove the token.
+	clk.Add(time.Second)
+	select {
+	case event := <-sub.Events():
+		t.Errorf("Unexpected event %#v", event)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// Discovery is repeated at the discovery interval of the injected clock.
+func TestNewClientWithProtocol_Rediscovery(t *testing.T) {
+	clk := clock.NewMock()
+	p := new(protocolMocks.Protocol)
+	p.On("SetExpiryTime", mock.Anything)
+	p.On("SetOfflineExpiryTime", mock.Anything)
+	p.On("NewSubscription").Return(subscription.NewTarget().NewSubscription())
+	p.On("Start").Return(nil)
+	discovered := make(chan struct{}, 1)
+	p.On("Discover").Return(nil).Run(func(args mock.Arguments) {
+		discovered <- struct{}{}
+	})
+
+	_, err := NewClientWithProtocol(p, WithClock(clk), WithDiscoveryInterval(time.Second*15))
+	assert.NoError(t, err)
+	<-discovered
+
+	clk.Add(time.Second * 14)
+	select {
+	case <-discovered:
+		t.Error("Discovery performed before the interval elapsed")
+	default:
+	}
+
+	clk.Add(time.Second)
+	<-discovered
+	p.AssertNumberOfCalls(t, "Discover", 2)
+}
+
+// A zero offline expiry retains offline devices forever, and negative expiries
+// are rejected.
+func TestNewClientWithProtocol_OfflineExpiry(t *testing.T) {
+	p := new(protocolMocks.Protocol)
+	p.On("SetExpiryTime", mock.Anything)
+	p.On("SetOfflineExpiryTime", time.Duration(0)).Once()
+	p.On("NewSubscription").Return(subscription.NewTarget().NewSubscription())
+	p.On("Start").Return(nil)
+	p.On("Discover").Return(nil)
+
+	_, err := NewClientWithProtocol(p, WithDiscoveryInterval(0), WithOfflineExpiry(0))
+	assert.NoError(t, err)
+	p.AssertExpectations(t)
+
+	_, err = NewClientWithProtocol(new(protocolMocks.Protocol), WithOfflineExpiry(-time.Second))
+	assert.Equal(t, ErrOfflineExpiry, err)
+}
+
+// Devices would expire immediately with an expiry multiplier below 1.
+func TestNewClient_InvalidExpiryMultiplier(t *testing.T) {
+	for _, multiplier := range []int{0, -1} {
+		_, err := NewClientWithProtocol(new(protocolMocks.Protocol), WithExpiryMultiplier(multiplier))
+		assert.Equal(t, ErrExpiryMultiplier, err)
+
+		_, err = NewClient(WithTokenStore(tokens.New()), WithExpiryMultiplier(multiplier))
+		assert.Equal(t, ErrExpiryMultiplier, err)
+	}
+}
+
+func TestNewClient_InvalidRefreshPolicy(t *testing.T) {
+	_, err := NewClientWithProtocol(new(protocolMocks.Protocol), WithRefreshInterval(-time.Second))
+	assert.Equal(t, rthrottle.ErrPolicyInterval, err)
+
+	_, err = NewClientWithProtocol(new(protocolMocks.Protocol),
+		WithRefreshPolicy(rthrottle.Policy{Interval: time.Second, Jitter: 2}))
+	assert.Equal(t, rthrottle.ErrPolicyJitter, err)
+
+	_, err = NewClientWithProtocol(new(protocolMocks.Protocol),
+		WithModelRefreshPolicy("chuangmi.plug.m1", rthrottle.Policy{}))
+	assert.EqualError(t, err, "Invalid refresh policy for model chuangmi.plug.m1: Refresh interval must be positive.")
+
+	_, err = NewClient(WithTokenStore(tokens.New()),
+		WithDeviceRefreshPolicy(1234, rthrottle.Policy{Interval: time.Second, MinInterval: time.Minute}))
+	assert.EqualError(t, err, "Invalid refresh policy for device 1234: Refresh interval must be between the minimum and maximum intervals.")
+}
+
+func TestNewClient_InvalidTransition(t *testing.T) {
+	_, err := NewClientWithProtocol(new(protocolMocks.Protocol),
+		WithTransition(capability.Smooth(time.Millisecond)))
+	assert.Equal(t, capability.ErrTransitionDuration, err)
+
+	_, err = NewClientWithProtocol(new(protocolMocks.Protocol),
+		WithDeviceTransition(1234, capability.Transition{Effect: "fade"}))
+	assert.EqualError(t, err, "Invalid transition for device 1234: Transition effect must be sudden or smooth.")
+}
+
+// Setup errors after the token watcher has started are returned.
+func TestNewClient_CacheError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "miio")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenPath := filepath.Join(dir, "tokens.txt")
+	assert.NoError(t, ioutil.WriteFile(tokenPath, []byte(""), 0600))
+	cachePath := filepath.Join(dir, "devices.json")
+	assert.NoError(t, ioutil.WriteFile(cachePath, []byte("not json"), 0600))
+
+	client, err := NewClient(
+		WithTokenFile(tokenPath),
+		WithTokenReload(time.Second),
+		WithDeviceCache(cachePath, 0),
+	)
+	assert.Error(t, err)
+	assert.Nil(t, client)
+}
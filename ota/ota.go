@@ -0,0 +1,285 @@
+// Package ota installs firmware updates on devices, serving the firmware from
+// an embedded HTTP server.
+package ota
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+	"unicode"
+
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/common"
+	"github.com/nickw444/miio-go/device"
+	"github.com/nickw444/miio-go/protocol/transport"
+)
+
+const (
+	DefaultPollInterval = time.Second * 2
+	DefaultTimeout      = time.Minute * 10
+)
+
+var (
+	ErrModelMismatch = errors.New("Firmware is for a different model.")
+	ErrSameVersion   = errors.New("Device is already running this firmware version.")
+	ErrDowngrade     = errors.New("Firmware is older than the installed version.")
+	ErrNoModel       = errors.New("The model the firmware is for is required.")
+	ErrFailed        = errors.New("Device failed to install the firmware.")
+	ErrTimeout       = errors.New("Timed out whilst waiting for the firmware to install.")
+)
+
+type Config struct {
+	// Firmware is the path to the firmware file.
+	Firmware string
+	// Model is the model the firmware is built for, which must match the
+	// device's model.
+	Model string
+	// Version is the version of the firmware. If set, it is checked against
+	// the installed version before and after the update.
+	Version string
+	// AllowDowngrade allows installing firmware older than the installed
+	// version.
+	AllowDowngrade bool
+	// Force skips the model and version checks.
+	Force bool
+
+	// ListenAddr is the address to serve the firmware on. Defaults to the
+	// local address used to reach the device, with a random port.
+	ListenAddr string
+
+	PollInterval time.Duration
+	Timeout      time.Duration
+	// Clock defaults to the device's clock.
+	Clock clock.Clock
+}
+
+type otaParams struct {
+	Mode    string `json:"mode"`
+	Install string `json:"install"`
+	AppURL  string `json:"app_url"`
+	FileMD5 string `json:"file_md5"`
+	Proc    string `json:"proc"`
+}
+
+type stateResponse struct {
+	Result []common.OTAState `json:"result"`
+}
+
+type progressResponse struct {
+	Result []int `json:"result"`
+}
+
+// Update installs firmware on the device, publishing EventOTAProgress events
+// to the device as the update progresses and EventOTAComplete once done. It
+// blocks until the update has completed, failed or timed out.
+func Update(dev device.Device, config Config) error {
+	if config.PollInterval == 0 {
+		config.PollInterval = DefaultPollInterval
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.Clock == nil {
+		config.Clock = dev.Clock()
+	}
+
+	info, err := dev.GetInfo()
+	if err != nil {
+		return err
+	}
+	if !config.Force {
+		if err := check(info, config); err != nil {
+			return err
+		}
+	}
+
+	listenAddr := config.ListenAddr
+	if listenAddr == "" {
+		listenAddr, err = localAddr(dev.Addr())
+		if err != nil {
+			return err
+		}
+	}
+	s, err := NewServer(config.Firmware, listenAddr)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	common.Log.Infof("Updating device %d from %s to %s using %s", dev.ID(), info.FirmwareVersion,
+		config.Version, s.URL())
+	resp := transport.Response{}
+	err = dev.Outbound().CallAndDeserialize("miIO.ota", otaParams{
+		Mode:    "normal",
+		Install: "1",
+		AppURL:  s.URL(),
+		FileMD5: s.MD5(),
+		Proc:    "dnld install",
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	if !resp.IsOK() {
+		return fmt.Errorf("Device %d rejected the update: %v", dev.ID(), resp.Result)
+	}
+
+	if err := poll(dev, config, info.FirmwareVersion); err != nil {
+		return err
+	}
+
+	info, err = dev.GetInfo()
+	if err != nil {
+		return err
+	}
+	if config.Version != "" && info.FirmwareVersion != config.Version {
+		return fmt.Errorf("Device %d reports firmware version %s after updating, expected %s", dev.ID(),
+			info.FirmwareVersion, config.Version)
+	}
+	common.Log.Infof("Device %d updated to %s", dev.ID(), info.FirmwareVersion)
+	return dev.Publish(common.EventOTAComplete{Device: dev, FirmwareVersion: info.FirmwareVersion})
+}
+
+// check ensures the firmware is suitable for the device.
+func check(info common.DeviceInfo, config Config) error {
+	if config.Model == "" {
+		return ErrNoModel
+	}
+	if info.Model != config.Model {
+		return ErrModelMismatch
+	}
+	if config.Version == "" {
+		return nil
+	}
+	cmp := compareVersions(config.Version, info.FirmwareVersion)
+	if cmp == 0 {
+		return ErrSameVersion
+	}
+	if cmp < 0 && !config.AllowDowngrade {
+		return ErrDowngrade
+	}
+	return nil
+}
+
+// poll waits for the device to download and install the firmware. Devices
+// reboot whilst installing, so calls which fail are retried until the
+// timeout. The update is complete once the device is idle after downloading
+// or installing, or once it reports a firmware version other than the
+// previous version, in case it finished between polls.
+func poll(dev device.Device, config Config, previousVersion string) error {
+	ticker := config.Clock.Ticker(config.PollInterval)
+	defer ticker.Stop()
+	timeout := config.Clock.After(config.Timeout)
+
+	started := false
+	var lastState common.OTAState
+	lastProgress := -1
+	for {
+		select {
+		case <-timeout:
+			return ErrTimeout
+		case <-ticker.C:
+		}
+
+		state, progress, err := status(dev)
+		if err != nil {
+			common.Log.Debugf("Unable to get update status of device %d: %s", dev.ID(), err)
+			continue
+		}
+		if state != lastState || progress != lastProgress {
+			lastState, lastProgress = state, progress
+			dev.Publish(common.EventOTAProgress{Device: dev, State: state, Progress: progress})
+		}
+
+		switch state {
+		case common.OTAStateFailed:
+			return ErrFailed
+		case common.OTAStateDownloading, common.OTAStateInstalling:
+			started = true
+		case common.OTAStateIdle:
+			if started {
+				return nil
+			}
+			info, err := dev.GetInfo()
+			if err != nil {
+				common.Log.Debugf("Unable to get firmware version of device %d: %s", dev.ID(), err)
+			} else if info.FirmwareVersion != previousVersion {
+				return nil
+			}
+		}
+	}
+}
+
+func status(dev device.Device) (common.OTAState, int, error) {
+	state := stateResponse{}
+	if err := dev.Outbound().CallAndDeserialize("miIO.get_ota_state", nil, &state); err != nil {
+		return "", 0, err
+	}
+	progress := progressResponse{}
+	if err := dev.Outbound().CallAndDeserialize("miIO.get_ota_progress", nil, &progress); err != nil {
+		return "", 0, err
+	}
+	if len(state.Result) == 0 || len(progress.Result) == 0 {
+		return "", 0, errors.New("Empty update status")
+	}
+	return state.Result[0], progress.Result[0], nil
+}
+
+// localAddr returns the local address used to reach the device, with a random
+// port.
+func localAddr(addr net.Addr) (string, error) {
+	if addr == nil {
+		return "", errors.New("Device address is unknown")
+	}
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, "0"), nil
+}
+
+// compareVersions compares firmware versions such as 1.2.4_43 by their
+// numeric components, returning -1, 0 or 1.
+func compareVersions(a string, b string) int {
+	as, bs := versionParts(a), versionParts(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(version string) []int {
+	var parts []int
+	start := -1
+	for i, r := range version + "." {
+		if unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			n, _ := strconv.Atoi(version[start:i])
+			parts = append(parts, n)
+			start = -1
+		}
+	}
+	return parts
+}
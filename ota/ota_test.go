@@ -0,0 +1,203 @@
+package ota
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/common"
+	"github.com/nickw444/miio-go/device"
+	deviceMocks "github.com/nickw444/miio-go/device/mocks"
+	"github.com/nickw444/miio-go/protocol/packet"
+	"github.com/nickw444/miio-go/protocol/transport"
+	transportMocks "github.com/nickw444/miio-go/protocol/transport/mocks"
+	simdevice "github.com/nickw444/miio-go/simulator/device"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const simulatedID = 12341234
+
+var simulatedToken = bytes.Repeat([]byte{0x00, 0xff}, 8)
+
+// Device_SetUp connects a device to a simulated power plug on localhost.
+func Device_SetUp(t *testing.T) (device.Device, func()) {
+	simConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	baseDev, err := simdevice.NewBaseDevice(simulatedID, simulatedToken, true)
+	assert.NoError(t, err)
+	sim := simdevice.NewSimulatedPowerPlug(baseDev)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	tr := transport.NewTransport(conn)
+	crypto, err := packet.NewCrypto(simulatedID, simulatedToken, 0, time.Now(), clock.New())
+	assert.NoError(t, err)
+	dev := device.New(simulatedID, tr.NewOutbound(crypto, simConn.LocalAddr()), time.Now(), simulatedToken)
+
+	quit := make(chan struct{})
+	simDone := make(chan struct{})
+	go func() {
+		simdevice.Serve(simConn, sim, quit)
+		close(simDone)
+	}()
+	go func() {
+		for {
+			select {
+			case <-quit:
+				return
+			case pkt := <-tr.Inbound().Packets():
+				dev.Handle(pkt)
+			}
+		}
+	}()
+
+	return dev, func() {
+		close(quit)
+		<-simDone
+		simConn.Close()
+		tr.Close()
+	}
+}
+
+func Firmware_SetUp(t *testing.T, version string) (string, func()) {
+	dir, err := ioutil.TempDir("", "ota")
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "firmware.bin")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(version+"\n"), 0644))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestUpdate(t *testing.T) {
+	dev, stop := Device_SetUp(t)
+	defer stop()
+	firmware, cleanup := Firmware_SetUp(t, "SIM_1")
+	defer cleanup()
+	sub, err := dev.NewSubscription()
+	assert.NoError(t, err)
+
+	err = Update(dev, Config{
+		Firmware:     firmware,
+		Model:        "chuangmi.plug.m1",
+		Version:      "SIM_1",
+		PollInterval: time.Millisecond * 10,
+	})
+	assert.NoError(t, err)
+
+	info, err := dev.GetInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, "SIM_1", info.FirmwareVersion)
+
+	var events []interface{}
+	for len(sub.Events()) > 0 {
+		events = append(events, <-sub.Events())
+	}
+	assert.Equal(t, []interface{}{
+		common.EventOTAProgress{Device: dev, State: common.OTAStateDownloading, Progress: 25},
+		common.EventOTAProgress{Device: dev, State: common.OTAStateDownloading, Progress: 50},
+		common.EventOTAProgress{Device: dev, State: common.OTAStateDownloading, Progress: 75},
+		common.EventOTAProgress{Device: dev, State: common.OTAStateInstalling, Progress: 100},
+		common.EventOTAProgress{Device: dev, State: common.OTAStateIdle, Progress: 100},
+		common.EventOTAComplete{Device: dev, FirmwareVersion: "SIM_1"},
+	}, events)
+}
+
+func TestUpdate_SafetyChecks(t *testing.T) {
+	dev, stop := Device_SetUp(t)
+	defer stop()
+	firmware, cleanup := Firmware_SetUp(t, "SIM_1")
+	defer cleanup()
+
+	err := Update(dev, Config{Firmware: firmware, Model: "yeelink.light.color1", Version: "SIM_1"})
+	assert.Equal(t, ErrModelMismatch, err)
+
+	err = Update(dev, Config{Firmware: firmware, Version: "SIM_1"})
+	assert.Equal(t, ErrNoModel, err)
+
+	err = Update(dev, Config{Firmware: firmware, Model: "chuangmi.plug.m1", Version: "SIM_0"})
+	assert.Equal(t, ErrSameVersion, err)
+
+	// Nothing was installed.
+	info, err := dev.GetInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, "SIM_0", info.FirmwareVersion)
+}
+
+// Firmware which fails verification on the device fails the update.
+func TestUpdate_Failed(t *testing.T) {
+	dev, stop := Device_SetUp(t)
+	defer stop()
+
+	s, err := NewServer("ota.go", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer s.Close()
+	resp := transport.Response{}
+	assert.NoError(t, dev.Outbound().CallAndDeserialize("miIO.ota", otaParams{
+		AppURL:  s.URL(),
+		FileMD5: "00000000000000000000000000000000",
+	}, &resp))
+
+	err = poll(dev, Config{PollInterval: time.Millisecond * 10, Timeout: time.Second, Clock: clock.New()}, "SIM_0")
+	assert.Equal(t, ErrFailed, err)
+}
+
+// Devices which finish updating between polls are idle with a new firmware
+// version.
+func TestPoll_VersionChanged(t *testing.T) {
+	dev := new(deviceMocks.Device)
+	outbound := new(transportMocks.Outbound)
+	dev.On("Outbound").Return(outbound)
+	dev.On("Publish", mock.Anything).Return(nil)
+	outbound.On("CallAndDeserialize", "miIO.get_ota_state", nil, mock.Anything).
+		Return(nil).
+		Run(func(args mock.Arguments) {
+			args.Get(2).(*stateResponse).Result = []common.OTAState{common.OTAStateIdle}
+		})
+	outbound.On("CallAndDeserialize", "miIO.get_ota_progress", nil, mock.Anything).
+		Return(nil).
+		Run(func(args mock.Arguments) {
+			args.Get(2).(*progressResponse).Result = []int{0}
+		})
+	dev.On("GetInfo").Return(common.DeviceInfo{FirmwareVersion: "SIM_0"}, nil).Twice()
+	dev.On("GetInfo").Return(common.DeviceInfo{FirmwareVersion: "SIM_1"}, nil).Once()
+
+	err := poll(dev, Config{PollInterval: time.Millisecond * 10, Timeout: time.Second, Clock: clock.New()}, "SIM_0")
+	assert.NoError(t, err)
+	dev.AssertExpectations(t)
+}
+
+func TestCheck(t *testing.T) {
+	info := common.DeviceInfo{Model: "chuangmi.plug.m1", FirmwareVersion: "1.2.4_43"}
+
+	assert.NoError(t, check(info, Config{Model: "chuangmi.plug.m1"}))
+	assert.NoError(t, check(info, Config{Model: "chuangmi.plug.m1", Version: "1.2.4_59"}))
+	assert.Equal(t, ErrDowngrade, check(info, Config{Model: "chuangmi.plug.m1", Version: "1.2.3_60"}))
+	assert.NoError(t, check(info, Config{Model: "chuangmi.plug.m1", Version: "1.2.3_60", AllowDowngrade: true}))
+	assert.Equal(t, ErrSameVersion, check(info, Config{Model: "chuangmi.plug.m1", Version: "1.2.4_43"}))
+}
+
+func TestCompareVersions(t *testing.T) {
+	assert.Equal(t, 0, compareVersions("1.2.4_43", "1.2.4_43"))
+	assert.Equal(t, 1, compareVersions("1.2.10", "1.2.9"))
+	assert.Equal(t, -1, compareVersions("2.0.6_0041", "2.0.6_0100"))
+	assert.Equal(t, 1, compareVersions("1.2.4_1", "1.2.4"))
+}
+
+func TestServer(t *testing.T) {
+	firmware, cleanup := Firmware_SetUp(t, "SIM_1")
+	defer cleanup()
+
+	s, err := NewServer(firmware, "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.Len(t, s.MD5(), 32)
+	assert.Contains(t, s.URL(), "/firmware/"+s.MD5()+".bin")
+
+	_, err = NewServer(filepath.Join(filepath.Dir(firmware), "missing.bin"), "127.0.0.1:0")
+	assert.Error(t, err)
+}
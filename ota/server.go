@@ -0,0 +1,81 @@
+package ota
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Server serves a single firmware file over HTTP for devices to download.
+type Server interface {
+	// URL returns the address devices download the firmware from.
+	URL() string
+	// MD5 returns the hex MD5 of the firmware, which devices use to verify
+	// the download.
+	MD5() string
+	Close() error
+}
+
+type server struct {
+	listener net.Listener
+	firmware []byte
+	md5      string
+	path     string
+
+	closeOnce sync.Once
+}
+
+// NewServer starts serving the firmware file at path on the given listen
+// address, e.g. 192.168.1.10:0. The host must be reachable by the device.
+func NewServer(path string, listenAddr string) (Server, error) {
+	firmware, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(firmware) == 0 {
+		return nil, fmt.Errorf("Firmware file %s is empty", path)
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := md5.Sum(firmware)
+	s := &server{
+		listener: listener,
+		firmware: firmware,
+		md5:      hex.EncodeToString(sum[:]),
+	}
+	s.path = "/firmware/" + s.md5 + ".bin"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(s.path, s.serveFirmware)
+	go http.Serve(listener, mux)
+	return s, nil
+}
+
+func (s *server) URL() string {
+	return "http://" + s.listener.Addr().String() + s.path
+}
+
+func (s *server) MD5() string {
+	return s.md5
+}
+
+func (s *server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.listener.Close()
+	})
+	return err
+}
+
+func (s *server) serveFirmware(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(s.firmware)
+}
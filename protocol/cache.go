@@ -0,0 +1,128 @@
+package protocol
+
+import (
+	"net"
+	"time"
+
+	"github.com/nickw444/miio-go/common"
+	"github.com/nickw444/miio-go/device"
+	"github.com/nickw444/miio-go/protocol/devicecache"
+)
+
+// loadCache prunes stale entries from the device cache and pre-registers the
+// remainder, so that they can be controlled before discovery confirms them.
+// The registered devices are returned so that they can be sent a Hello once
+// the protocol has started.
+func (p *protocol) loadCache(maxAge time.Duration) []device.Device {
+	if p.deviceCache == nil {
+		return nil
+	}
+
+	now := p.clock.Now()
+	for _, entry := range p.deviceCache.Prune(now.Add(maxAge * -1)) {
+		common.Log.Debugf("Pruned device %d from cache, last seen %s", entry.DeviceID, entry.LastSeen)
+	}
+
+	var devices []device.Device
+	for _, entry := range p.deviceCache.Entries() {
+		dev, err := p.registerCached(entry, now)
+		if err != nil {
+			common.Log.Warnf("Unable to register cached device %d: %s", entry.DeviceID, err)
+			p.deviceCache.Remove(entry.DeviceID)
+			continue
+		}
+		if dev != nil {
+			devices = append(devices, dev)
+		}
+	}
+	p.saveCache()
+	return devices
+}
+
+// registerCached creates and classifies a device from a cache entry. Devices
+// without a token in the token store are skipped, returning nil. The device
+// keeps the entry's last seen time until it responds.
+func (p *protocol) registerCached(entry devicecache.Entry, now time.Time) (device.Device, error) {
+	token, err := p.tokenStore.GetToken(entry.DeviceID)
+	if err != nil {
+		common.Log.Debugf("No token for cached device %d, waiting for discovery", entry.DeviceID)
+		return nil, nil
+	}
+
+	ip := net.ParseIP(entry.IP)
+	if ip == nil {
+		return nil, errInvalidCacheIP
+	}
+
+	// The stamp is unknown until the device responds to a Hello, at which
+	// point the outbound resynchronises it.
+	crypto, err := p.cryptoFactory(entry.DeviceID, token, 0, now)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := &net.UDPAddr{IP: ip, Port: DefaultBroadcastPort}
+	baseDev := p.deviceFactory(entry.DeviceID, p.transport.NewOutbound(crypto, addr), entry.LastSeen, token)
+	baseDev.SetInfo(common.DeviceInfo{
+		Model:           entry.Model,
+		MacAddress:      entry.MacAddress,
+		FirmwareVersion: entry.FirmwareVersion,
+	})
+	p.applyMetadata(baseDev)
+
+	dev, err := device.Classify(baseDev)
+	if err != nil {
+		baseDev.Close()
+		return nil, err
+	}
+
+	common.Log.Infof("Registered cached device %d (%s) at %s", entry.DeviceID, entry.Model, addr)
+	p.addDevice(dev)
+	return dev, nil
+}
+
+// cacheDevice records the device in the device cache and saves it.
+func (p *protocol) cacheDevice(dev device.Device) {
+	if p.deviceCache == nil {
+		return
+	}
+	p.deviceCache.Put(cacheEntry(dev))
+	p.saveCache()
+}
+
+// cacheAllDevices records every classified device seen since the protocol
+// started in the device cache and saves it, refreshing their last seen times.
+// Entries for devices which were not seen are left as they were, so that they
+// are eventually pruned.
+func (p *protocol) cacheAllDevices() {
+	if p.deviceCache == nil {
+		return
+	}
+	for _, dev := range p.Devices() {
+		if !dev.Provisional() && !dev.Seen().Before(p.startedAt) {
+			p.deviceCache.Put(cacheEntry(dev))
+		}
+	}
+	p.saveCache()
+}
+
+func (p *protocol) saveCache() {
+	if err := p.deviceCache.Save(); err != nil {
+		common.Log.Warnf("Unable to save device cache: %s", err)
+	}
+}
+
+func cacheEntry(dev device.Device) devicecache.Entry {
+	info := dev.Info()
+	entry := devicecache.Entry{
+		DeviceID:        dev.ID(),
+		Model:           info.Model,
+		MacAddress:      info.MacAddress,
+		FirmwareVersion: info.FirmwareVersion,
+		LastSeen:        dev.Seen(),
+	}
+	if addr, ok := dev.Addr().(*net.UDPAddr); ok {
+		entry.IP = addr.IP.String()
+	}
+	return entry
+}
@@ -0,0 +1,155 @@
+package devicecache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nickw444/miio-go/common"
+)
+
+// Entry records what was last known about a device, allowing it to be
+// contacted before it has been rediscovered.
+type Entry struct {
+	DeviceID        uint32    `json:"id"`
+	Model           string    `json:"model"`
+	IP              string    `json:"ip"`
+	MacAddress      string    `json:"mac"`
+	FirmwareVersion string    `json:"fw_ver"`
+	LastSeen        time.Time `json:"last_seen"`
+}
+
+// DeviceCache persists known devices between runs. Tokens are not cached;
+// they remain in the TokenStore.
+type DeviceCache interface {
+	LoadFile(inputPath string) error
+	WriteFile(outputPath string) error
+	// Save writes the cache back to the file it was loaded from. It is a
+	// no-op for caches not backed by a file.
+	Save() error
+	Entries() []Entry
+	Get(deviceId uint32) (Entry, bool)
+	Put(entry Entry)
+	Remove(deviceId uint32)
+	// Prune removes all entries last seen before the cutoff, returning them.
+	Prune(cutoff time.Time) []Entry
+}
+
+type deviceCache struct {
+	mutex     sync.RWMutex
+	saveMutex sync.Mutex
+	path      string
+	entries   map[uint32]Entry
+}
+
+func New() DeviceCache {
+	return &deviceCache{
+		entries: make(map[uint32]Entry),
+	}
+}
+
+// FromFile loads a cache from the given path, which is also used by Save. A
+// missing file results in an empty cache.
+func FromFile(filePath string) (DeviceCache, error) {
+	cache := &deviceCache{
+		path:    filePath,
+		entries: make(map[uint32]Entry),
+	}
+	err := cache.LoadFile(filePath)
+	return cache, err
+}
+
+func (c *deviceCache) LoadFile(inputPath string) error {
+	data, err := ioutil.ReadFile(inputPath)
+	if os.IsNotExist(err) {
+		// File doesn't exist, so don't load anything.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	for _, entry := range entries {
+		c.entries[entry.DeviceID] = entry
+	}
+	c.mutex.Unlock()
+	return nil
+}
+
+// WriteFile writes the cache atomically, so that a crash part way through does
+// not corrupt the existing cache.
+func (c *deviceCache) WriteFile(outputPath string) error {
+	// Serialise writes so that the most recent entries are written last.
+	c.saveMutex.Lock()
+	defer c.saveMutex.Unlock()
+
+	data, err := json.MarshalIndent(c.Entries(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return common.WriteFileAtomic(outputPath, data, 0600)
+}
+
+func (c *deviceCache) Save() error {
+	if c.path == "" {
+		return nil
+	}
+	return c.WriteFile(c.path)
+}
+
+// Entries returns all entries ordered by device ID.
+func (c *deviceCache) Entries() []Entry {
+	c.mutex.RLock()
+	entries := make([]Entry, 0, len(c.entries))
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	c.mutex.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeviceID < entries[j].DeviceID
+	})
+	return entries
+}
+
+func (c *deviceCache) Get(deviceId uint32) (Entry, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	entry, ok := c.entries[deviceId]
+	return entry, ok
+}
+
+func (c *deviceCache) Put(entry Entry) {
+	c.mutex.Lock()
+	c.entries[entry.DeviceID] = entry
+	c.mutex.Unlock()
+}
+
+func (c *deviceCache) Remove(deviceId uint32) {
+	c.mutex.Lock()
+	delete(c.entries, deviceId)
+	c.mutex.Unlock()
+}
+
+func (c *deviceCache) Prune(cutoff time.Time) []Entry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var pruned []Entry
+	for id, entry := range c.entries {
+		if entry.LastSeen.Before(cutoff) {
+			pruned = append(pruned, entry)
+			delete(c.entries, id)
+		}
+	}
+	return pruned
+}
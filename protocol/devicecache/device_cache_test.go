@@ -0,0 +1,70 @@
+package devicecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromFile(t *testing.T) {
+	cache, err := FromFile("devices.example.json")
+	assert.NoError(t, err)
+
+	entry, ok := cache.Get(123456)
+	assert.True(t, ok)
+	assert.Equal(t, "yeelink.light.color1", entry.Model)
+	assert.Equal(t, "192.168.1.10", entry.IP)
+	assert.Len(t, cache.Entries(), 2)
+}
+
+// A missing file results in an empty cache.
+func TestFromFile2(t *testing.T) {
+	cache, err := FromFile("does-not-exist.json")
+	assert.NoError(t, err)
+	assert.Empty(t, cache.Entries())
+}
+
+// Entries survive a round trip through Save.
+func TestSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "devicecache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "devices.json")
+
+	cache, err := FromFile(path)
+	assert.NoError(t, err)
+	seen := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.Put(Entry{DeviceID: 2, Model: "chuangmi.plug.m1", LastSeen: seen})
+	cache.Put(Entry{DeviceID: 1, Model: "yeelink.light.color1", LastSeen: seen})
+	assert.NoError(t, cache.Save())
+
+	loaded, err := FromFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, cache.Entries(), loaded.Entries())
+	assert.Equal(t, uint32(1), loaded.Entries()[0].DeviceID)
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1, "Temporary file was not cleaned up")
+}
+
+// Prune removes entries last seen before the cutoff.
+func TestPrune(t *testing.T) {
+	cache := New()
+	now := time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC)
+	cache.Put(Entry{DeviceID: 1, LastSeen: now.Add(-time.Hour * 24 * 8)})
+	cache.Put(Entry{DeviceID: 2, LastSeen: now.Add(-time.Hour)})
+
+	pruned := cache.Prune(now.Add(-time.Hour * 24 * 7))
+	assert.Len(t, pruned, 1)
+	assert.Equal(t, uint32(1), pruned[0].DeviceID)
+
+	_, ok := cache.Get(1)
+	assert.False(t, ok)
+	_, ok = cache.Get(2)
+	assert.True(t, ok)
+}
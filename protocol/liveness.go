@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"time"
+
+	"github.com/nickw444/miio-go/common"
+	"github.com/nickw444/miio-go/device"
+)
+
+// checkLiveness probes devices which have not been seen within the expiry
+// time. A suspect device is pinged directly; if it still has not responded by
+// the next check it is marked offline. Offline devices keep their identity
+// and subscriptions, and are marked online again as soon as they respond.
+// They are only expired if an offline expiry time has been set.
+func (p *protocol) checkLiveness(now time.Time) {
+	cutoff := now.Add(p.expireAfter * -1)
+
+	for _, dev := range p.Devices() {
+		if dev.Provisional() || !dev.Seen().Before(cutoff) {
+			continue
+		}
+
+		if !dev.Online() {
+			if p.offlineExpireAfter > 0 && dev.Seen().Before(now.Add(p.offlineExpireAfter*-1)) {
+				p.expireDevice(dev)
+				continue
+			}
+			p.ping(dev, now)
+			continue
+		}
+
+		p.livenessMutex.Lock()
+		pingedAt, pinged := p.pings[dev.ID()]
+		p.livenessMutex.Unlock()
+
+		if pinged && dev.Seen().Before(pingedAt) {
+			p.markOffline(dev)
+			continue
+		}
+		p.ping(dev, now)
+	}
+}
+
+func (p *protocol) ping(dev device.Device, now time.Time) {
+	common.Log.Debugf("Device %d is stale. Last Seen at %s. Pinging.", dev.ID(), dev.Seen())
+	p.livenessMutex.Lock()
+	p.pings[dev.ID()] = now
+	p.livenessMutex.Unlock()
+
+	p.solicit()
+	if err := dev.Discover(); err != nil {
+		common.Log.Warnf("Unable to ping device %d: %s", dev.ID(), err)
+	}
+}
+
+func (p *protocol) markOffline(dev device.Device) {
+	p.livenessMutex.Lock()
+	wasOnline := dev.Online()
+	dev.SetOnline(false)
+	p.livenessMutex.Unlock()
+
+	if wasOnline {
+		common.Log.Infof("Device %d did not respond to ping and is now offline.", dev.ID())
+		if err := p.Publish(common.EventDeviceOffline{Device: dev}); err != nil {
+			common.Log.Warn(err)
+		}
+	}
+}
+
+// markSeen records that a device has responded, bringing it back online if
+// it was offline.
+func (p *protocol) markSeen(dev device.Device) {
+	p.livenessMutex.Lock()
+	delete(p.pings, dev.ID())
+	wasOnline := dev.Online()
+	dev.SetOnline(true)
+	p.livenessMutex.Unlock()
+
+	if !wasOnline {
+		common.Log.Infof("Device %d is back online.", dev.ID())
+		if err := p.Publish(common.EventDeviceOnline{Device: dev}); err != nil {
+			common.Log.Warn(err)
+		}
+	}
+}
+
+func (p *protocol) expireDevice(dev device.Device) {
+	common.Log.Debugf("Removing expired device with id %d.", dev.ID())
+	p.removeDevice(dev.ID())
+	p.livenessMutex.Lock()
+	delete(p.pings, dev.ID())
+	p.livenessMutex.Unlock()
+
+	dev.Close()
+	if err := p.Publish(common.EventExpiredDevice{Device: dev}); err != nil {
+		common.Log.Warn(err)
+	}
+}
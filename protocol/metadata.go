@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"net"
+
+	"github.com/nickw444/miio-go/common"
+	"github.com/nickw444/miio-go/device"
+	"github.com/nickw444/miio-go/protocol/tokens"
+)
+
+// staticIPs returns the static IPs of devices in the token store, which are
+// sent discovery packets directly in addition to the broadcast addresses.
+func staticIPs(store tokens.TokenStore) []net.IP {
+	var ips []net.IP
+	for _, deviceId := range store.Devices() {
+		staticIP := store.GetMetadata(deviceId).StaticIP
+		if staticIP == "" {
+			continue
+		}
+		ip := net.ParseIP(staticIP)
+		if ip == nil {
+			common.Log.Warnf("Ignoring invalid static IP %q for device %d", staticIP, deviceId)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// applyMetadata labels a new device and applies any model override from the
+// token store, before the device is classified.
+func (p *protocol) applyMetadata(dev device.Device) {
+	metadata := p.tokenStore.GetMetadata(dev.ID())
+	if metadata.Name != "" {
+		dev.SetLabel(metadata.Name)
+	}
+	if metadata.Model == "" {
+		return
+	}
+
+	info := dev.Info()
+	if info.Model == "" {
+		// Overriding the model skips miIO.info during classification, so
+		// fetch the rest of the info now.
+		fetched, err := dev.GetInfo()
+		if err != nil {
+			common.Log.Warnf("Unable to get info for device %d: %s", dev.ID(), err)
+		} else {
+			info = fetched
+		}
+	}
+	common.Log.Debugf("Overriding model of device %d from %q to %q", dev.ID(), info.Model, metadata.Model)
+	info.Model = metadata.Model
+	dev.SetInfo(info)
+}
@@ -3,7 +3,14 @@
 package mocks
 
 import (
+	context "context"
+
+	device "github.com/nickw444/miio-go/device"
+
+	tokens "github.com/nickw444/miio-go/protocol/tokens"
+
 	common "github.com/nickw444/miio-go/subscription/common"
+
 	mock "github.com/stretchr/testify/mock"
 
 	time "time"
@@ -14,6 +21,48 @@ type Protocol struct {
 	mock.Mock
 }
 
+// AddToken provides a mock function with given fields: deviceID, token
+func (_m *Protocol) AddToken(deviceID uint32, token []byte) error {
+	ret := _m.Called(deviceID, token)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(uint32, []byte) error); ok {
+		r0 = rf(deviceID, token)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// ApplyTokenChange provides a mock function with given fields: change
+func (_m *Protocol) ApplyTokenChange(change tokens.Change) error {
+	ret := _m.Called(change)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(tokens.Change) error); ok {
+		r0 = rf(change)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Close provides a mock function with given fields:
+func (_m *Protocol) Close() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // CloseAllSubscriptions provides a mock function with given fields:
 func (_m *Protocol) CloseAllSubscriptions() error {
 	ret := _m.Called()
@@ -28,6 +77,38 @@ func (_m *Protocol) CloseAllSubscriptions() error {
 	return r0
 }
 
+// Device provides a mock function with given fields: id
+func (_m *Protocol) Device(id uint32) device.Device {
+	ret := _m.Called(id)
+
+	var r0 device.Device
+	if rf, ok := ret.Get(0).(func(uint32) device.Device); ok {
+		r0 = rf(id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(device.Device)
+		}
+	}
+
+	return r0
+}
+
+// Devices provides a mock function with given fields:
+func (_m *Protocol) Devices() []device.Device {
+	ret := _m.Called()
+
+	var r0 []device.Device
+	if rf, ok := ret.Get(0).(func() []device.Device); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]device.Device)
+		}
+	}
+
+	return r0
+}
+
 // Discover provides a mock function with given fields:
 func (_m *Protocol) Discover() error {
 	ret := _m.Called()
@@ -42,6 +123,20 @@ func (_m *Protocol) Discover() error {
 	return r0
 }
 
+// Drain provides a mock function with given fields: ctx
+func (_m *Protocol) Drain(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // HasSubscribers provides a mock function with given fields:
 func (_m *Protocol) HasSubscribers() bool {
 	ret := _m.Called()
@@ -111,3 +206,22 @@ func (_m *Protocol) RemoveSubscription(s common.Subscription) error {
 func (_m *Protocol) SetExpiryTime(duration time.Duration) {
 	_m.Called(duration)
 }
+
+// SetOfflineExpiryTime provides a mock function with given fields: duration
+func (_m *Protocol) SetOfflineExpiryTime(duration time.Duration) {
+	_m.Called(duration)
+}
+
+// Start provides a mock function with given fields:
+func (_m *Protocol) Start() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/cipher"
 	"crypto/md5"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/benbjohnson/clock"
@@ -16,6 +17,11 @@ type Crypto interface {
 	Decrypt(data []byte) ([]byte, error)
 	Encrypt(data []byte) ([]byte, error)
 	NewPacket(data []byte) (*Packet, error)
+	// SyncStamp resets the stamp used for new packets to one received from
+	// the device at the given time.
+	SyncStamp(stamp uint32, stampTime time.Time)
+	// DeviceID returns the ID of the device packets are created for.
+	DeviceID() uint32
 }
 
 type crypto struct {
@@ -23,6 +29,7 @@ type crypto struct {
 	key          []byte
 	deviceId     uint32
 	deviceToken  []byte
+	stampMutex   sync.RWMutex
 	initialStamp uint32
 	stampTime    time.Time
 	clock        clock.Clock
@@ -92,7 +99,20 @@ func (c *crypto) Encrypt(data []byte) ([]byte, error) {
 	return encrypted, nil
 }
 
+func (c *crypto) SyncStamp(stamp uint32, stampTime time.Time) {
+	c.stampMutex.Lock()
+	c.initialStamp = stamp
+	c.stampTime = stampTime
+	c.stampMutex.Unlock()
+}
+
+func (c *crypto) DeviceID() uint32 {
+	return c.deviceId
+}
+
 func (c *crypto) getStamp() uint32 {
+	c.stampMutex.RLock()
+	defer c.stampMutex.RUnlock()
 	return uint32(c.clock.Now().Sub(c.stampTime).Seconds()) + c.initialStamp
 }
 
@@ -3,7 +3,9 @@ package packet
 import (
 	"bytes"
 	"testing"
+	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -42,3 +44,34 @@ func TestPkcs5Unpad2(t *testing.T) {
 	assert.Len(t, result, 15)
 	assert.Equal(t, data, result)
 }
+
+// Stamps advance with the clock from the time of the initial stamp.
+func TestCrypto_NewPacketStamp(t *testing.T) {
+	clk := clock.NewMock()
+	c, err := NewCrypto(10, bytes.Repeat([]byte{0xff}, 16), 1000, clk.Now(), clk)
+	assert.NoError(t, err)
+
+	pkt, err := c.NewPacket([]byte("{}"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1000), pkt.Header.Stamp)
+
+	clk.Add(time.Second * 90)
+	pkt, err = c.NewPacket([]byte("{}"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1090), pkt.Header.Stamp)
+}
+
+// SyncStamp restarts stamps from the synchronised value.
+func TestCrypto_SyncStamp(t *testing.T) {
+	clk := clock.NewMock()
+	c, err := NewCrypto(10, bytes.Repeat([]byte{0xff}, 16), 0, clk.Now(), clk)
+	assert.NoError(t, err)
+
+	clk.Add(time.Second * 30)
+	c.SyncStamp(5000, clk.Now())
+	clk.Add(time.Second * 10)
+
+	pkt, err := c.NewPacket([]byte("{}"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(5010), pkt.Header.Stamp)
+}
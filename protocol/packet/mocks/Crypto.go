@@ -4,7 +4,10 @@ package mocks
 
 import (
 	packet "github.com/nickw444/miio-go/protocol/packet"
+
 	mock "github.com/stretchr/testify/mock"
+
+	time "time"
 )
 
 // Crypto is an autogenerated mock type for the Crypto type
@@ -35,6 +38,20 @@ func (_m *Crypto) Decrypt(data []byte) ([]byte, error) {
 	return r0, r1
 }
 
+// DeviceID provides a mock function with given fields:
+func (_m *Crypto) DeviceID() uint32 {
+	ret := _m.Called()
+
+	var r0 uint32
+	if rf, ok := ret.Get(0).(func() uint32); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(uint32)
+	}
+
+	return r0
+}
+
 // Encrypt provides a mock function with given fields: data
 func (_m *Crypto) Encrypt(data []byte) ([]byte, error) {
 	ret := _m.Called(data)
@@ -81,6 +98,11 @@ func (_m *Crypto) NewPacket(data []byte) (*packet.Packet, error) {
 	return r0, r1
 }
 
+// SyncStamp provides a mock function with given fields: stamp, stampTime
+func (_m *Crypto) SyncStamp(stamp uint32, stampTime time.Time) {
+	_m.Called(stamp, stampTime)
+}
+
 // VerifyPacket provides a mock function with given fields: pkt
 func (_m *Crypto) VerifyPacket(pkt *packet.Packet) error {
 	ret := _m.Called(pkt)
@@ -14,6 +14,11 @@ import (
 
 const checksumLengthBytes = 16
 
+// strucOptions are passed to struc rather than its default options, which it
+// modifies on every call and so races between goroutines. Setting PtrSize
+// leaves nothing for struc to fill in.
+var strucOptions = &struc.Options{PtrSize: 32}
+
 // See https://github.com/OpenMiHome/mihome-binary-protocol/blob/master/doc/PROTOCOL.md for
 // documentation
 type Header struct {
@@ -39,7 +44,7 @@ type Packet struct {
 
 func (p *Packet) Serialize() []byte {
 	var buf bytes.Buffer
-	err := struc.Pack(&buf, &p.Header)
+	err := struc.PackWithOptions(&buf, &p.Header, strucOptions)
 	if err != nil {
 		panic(err)
 	}
@@ -99,9 +104,14 @@ func (p *Packet) Verify(deviceToken []byte) error {
 }
 
 func Decode(data []byte, addr *net.UDPAddr) (*Packet, error) {
-	meta := Meta{DecodeTime: time.Now(), Addr: addr}
+	return DecodeAt(data, addr, time.Now())
+}
+
+// DecodeAt decodes a packet, recording decodeTime as the time it was received.
+func DecodeAt(data []byte, addr *net.UDPAddr, decodeTime time.Time) (*Packet, error) {
+	meta := Meta{DecodeTime: decodeTime, Addr: addr}
 	header := Header{}
-	struc.Unpack(bytes.NewBuffer(data[:32]), &header)
+	struc.UnpackWithOptions(bytes.NewBuffer(data[:32]), &header, strucOptions)
 
 	p := &Packet{
 		Meta:   meta,
@@ -1,13 +1,21 @@
 package protocol
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/capability"
 	"github.com/nickw444/miio-go/common"
 	"github.com/nickw444/miio-go/device"
+	"github.com/nickw444/miio-go/device/rthrottle"
+	"github.com/nickw444/miio-go/protocol/devicecache"
 	"github.com/nickw444/miio-go/protocol/packet"
 	"github.com/nickw444/miio-go/protocol/tokens"
 	"github.com/nickw444/miio-go/protocol/transport"
@@ -17,23 +25,78 @@ import (
 type Protocol interface {
 	subscription.SubscriptionTarget
 
+	// Start announces devices registered from the device cache and sends
+	// them a Hello to confirm them. It should be called once, after
+	// subscribing and before the first Discover.
+	Start() error
 	Discover() error
+	// SetExpiryTime sets how long a device may go unseen before it is pinged
+	// and, if it does not respond, marked offline.
 	SetExpiryTime(duration time.Duration)
+	// SetOfflineExpiryTime sets how long a device may go unseen before it is
+	// removed entirely. Zero, the default, retains offline devices forever.
+	SetOfflineExpiryTime(duration time.Duration)
+	// Devices returns all devices currently known to the protocol.
+	Devices() []device.Device
+	// Device returns the device with the given ID, or nil if it is unknown.
+	Device(id uint32) device.Device
+	// AddToken adds a device token to the token store. If the device was
+	// previously ignored for hiding its token, it is handshaken with
+	// immediately so that it can be classified without waiting for discovery.
+	AddToken(deviceID uint32, token []byte) error
+	// ApplyTokenChange applies a change from reloading the token store. Known
+	// devices whose token changed are rekeyed, and ignored devices which now
+	// have a token are handshaken with.
+	ApplyTokenChange(change tokens.Change) error
+	// Drain blocks until in-flight packet processing and calls have completed
+	// or the context is done. It should be called after discovery has
+	// stopped and before Close.
+	Drain(ctx context.Context) error
+	// Close stops processing packets, closes every known device and
+	// releases the underlying transport.
+	Close() error
 }
 
+var (
+	ErrClosed       = errors.New("Protocol is already closed.")
+	ErrInvalidToken = errors.New("Device tokens must be 16 bytes.")
+
+	errInvalidCacheIP = errors.New("Invalid IP address in device cache")
+)
+
 type protocol struct {
 	subscription.SubscriptionTarget
-	port          int
-	expireAfter   time.Duration
-	clock         clock.Clock
-	lastDiscovery time.Time
-	tokenStore    tokens.TokenStore
-
-	broadcastDev   device.Device
-	quitChan       chan struct{}
+	port               int
+	expireAfter        time.Duration
+	offlineExpireAfter time.Duration
+	clock              clock.Clock
+	lastDiscovery      time.Time
+	startedAt          time.Time
+	tokenStore         tokens.TokenStore
+	deviceCache        devicecache.DeviceCache
+
+	broadcastDevs []device.Device
+	cachedDevs    []device.Device
+	quitChan      chan struct{}
+	startOnce     sync.Once
+	closeOnce     sync.Once
+	dispatcherWg  sync.WaitGroup
+	// Tracks packets being processed so that they can be drained. A
+	// WaitGroup can't be used as packets keep arriving whilst draining.
+	processMutex   sync.Mutex
+	processing     int
+	processIdle    chan struct{}
 	devicesMutex   sync.RWMutex
 	devices        map[uint32]device.Device
-	ignoredDevices map[uint32]bool
+	ignoredMutex   sync.Mutex
+	ignoredDevices map[uint32]net.Addr
+	livenessMutex  sync.Mutex
+	addrMutex      sync.Mutex
+	pings          map[uint32]time.Time
+	// discoveredAt is when a Hello was last sent, either broadcast by
+	// discovery or directly to a device. Hello responses, which cannot be
+	// verified, are only trusted shortly afterwards.
+	discoveredAt time.Time
 
 	transport     transport.Transport
 	deviceFactory DeviceFactory
@@ -43,17 +106,63 @@ type protocol struct {
 type DeviceFactory func(deviceId uint32, outbound transport.Outbound, seen time.Time, token []byte) device.Device
 type CryptoFactory func(deviceID uint32, deviceToken []byte, initialStamp uint32, stampTime time.Time) (packet.Crypto, error)
 
+const (
+	DefaultBroadcastPort     = transport.DevicePort
+	DefaultDeviceCacheMaxAge = time.Hour * 24 * 7
+
+	// helloResponseWindow is how long after discovery Hello responses are
+	// trusted to report a device's address and stamp.
+	helloResponseWindow = time.Second * 5
+)
+
 type ProtocolConfig struct {
 	// Required config
-	BroadcastIP net.IP
+	BroadcastIP net.IP // May be omitted if BroadcastIPs is provided.
 	TokenStore  tokens.TokenStore
 
 	// Optional config
-	ListenPort int // Defaults to a random system-assigned port if not provided.
+	ListenPort      int                   // Defaults to a random system-assigned port if not provided.
+	BroadcastIPs    []net.IP              // Additional addresses to send discovery packets to.
+	RefreshInterval time.Duration         // Defaults to device.DefaultRefreshInterval.
+	RefreshPolicy   rthrottle.Policy      // Defaults to device.DefaultRefreshPolicy.
+	RetryPolicy     transport.RetryPolicy // Defaults to transport.DefaultRetryPolicy.
+	Clock           clock.Clock           // Defaults to the system clock.
+
+	// ModelRefreshPolicies and DeviceRefreshPolicies override RefreshPolicy
+	// by model name and device ID respectively.
+	ModelRefreshPolicies  map[string]rthrottle.Policy
+	DeviceRefreshPolicies map[uint32]rthrottle.Policy
+	// AlwaysRefresh polls devices even when they have no subscribers.
+	AlwaysRefresh bool
+	// ConfirmWrites reads back properties after writing them.
+	ConfirmWrites bool
+	// Transition is the default transition for light commands, and
+	// DeviceTransitions override it by device ID.
+	Transition        capability.Transition
+	DeviceTransitions map[uint32]capability.Transition
+
+	// DeviceCache persists known devices between runs. Cached devices with a
+	// token in the TokenStore are registered at startup, before discovery.
+	DeviceCache       devicecache.DeviceCache
+	DeviceCacheMaxAge time.Duration // Defaults to DefaultDeviceCacheMaxAge.
 }
 
 func NewProtocol(c ProtocolConfig) (Protocol, error) {
-	clk := clock.New()
+	clk := c.Clock
+	if clk == nil {
+		clk = clock.New()
+	}
+
+	var broadcastIPs []net.IP
+	if c.BroadcastIP != nil {
+		broadcastIPs = append(broadcastIPs, c.BroadcastIP)
+	}
+	broadcastIPs = append(broadcastIPs, c.BroadcastIPs...)
+	if len(broadcastIPs) == 0 {
+		return nil, fmt.Errorf("At least one broadcast IP must be provided")
+	}
+	broadcastIPs = append(broadcastIPs, staticIPs(c.TokenStore)...)
+
 	var listenAddr *net.UDPAddr
 	if c.ListenPort != 0 {
 		listenAddr = &net.UDPAddr{Port: c.ListenPort}
@@ -64,27 +173,50 @@ func NewProtocol(c ProtocolConfig) (Protocol, error) {
 		return nil, err
 	}
 
-	t := transport.NewTransport(s)
+	t := transport.NewTransportWithConfig(s, transport.Config{RetryPolicy: c.RetryPolicy, Clock: clk})
+	deviceConfig := device.Config{
+		RefreshInterval:       c.RefreshInterval,
+		RefreshPolicy:         c.RefreshPolicy,
+		ModelRefreshPolicies:  c.ModelRefreshPolicies,
+		DeviceRefreshPolicies: c.DeviceRefreshPolicies,
+		AlwaysRefresh:         c.AlwaysRefresh,
+		ConfirmWrites:         c.ConfirmWrites,
+		Transition:            c.Transition,
+		DeviceTransitions:     c.DeviceTransitions,
+		Clock:                 clk,
+	}
 	deviceFactory := func(deviceId uint32, outbound transport.Outbound, seen time.Time, token []byte) device.Device {
-		return device.New(deviceId, outbound, seen, token)
+		return device.NewWithConfig(deviceId, outbound, seen, token, deviceConfig)
 	}
 	cryptoFactory := func(deviceID uint32, deviceToken []byte, initialStamp uint32, stampTime time.Time) (packet.Crypto, error) {
 		return packet.NewCrypto(deviceID, deviceToken, initialStamp, stampTime, clk)
 	}
 
-	addr := &net.UDPAddr{
-		IP:   c.BroadcastIP,
-		Port: 54321,
+	var broadcastDevs []device.Device
+	for _, ip := range broadcastIPs {
+		addr := &net.UDPAddr{
+			IP:   ip,
+			Port: DefaultBroadcastPort,
+		}
+		broadcastDevs = append(broadcastDevs, deviceFactory(0, t.NewOutbound(nil, addr), time.Time{}, nil))
+	}
+
+	p := newProtocol(clk, t, deviceFactory, cryptoFactory, subscription.NewTargetWithClock(clk), broadcastDevs,
+		c.TokenStore)
+	p.deviceCache = c.DeviceCache
+
+	maxAge := c.DeviceCacheMaxAge
+	if maxAge == 0 {
+		maxAge = DefaultDeviceCacheMaxAge
 	}
-	broadcastDev := deviceFactory(0, t.NewOutbound(nil, addr), time.Time{}, nil)
+	p.cachedDevs = p.loadCache(maxAge)
 
-	p := newProtocol(clk, t, deviceFactory, cryptoFactory, subscription.NewTarget(), broadcastDev, c.TokenStore)
 	p.start()
 	return p, nil
 }
 
 func newProtocol(c clock.Clock, transport transport.Transport, deviceFactory DeviceFactory,
-	crptoFactory CryptoFactory, target subscription.SubscriptionTarget, broadcastDev device.Device,
+	crptoFactory CryptoFactory, target subscription.SubscriptionTarget, broadcastDevs []device.Device,
 	tokenStore tokens.TokenStore) *protocol {
 
 	p := &protocol{
@@ -93,16 +225,36 @@ func newProtocol(c clock.Clock, transport transport.Transport, deviceFactory Dev
 		deviceFactory:      deviceFactory,
 		cryptoFactory:      crptoFactory,
 		clock:              c,
+		startedAt:          c.Now(),
 		quitChan:           make(chan struct{}),
 		devices:            make(map[uint32]device.Device),
-		broadcastDev:       broadcastDev,
+		broadcastDevs:      broadcastDevs,
 		tokenStore:         tokenStore,
-		ignoredDevices:     make(map[uint32]bool),
+		ignoredDevices:     make(map[uint32]net.Addr),
+		pings:              make(map[uint32]time.Time),
 	}
 	return p
 }
 
+func (p *protocol) Start() error {
+	p.startOnce.Do(func() {
+		for _, dev := range p.cachedDevs {
+			p.Publish(common.EventNewDevice{Device: dev})
+
+			// Confirm cached devices by unicast, which also synchronises their
+			// stamps.
+			p.solicit()
+			if err := dev.Discover(); err != nil {
+				common.Log.Warnf("Unable to send Hello to cached device %d: %s", dev.ID(), err)
+			}
+		}
+		p.cachedDevs = nil
+	})
+	return nil
+}
+
 func (p *protocol) start() {
+	p.dispatcherWg.Add(1)
 	go p.dispatcher()
 }
 
@@ -110,7 +262,12 @@ func (p *protocol) SetExpiryTime(duration time.Duration) {
 	p.expireAfter = duration
 }
 
+func (p *protocol) SetOfflineExpiryTime(duration time.Duration) {
+	p.offlineExpireAfter = duration
+}
+
 func (p *protocol) dispatcher() {
+	defer p.dispatcherWg.Done()
 	pkts := p.transport.Inbound().Packets()
 	for {
 		select {
@@ -123,47 +280,131 @@ func (p *protocol) dispatcher() {
 		case <-p.quitChan:
 			return
 		case pkt := <-pkts:
-			go p.process(pkt)
+			p.beginProcess()
+			go func() {
+				defer p.endProcess()
+				p.process(pkt)
+			}()
 		}
 	}
 }
 
-func (p *protocol) Discover() error {
-	common.Log.Debugf("Running discovery...")
+func (p *protocol) beginProcess() {
+	p.processMutex.Lock()
+	defer p.processMutex.Unlock()
+	if p.processing == 0 {
+		p.processIdle = make(chan struct{})
+	}
+	p.processing++
+}
 
-	if p.lastDiscovery.After(time.Time{}) {
-		// If the device has not been seen recently, it should be expired.
-		cutoff := time.Now().Add(p.expireAfter * -1)
-		var expiredDevices []device.Device
-		p.devicesMutex.RLock()
-		for _, dev := range p.devices {
-			if dev.Seen().Before(cutoff) {
-				common.Log.Debugf("Device %d is stale. Last Seen at %s", dev.ID(), dev.Seen())
-				expiredDevices = append(expiredDevices, dev)
-			}
+func (p *protocol) endProcess() {
+	p.processMutex.Lock()
+	defer p.processMutex.Unlock()
+	p.processing--
+	if p.processing == 0 {
+		close(p.processIdle)
+	}
+}
+
+// idle returns a channel which is closed once no packets are being
+// processed.
+func (p *protocol) idle() <-chan struct{} {
+	p.processMutex.Lock()
+	defer p.processMutex.Unlock()
+	if p.processing == 0 {
+		idle := make(chan struct{})
+		close(idle)
+		return idle
+	}
+	return p.processIdle
+}
+
+func (p *protocol) Drain(ctx context.Context) error {
+	select {
+	case <-p.idle():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return p.transport.Drain(ctx)
+}
+
+func (p *protocol) Close() error {
+	closed := false
+	p.closeOnce.Do(func() {
+		closed = true
+	})
+	if !closed {
+		return ErrClosed
+	}
+
+	// Stop dispatching new packets before closing devices, which aborts any
+	// calls that are still in flight.
+	close(p.quitChan)
+	p.dispatcherWg.Wait()
+
+	p.cacheAllDevices()
+	errs := p.closeDevices()
+	for _, dev := range p.broadcastDevs {
+		if err := dev.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("broadcast device: %s", err))
 		}
-		p.devicesMutex.RUnlock()
+	}
 
-		for _, dev := range expiredDevices {
-			common.Log.Debugf("Removing expired device with id %d.", dev.ID())
-			p.removeDevice(dev.ID())
-			dev.Close()
-			err := p.Publish(common.EventExpiredDevice{dev})
-			if err != nil {
-				common.Log.Warn(err)
-			}
+	// Processing goroutines finish promptly once their outbounds are closed,
+	// but may have registered further devices in the meantime.
+	<-p.idle()
+	errs = append(errs, p.closeDevices()...)
+
+	if err := p.CloseAllSubscriptions(); err != nil {
+		errs = append(errs, fmt.Sprintf("subscriptions: %s", err))
+	}
+	if err := p.transport.Close(); err != nil {
+		errs = append(errs, fmt.Sprintf("transport: %s", err))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Errors whilst closing protocol: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// closeDevices removes and closes all known devices, returning a description
+// of any errors encountered.
+func (p *protocol) closeDevices() []string {
+	p.devicesMutex.Lock()
+	devices := p.devices
+	p.devices = make(map[uint32]device.Device)
+	p.devicesMutex.Unlock()
+
+	var errs []string
+	for _, dev := range devices {
+		if err := dev.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("device %d: %s", dev.ID(), err))
 		}
 	}
-	if err := p.broadcastDev.Discover(); err != nil {
-		return err
+	return errs
+}
+
+func (p *protocol) Discover() error {
+	common.Log.Debugf("Running discovery...")
+
+	if p.lastDiscovery.After(time.Time{}) {
+		p.checkLiveness(p.clock.Now())
+	}
+	p.solicit()
+	for _, dev := range p.broadcastDevs {
+		if err := dev.Discover(); err != nil {
+			return err
+		}
 	}
 
-	p.lastDiscovery = time.Now()
+	p.lastDiscovery = p.clock.Now()
 	return nil
 }
 func (p *protocol) process(pkt *packet.Packet) {
 	common.Log.Debugf("Processing incoming packet from %s", pkt.Meta.Addr)
-	if ok, _ := p.ignoredDevices[pkt.Header.DeviceID]; ok {
+	if p.isIgnored(pkt.Header.DeviceID) {
 		return
 	}
 
@@ -177,7 +418,7 @@ func (p *protocol) process(pkt *packet.Packet) {
 			token, err := p.tokenStore.GetToken(pkt.Header.DeviceID)
 			if err != nil {
 				common.Log.Warnf("Device with id %d is not revealing its token. You must manually collect this token and add it to the store.", pkt.Header.DeviceID)
-				p.ignoredDevices[pkt.Header.DeviceID] = true
+				p.ignoreDevice(pkt.Header.DeviceID, pkt.Meta.Addr)
 				p.Publish(common.EventNewMaskedDevice{DeviceID: pkt.Header.DeviceID})
 				return
 			} else {
@@ -198,27 +439,189 @@ func (p *protocol) process(pkt *packet.Packet) {
 		// Store the provisional device for now to ensure it can handle subsequent
 		// packets that may occur during classification.
 		p.addDevice(baseDev)
+		p.applyMetadata(baseDev)
 
 		common.Log.Infof("Classifying device...")
 		dev, err := device.Classify(baseDev)
 		if err != nil {
-			panic(err)
+			common.Log.Errorf("Unable to classify device %d: %s", pkt.Header.DeviceID, err)
+			p.removeDevice(baseDev.ID())
+			baseDev.Close()
+			return
 		}
 
 		// Store the specific device and publish a new device event.
 		p.addDevice(dev)
+		p.cacheDevice(dev)
 		p.Publish(common.EventNewDevice{Device: dev})
+	} else if dev != nil && pkt.DataLength() == 0 {
+		// Any Hello response shows the device is reachable. Hello responses
+		// are not verified though, so are only trusted to retarget the device
+		// and sync its stamp when solicited. The device is retargeted first so
+		// that its outbound accepts the stamp from the new address.
+		if p.solicited(pkt.Meta.DecodeTime) {
+			p.updateAddr(dev, pkt.Meta.Addr)
+			if err := dev.Handle(pkt); err != nil {
+				common.Log.Errorf("Unable to process packet %v for device %d. Error %s", pkt, dev.ID(), err)
+			}
+		} else {
+			common.Log.Debugf("Not retargeting device %d to %s for an unsolicited Hello", dev.ID(), pkt.Meta.Addr)
+		}
+		p.markSeen(dev)
 	} else if dev != nil {
 		// Known device. Handle the incoming packet.
 		err := dev.Handle(pkt)
 		if err != nil {
 			common.Log.Errorf("Unable to process packet %v for device %d. Error %s", pkt, dev.ID(), err)
+			return
 		}
+		p.updateAddr(dev, pkt.Meta.Addr)
+		p.markSeen(dev)
 	} else {
 		common.Log.Errorf("Unable to process packet %v. Device unknown.", pkt)
 	}
 }
 
+func (p *protocol) AddToken(deviceID uint32, token []byte) error {
+	if len(token) != 16 {
+		return ErrInvalidToken
+	}
+	if err := p.tokenStore.AddDevice(deviceID, token); err != nil {
+		return err
+	}
+	return p.applyToken(deviceID, token)
+}
+
+func (p *protocol) ApplyTokenChange(change tokens.Change) error {
+	if change.NewToken == nil {
+		common.Log.Infof("Token removed for device %d", change.DeviceID)
+		p.Publish(common.EventTokenRemoved{DeviceID: change.DeviceID})
+		return nil
+	}
+	if len(change.NewToken) != 16 {
+		return ErrInvalidToken
+	}
+	p.Publish(common.EventTokenChanged{DeviceID: change.DeviceID})
+	return p.applyToken(change.DeviceID, change.NewToken)
+}
+
+// applyToken rekeys a known device if its token has changed, or handshakes
+// with a device which was ignored for hiding its token.
+func (p *protocol) applyToken(deviceID uint32, token []byte) error {
+	if dev := p.getDevice(deviceID); dev != nil {
+		if bytes.Equal(dev.GetToken(), token) {
+			return nil
+		}
+		return p.rekey(dev, token)
+	}
+
+	p.ignoredMutex.Lock()
+	addr, ignored := p.ignoredDevices[deviceID]
+	delete(p.ignoredDevices, deviceID)
+	p.ignoredMutex.Unlock()
+
+	if !ignored {
+		return nil
+	}
+	if addr == nil {
+		// The device's address is unknown, so rediscover everything.
+		for _, dev := range p.broadcastDevs {
+			if err := dev.Discover(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	common.Log.Infof("Token added for device %d, sending Hello to %s", deviceID, addr)
+	return p.handshake(addr)
+}
+
+// rekey rebuilds the device's crypto with a new token. The stamp is
+// resynchronised by sending the device a Hello.
+func (p *protocol) rekey(dev device.Device, token []byte) error {
+	crypto, err := p.cryptoFactory(dev.ID(), token, 0, p.clock.Now())
+	if err != nil {
+		return err
+	}
+	dev.Outbound().SetCrypto(crypto)
+	dev.SetToken(token)
+
+	common.Log.Infof("Token changed for device %d, rekeyed", dev.ID())
+	p.Publish(common.EventDeviceRekeyed{Device: dev})
+	p.solicit()
+	return dev.Discover()
+}
+
+// handshake sends a Hello directly to the given address. The response is
+// processed as though it were a response to discovery.
+func (p *protocol) handshake(addr net.Addr) error {
+	outbound := p.transport.NewOutbound(nil, addr)
+	defer outbound.Close()
+	return outbound.Send(packet.NewHello())
+}
+
+func (p *protocol) isIgnored(deviceID uint32) bool {
+	p.ignoredMutex.Lock()
+	defer p.ignoredMutex.Unlock()
+	_, ok := p.ignoredDevices[deviceID]
+	return ok
+}
+
+// ignoreDevice ignores packets from a device until a token is added for it,
+// remembering its address for the subsequent handshake.
+func (p *protocol) ignoreDevice(deviceID uint32, addr *net.UDPAddr) {
+	var a net.Addr
+	if addr != nil {
+		a = addr
+	}
+	p.ignoredMutex.Lock()
+	p.ignoredDevices[deviceID] = a
+	p.ignoredMutex.Unlock()
+}
+
+// solicit records that a Hello is about to be sent, so that responses are
+// trusted.
+func (p *protocol) solicit() {
+	p.addrMutex.Lock()
+	p.discoveredAt = p.clock.Now()
+	p.addrMutex.Unlock()
+}
+
+// solicited reports whether a Hello response received at the given time
+// follows discovery.
+func (p *protocol) solicited(at time.Time) bool {
+	p.addrMutex.Lock()
+	defer p.addrMutex.Unlock()
+	return !p.discoveredAt.IsZero() && !at.Before(p.discoveredAt) && at.Sub(p.discoveredAt) <= helloResponseWindow
+}
+
+// updateAddr retargets the device's outbound if it has responded from a new
+// address.
+func (p *protocol) updateAddr(dev device.Device, addr *net.UDPAddr) {
+	if addr == nil {
+		return
+	}
+	p.addrMutex.Lock()
+	oldAddr := dev.Addr()
+	if oldAddr != nil && oldAddr.String() == addr.String() {
+		p.addrMutex.Unlock()
+		return
+	}
+	dev.Outbound().SetDest(addr)
+	p.addrMutex.Unlock()
+
+	if !dev.Provisional() {
+		p.cacheDevice(dev)
+	}
+
+	common.Log.Infof("Device %d changed address from %s to %s", dev.ID(), oldAddr, addr)
+	err := p.Publish(common.EventDeviceAddressChanged{Device: dev, OldAddr: oldAddr, NewAddr: addr})
+	if err != nil {
+		common.Log.Warn(err)
+	}
+}
+
 func (p *protocol) removeDevice(id uint32) {
 	p.devicesMutex.Lock()
 	delete(p.devices, id)
@@ -231,6 +634,20 @@ func (p *protocol) addDevice(dev device.Device) {
 	p.devicesMutex.Unlock()
 }
 
+func (p *protocol) Devices() []device.Device {
+	p.devicesMutex.RLock()
+	defer p.devicesMutex.RUnlock()
+	devices := make([]device.Device, 0, len(p.devices))
+	for _, dev := range p.devices {
+		devices = append(devices, dev)
+	}
+	return devices
+}
+
+func (p *protocol) Device(id uint32) device.Device {
+	return p.getDevice(id)
+}
+
 func (p *protocol) getDevice(id uint32) device.Device {
 	p.devicesMutex.RLock()
 	dev, ok := p.devices[id]
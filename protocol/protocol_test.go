@@ -1,14 +1,20 @@
 package protocol
 
 import (
+	"bytes"
+	"context"
 	"net"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/capability"
+	"github.com/nickw444/miio-go/common"
 	"github.com/nickw444/miio-go/device"
 	deviceMocks "github.com/nickw444/miio-go/device/mocks"
+	"github.com/nickw444/miio-go/device/product"
+	"github.com/nickw444/miio-go/protocol/devicecache"
 	"github.com/nickw444/miio-go/protocol/packet"
 	"github.com/nickw444/miio-go/protocol/tokens"
 	"github.com/nickw444/miio-go/protocol/transport"
@@ -29,7 +35,7 @@ func Protocol_SetUp() (tt struct {
 	broadcastDevice    *deviceMocks.Device
 }) {
 	tt.clk = clock.NewMock()
-	tt.transport = &mockTransport{new(transportMocks.Inbound)}
+	tt.transport = &mockTransport{inbound: new(transportMocks.Inbound)}
 	tt.subscriptionTarget = new(subscriptionMocks.SubscriptionTarget)
 	tt.deviceFactory = func(deviceId uint32, outbound transport.Outbound, seen time.Time, token []byte) device.Device {
 		d := &deviceMocks.Device{}
@@ -42,7 +48,7 @@ func Protocol_SetUp() (tt struct {
 	tt.broadcastDevice = &deviceMocks.Device{}
 	tt.broadcastDevice.On("Discover").Return(nil)
 	tt.protocol = newProtocol(tt.clk, tt.transport, tt.deviceFactory, tt.cryptoFactory, tt.subscriptionTarget,
-		tt.broadcastDevice, tokens.New())
+		[]device.Device{tt.broadcastDevice}, tokens.New())
 	return
 }
 
@@ -55,6 +61,220 @@ func TestProtocol_Discover(t *testing.T) {
 	tt.broadcastDevice.AssertCalled(t, "Discover")
 }
 
+func Protocol_LivenessDevice(tt *struct {
+	clk                *clock.Mock
+	transport          *mockTransport
+	deviceFactory      DeviceFactory
+	cryptoFactory      CryptoFactory
+	subscriptionTarget *subscriptionMocks.SubscriptionTarget
+	protocol           *protocol
+	devices            []*deviceMocks.Device
+	broadcastDevice    *deviceMocks.Device
+}) (*deviceMocks.Device, *bool) {
+	online := true
+	dev := &deviceMocks.Device{}
+	dev.On("ID").Return(uint32(10))
+	dev.On("Provisional").Return(false)
+	dev.On("Seen").Return(tt.clk.Now())
+	dev.On("Online").Return(func() bool { return online })
+	dev.On("SetOnline", mock.Anything).Run(func(args mock.Arguments) {
+		online = args.Bool(0)
+	})
+	tt.protocol.addDevice(dev)
+	return dev, &online
+}
+
+// Stale devices are pinged, then marked offline but retained if they do not
+// respond.
+func TestProtocol_Discover_PingsStaleDeviceThenMarksOffline(t *testing.T) {
+	tt := Protocol_SetUp()
+	tt.protocol.SetExpiryTime(time.Second * 30)
+	dev, online := Protocol_LivenessDevice(&tt)
+
+	assert.NoError(t, tt.protocol.Discover())
+
+	// The device is stale and is pinged.
+	tt.clk.Add(time.Second * 31)
+	dev.On("Discover").Return(nil).Once()
+	assert.NoError(t, tt.protocol.Discover())
+	dev.AssertCalled(t, "Discover")
+	assert.True(t, *online)
+
+	// The device did not respond to the ping and is now offline.
+	tt.clk.Add(time.Second * 15)
+	tt.subscriptionTarget.On("Publish", common.EventDeviceOffline{Device: dev}).Return(nil).Once()
+	assert.NoError(t, tt.protocol.Discover())
+	assert.False(t, *online)
+	assert.Equal(t, []device.Device{dev}, tt.protocol.Devices())
+	tt.subscriptionTarget.AssertExpectations(t)
+	dev.AssertNotCalled(t, "Close")
+}
+
+// Offline devices come back online when a packet is received from them.
+func TestProtocol_process_MarksOfflineDeviceOnline(t *testing.T) {
+	tt := Protocol_SetUp()
+	dev, online := Protocol_LivenessDevice(&tt)
+	*online = false
+	assert.NoError(t, tt.protocol.Discover())
+
+	pkt := packet.New(10, make([]byte, 16), 1, nil)
+	pkt.Meta.DecodeTime = tt.clk.Now()
+	dev.On("Handle", pkt).Return(nil)
+	tt.subscriptionTarget.On("Publish", common.EventDeviceOnline{Device: dev}).Return(nil).Once()
+
+	tt.protocol.process(pkt)
+	assert.True(t, *online)
+	tt.subscriptionTarget.AssertExpectations(t)
+
+	// No further events whilst the device remains online.
+	tt.protocol.process(pkt)
+	tt.subscriptionTarget.AssertExpectations(t)
+}
+
+// Packets which fail verification do not bring offline devices back online.
+func TestProtocol_process_UnverifiedPacketKeepsDeviceOffline(t *testing.T) {
+	tt := Protocol_SetUp()
+	dev, online := Protocol_LivenessDevice(&tt)
+	*online = false
+
+	pkt := packet.New(10, make([]byte, 16), 1, []byte("data"))
+	dev.On("Handle", pkt).Return(assert.AnError)
+
+	tt.protocol.process(pkt)
+	assert.False(t, *online)
+	tt.subscriptionTarget.AssertNotCalled(t, "Publish", mock.Anything)
+}
+
+// Offline devices are expired once the offline expiry time has elapsed.
+func TestProtocol_Discover_ExpiresOfflineDevice(t *testing.T) {
+	tt := Protocol_SetUp()
+	tt.protocol.SetExpiryTime(time.Second * 30)
+	tt.protocol.SetOfflineExpiryTime(time.Minute * 5)
+	dev, online := Protocol_LivenessDevice(&tt)
+	*online = false
+
+	assert.NoError(t, tt.protocol.Discover())
+
+	tt.clk.Add(time.Minute)
+	dev.On("Discover").Return(nil).Once()
+	assert.NoError(t, tt.protocol.Discover())
+	assert.Len(t, tt.protocol.Devices(), 1)
+
+	tt.clk.Add(time.Minute * 5)
+	dev.On("Close").Return(nil).Once()
+	tt.subscriptionTarget.On("Publish", common.EventExpiredDevice{Device: dev}).Return(nil).Once()
+	assert.NoError(t, tt.protocol.Discover())
+	assert.Empty(t, tt.protocol.Devices())
+	dev.AssertCalled(t, "Close")
+	tt.subscriptionTarget.AssertExpectations(t)
+}
+
+// Verified packets from a known device at a new address retarget its
+// outbound.
+func TestProtocol_process_RetargetsOnVerifiedPacket(t *testing.T) {
+	tt := Protocol_SetUp()
+	dev, _ := Protocol_LivenessDevice(&tt)
+	outbound := &transportMocks.Outbound{}
+	oldAddr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 54321}
+	newAddr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 54321}
+	dev.On("Outbound").Return(outbound)
+	dev.On("Addr").Return(oldAddr).Once()
+
+	pkt := packet.New(10, make([]byte, 16), 1, []byte("data"))
+	pkt.Meta.Addr = newAddr
+	dev.On("Handle", pkt).Return(nil)
+	outbound.On("SetDest", newAddr).Once()
+	tt.subscriptionTarget.On("Publish", common.EventDeviceAddressChanged{
+		Device:  dev,
+		OldAddr: oldAddr,
+		NewAddr: newAddr,
+	}).Return(nil).Once()
+
+	tt.protocol.process(pkt)
+	outbound.AssertExpectations(t)
+	tt.subscriptionTarget.AssertExpectations(t)
+
+	// Subsequent packets from the same address are not reported.
+	dev.On("Addr").Return(newAddr)
+	tt.protocol.process(pkt)
+	outbound.AssertExpectations(t)
+	tt.subscriptionTarget.AssertExpectations(t)
+}
+
+// Packets which fail verification do not retarget the device.
+func TestProtocol_process_UnverifiedPacketKeepsAddress(t *testing.T) {
+	tt := Protocol_SetUp()
+	dev, _ := Protocol_LivenessDevice(&tt)
+
+	pkt := packet.New(10, make([]byte, 16), 1, []byte("data"))
+	pkt.Meta.Addr = &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 54321}
+	dev.On("Handle", pkt).Return(assert.AnError)
+
+	tt.protocol.process(pkt)
+	dev.AssertNotCalled(t, "Outbound")
+	tt.subscriptionTarget.AssertNotCalled(t, "Publish", mock.Anything)
+}
+
+// Hello responses are only handled, and only retarget the device, shortly
+// after discovery, but always mark the device as seen.
+func TestProtocol_process_RetargetsOnSolicitedHello(t *testing.T) {
+	tt := Protocol_SetUp()
+	dev, online := Protocol_LivenessDevice(&tt)
+	*online = false
+	outbound := &transportMocks.Outbound{}
+	oldAddr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 54321}
+	newAddr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 54321}
+	dev.On("Outbound").Return(outbound)
+	dev.On("Addr").Return(oldAddr)
+
+	pkt := packet.New(10, make([]byte, 16), 1, nil)
+	pkt.Meta.Addr = newAddr
+	pkt.Meta.DecodeTime = tt.clk.Now()
+	dev.On("Handle", pkt).Return(nil)
+
+	// Unsolicited.
+	tt.subscriptionTarget.On("Publish", common.EventDeviceOnline{Device: dev}).Return(nil).Once()
+	tt.protocol.process(pkt)
+	outbound.AssertNotCalled(t, "SetDest", mock.Anything)
+	dev.AssertNotCalled(t, "Handle", pkt)
+	assert.True(t, *online)
+
+	// Solicited by discovery.
+	assert.NoError(t, tt.protocol.Discover())
+	outbound.On("SetDest", newAddr).Once()
+	tt.subscriptionTarget.On("Publish", mock.AnythingOfType("common.EventDeviceAddressChanged")).Return(nil).Once()
+	tt.protocol.process(pkt)
+	outbound.AssertExpectations(t)
+	dev.AssertNumberOfCalls(t, "Handle", 1)
+
+	// Too long after discovery.
+	tt.clk.Add(helloResponseWindow + time.Second)
+	pkt.Meta.DecodeTime = tt.clk.Now()
+	tt.protocol.process(pkt)
+	outbound.AssertNumberOfCalls(t, "SetDest", 1)
+	dev.AssertNumberOfCalls(t, "Handle", 1)
+}
+
+// Drain waits for packets being processed, whilst more may still arrive.
+func TestProtocol_Drain(t *testing.T) {
+	tt := Protocol_SetUp()
+	assert.NoError(t, tt.protocol.Drain(context.Background()))
+
+	tt.protocol.beginProcess()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, tt.protocol.Drain(ctx))
+
+	done := make(chan error)
+	go func() {
+		done <- tt.protocol.Drain(context.Background())
+	}()
+	tt.protocol.beginProcess()
+	tt.protocol.endProcess()
+	tt.protocol.endProcess()
+	assert.NoError(t, <-done)
+}
+
 // Ensure that inbound's Packets method is called.
 func TestProtocol_dispatcher(t *testing.T) {
 	tt := Protocol_SetUp()
@@ -75,18 +295,263 @@ func TestProtocol_dispatcher(t *testing.T) {
 	tt.transport.inbound.AssertExpectations(t)
 }
 
+// Close closes every known device and the broadcast device.
+func TestProtocol_Close(t *testing.T) {
+	tt := Protocol_SetUp()
+	tt.transport.inbound.On("Packets").Return(make(<-chan *packet.Packet))
+	tt.protocol.start()
+
+	dev := &deviceMocks.Device{}
+	dev.On("ID").Return(uint32(10))
+	dev.On("Close").Return(nil).Once()
+	tt.protocol.addDevice(dev)
+	tt.broadcastDevice.On("Close").Return(nil).Once()
+	tt.subscriptionTarget.On("CloseAllSubscriptions").Return(nil)
+
+	err := tt.protocol.Close()
+	assert.NoError(t, err)
+	dev.AssertExpectations(t)
+	tt.broadcastDevice.AssertCalled(t, "Close")
+	assert.Empty(t, tt.protocol.Devices())
+}
+
+// Close reports errors from devices and may only be called once.
+func TestProtocol_Close2(t *testing.T) {
+	tt := Protocol_SetUp()
+	tt.transport.inbound.On("Packets").Return(make(<-chan *packet.Packet))
+	tt.protocol.start()
+
+	dev := &deviceMocks.Device{}
+	dev.On("ID").Return(uint32(10))
+	dev.On("Close").Return(assert.AnError)
+	tt.protocol.addDevice(dev)
+	tt.broadcastDevice.On("Close").Return(nil)
+	tt.subscriptionTarget.On("CloseAllSubscriptions").Return(nil)
+
+	err := tt.protocol.Close()
+	assert.Error(t, err)
+
+	err = tt.protocol.Close()
+	assert.Equal(t, ErrClosed, err)
+}
+
+// Cached devices with a token are registered without calling miIO.info, and
+// stale or tokenless entries are skipped.
+func TestProtocol_loadCache(t *testing.T) {
+	tt := Protocol_SetUp()
+	tt.protocol.tokenStore.AddDevice(1, make([]byte, 16))
+	tt.protocol.tokenStore.AddDevice(3, make([]byte, 16))
+
+	cache := devicecache.New()
+	cache.Put(devicecache.Entry{DeviceID: 1, Model: "chuangmi.plug.m1", IP: "192.168.1.10",
+		LastSeen: tt.clk.Now().Add(-time.Hour)})
+	cache.Put(devicecache.Entry{DeviceID: 2, Model: "chuangmi.plug.m1", IP: "192.168.1.11",
+		LastSeen: tt.clk.Now().Add(-time.Hour)})
+	cache.Put(devicecache.Entry{DeviceID: 3, Model: "chuangmi.plug.m1", IP: "192.168.1.12",
+		LastSeen: tt.clk.Now().Add(-time.Hour * 48)})
+	tt.protocol.deviceCache = cache
+
+	var baseDev *deviceMocks.Device
+	var baseSeen time.Time
+	tt.deviceFactory = func(deviceId uint32, outbound transport.Outbound, seen time.Time, token []byte) device.Device {
+		baseSeen = seen
+		baseDev = &deviceMocks.Device{}
+		baseDev.On("ID").Return(deviceId)
+		baseDev.On("SetInfo", common.DeviceInfo{Model: "chuangmi.plug.m1"})
+		baseDev.On("Provisional").Return(true)
+		baseDev.On("GetProduct").Return(product.PowerPlug, nil)
+		baseDev.On("SetProvisional", false)
+		baseDev.On("Outbound").Return(nil)
+		baseDev.On("Clock").Return(tt.clk)
+		baseDev.On("RefreshThrottle").Return(nil)
+		baseDev.On("ConfirmWrites").Return(false)
+		baseDev.On("Transition").Return(capability.Transition{})
+		return baseDev
+	}
+	tt.protocol.deviceFactory = tt.deviceFactory
+
+	devices := tt.protocol.loadCache(time.Hour * 24)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, uint32(1), devices[0].ID())
+	assert.NotNil(t, tt.protocol.Device(1))
+	assert.Nil(t, tt.protocol.Device(2))
+	baseDev.AssertCalled(t, "SetInfo", common.DeviceInfo{Model: "chuangmi.plug.m1"})
+
+	// Devices keep their cached last seen time, and are not announced until
+	// the protocol is started.
+	assert.Equal(t, tt.clk.Now().Add(-time.Hour), baseSeen)
+	tt.subscriptionTarget.AssertNotCalled(t, "Publish", mock.Anything)
+
+	// The stale entry is pruned, but the tokenless entry is retained.
+	_, ok := cache.Get(2)
+	assert.True(t, ok)
+	_, ok = cache.Get(3)
+	assert.False(t, ok)
+}
+
+// Starting announces cached devices and sends them a Hello, once only.
+func TestProtocol_Start(t *testing.T) {
+	tt := Protocol_SetUp()
+	dev := &deviceMocks.Device{}
+	dev.On("Discover").Return(nil).Once()
+	tt.protocol.cachedDevs = []device.Device{dev}
+	tt.subscriptionTarget.On("Publish", common.EventNewDevice{Device: dev}).Return(nil).Once()
+
+	assert.NoError(t, tt.protocol.Start())
+	assert.NoError(t, tt.protocol.Start())
+	dev.AssertExpectations(t)
+	tt.subscriptionTarget.AssertExpectations(t)
+}
+
+// Only devices seen since the protocol started are written back to the
+// cache, so that devices which have gone away are eventually pruned.
+func TestProtocol_cacheAllDevices(t *testing.T) {
+	tt := Protocol_SetUp()
+	cache := devicecache.New()
+	cache.Put(devicecache.Entry{DeviceID: 1, IP: "192.168.1.10", LastSeen: tt.clk.Now().Add(-time.Hour)})
+	cache.Put(devicecache.Entry{DeviceID: 2, IP: "192.168.1.11", LastSeen: tt.clk.Now().Add(-time.Hour)})
+	tt.protocol.deviceCache = cache
+	tt.clk.Add(time.Minute)
+
+	for id, seen := range map[uint32]time.Time{1: tt.clk.Now(), 2: tt.clk.Now().Add(-time.Hour)} {
+		dev := &deviceMocks.Device{}
+		dev.On("ID").Return(id)
+		dev.On("Provisional").Return(false)
+		dev.On("Seen").Return(seen)
+		dev.On("Info").Return(common.DeviceInfo{})
+		dev.On("Addr").Return(&net.UDPAddr{IP: net.IPv4(192, 168, 1, 20)})
+		tt.protocol.addDevice(dev)
+	}
+
+	tt.protocol.cacheAllDevices()
+	entry, _ := cache.Get(1)
+	assert.Equal(t, tt.clk.Now(), entry.LastSeen)
+	assert.Equal(t, "192.168.1.20", entry.IP)
+	entry, _ = cache.Get(2)
+	assert.Equal(t, tt.clk.Now().Add(-time.Hour-time.Minute), entry.LastSeen)
+	assert.Equal(t, "192.168.1.11", entry.IP)
+}
+
+// Masked devices are ignored until a token is added for them, which sends a
+// Hello directly to the device.
+func TestProtocol_AddToken(t *testing.T) {
+	tt := Protocol_SetUp()
+	addr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: DefaultBroadcastPort}
+	pkt := packet.New(10, make([]byte, 16), 1, nil)
+	pkt.Meta.Addr = addr
+	tt.subscriptionTarget.On("Publish", common.EventNewMaskedDevice{DeviceID: 10}).Return(nil).Once()
+
+	tt.protocol.process(pkt)
+	assert.True(t, tt.protocol.isIgnored(10))
+
+	outbound := &transportMocks.Outbound{}
+	outbound.On("Send", packet.NewHello()).Return(nil).Once()
+	outbound.On("Close").Return(nil)
+	tt.transport.outbound = outbound
+
+	token := []byte("0123456789abcdef")
+	assert.NoError(t, tt.protocol.AddToken(10, token))
+	assert.False(t, tt.protocol.isIgnored(10))
+	outbound.AssertExpectations(t)
+	assert.Equal(t, addr, tt.transport.dest)
+
+	stored, err := tt.protocol.tokenStore.GetToken(10)
+	assert.NoError(t, err)
+	assert.Equal(t, token, stored)
+}
+
+// Known devices are rekeyed when their token changes.
+func TestProtocol_ApplyTokenChange(t *testing.T) {
+	tt := Protocol_SetUp()
+	oldToken := bytes.Repeat([]byte{0x01}, 16)
+	newToken := bytes.Repeat([]byte{0x02}, 16)
+
+	outbound := &transportMocks.Outbound{}
+	outbound.On("SetCrypto", mock.Anything).Once()
+	dev := &deviceMocks.Device{}
+	dev.On("ID").Return(uint32(10))
+	dev.On("GetToken").Return(oldToken)
+	dev.On("Outbound").Return(outbound)
+	dev.On("SetToken", newToken).Once()
+	dev.On("Discover").Return(nil).Once()
+	tt.protocol.addDevice(dev)
+
+	tt.subscriptionTarget.On("Publish", common.EventTokenChanged{DeviceID: 10}).Return(nil).Once()
+	tt.subscriptionTarget.On("Publish", common.EventDeviceRekeyed{Device: dev}).Return(nil).Once()
+
+	err := tt.protocol.ApplyTokenChange(tokens.Change{DeviceID: 10, OldToken: oldToken, NewToken: newToken})
+	assert.NoError(t, err)
+	dev.AssertExpectations(t)
+	outbound.AssertExpectations(t)
+	tt.subscriptionTarget.AssertExpectations(t)
+}
+
+// Removed tokens are published, but known devices are left alone.
+func TestProtocol_ApplyTokenChange2(t *testing.T) {
+	tt := Protocol_SetUp()
+	tt.subscriptionTarget.On("Publish", common.EventTokenRemoved{DeviceID: 10}).Return(nil).Once()
+
+	err := tt.protocol.ApplyTokenChange(tokens.Change{DeviceID: 10, OldToken: bytes.Repeat([]byte{0x01}, 16)})
+	assert.NoError(t, err)
+	tt.subscriptionTarget.AssertExpectations(t)
+}
+
+// Tokens of the wrong length are rejected.
+func TestProtocol_AddToken2(t *testing.T) {
+	tt := Protocol_SetUp()
+	assert.Equal(t, ErrInvalidToken, tt.protocol.AddToken(10, []byte("short")))
+}
+
+// Names and model overrides from the token store are applied to new devices.
+func TestProtocol_applyMetadata(t *testing.T) {
+	tt := Protocol_SetUp()
+	tt.protocol.tokenStore.SetMetadata(10, tokens.Metadata{Name: "Lamp", Model: "yeelink.light.color1"})
+
+	dev := &deviceMocks.Device{}
+	dev.On("ID").Return(uint32(10))
+	dev.On("SetLabel", "Lamp").Once()
+	dev.On("Info").Return(common.DeviceInfo{})
+	dev.On("GetInfo").Return(common.DeviceInfo{Model: "unknown.model", MacAddress: "AA:BB"}, nil).Once()
+	dev.On("SetInfo", common.DeviceInfo{Model: "yeelink.light.color1", MacAddress: "AA:BB"}).Once()
+
+	tt.protocol.applyMetadata(dev)
+	dev.AssertExpectations(t)
+}
+
+// Static IPs from the token store are used as additional discovery targets.
+func TestStaticIPs(t *testing.T) {
+	store := tokens.New()
+	store.SetMetadata(10, tokens.Metadata{StaticIP: "10.0.0.5"})
+	store.SetMetadata(11, tokens.Metadata{StaticIP: "invalid"})
+	store.SetMetadata(12, tokens.Metadata{Name: "No IP"})
+
+	ips := staticIPs(store)
+	assert.Len(t, ips, 1)
+	assert.True(t, ips[0].Equal(net.IPv4(10, 0, 0, 5)))
+}
+
 type mockTransport struct {
-	inbound *transportMocks.Inbound
+	inbound  *transportMocks.Inbound
+	outbound *transportMocks.Outbound
+	dest     net.Addr
 }
 
 func (m *mockTransport) Inbound() transport.Inbound {
 	return m.inbound
 }
 
-func (*mockTransport) NewOutbound(crypto packet.Crypto, dest net.Addr) transport.Outbound {
+func (m *mockTransport) NewOutbound(crypto packet.Crypto, dest net.Addr) transport.Outbound {
+	m.dest = dest
+	if m.outbound != nil {
+		return m.outbound
+	}
 	return &transportMocks.Outbound{}
 }
 
+func (*mockTransport) Drain(ctx context.Context) error {
+	return nil
+}
+
 func (*mockTransport) Close() error {
 	return nil
 }
@@ -0,0 +1,337 @@
+// Package provision configures fresh or reset devices, which host their own
+// access point, to join a Wi-Fi network.
+package provision
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/common"
+	"github.com/nickw444/miio-go/protocol/packet"
+	"github.com/nickw444/miio-go/protocol/tokens"
+	"github.com/nickw444/miio-go/protocol/transport"
+)
+
+const (
+	DefaultHelloRetries   = 5
+	DefaultHelloTimeout   = time.Second
+	DefaultConfirmTimeout = time.Minute
+)
+
+var (
+	ErrNoAccessPoint = errors.New("Not connected to a device access point. Join the device's Wi-Fi network first.")
+	ErrNoResponse    = errors.New("Device did not respond to Hello.")
+	ErrTokenMasked   = errors.New("Device did not reveal its token and it is not in the token store.")
+	ErrNoSSID        = errors.New("An SSID is required.")
+	ErrNotJoined     = errors.New("Device was not found on the network before the timeout.")
+
+	ErrMultipleAccessPoints = errors.New("Connected to more than one network in the device access point range. Set the device address explicitly.")
+)
+
+type Config struct {
+	// SSID and Password of the network the device should join.
+	SSID     string
+	Password string
+	// Timezone is an IANA timezone name, e.g. Australia/Sydney.
+	Timezone string
+	// Country is the two letter country code, which selects the Wi-Fi
+	// regulatory domain and the Xiaomi cloud region.
+	Country string
+	// UID is the Xiaomi account ID to bind the device to, if any.
+	UID int64
+
+	// Addr is the device address. Defaults to the device's address on its
+	// access point network, see AccessPointAddr.
+	Addr net.Addr
+	// TokenStore receives the device's token, if set, once the device has
+	// acknowledged the configuration.
+	TokenStore tokens.TokenStore
+
+	HelloRetries int
+	HelloTimeout time.Duration
+	Clock        clock.Clock
+}
+
+// ConfirmConfig configures Confirm.
+type ConfirmConfig struct {
+	// Addr is where Hello is sent. Defaults to the broadcast address.
+	Addr net.Addr
+	// Timeout is how long to wait for the device to join the network.
+	// Defaults to DefaultConfirmTimeout.
+	Timeout time.Duration
+	// Interval is how often Hello is sent. Defaults to DefaultHelloTimeout.
+	Interval time.Duration
+	Clock    clock.Clock
+}
+
+// Result describes a device which has acknowledged its Wi-Fi configuration.
+type Result struct {
+	DeviceID uint32
+	Token    []byte
+}
+
+type routerConfig struct {
+	SSID          string            `json:"ssid"`
+	Password      string            `json:"passwd"`
+	UID           int64             `json:"uid"`
+	CountryDomain string            `json:"country_domain,omitempty"`
+	Timezone      string            `json:"tz,omitempty"`
+	GMTOffset     *int              `json:"gmt_offset,omitempty"`
+	ConfigType    string            `json:"config_type"`
+	WiFiConfig    map[string]string `json:"wifi_config,omitempty"`
+}
+
+// Provision performs a handshake with a device in AP mode, captures its token
+// and configures it to join the Wi-Fi network. The device leaves AP mode once
+// it has accepted the configuration.
+//
+// A nil error means only that the device acknowledged the configuration. The
+// device can't be reached once it leaves AP mode, so whether it managed to
+// join the network (e.g. with the right password) must be confirmed by
+// discovering it there, see Confirm.
+func Provision(config Config) (*Result, error) {
+	if config.SSID == "" {
+		return nil, ErrNoSSID
+	}
+	if config.HelloRetries == 0 {
+		config.HelloRetries = DefaultHelloRetries
+	}
+	if config.HelloTimeout == 0 {
+		config.HelloTimeout = DefaultHelloTimeout
+	}
+	if config.Clock == nil {
+		config.Clock = clock.New()
+	}
+	if config.Addr == nil {
+		addr, err := AccessPointAddr()
+		if err != nil {
+			return nil, err
+		}
+		config.Addr = addr
+	}
+
+	params, err := newRouterConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	t := transport.NewTransportWithConfig(s, transport.Config{Clock: config.Clock})
+	defer t.Close()
+
+	hello, err := handshake(t, config)
+	if err != nil {
+		return nil, err
+	}
+	deviceID := hello.Header.DeviceID
+	common.Log.Infof("Device %d responded to Hello from %s", deviceID, config.Addr)
+
+	token, err := deviceToken(hello, config.TokenStore)
+	if err != nil {
+		return nil, err
+	}
+
+	crypto, err := packet.NewCrypto(deviceID, token, hello.Header.Stamp, hello.Meta.DecodeTime, config.Clock)
+	if err != nil {
+		return nil, err
+	}
+	outbound := t.NewOutbound(crypto, config.Addr)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case pkt := <-t.Inbound().Packets():
+				if err := outbound.Handle(pkt); err != nil {
+					common.Log.Warnf("Unable to handle packet from device %d: %s", deviceID, err)
+				}
+			}
+		}
+	}()
+
+	resp := transport.Response{}
+	if err := outbound.CallAndDeserialize("miIO.config_router", params, &resp); err != nil {
+		return nil, err
+	}
+	if !resp.IsOK() {
+		return nil, fmt.Errorf("Device %d rejected the Wi-Fi configuration: %v", deviceID, resp.Result)
+	}
+
+	// Only store the token once the device has accepted the configuration,
+	// so that a failed provision leaves the store untouched.
+	if config.TokenStore != nil {
+		if _, err := tokens.Merge(config.TokenStore, tokens.ImportedDevice{DeviceID: deviceID, Token: token}); err != nil {
+			return nil, err
+		}
+	}
+
+	common.Log.Infof("Device %d acknowledged the configuration to join %s", deviceID, config.SSID)
+	return &Result{DeviceID: deviceID, Token: token}, nil
+}
+
+// Confirm discovers a provisioned device on the network it was configured to
+// join, returning its address there. This host must rejoin that network once
+// the device leaves AP mode, so Hello is sent until the device responds or the
+// timeout elapses, and errors sending it are ignored in the meantime.
+func Confirm(deviceID uint32, config ConfirmConfig) (net.Addr, error) {
+	if config.Addr == nil {
+		config.Addr = &net.UDPAddr{IP: net.IPv4bcast, Port: transport.DevicePort}
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultConfirmTimeout
+	}
+	if config.Interval == 0 {
+		config.Interval = DefaultHelloTimeout
+	}
+	if config.Clock == nil {
+		config.Clock = clock.New()
+	}
+
+	s, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	t := transport.NewTransportWithConfig(s, transport.Config{Clock: config.Clock})
+	defer t.Close()
+
+	hello := t.NewOutbound(nil, config.Addr)
+	packets := t.Inbound().Packets()
+	deadline := config.Clock.After(config.Timeout)
+	for {
+		if err := hello.Send(packet.NewHello()); err != nil {
+			common.Log.Debugf("Unable to send Hello to %s: %s", config.Addr, err)
+		}
+
+		next := config.Clock.After(config.Interval)
+	wait:
+		for {
+			select {
+			case pkt := <-packets:
+				if pkt.DataLength() == 0 && pkt.Header.DeviceID == deviceID {
+					common.Log.Infof("Device %d joined the network at %s", deviceID, pkt.Meta.Addr)
+					return pkt.Meta.Addr, nil
+				}
+			case <-next:
+				break wait
+			case <-deadline:
+				return nil, ErrNotJoined
+			}
+		}
+	}
+}
+
+// handshake sends Hello to the device until it responds.
+func handshake(t transport.Transport, config Config) (*packet.Packet, error) {
+	hello := t.NewOutbound(nil, config.Addr)
+	packets := t.Inbound().Packets()
+
+	for i := 0; i < config.HelloRetries; i++ {
+		if err := hello.Send(packet.NewHello()); err != nil {
+			return nil, err
+		}
+
+		timeout := config.Clock.After(config.HelloTimeout)
+	wait:
+		for {
+			select {
+			case pkt := <-packets:
+				if pkt.DataLength() == 0 {
+					return pkt, nil
+				}
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+	return nil, ErrNoResponse
+}
+
+// deviceToken returns the token revealed in the Hello response, falling back
+// to the token store for devices which mask their token.
+func deviceToken(hello *packet.Packet, store tokens.TokenStore) ([]byte, error) {
+	checksum := hello.Header.Checksum
+	if !hello.HasZeroChecksum() && !bytes.Equal(checksum, bytes.Repeat([]byte{0xff}, len(checksum))) {
+		return checksum, nil
+	}
+	if store != nil {
+		if token, err := store.GetToken(hello.Header.DeviceID); err == nil {
+			return token, nil
+		}
+	}
+	return nil, ErrTokenMasked
+}
+
+func newRouterConfig(config Config) (*routerConfig, error) {
+	params := &routerConfig{
+		SSID:       config.SSID,
+		Password:   config.Password,
+		UID:        config.UID,
+		ConfigType: "app",
+	}
+	if config.Country != "" {
+		params.CountryDomain = strings.ToLower(config.Country)
+		params.WiFiConfig = map[string]string{"cc": strings.ToUpper(config.Country)}
+	}
+	if config.Timezone != "" {
+		loc, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		_, offset := config.Clock.Now().In(loc).Zone()
+		params.Timezone = config.Timezone
+		params.GMTOffset = &offset
+	}
+	return params, nil
+}
+
+// AccessPointAddr returns the address of a device whose access point this
+// host has joined. miIO devices host a 192.168.13.0/24 network and use its
+// first address. An error is returned if more than one interface is on that
+// network, rather than guessing which one leads to the device.
+func AccessPointAddr() (net.Addr, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	return accessPointAddr(addrs)
+}
+
+var accessPointNet = &net.IPNet{
+	IP:   net.IPv4(192, 168, 13, 0),
+	Mask: net.CIDRMask(24, 32),
+}
+
+func accessPointAddr(addrs []net.Addr) (net.Addr, error) {
+	found := 0
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip := ipNet.IP.To4(); ip != nil && accessPointNet.Contains(ip) {
+			found++
+		}
+	}
+
+	switch found {
+	case 0:
+		return nil, ErrNoAccessPoint
+	case 1:
+		return &net.UDPAddr{
+			IP:   net.IPv4(192, 168, 13, 1),
+			Port: transport.DevicePort,
+		}, nil
+	default:
+		return nil, ErrMultipleAccessPoints
+	}
+}
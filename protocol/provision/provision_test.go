@@ -0,0 +1,196 @@
+package provision
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/protocol/tokens"
+	"github.com/nickw444/miio-go/simulator/device"
+	"github.com/stretchr/testify/assert"
+)
+
+var simulatedToken = bytes.Repeat([]byte{0x00, 0xff}, 8)
+
+// Simulator_SetUp serves a simulated device on localhost, returning its
+// address.
+func Simulator_SetUp(t *testing.T, revealToken bool, apMode bool) (*device.BaseDevice, net.Addr, func()) {
+	s, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+
+	baseDev, err := device.NewBaseDevice(12341234, simulatedToken, revealToken)
+	assert.NoError(t, err)
+	dev := device.NewSimulatedPowerPlug(baseDev)
+	if apMode {
+		baseDev.EnableAPMode()
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		device.Serve(s, dev, quit)
+		close(done)
+	}()
+	return baseDev, s.LocalAddr(), func() {
+		close(quit)
+		<-done
+		s.Close()
+	}
+}
+
+func TestProvision(t *testing.T) {
+	sim, addr, stop := Simulator_SetUp(t, false, true)
+	defer stop()
+	store := tokens.New()
+
+	result, err := Provision(Config{
+		SSID:       "home",
+		Password:   "hunter2",
+		Timezone:   "Europe/Berlin",
+		Country:    "DE",
+		Addr:       addr,
+		TokenStore: store,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &Result{DeviceID: 12341234, Token: simulatedToken}, result)
+
+	token, err := store.GetToken(12341234)
+	assert.NoError(t, err)
+	assert.Equal(t, simulatedToken, token)
+
+	config := sim.WiFiConfig()
+	if assert.NotNil(t, config) {
+		assert.Equal(t, "home", config.SSID)
+		assert.Equal(t, "hunter2", config.Password)
+		assert.Equal(t, "Europe/Berlin", config.Timezone)
+		assert.Equal(t, "de", config.CountryDomain)
+		assert.Equal(t, "DE", config.WiFiConfig.CountryCode)
+	}
+
+	// Once configured, the device no longer reveals its token.
+	_, err = Provision(Config{SSID: "home", Addr: addr})
+	assert.Equal(t, ErrTokenMasked, err)
+}
+
+// Devices which mask their token can be provisioned with a known token.
+func TestProvision_MaskedToken(t *testing.T) {
+	sim, addr, stop := Simulator_SetUp(t, false, true)
+	defer stop()
+	// Configure the device once, so that it masks its token.
+	_, err := Provision(Config{SSID: "old", Addr: addr})
+	assert.NoError(t, err)
+
+	_, err = Provision(Config{SSID: "home", Addr: addr})
+	assert.Equal(t, ErrTokenMasked, err)
+
+	store := tokens.New()
+	store.AddDevice(12341234, simulatedToken)
+	result, err := Provision(Config{SSID: "home", Addr: addr, TokenStore: store})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(12341234), result.DeviceID)
+	assert.Equal(t, "home", sim.WiFiConfig().SSID)
+}
+
+func TestProvision_NoResponse(t *testing.T) {
+	s, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	_, err = Provision(Config{
+		SSID:         "home",
+		Addr:         s.LocalAddr(),
+		HelloRetries: 2,
+		HelloTimeout: time.Millisecond * 20,
+	})
+	assert.Equal(t, ErrNoResponse, err)
+}
+
+// The token is not stored when the device doesn't accept the configuration.
+func TestProvision_NotConfigured(t *testing.T) {
+	// A device which reveals its token, but is not in AP mode, doesn't
+	// respond to miIO.config_router.
+	_, addr, stop := Simulator_SetUp(t, true, false)
+	defer stop()
+	store := tokens.New()
+
+	_, err := Provision(Config{SSID: "home", Addr: addr, TokenStore: store})
+	assert.Error(t, err)
+	assert.Empty(t, store.Devices())
+}
+
+// Confirm finds the device once it responds to Hello.
+func TestConfirm(t *testing.T) {
+	_, addr, stop := Simulator_SetUp(t, false, false)
+	defer stop()
+
+	found, err := Confirm(12341234, ConfirmConfig{Addr: addr, Timeout: time.Second, Interval: time.Millisecond * 20})
+	assert.NoError(t, err)
+	assert.Equal(t, addr.String(), found.String())
+}
+
+// Devices which don't respond, or respond with a different ID, are not
+// confirmed.
+func TestConfirm_NotJoined(t *testing.T) {
+	_, addr, stop := Simulator_SetUp(t, false, false)
+	defer stop()
+
+	_, err := Confirm(1, ConfirmConfig{Addr: addr, Timeout: time.Millisecond * 100, Interval: time.Millisecond * 20})
+	assert.Equal(t, ErrNotJoined, err)
+
+	s, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer s.Close()
+	_, err = Confirm(12341234, ConfirmConfig{Addr: s.LocalAddr(), Timeout: time.Millisecond * 100,
+		Interval: time.Millisecond * 20})
+	assert.Equal(t, ErrNotJoined, err)
+}
+
+func TestProvision_NoSSID(t *testing.T) {
+	_, err := Provision(Config{})
+	assert.Equal(t, ErrNoSSID, err)
+}
+
+func TestNewRouterConfig(t *testing.T) {
+	clk := clock.NewMock()
+	clk.Set(time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC))
+
+	params, err := newRouterConfig(Config{
+		SSID:     "home",
+		Password: "hunter2",
+		Timezone: "Europe/Berlin",
+		Country:  "de",
+		Clock:    clk,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "home", params.SSID)
+	assert.Equal(t, "de", params.CountryDomain)
+	assert.Equal(t, map[string]string{"cc": "DE"}, params.WiFiConfig)
+	// Daylight saving time applies in July.
+	assert.Equal(t, 7200, *params.GMTOffset)
+
+	_, err = newRouterConfig(Config{SSID: "home", Timezone: "Not/AZone", Clock: clk})
+	assert.Error(t, err)
+}
+
+func TestAccessPointAddr(t *testing.T) {
+	ipNet := func(ip string) net.Addr {
+		return &net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(24, 32)}
+	}
+	apAddr := &net.UDPAddr{IP: net.IPv4(192, 168, 13, 1), Port: 54321}
+
+	addr, err := accessPointAddr([]net.Addr{ipNet("127.0.0.1"), ipNet("192.168.13.2")})
+	assert.NoError(t, err)
+	assert.Equal(t, apAddr, addr)
+
+	// Other 192.168.x.0/24 networks, e.g. a home LAN, are not used.
+	addr, err = accessPointAddr([]net.Addr{ipNet("192.168.1.10"), ipNet("192.168.13.2")})
+	assert.NoError(t, err)
+	assert.Equal(t, apAddr, addr)
+	_, err = accessPointAddr([]net.Addr{ipNet("192.168.1.10")})
+	assert.Equal(t, ErrNoAccessPoint, err)
+
+	_, err = accessPointAddr([]net.Addr{ipNet("192.168.13.2"), ipNet("192.168.13.3")})
+	assert.Equal(t, ErrMultipleAccessPoints, err)
+}
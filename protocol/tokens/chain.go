@@ -0,0 +1,113 @@
+package tokens
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/nickw444/miio-go/common"
+)
+
+var (
+	ErrReadOnly = errors.New("Token store is read only.")
+)
+
+type chainStore struct {
+	writable TokenStore
+	sources  []TokenSource
+}
+
+// NewChain creates a TokenStore which looks up tokens from the writable store
+// first, followed by each source in order. The first token found is used.
+// Writes only go to the writable store, which may be nil to make the chain
+// read only.
+func NewChain(writable TokenStore, sources ...TokenSource) TokenStore {
+	return &chainStore{
+		writable: writable,
+		sources:  sources,
+	}
+}
+
+// lookup returns the writable store followed by the sources.
+func (c *chainStore) lookup() []TokenSource {
+	var sources []TokenSource
+	if c.writable != nil {
+		sources = append(sources, c.writable)
+	}
+	return append(sources, c.sources...)
+}
+
+func (c *chainStore) LoadFile(inputPath string) error {
+	if c.writable == nil {
+		return ErrReadOnly
+	}
+	return c.writable.LoadFile(inputPath)
+}
+
+func (c *chainStore) WriteFile(outputPath string) error {
+	if c.writable == nil {
+		return ErrReadOnly
+	}
+	return c.writable.WriteFile(outputPath)
+}
+
+func (c *chainStore) GetToken(deviceId uint32) ([]byte, error) {
+	for _, source := range c.lookup() {
+		token, err := source.GetToken(deviceId)
+		if err == nil {
+			return token, nil
+		}
+		common.Log.Debugf("Token source %T: %s", source, err)
+	}
+	return nil, errNotFound(deviceId)
+}
+
+func (c *chainStore) AddDevice(deviceId uint32, token []byte) error {
+	if c.writable == nil {
+		return ErrReadOnly
+	}
+	return c.writable.AddDevice(deviceId, token)
+}
+
+func (c *chainStore) RemoveDevice(deviceId uint32) {
+	if c.writable != nil {
+		c.writable.RemoveDevice(deviceId)
+	}
+}
+
+// GetMetadata returns metadata from the first source which has any.
+func (c *chainStore) GetMetadata(deviceId uint32) Metadata {
+	for _, source := range c.lookup() {
+		if m, ok := source.(metadataSource); ok {
+			if metadata := m.GetMetadata(deviceId); metadata != (Metadata{}) {
+				return metadata
+			}
+		}
+	}
+	return Metadata{}
+}
+
+func (c *chainStore) SetMetadata(deviceId uint32, metadata Metadata) {
+	if c.writable != nil {
+		c.writable.SetMetadata(deviceId, metadata)
+	}
+}
+
+// Devices returns the devices of all sources which can list them.
+func (c *chainStore) Devices() []uint32 {
+	seen := make(map[uint32]bool)
+	var ids []uint32
+	for _, source := range c.lookup() {
+		e, ok := source.(enumerableSource)
+		if !ok {
+			continue
+		}
+		for _, deviceId := range e.Devices() {
+			if !seen[deviceId] {
+				seen[deviceId] = true
+				ids = append(ids, deviceId)
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
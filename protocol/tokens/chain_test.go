@@ -0,0 +1,61 @@
+package tokens
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Tokens are looked up from the writable store, then each source in order.
+func TestChain_GetToken(t *testing.T) {
+	writable := New()
+	writable.AddDevice(10, bytes.Repeat([]byte{0x01}, 16))
+	first := New()
+	first.AddDevice(10, bytes.Repeat([]byte{0x02}, 16))
+	first.AddDevice(11, bytes.Repeat([]byte{0x02}, 16))
+	second := New()
+	second.AddDevice(11, bytes.Repeat([]byte{0x03}, 16))
+	second.AddDevice(12, bytes.Repeat([]byte{0x03}, 16))
+
+	chain := NewChain(writable, first, second)
+
+	token, err := chain.GetToken(10)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{0x01}, 16), token)
+	token, err = chain.GetToken(11)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{0x02}, 16), token)
+	token, err = chain.GetToken(12)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{0x03}, 16), token)
+	_, err = chain.GetToken(13)
+	assert.Error(t, err)
+
+	assert.Equal(t, []uint32{10, 11, 12}, chain.Devices())
+}
+
+// Writes only go to the writable store.
+func TestChain_Writes(t *testing.T) {
+	writable := New()
+	source := New()
+	chain := NewChain(writable, source)
+
+	assert.NoError(t, chain.AddDevice(10, bytes.Repeat([]byte{0x01}, 16)))
+	chain.SetMetadata(10, Metadata{Name: "Lamp"})
+
+	_, err := writable.GetToken(10)
+	assert.NoError(t, err)
+	_, err = source.GetToken(10)
+	assert.Error(t, err)
+	assert.Equal(t, "Lamp", chain.GetMetadata(10).Name)
+}
+
+// Chains without a writable store are read only.
+func TestChain_ReadOnly(t *testing.T) {
+	chain := NewChain(nil, NewEnvSource(DefaultEnvPrefix))
+
+	assert.Equal(t, ErrReadOnly, chain.AddDevice(10, bytes.Repeat([]byte{0x01}, 16)))
+	assert.Equal(t, ErrReadOnly, chain.WriteFile(os.DevNull))
+}
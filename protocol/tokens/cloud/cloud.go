@@ -0,0 +1,384 @@
+// Package cloud fetches device tokens from a Xiaomi account.
+package cloud
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/protocol/tokens"
+)
+
+const (
+	DefaultAccountURL = "https://account.xiaomi.com"
+	DefaultTimeout    = time.Second * 30
+
+	// defaultAPIURL is formatted with the region prefix, which is empty for
+	// mainland China.
+	defaultAPIURL = "https://%sapi.io.mi.com/app"
+
+	// jsonPrefix precedes the JSON body of account responses.
+	jsonPrefix = "&&&START&&&"
+	sid        = "xiaomiio"
+	userAgent  = "Android-7.1.1-1.0.0-ONEPLUS A3010-136-miio-go APP/xiaomi.smarthome APPV/62830"
+)
+
+// Regions are the server regions of the Xiaomi cloud. Devices are only listed
+// by the region they were added in.
+var Regions = []string{"cn", "de", "us", "ru", "tw", "sg", "in", "i2"}
+
+var (
+	ErrLogin       = errors.New("Xiaomi account login failed. Check the username and password.")
+	ErrTwoFactor   = errors.New("Xiaomi account requires two factor verification. Log in with the Mi Home app first.")
+	ErrNotLoggedIn = errors.New("Not logged in to Xiaomi account.")
+)
+
+// Device is a device listed by the Xiaomi cloud.
+type Device = tokens.ImportedDevice
+
+type Config struct {
+	Username string
+	Password string
+
+	// AccountURL is the base URL of the account service. Defaults to
+	// DefaultAccountURL.
+	AccountURL string
+	// APIURL is the base URL of the device API. It is used for all regions
+	// if set, otherwise the regional Xiaomi servers are used.
+	APIURL string
+
+	HTTPClient *http.Client
+	Clock      clock.Clock
+}
+
+// Client logs in to a Xiaomi account and lists its devices.
+type Client interface {
+	Login() error
+	Devices(region string) ([]Device, error)
+}
+
+type client struct {
+	config Config
+	http   *http.Client
+	clock  clock.Clock
+
+	mutex        sync.Mutex
+	userId       string
+	ssecurity    []byte
+	serviceToken string
+}
+
+func NewClient(config Config) (Client, error) {
+	if config.AccountURL == "" {
+		config.AccountURL = DefaultAccountURL
+	}
+	if config.Clock == nil {
+		config.Clock = clock.New()
+	}
+
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	// Copy the client, so the cookie jar does not leak into a shared client.
+	c := *httpClient
+	c.Jar = jar
+
+	return &client{
+		config: config,
+		http:   &c,
+		clock:  config.Clock,
+	}, nil
+}
+
+type signResponse struct {
+	Sign string `json:"_sign"`
+}
+
+type authResponse struct {
+	Code            int    `json:"code"`
+	UserID          int64  `json:"userId"`
+	Ssecurity       string `json:"ssecurity"`
+	Location        string `json:"location"`
+	NotificationURL string `json:"notificationUrl"`
+}
+
+// Login authenticates with the account service. It must be called before
+// listing devices.
+func (c *client) Login() error {
+	sign, err := c.loginSign()
+	if err != nil {
+		return err
+	}
+
+	hash := md5.Sum([]byte(c.config.Password))
+	form := url.Values{
+		"sid":      {sid},
+		"hash":     {strings.ToUpper(hex.EncodeToString(hash[:]))},
+		"callback": {"https://sts.api.io.mi.com/sts"},
+		"qs":       {"%3Fsid%3Dxiaomiio%26_json%3Dtrue"},
+		"user":     {c.config.Username},
+		"_sign":    {sign},
+		"_json":    {"true"},
+	}
+	var auth authResponse
+	if err := c.account(http.MethodPost, "/pass/serviceLoginAuth2", form, &auth); err != nil {
+		return err
+	}
+	if auth.NotificationURL != "" {
+		return ErrTwoFactor
+	}
+	if auth.Code != 0 || auth.Ssecurity == "" || auth.Location == "" {
+		return ErrLogin
+	}
+
+	ssecurity, err := base64.StdEncoding.DecodeString(auth.Ssecurity)
+	if err != nil {
+		return fmt.Errorf("Malformed ssecurity in login response: %s", err)
+	}
+	serviceToken, err := c.fetchServiceToken(auth.Location)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.userId = strconv.FormatInt(auth.UserID, 10)
+	c.ssecurity = ssecurity
+	c.serviceToken = serviceToken
+	return nil
+}
+
+// loginSign fetches the signature which must accompany the credentials.
+func (c *client) loginSign() (string, error) {
+	var sign signResponse
+	err := c.account(http.MethodGet, "/pass/serviceLogin?sid="+sid+"&_json=true", nil, &sign)
+	return sign.Sign, err
+}
+
+// account makes a request to the account service, decoding the prefixed JSON
+// response.
+func (c *client) account(method string, path string, form url.Values, v interface{}) error {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(c.config.AccountURL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.AddCookie(&http.Cookie{Name: "sdkVersion", Value: "accountsdk-18.8.15"})
+	req.AddCookie(&http.Cookie{Name: "deviceId", Value: "miio-go"})
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Xiaomi account request %s failed: %s", path, resp.Status)
+	}
+
+	data = bytes.TrimPrefix(data, []byte(jsonPrefix))
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Malformed Xiaomi account response: %s", err)
+	}
+	return nil
+}
+
+// fetchServiceToken follows the login location to obtain the service token.
+func (c *client) fetchServiceToken(location string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Unable to fetch service token: %s", resp.Status)
+	}
+
+	for _, cookie := range c.http.Jar.Cookies(req.URL) {
+		if cookie.Name == "serviceToken" {
+			return cookie.Value, nil
+		}
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "serviceToken" {
+			return cookie.Value, nil
+		}
+	}
+	return "", ErrLogin
+}
+
+type deviceListResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Result  struct {
+		List []struct {
+			DID     string `json:"did"`
+			Token   string `json:"token"`
+			LocalIP string `json:"localip"`
+			Model   string `json:"model"`
+			Name    string `json:"name"`
+			Mac     string `json:"mac"`
+		} `json:"list"`
+	} `json:"result"`
+}
+
+// Devices lists the devices in a region which have a token. Bluetooth and
+// other devices without a miIO device ID are skipped.
+func (c *client) Devices(region string) ([]Device, error) {
+	var list deviceListResponse
+	params := `{"getVirtualModel":false,"getHuamiDevices":0}`
+	if err := c.api(region, "/home/device_list", params, &list); err != nil {
+		return nil, err
+	}
+	if list.Code != 0 {
+		return nil, fmt.Errorf("Xiaomi cloud returned error %d: %s", list.Code, list.Message)
+	}
+
+	var devices []Device
+	for _, d := range list.Result.List {
+		deviceId, err := strconv.ParseUint(d.DID, 10, 32)
+		if err != nil {
+			continue
+		}
+		token, err := hex.DecodeString(d.Token)
+		if err != nil || len(token) != 16 {
+			continue
+		}
+		devices = append(devices, Device{
+			DeviceID:   uint32(deviceId),
+			Token:      token,
+			Model:      d.Model,
+			IP:         d.LocalIP,
+			MacAddress: d.Mac,
+			Name:       d.Name,
+		})
+	}
+	return devices, nil
+}
+
+func (c *client) apiURL(region string) string {
+	if c.config.APIURL != "" {
+		return strings.TrimRight(c.config.APIURL, "/")
+	}
+	if region == "cn" || region == "" {
+		return fmt.Sprintf(defaultAPIURL, "")
+	}
+	return fmt.Sprintf(defaultAPIURL, region+".")
+}
+
+// api makes a signed request to the device API.
+func (c *client) api(region string, path string, params string, v interface{}) error {
+	c.mutex.Lock()
+	userId, ssecurity, serviceToken := c.userId, c.ssecurity, c.serviceToken
+	c.mutex.Unlock()
+	if ssecurity == nil {
+		return ErrNotLoggedIn
+	}
+
+	nonce, err := c.nonce()
+	if err != nil {
+		return err
+	}
+	signedNonce := signNonce(ssecurity, nonce)
+	form := url.Values{
+		"signature": {signature(path, signedNonce, nonce, params)},
+		"_nonce":    {nonce},
+		"data":      {params},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.apiURL(region)+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("x-xiaomi-protocal-flag-cli", "PROTOCAL-HTTP2")
+	req.AddCookie(&http.Cookie{Name: "userId", Value: userId})
+	req.AddCookie(&http.Cookie{Name: "yetAnotherServiceToken", Value: serviceToken})
+	req.AddCookie(&http.Cookie{Name: "serviceToken", Value: serviceToken})
+	req.AddCookie(&http.Cookie{Name: "locale", Value: "en_GB"})
+	req.AddCookie(&http.Cookie{Name: "channel", Value: "MI_APP_STORE"})
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		return ErrNotLoggedIn
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Xiaomi cloud request %s failed: %s", path, resp.Status)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Malformed Xiaomi cloud response: %s", err)
+	}
+	return nil
+}
+
+// nonce returns 8 random bytes followed by the minutes since the epoch.
+func (c *client) nonce() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b[:8]); err != nil {
+		return "", err
+	}
+	binary.BigEndian.PutUint32(b[8:], uint32(c.clock.Now().Unix()/60))
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func signNonce(ssecurity []byte, nonce string) string {
+	decoded, _ := base64.StdEncoding.DecodeString(nonce)
+	sum := sha256.Sum256(append(append([]byte{}, ssecurity...), decoded...))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func signature(path string, signedNonce string, nonce string, params string) string {
+	key, _ := base64.StdEncoding.DecodeString(signedNonce)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join([]string{path, signedNonce, nonce, "data=" + params}, "&")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,216 @@
+package cloud
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/protocol/tokens"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testUser      = "user@example.com"
+	testPassword  = "hunter2"
+	testSsecurity = "2Dsc6NMEpq4DQ05HyrwkCA=="
+	testService   = "c2VydmljZXRva2Vu"
+)
+
+// cloudServer replays recorded responses, checking the requests made by the
+// client along the way.
+type cloudServer struct {
+	t        *testing.T
+	server   *httptest.Server
+	password string
+
+	deviceListCalls int
+}
+
+func CloudServer_SetUp(t *testing.T) *cloudServer {
+	s := &cloudServer{t: t, password: testPassword}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pass/serviceLogin", s.serviceLogin)
+	mux.HandleFunc("/pass/serviceLoginAuth2", s.serviceLoginAuth2)
+	mux.HandleFunc("/sts", s.sts)
+	mux.HandleFunc("/app/home/device_list", s.deviceList)
+	s.server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *cloudServer) Close() {
+	s.server.Close()
+}
+
+func (s *cloudServer) replay(w http.ResponseWriter, file string) {
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(s.t, err)
+	w.Write([]byte(strings.Replace(string(data), "{{server}}", s.server.URL, -1)))
+}
+
+func (s *cloudServer) serviceLogin(w http.ResponseWriter, r *http.Request) {
+	assert.Equal(s.t, "xiaomiio", r.URL.Query().Get("sid"))
+	s.replay(w, "service_login.example.txt")
+}
+
+func (s *cloudServer) serviceLoginAuth2(w http.ResponseWriter, r *http.Request) {
+	assert.Equal(s.t, http.MethodPost, r.Method)
+	assert.Equal(s.t, testUser, r.FormValue("user"))
+	assert.Equal(s.t, "XGqnWHsqAOk4HGKYBmc9ODBbeSw=", r.FormValue("_sign"))
+
+	hash := md5.Sum([]byte(s.password))
+	if r.FormValue("hash") != strings.ToUpper(hex.EncodeToString(hash[:])) {
+		w.Write([]byte(jsonPrefix + `{"code":70016,"desc":"登录验证失败"}`))
+		return
+	}
+	s.replay(w, "service_login_auth2.example.txt")
+}
+
+func (s *cloudServer) sts(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: "serviceToken", Value: testService, Path: "/"})
+	w.Write([]byte("ok"))
+}
+
+func (s *cloudServer) deviceList(w http.ResponseWriter, r *http.Request) {
+	s.deviceListCalls++
+
+	userId, _ := r.Cookie("userId")
+	serviceToken, _ := r.Cookie("serviceToken")
+	if userId == nil || serviceToken == nil || serviceToken.Value != testService {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	assert.Equal(s.t, "1234567890", userId.Value)
+
+	ssecurity, _ := base64.StdEncoding.DecodeString(testSsecurity)
+	nonce := r.FormValue("_nonce")
+	expected := signature("/home/device_list", signNonce(ssecurity, nonce), nonce, r.FormValue("data"))
+	if r.FormValue("signature") != expected {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.replay(w, "device_list.example.json")
+}
+
+func Client_SetUp(t *testing.T, s *cloudServer) Client {
+	c, err := NewClient(Config{
+		Username:   testUser,
+		Password:   testPassword,
+		AccountURL: s.server.URL,
+		APIURL:     s.server.URL + "/app",
+		Clock:      clock.NewMock(),
+	})
+	assert.NoError(t, err)
+	return c
+}
+
+func TestClient_Devices(t *testing.T) {
+	s := CloudServer_SetUp(t)
+	defer s.Close()
+	c := Client_SetUp(t, s)
+
+	assert.NoError(t, c.Login())
+	devices, err := c.Devices("de")
+	assert.NoError(t, err)
+
+	// The Bluetooth device is skipped.
+	assert.Equal(t, []Device{
+		{
+			DeviceID:   57212011,
+			Token:      mustDecode("00112233445566778899aabbccddeeff"),
+			Model:      "yeelink.light.color1",
+			IP:         "192.168.1.20",
+			MacAddress: "28:6C:07:AA:BB:CC",
+			Name:       "Living Room Light",
+		},
+		{
+			DeviceID:   57212012,
+			Token:      mustDecode("ffeeddccbbaa99887766554433221100"),
+			Model:      "chuangmi.plug.m1",
+			IP:         "192.168.1.21",
+			MacAddress: "28:6C:07:AA:BB:CD",
+			Name:       "Desk Plug",
+		},
+	}, devices)
+}
+
+func TestClient_LoginFailed(t *testing.T) {
+	s := CloudServer_SetUp(t)
+	defer s.Close()
+	s.password = "something else"
+	c := Client_SetUp(t, s)
+
+	assert.Equal(t, ErrLogin, c.Login())
+}
+
+func TestClient_NotLoggedIn(t *testing.T) {
+	s := CloudServer_SetUp(t)
+	defer s.Close()
+	c := Client_SetUp(t, s)
+
+	_, err := c.Devices("cn")
+	assert.Equal(t, ErrNotLoggedIn, err)
+	assert.Equal(t, 0, s.deviceListCalls)
+}
+
+func TestClient_APIURL(t *testing.T) {
+	c, err := NewClient(Config{})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://api.io.mi.com/app", c.(*client).apiURL("cn"))
+	assert.Equal(t, "https://de.api.io.mi.com/app", c.(*client).apiURL("de"))
+}
+
+func TestClient_Nonce(t *testing.T) {
+	clk := clock.NewMock()
+	clk.Add(time.Hour)
+	c, err := NewClient(Config{Clock: clk})
+	assert.NoError(t, err)
+
+	nonce, err := c.(*client).nonce()
+	assert.NoError(t, err)
+	decoded, err := base64.StdEncoding.DecodeString(nonce)
+	assert.NoError(t, err)
+	assert.Len(t, decoded, 12)
+	assert.Equal(t, uint32(60), binary.BigEndian.Uint32(decoded[8:]))
+}
+
+func TestImport(t *testing.T) {
+	s := CloudServer_SetUp(t)
+	defer s.Close()
+	c := Client_SetUp(t, s)
+	assert.NoError(t, c.Login())
+	devices, err := c.Devices("cn")
+	assert.NoError(t, err)
+
+	store := tokens.New()
+	imported, err := tokens.Import(store, devices)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, imported)
+
+	token, err := store.GetToken(57212012)
+	assert.NoError(t, err)
+	assert.Equal(t, "ffeeddccbbaa99887766554433221100", hex.EncodeToString(token))
+	// Only the name is kept, as the model and IP would override
+	// classification and discovery.
+	assert.Equal(t, tokens.Metadata{Name: "Desk Plug"}, store.GetMetadata(57212012))
+
+	// Importing again changes nothing.
+	imported, err = tokens.Import(store, devices)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, imported)
+}
+
+func mustDecode(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
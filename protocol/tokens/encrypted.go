@@ -0,0 +1,303 @@
+package tokens
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/nickw444/miio-go/common"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	ErrDecrypt   = errors.New("Unable to decrypt token store. Is the passphrase or key file correct?")
+	ErrEncrypted = errors.New("Token store is encrypted. A passphrase or key file is required to load it.")
+)
+
+const (
+	encryptedVersion = 1
+	encryptedKDF     = "scrypt"
+	encryptedCipher  = "aes-256-gcm"
+
+	// Parameters recommended for interactive use as of 2017.
+	scryptN      = 32768
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltLen      = 16
+
+	// Upper bounds on the parameters accepted from a store, so that a crafted
+	// file can't make scrypt allocate gigabytes before it is authenticated.
+	maxScryptN = 1 << 20
+	maxScryptR = 32
+	maxScryptP = 16
+)
+
+// envelope is the on-disk format of an encrypted token store. The plaintext
+// is a token store in the JSON format.
+type envelope struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Cipher     string `json:"cipher"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// encryptedStore is a token store which is encrypted at rest with a key
+// derived from a secret using scrypt.
+type encryptedStore struct {
+	*tokenStore
+
+	secret   []byte
+	keyMutex sync.Mutex
+	n        int
+	r        int
+	p        int
+	salt     []byte
+	key      []byte
+}
+
+// NewEncrypted creates an empty token store which is encrypted with a key
+// derived from the secret when written.
+func NewEncrypted(secret []byte) TokenStore {
+	return &encryptedStore{
+		tokenStore: New().(*tokenStore),
+		secret:     secret,
+	}
+}
+
+// EncryptedFromFile loads an encrypted token store. Plaintext stores are also
+// accepted, and are encrypted when next written.
+func EncryptedFromFile(filePath string, secret []byte) (TokenStore, error) {
+	store := NewEncrypted(secret)
+	err := store.LoadFile(filePath)
+	return store, err
+}
+
+// ReadKeyFile reads a secret from a key file, ignoring surrounding whitespace.
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(data)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("Key file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// IsEncrypted reports whether the file at the given path is an encrypted
+// token store.
+func IsEncrypted(path string) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	_, ok := parseEnvelope(data)
+	return ok, nil
+}
+
+func parseEnvelope(data []byte) (envelope, bool) {
+	var env envelope
+	if !isJSON(data) {
+		return env, false
+	}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return env, false
+	}
+	return env, env.KDF != "" && len(env.Ciphertext) > 0
+}
+
+func (e *encryptedStore) LoadFile(inputPath string) error {
+	data, err := ioutil.ReadFile(inputPath)
+	if os.IsNotExist(err) {
+		// File doesn't exist, so don't load anything.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	env, ok := parseEnvelope(data)
+	if !ok {
+		common.Log.Warnf("Token store %s is not encrypted. It will be encrypted when next written.", inputPath)
+		return e.tokenStore.LoadFile(inputPath)
+	}
+
+	plaintext, err := e.decrypt(env)
+	if err != nil {
+		return err
+	}
+	return e.tokenStore.loadJSON(plaintext)
+}
+
+func (e *encryptedStore) WriteFile(outputPath string) error {
+	e.writeMutex.Lock()
+	defer e.writeMutex.Unlock()
+
+	plaintext, err := e.marshalJSON()
+	if err != nil {
+		return err
+	}
+	env, err := e.encrypt(plaintext)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return err
+	}
+	return common.WriteFileAtomic(outputPath, append(data, '\n'), 0600)
+}
+
+func (e *encryptedStore) decrypt(env envelope) ([]byte, error) {
+	if env.Version > encryptedVersion {
+		return nil, fmt.Errorf("Unsupported encrypted token store version %d", env.Version)
+	}
+	if env.KDF != encryptedKDF || env.Cipher != encryptedCipher {
+		return nil, fmt.Errorf("Unsupported encrypted token store kdf %q or cipher %q", env.KDF, env.Cipher)
+	}
+
+	if env.N > maxScryptN || env.R > maxScryptR || env.P > maxScryptP {
+		return nil, fmt.Errorf("Encrypted token store scrypt parameters n=%d, r=%d, p=%d exceed the maximum of n=%d, r=%d, p=%d",
+			env.N, env.R, env.P, maxScryptN, maxScryptR, maxScryptP)
+	}
+
+	key, err := scrypt.Key(e.secret, env.Salt, env.N, env.R, env.P, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, env.Nonce, env.Ciphertext, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	// Reuse the derived key for subsequent writes, avoiding the cost of
+	// scrypt each time the store is saved. The parameters are kept so that
+	// the written header matches the key.
+	e.keyMutex.Lock()
+	e.n, e.r, e.p = env.N, env.R, env.P
+	e.salt = env.Salt
+	e.key = key
+	e.keyMutex.Unlock()
+	return plaintext, nil
+}
+
+func (e *encryptedStore) encrypt(plaintext []byte) (envelope, error) {
+	n, r, p, salt, key, err := e.derivedKey()
+	if err != nil {
+		return envelope{}, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return envelope{}, err
+	}
+
+	// A fresh nonce is used for every write.
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return envelope{}, err
+	}
+
+	return envelope{
+		Version:    encryptedVersion,
+		KDF:        encryptedKDF,
+		N:          n,
+		R:          r,
+		P:          p,
+		Salt:       salt,
+		Cipher:     encryptedCipher,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, nil),
+	}, nil
+}
+
+// derivedKey returns the scrypt parameters, salt and key from the loaded
+// store, or derives a new key with the default parameters and a random salt.
+func (e *encryptedStore) derivedKey() (n, r, p int, salt, key []byte, err error) {
+	e.keyMutex.Lock()
+	defer e.keyMutex.Unlock()
+	if e.key != nil {
+		return e.n, e.r, e.p, e.salt, e.key, nil
+	}
+
+	salt = make([]byte, saltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return 0, 0, 0, nil, nil, err
+	}
+	key, err = scrypt.Key(e.secret, salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return 0, 0, 0, nil, nil, err
+	}
+	e.n, e.r, e.p = scryptN, scryptR, scryptP
+	e.salt = salt
+	e.key = key
+	return e.n, e.r, e.p, salt, key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt encrypts a plaintext token store in either format. The input and
+// output paths may be the same.
+func Encrypt(inputPath string, outputPath string, secret []byte) error {
+	store := New()
+	if err := store.LoadFile(inputPath); err != nil {
+		return err
+	}
+	encrypted := NewEncrypted(secret).(*encryptedStore)
+	encrypted.copyFrom(store.(*tokenStore))
+	return encrypted.WriteFile(outputPath)
+}
+
+// RotateKey re-encrypts an encrypted token store with a key derived from a
+// new secret, using a fresh salt. The input and output paths may be the same.
+func RotateKey(inputPath string, outputPath string, oldSecret []byte, newSecret []byte) error {
+	encrypted, err := IsEncrypted(inputPath)
+	if err != nil {
+		return err
+	}
+	if !encrypted {
+		return fmt.Errorf("Token store %s is not encrypted", inputPath)
+	}
+
+	store := NewEncrypted(oldSecret).(*encryptedStore)
+	if err := store.LoadFile(inputPath); err != nil {
+		return err
+	}
+	rotated := NewEncrypted(newSecret).(*encryptedStore)
+	rotated.copyFrom(store.tokenStore)
+	return rotated.WriteFile(outputPath)
+}
+
+func (e *encryptedStore) copyFrom(store *tokenStore) {
+	for _, deviceId := range store.Devices() {
+		if token, err := store.GetToken(deviceId); err == nil {
+			e.AddDevice(deviceId, token)
+		}
+		if metadata := store.GetMetadata(deviceId); metadata != (Metadata{}) {
+			e.SetMetadata(deviceId, metadata)
+		}
+	}
+}
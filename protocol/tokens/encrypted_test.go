@@ -0,0 +1,158 @@
+package tokens
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/scrypt"
+)
+
+func Encrypted_SetUp(t *testing.T) (dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "tokens")
+	assert.NoError(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// Encrypted stores survive a round trip and do not contain plaintext tokens.
+func TestEncryptedStore(t *testing.T) {
+	dir, cleanup := Encrypted_SetUp(t)
+	defer cleanup()
+	path := filepath.Join(dir, "tokens.enc")
+	token := bytes.Repeat([]byte{0xab}, 16)
+
+	store := NewEncrypted([]byte("passphrase"))
+	store.AddDevice(10, token)
+	store.SetMetadata(10, Metadata{Name: "Lamp"})
+	assert.NoError(t, store.WriteFile(path))
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), hex.EncodeToString(token))
+	assert.NotContains(t, string(data), "Lamp")
+
+	loaded, err := EncryptedFromFile(path, []byte("passphrase"))
+	assert.NoError(t, err)
+	loadedToken, err := loaded.GetToken(10)
+	assert.NoError(t, err)
+	assert.Equal(t, token, loadedToken)
+	assert.Equal(t, "Lamp", loaded.GetMetadata(10).Name)
+}
+
+// Loading fails with the wrong secret, or without one.
+func TestEncryptedStore_WrongSecret(t *testing.T) {
+	dir, cleanup := Encrypted_SetUp(t)
+	defer cleanup()
+	path := filepath.Join(dir, "tokens.enc")
+
+	assert.NoError(t, Encrypt("tokens.example.txt", path, []byte("passphrase")))
+
+	_, err := EncryptedFromFile(path, []byte("wrong"))
+	assert.Equal(t, ErrDecrypt, err)
+	_, err = FromFile(path)
+	assert.Equal(t, ErrEncrypted, err)
+}
+
+// Plaintext stores can be loaded, and are encrypted on write.
+func TestEncrypt(t *testing.T) {
+	dir, cleanup := Encrypted_SetUp(t)
+	defer cleanup()
+	path := filepath.Join(dir, "tokens.txt")
+	data, err := ioutil.ReadFile("tokens.example.txt")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	store, err := EncryptedFromFile(path, []byte("passphrase"))
+	assert.NoError(t, err)
+	assert.NoError(t, store.WriteFile(path))
+
+	encrypted, err := IsEncrypted(path)
+	assert.NoError(t, err)
+	assert.True(t, encrypted)
+
+	store, err = EncryptedFromFile(path, []byte("passphrase"))
+	assert.NoError(t, err)
+	token, err := store.GetToken(111222)
+	assert.NoError(t, err)
+	assert.Equal(t, "badcafefffffffffffffffffffffffff", hex.EncodeToString(token))
+}
+
+// RotateKey re-encrypts the store with the new secret.
+func TestRotateKey(t *testing.T) {
+	dir, cleanup := Encrypted_SetUp(t)
+	defer cleanup()
+	path := filepath.Join(dir, "tokens.enc")
+	keyPath := filepath.Join(dir, "key")
+	assert.NoError(t, ioutil.WriteFile(keyPath, []byte("new secret\n"), 0600))
+
+	assert.NoError(t, Encrypt("tokens.example.json", path, []byte("old secret")))
+	newSecret, err := ReadKeyFile(keyPath)
+	assert.NoError(t, err)
+	assert.NoError(t, RotateKey(path, path, []byte("old secret"), newSecret))
+
+	_, err = EncryptedFromFile(path, []byte("old secret"))
+	assert.Equal(t, ErrDecrypt, err)
+	store, err := EncryptedFromFile(path, []byte("new secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Lamp", store.GetMetadata(111222).Name)
+}
+
+// Stores written with other scrypt parameters keep them when rewritten.
+func TestEncryptedStore_KeepsScryptParameters(t *testing.T) {
+	dir, cleanup := Encrypted_SetUp(t)
+	defer cleanup()
+	path := filepath.Join(dir, "tokens.enc")
+
+	store := NewEncrypted([]byte("passphrase")).(*encryptedStore)
+	store.n, store.r, store.p = 1024, 4, 2
+	store.salt = bytes.Repeat([]byte{0x01}, saltLen)
+	key, err := scrypt.Key(store.secret, store.salt, 1024, 4, 2, scryptKeyLen)
+	assert.NoError(t, err)
+	store.key = key
+	store.AddDevice(10, bytes.Repeat([]byte{0xab}, 16))
+	assert.NoError(t, store.WriteFile(path))
+
+	loaded, err := EncryptedFromFile(path, []byte("passphrase"))
+	assert.NoError(t, err)
+	loaded.AddDevice(11, bytes.Repeat([]byte{0xcd}, 16))
+	assert.NoError(t, loaded.WriteFile(path))
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	env, ok := parseEnvelope(data)
+	assert.True(t, ok)
+	assert.Equal(t, []int{1024, 4, 2}, []int{env.N, env.R, env.P})
+
+	loaded, err = EncryptedFromFile(path, []byte("passphrase"))
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{10, 11}, loaded.Devices())
+}
+
+// Excessive scrypt parameters are rejected before deriving a key.
+func TestEncryptedStore_RejectsExcessiveScryptParameters(t *testing.T) {
+	dir, cleanup := Encrypted_SetUp(t)
+	defer cleanup()
+	path := filepath.Join(dir, "tokens.enc")
+
+	data, err := json.Marshal(envelope{
+		Version:    encryptedVersion,
+		KDF:        encryptedKDF,
+		N:          1 << 30,
+		R:          scryptR,
+		P:          scryptP,
+		Salt:       make([]byte, saltLen),
+		Cipher:     encryptedCipher,
+		Nonce:      make([]byte, 12),
+		Ciphertext: []byte{0x01},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	_, err = EncryptedFromFile(path, []byte("passphrase"))
+	assert.EqualError(t, err, "Encrypted token store scrypt parameters n=1073741824, r=8, p=1 exceed the maximum of n=1048576, r=32, p=16")
+}
@@ -0,0 +1,94 @@
+package tokens
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+const jsonVersion = 1
+
+type jsonStore struct {
+	Version int          `json:"version"`
+	Devices []jsonDevice `json:"devices"`
+}
+
+type jsonDevice struct {
+	ID    uint32 `json:"id"`
+	Token string `json:"token,omitempty"`
+	Metadata
+}
+
+// isJSON reports whether the data looks like a JSON token store rather than
+// the legacy format.
+func isJSON(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+func (t *tokenStore) loadJSON(data []byte) error {
+	var store jsonStore
+	if err := json.Unmarshal(data, &store); err != nil {
+		return err
+	}
+	if store.Version > jsonVersion {
+		return fmt.Errorf("Unsupported token store version %d", store.Version)
+	}
+
+	tokens := make(map[uint32][]byte)
+	metadata := make(map[uint32]Metadata)
+	for _, dev := range store.Devices {
+		if dev.Token != "" {
+			token, err := hex.DecodeString(dev.Token)
+			if err != nil {
+				return fmt.Errorf("Malformed token for device %d: %s", dev.ID, err)
+			}
+			tokens[dev.ID] = token
+		}
+		if dev.Metadata != (Metadata{}) {
+			metadata[dev.ID] = dev.Metadata
+		}
+	}
+
+	t.mutex.Lock()
+	for deviceId, token := range tokens {
+		t.tokens[deviceId] = token
+	}
+	for deviceId, m := range metadata {
+		t.metadata[deviceId] = m
+	}
+	t.layout = layout{}
+	t.format = FormatJSON
+	t.mutex.Unlock()
+	return nil
+}
+
+func (t *tokenStore) marshalJSON() ([]byte, error) {
+	store := jsonStore{Version: jsonVersion, Devices: []jsonDevice{}}
+	for _, deviceId := range t.Devices() {
+		dev := jsonDevice{ID: deviceId}
+		t.mutex.RLock()
+		if token, ok := t.tokens[deviceId]; ok {
+			dev.Token = hex.EncodeToString(token)
+		}
+		dev.Metadata = t.metadata[deviceId]
+		t.mutex.RUnlock()
+		store.Devices = append(store.Devices, dev)
+	}
+
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Migrate converts a token store in either format to the JSON format. The
+// input and output paths may be the same.
+func Migrate(inputPath string, outputPath string) error {
+	store := New().(*tokenStore)
+	if err := store.LoadFile(inputPath); err != nil {
+		return err
+	}
+	return store.writeFormat(outputPath, FormatJSON)
+}
@@ -0,0 +1,85 @@
+package tokens
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromFile_JSON(t *testing.T) {
+	store, err := FromFile("tokens.example.json")
+	assert.NoError(t, err)
+
+	token, err := store.GetToken(111222)
+	assert.NoError(t, err)
+	assert.Equal(t, "badcafefffffffffffffffffffffffff", hex.EncodeToString(token))
+	assert.Equal(t, Metadata{
+		Name:     "Lamp",
+		Room:     "Living Room",
+		StaticIP: "192.168.1.10",
+		Notes:    "Behind the couch",
+	}, store.GetMetadata(111222))
+	assert.Equal(t, "chuangmi.plug.m1", store.GetMetadata(123456).Model)
+	assert.Equal(t, []uint32{111222, 123456}, store.Devices())
+}
+
+// JSON stores survive a round trip through WriteFile.
+func TestWriteFile_JSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+
+	store, err := FromFile("tokens.example.json")
+	assert.NoError(t, err)
+	assert.NoError(t, store.WriteFile(path))
+
+	expected, err := ioutil.ReadFile("tokens.example.json")
+	assert.NoError(t, err)
+	actual, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+}
+
+// Legacy stores are written as JSON once they hold metadata.
+func TestWriteFile_LegacyWithMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.txt")
+
+	store, err := FromFile("tokens.example.txt")
+	assert.NoError(t, err)
+	store.SetMetadata(123456, Metadata{Name: "Plug"})
+	assert.NoError(t, store.WriteFile(path))
+
+	loaded, err := FromFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "Plug", loaded.GetMetadata(123456).Name)
+	_, err = loaded.GetToken(111222)
+	assert.NoError(t, err)
+}
+
+// Migrate converts a legacy store to JSON.
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.json")
+
+	assert.NoError(t, Migrate("tokens.example.txt", path))
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.True(t, isJSON(data))
+
+	store, err := FromFile(path)
+	assert.NoError(t, err)
+	token, err := store.GetToken(123456)
+	assert.NoError(t, err)
+	assert.Equal(t, "ffffffffffffffffffffffffffffffff", hex.EncodeToString(token))
+}
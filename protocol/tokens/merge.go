@@ -0,0 +1,51 @@
+package tokens
+
+import "bytes"
+
+// ImportedDevice is a device and its token found outside of the store, such
+// as in the Xiaomi cloud or a Mi Home backup.
+type ImportedDevice struct {
+	DeviceID   uint32
+	Token      []byte
+	Model      string
+	IP         string
+	MacAddress string
+	Name       string
+}
+
+// Import merges the tokens of devices into the store, returning the number of
+// tokens which were new or changed.
+func Import(store TokenStore, devices []ImportedDevice) (int, error) {
+	imported := 0
+	for _, d := range devices {
+		changed, err := Merge(store, d)
+		if err != nil {
+			return imported, err
+		}
+		if changed {
+			imported++
+		}
+	}
+	return imported, nil
+}
+
+// Merge adds an imported device's token to the store, returning whether it
+// was new or changed. The name is stored as metadata unless the device
+// already has one. The imported model and IP are not stored, as they are
+// often out of date and metadata overrides classification and discovery.
+func Merge(store TokenStore, device ImportedDevice) (bool, error) {
+	changed := false
+	if existing, err := store.GetToken(device.DeviceID); err != nil || !bytes.Equal(existing, device.Token) {
+		if err := store.AddDevice(device.DeviceID, device.Token); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	metadata := store.GetMetadata(device.DeviceID)
+	if metadata.Name == "" && device.Name != "" {
+		metadata.Name = device.Name
+		store.SetMetadata(device.DeviceID, metadata)
+	}
+	return changed, nil
+}
@@ -0,0 +1,168 @@
+// Package mihome imports device tokens from local backups of the Mi Home app.
+package mihome
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nickw444/miio-go/common"
+	"github.com/nickw444/miio-go/protocol/tokens"
+)
+
+const (
+	// androidTable is the device table in the Android app's miio2.db.
+	androidTable = "devicerecord"
+	// iosTable is the device table in the iOS app's <user id>_mihome.sqlite.
+	iosTable = "ZDEVICE"
+)
+
+var (
+	ErrUnknownBackup = errors.New("Database is not a known Mi Home backup.")
+
+	// iosKey is the key the iOS app uses to encrypt tokens at rest.
+	iosKey = make([]byte, 16)
+)
+
+// Device is a device found in a Mi Home backup.
+type Device = tokens.ImportedDevice
+
+// Read reads devices from either an Android or iOS backup.
+func Read(path string) ([]Device, error) {
+	db, err := openDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case db.hasTable(androidTable):
+		return readAndroid(db)
+	case db.hasTable(iosTable):
+		return readIOS(db)
+	default:
+		return nil, ErrUnknownBackup
+	}
+}
+
+// ReadAndroid reads devices from the miio2.db database of the Android app.
+func ReadAndroid(path string) ([]Device, error) {
+	db, err := openDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+	return readAndroid(db)
+}
+
+// ReadIOS reads devices from the _mihome.sqlite database of an iOS backup.
+func ReadIOS(path string) ([]Device, error) {
+	db, err := openDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+	return readIOS(db)
+}
+
+func readAndroid(db *database) ([]Device, error) {
+	rows, err := db.rows(androidTable)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []Device
+	for _, r := range rows {
+		d, ok := newDevice(r.str("did"), r.str("token"), r.str("name"))
+		if !ok {
+			continue
+		}
+		d.Model = r.str("model")
+		d.IP = r.str("localip")
+		d.MacAddress = r.str("mac")
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+func readIOS(db *database) ([]Device, error) {
+	rows, err := db.rows(iosTable)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []Device
+	for _, r := range rows {
+		token, err := decryptIOSToken(r.str("ztoken"))
+		if err != nil {
+			common.Log.Warnf("Skipping device %s in Mi Home backup: %s", r.str("zdid"), err)
+			continue
+		}
+		d, ok := newDevice(r.str("zdid"), token, r.str("zname"))
+		if !ok {
+			continue
+		}
+		d.Model = r.str("zmodel")
+		d.IP = r.str("zlocalip")
+		d.MacAddress = r.str("zmac")
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// newDevice parses the device ID and hex token of a backup row. Rows without
+// a numeric device ID, such as Bluetooth devices, or without a valid token
+// are skipped.
+func newDevice(did string, hexToken string, name string) (Device, bool) {
+	deviceId, err := strconv.ParseUint(did, 10, 32)
+	if err != nil {
+		common.Log.Debugf("Skipping device %q in Mi Home backup: not a miIO device", did)
+		return Device{}, false
+	}
+	token, err := hex.DecodeString(strings.TrimSpace(hexToken))
+	if err != nil || len(token) != 16 {
+		common.Log.Warnf("Skipping device %d in Mi Home backup: malformed token", deviceId)
+		return Device{}, false
+	}
+	return Device{DeviceID: uint32(deviceId), Token: token, Name: name}, true
+}
+
+// decryptIOSToken returns the hex token from an iOS ZTOKEN value. Tokens are
+// stored as the hex encoding of the AES-128-ECB encrypted hex token, though
+// older versions of the app stored the hex token directly.
+func decryptIOSToken(ztoken string) (string, error) {
+	ztoken = strings.TrimSpace(ztoken)
+	if len(ztoken) <= 32 {
+		return ztoken, nil
+	}
+	if len(ztoken) < 64 {
+		return "", fmt.Errorf("Encrypted token too short")
+	}
+
+	ciphertext, err := hex.DecodeString(ztoken[:64])
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(iosKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	for i := 0; i < len(ciphertext); i += aes.BlockSize {
+		block.Decrypt(plaintext[i:i+aes.BlockSize], ciphertext[i:i+aes.BlockSize])
+	}
+	return string(plaintext), nil
+}
+
+// str returns a column as a string, formatting integers as decimal.
+func (r row) str(column string) string {
+	switch v := r[column].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	default:
+		return ""
+	}
+}
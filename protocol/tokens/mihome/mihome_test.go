@@ -0,0 +1,118 @@
+package mihome
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/nickw444/miio-go/protocol/tokens"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadAndroid(t *testing.T) {
+	devices, err := ReadAndroid("miio2.example.db")
+	assert.NoError(t, err)
+
+	// The Bluetooth device is skipped.
+	assert.Len(t, devices, 62)
+	assert.Equal(t, Device{
+		DeviceID:   57212011,
+		Token:      mustDecode("00112233445566778899aabbccddeeff"),
+		Model:      "yeelink.light.color1",
+		IP:         "192.168.1.20",
+		MacAddress: "28:6c:07:aa:bb:cc",
+		Name:       "Living Room Light",
+	}, devices[0])
+
+	// Large rows spill onto overflow pages.
+	assert.Equal(t, uint32(57212012), devices[1].DeviceID)
+	assert.Len(t, devices[1].Name, 3010)
+	assert.Equal(t, "ffeeddccbbaa99887766554433221100", hex.EncodeToString(devices[1].Token))
+
+	// Later rows are stored across several pages.
+	assert.Equal(t, uint32(100059), devices[61].DeviceID)
+	assert.Equal(t, "Fan 59", devices[61].Name)
+}
+
+func TestReadIOS(t *testing.T) {
+	devices, err := ReadIOS("mihome.example.sqlite")
+	assert.NoError(t, err)
+
+	assert.Len(t, devices, 3)
+	assert.Equal(t, Device{
+		DeviceID:   57212011,
+		Token:      mustDecode("00112233445566778899aabbccddeeff"),
+		Model:      "yeelink.light.color1",
+		IP:         "192.168.1.20",
+		MacAddress: "28:6C:07:AA:BB:CC",
+		Name:       "Living Room Light",
+	}, devices[0])
+	assert.Equal(t, "ffeeddccbbaa99887766554433221100", hex.EncodeToString(devices[1].Token))
+
+	// Older versions of the app stored unencrypted tokens.
+	assert.Equal(t, "0123456789abcdef0123456789abcdef", hex.EncodeToString(devices[2].Token))
+}
+
+func TestRead(t *testing.T) {
+	devices, err := Read("miio2.example.db")
+	assert.NoError(t, err)
+	assert.Len(t, devices, 62)
+
+	devices, err = Read("mihome.example.sqlite")
+	assert.NoError(t, err)
+	assert.Len(t, devices, 3)
+
+	_, err = Read("mihome.go")
+	assert.Equal(t, ErrNotSQLite, err)
+}
+
+func TestImport(t *testing.T) {
+	store := tokens.New()
+	store.AddDevice(57212011, mustDecode("00112233445566778899aabbccddeeff"))
+	store.AddDevice(57212012, mustDecode("ffffffffffffffffffffffffffffffff"))
+	store.SetMetadata(57212012, tokens.Metadata{Name: "Plug"})
+
+	devices, err := ReadIOS("mihome.example.sqlite")
+	assert.NoError(t, err)
+
+	imported, err := tokens.Import(store, devices)
+	assert.NoError(t, err)
+	// The unchanged token is not counted.
+	assert.Equal(t, 2, imported)
+
+	token, err := store.GetToken(57212012)
+	assert.NoError(t, err)
+	assert.Equal(t, "ffeeddccbbaa99887766554433221100", hex.EncodeToString(token))
+	_, err = store.GetToken(57212013)
+	assert.NoError(t, err)
+
+	// Existing names are kept.
+	assert.Equal(t, "Living Room Light", store.GetMetadata(57212011).Name)
+	assert.Equal(t, "Plug", store.GetMetadata(57212012).Name)
+	assert.Equal(t, "Bedroom Purifier", store.GetMetadata(57212013).Name)
+
+	// The model and IP are not kept, as they would override classification
+	// and discovery.
+	assert.Equal(t, tokens.Metadata{Name: "Living Room Light"}, store.GetMetadata(57212011))
+}
+
+func TestReadVarint(t *testing.T) {
+	v, n := readVarint([]byte{0x7f})
+	assert.Equal(t, uint64(0x7f), v)
+	assert.Equal(t, 1, n)
+
+	v, n = readVarint([]byte{0x81, 0x00})
+	assert.Equal(t, uint64(0x80), v)
+	assert.Equal(t, 2, n)
+
+	v, n = readVarint([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	assert.Equal(t, ^uint64(0), v)
+	assert.Equal(t, 9, n)
+}
+
+func mustDecode(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
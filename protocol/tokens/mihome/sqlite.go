@@ -0,0 +1,504 @@
+package mihome
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+)
+
+// A minimal, read-only reader for SQLite 3 database files. It supports just
+// enough of the file format to read every row of a table, which avoids a cgo
+// dependency for what is a one-off import. Changes which are still in a
+// rollback journal or write-ahead log are not applied, so databases with a
+// non-empty journal are refused rather than read stale.
+
+var (
+	ErrNotSQLite     = errors.New("File is not a SQLite 3 database.")
+	ErrTableNotFound = errors.New("Table not found.")
+)
+
+const (
+	sqliteMagic = "SQLite format 3\x00"
+
+	pageInteriorTable = 0x05
+	pageLeafTable     = 0x0d
+
+	// maxTreeDepth bounds how deep walk will descend, guarding against
+	// corrupt files. Real table b-trees are only a handful of levels deep.
+	maxTreeDepth = 64
+)
+
+type database struct {
+	data       []byte
+	pageSize   int
+	usableSize int
+}
+
+// row maps lower-cased column names to values. Values are nil, int64,
+// float64, string or []byte.
+type row map[string]interface{}
+
+func openDatabase(path string) (*database, error) {
+	for _, suffix := range []string{"-wal", "-journal"} {
+		info, err := os.Stat(path + suffix)
+		if err == nil && info.Size() > 0 {
+			return nil, fmt.Errorf("Database has uncommitted changes in %s. Close the app using it, "+
+				"or copy the database and open it with sqlite3 once to apply them, then try again", path+suffix)
+		} else if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 100 || string(data[:16]) != sqliteMagic {
+		return nil, ErrNotSQLite
+	}
+
+	pageSize := int(binary.BigEndian.Uint16(data[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return nil, ErrNotSQLite
+	}
+	// SQLite requires at least 480 usable bytes per page.
+	usableSize := pageSize - int(data[20])
+	if usableSize < 480 {
+		return nil, ErrNotSQLite
+	}
+	if encoding := binary.BigEndian.Uint32(data[56:60]); encoding > 1 {
+		return nil, fmt.Errorf("Unsupported SQLite text encoding %d", encoding)
+	}
+
+	return &database{
+		data:       data,
+		pageSize:   pageSize,
+		usableSize: usableSize,
+	}, nil
+}
+
+func (db *database) page(n uint32) ([]byte, error) {
+	start := int(n-1) * db.pageSize
+	if n == 0 || start+db.pageSize > len(db.data) {
+		return nil, fmt.Errorf("Page %d out of range", n)
+	}
+	return db.data[start : start+db.pageSize], nil
+}
+
+// hasTable reports whether the database contains a table with the given name.
+// Tables which cannot be read are still reported, so that reading them returns
+// the reason.
+func (db *database) hasTable(name string) bool {
+	_, _, err := db.schema(name)
+	return err != ErrTableNotFound
+}
+
+// schema returns the root page and columns of a table.
+func (db *database) schema(name string) (uint32, []column, error) {
+	var rootPage uint32
+	var sql string
+	found := false
+	err := db.walk(1, func(rowid int64, values []interface{}) error {
+		if len(values) < 5 || found {
+			return nil
+		}
+		if t, _ := values[0].(string); t != "table" {
+			return nil
+		}
+		if n, _ := values[1].(string); !strings.EqualFold(n, name) {
+			return nil
+		}
+		root, _ := values[3].(int64)
+		rootPage = uint32(root)
+		sql, _ = values[4].(string)
+		found = true
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if !found {
+		return 0, nil, ErrTableNotFound
+	}
+
+	columns, err := parseColumns(sql)
+	return rootPage, columns, err
+}
+
+// rows returns every row in the table.
+func (db *database) rows(table string) ([]row, error) {
+	rootPage, columns, err := db.schema(table)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []row
+	err = db.walk(rootPage, func(rowid int64, values []interface{}) error {
+		r := make(row, len(columns))
+		for i, c := range columns {
+			switch {
+			case c.rowid:
+				// An INTEGER PRIMARY KEY column is an alias for the rowid, and
+				// is stored as NULL in the record.
+				r[c.name] = rowid
+			case i < len(values):
+				r[c.name] = values[i]
+			default:
+				// Columns added after the row was written are NULL.
+				r[c.name] = nil
+			}
+		}
+		rows = append(rows, r)
+		return nil
+	})
+	return rows, err
+}
+
+// walk visits every record in the table b-tree rooted at the given page.
+func (db *database) walk(pageNum uint32, visit func(rowid int64, values []interface{}) error) error {
+	return db.walkPage(pageNum, visit, make(map[uint32]bool), 0)
+}
+
+func (db *database) walkPage(pageNum uint32, visit func(rowid int64, values []interface{}) error, visited map[uint32]bool, depth int) error {
+	if depth > maxTreeDepth {
+		return fmt.Errorf("B-tree deeper than %d pages at page %d", maxTreeDepth, pageNum)
+	}
+	if visited[pageNum] {
+		return fmt.Errorf("Page %d is referenced more than once", pageNum)
+	}
+	visited[pageNum] = true
+
+	page, err := db.page(pageNum)
+	if err != nil {
+		return err
+	}
+
+	headerOffset := 0
+	if pageNum == 1 {
+		headerOffset = 100
+	}
+	header := page[headerOffset:]
+	if len(header) < 8 {
+		return fmt.Errorf("Page header out of range on page %d", pageNum)
+	}
+	pageType := header[0]
+	numCells := int(binary.BigEndian.Uint16(header[3:5]))
+
+	cellPointers := header[8:]
+	if pageType == pageInteriorTable {
+		if len(header) < 12 {
+			return fmt.Errorf("Page header out of range on page %d", pageNum)
+		}
+		cellPointers = header[12:]
+	} else if pageType != pageLeafTable {
+		return fmt.Errorf("Unexpected page type %d on page %d", pageType, pageNum)
+	}
+	if numCells*2 > len(cellPointers) {
+		return fmt.Errorf("Cell count %d out of range on page %d", numCells, pageNum)
+	}
+
+	for i := 0; i < numCells; i++ {
+		offset := int(binary.BigEndian.Uint16(cellPointers[i*2 : i*2+2]))
+		if offset >= len(page) {
+			return fmt.Errorf("Cell offset out of range on page %d", pageNum)
+		}
+		cell := page[offset:]
+
+		if pageType == pageInteriorTable {
+			if len(cell) < 4 {
+				return fmt.Errorf("Cell out of range on page %d", pageNum)
+			}
+			if err := db.walkPage(binary.BigEndian.Uint32(cell[0:4]), visit, visited, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		payload, rowid, err := db.leafPayload(cell)
+		if err != nil {
+			return err
+		}
+		values, err := parseRecord(payload)
+		if err != nil {
+			return err
+		}
+		if err := visit(rowid, values); err != nil {
+			return err
+		}
+	}
+
+	if pageType == pageInteriorTable {
+		return db.walkPage(binary.BigEndian.Uint32(header[8:12]), visit, visited, depth+1)
+	}
+	return nil
+}
+
+// leafPayload reads the payload of a table leaf cell, following overflow
+// pages if necessary.
+func (db *database) leafPayload(cell []byte) ([]byte, int64, error) {
+	payloadSize, n := readVarint(cell)
+	cell = cell[n:]
+	rowid, n := readVarint(cell)
+	cell = cell[n:]
+
+	// A payload can never be larger than the file it is stored in.
+	if payloadSize > uint64(len(db.data)) {
+		return nil, 0, errors.New("Payload out of range")
+	}
+	p := int(payloadSize)
+	u := db.usableSize
+	maxLocal := u - 35
+	if p <= maxLocal {
+		if p > len(cell) {
+			return nil, 0, errors.New("Payload out of range")
+		}
+		return cell[:p], int64(rowid), nil
+	}
+
+	minLocal := ((u-12)*32)/255 - 23
+	local := minLocal + (p-minLocal)%(u-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	if local+4 > len(cell) {
+		return nil, 0, errors.New("Payload out of range")
+	}
+
+	payload := make([]byte, 0, p)
+	payload = append(payload, cell[:local]...)
+	next := binary.BigEndian.Uint32(cell[local : local+4])
+	for len(payload) < p {
+		if next == 0 {
+			return nil, 0, errors.New("Overflow chain ended early")
+		}
+		page, err := db.page(next)
+		if err != nil {
+			return nil, 0, err
+		}
+		next = binary.BigEndian.Uint32(page[0:4])
+		remaining := p - len(payload)
+		if remaining > u-4 {
+			remaining = u - 4
+		}
+		if 4+remaining > len(page) {
+			return nil, 0, errors.New("Overflow page out of range")
+		}
+		payload = append(payload, page[4:4+remaining]...)
+	}
+	return payload, int64(rowid), nil
+}
+
+func parseRecord(payload []byte) ([]interface{}, error) {
+	headerSize, n := readVarint(payload)
+	if headerSize > uint64(len(payload)) || int(headerSize) < n {
+		return nil, errors.New("Record header out of range")
+	}
+
+	var serialTypes []uint64
+	for offset := n; offset < int(headerSize); {
+		serialType, n := readVarint(payload[offset:])
+		serialTypes = append(serialTypes, serialType)
+		offset += n
+	}
+
+	body := payload[headerSize:]
+	values := make([]interface{}, 0, len(serialTypes))
+	for _, serialType := range serialTypes {
+		value, size, err := parseValue(serialType, body)
+		if err != nil {
+			return nil, err
+		}
+		if size > len(body) {
+			return nil, errors.New("Value out of range")
+		}
+		values = append(values, value)
+		body = body[size:]
+	}
+	return values, nil
+}
+
+func parseValue(serialType uint64, body []byte) (interface{}, int, error) {
+	intSizes := map[uint64]int{1: 1, 2: 2, 3: 3, 4: 4, 5: 6, 6: 8}
+
+	switch {
+	case serialType == 0:
+		return nil, 0, nil
+	case serialType == 8:
+		return int64(0), 0, nil
+	case serialType == 9:
+		return int64(1), 0, nil
+	case serialType == 7:
+		if len(body) < 8 {
+			return nil, 0, errors.New("Value out of range")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(body[:8])), 8, nil
+	case serialType <= 6:
+		size := intSizes[serialType]
+		if len(body) < size {
+			return nil, 0, errors.New("Value out of range")
+		}
+		// Sign extend the big endian integer.
+		v := int64(int8(body[0]))
+		for _, b := range body[1:size] {
+			v = v<<8 | int64(b)
+		}
+		return v, size, nil
+	case serialType >= 12:
+		if (serialType-12)/2 > uint64(len(body)) {
+			return nil, 0, errors.New("Value out of range")
+		}
+		size := int(serialType-12) / 2
+		if serialType%2 == 0 {
+			return append([]byte{}, body[:size]...), size, nil
+		}
+		return string(body[:size]), size, nil
+	default:
+		return nil, 0, fmt.Errorf("Unsupported serial type %d", serialType)
+	}
+}
+
+// readVarint reads a SQLite variable length integer, returning it and the
+// number of bytes read.
+func readVarint(data []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9 && i < len(data); i++ {
+		if i == 8 {
+			return v<<8 | uint64(data[i]), 9
+		}
+		v = v<<7 | uint64(data[i]&0x7f)
+		if data[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return v, len(data)
+}
+
+type column struct {
+	name  string
+	rowid bool
+}
+
+// parseColumns extracts the lower-cased column names from a CREATE TABLE
+// statement.
+func parseColumns(sql string) ([]column, error) {
+	defs, tail, ok := splitDefinitions(sql)
+	if !ok {
+		return nil, fmt.Errorf("Unable to parse table definition: %s", sql)
+	}
+	if strings.Contains(strings.Join(strings.Fields(strings.ToUpper(tail)), " "), "WITHOUT ROWID") {
+		// Rows of these tables are stored in an index b-tree, which walk
+		// does not read.
+		return nil, fmt.Errorf("WITHOUT ROWID tables are not supported: %s", sql)
+	}
+
+	var columns []column
+	for _, def := range defs {
+		name, rest, quoted := parseName(strings.TrimSpace(def))
+		if name == "" && !quoted {
+			continue
+		}
+		if !quoted {
+			switch strings.ToUpper(name) {
+			case "PRIMARY", "UNIQUE", "CHECK", "FOREIGN", "CONSTRAINT":
+				// Table constraints rather than columns.
+				continue
+			}
+		}
+		fields := strings.Fields(strings.ToUpper(rest))
+		columns = append(columns, column{
+			name:  strings.ToLower(name),
+			rowid: len(fields) > 0 && fields[0] == "INTEGER" && strings.Contains(strings.Join(fields, " "), "PRIMARY KEY"),
+		})
+	}
+	return columns, nil
+}
+
+// closingQuote returns the character which ends an identifier or string
+// starting with r, or 0 if r does not start one.
+func closingQuote(r byte) byte {
+	switch r {
+	case '"', '`', '\'':
+		return r
+	case '[':
+		return ']'
+	}
+	return 0
+}
+
+// parseName splits a column definition into its unquoted name and the rest of
+// the definition.
+func parseName(def string) (name string, rest string, quoted bool) {
+	if def == "" {
+		return "", "", false
+	}
+	end := closingQuote(def[0])
+	if end == 0 {
+		i := strings.IndexAny(def, " \t\r\n")
+		if i < 0 {
+			return def, "", false
+		}
+		return def[:i], def[i:], false
+	}
+
+	var b bytes.Buffer
+	for i := 1; i < len(def); i++ {
+		if def[i] != end {
+			b.WriteByte(def[i])
+			continue
+		}
+		// A doubled quote is an escaped quote, except within brackets.
+		if end != ']' && i+1 < len(def) && def[i+1] == end {
+			b.WriteByte(end)
+			i++
+			continue
+		}
+		return b.String(), def[i+1:], true
+	}
+	return b.String(), "", true
+}
+
+// splitDefinitions splits the parenthesised column definitions of a CREATE
+// TABLE statement on commas which are not nested within parentheses or
+// quotes, and returns the remainder of the statement after them.
+func splitDefinitions(sql string) (defs []string, tail string, ok bool) {
+	var current bytes.Buffer
+	depth := 0
+	var quote byte
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case closingQuote(c) != 0:
+			quote = closingQuote(c)
+		case c == '(':
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return append(defs, current.String()), sql[i+1:], true
+			}
+		case c == ',' && depth == 1:
+			defs = append(defs, current.String())
+			current.Reset()
+			continue
+		}
+		if depth > 0 {
+			current.WriteByte(c)
+		}
+	}
+	return nil, "", false
+}
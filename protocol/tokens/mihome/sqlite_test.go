@@ -0,0 +1,172 @@
+package mihome
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPageSize = 512
+
+// writeDatabase writes a database with 512 byte pages to a temporary file.
+// Each page is given as its b-tree page header and content, which is offset
+// past the file header on page 1.
+func writeDatabase(t *testing.T, dir string, pages ...[]byte) string {
+	data := make([]byte, testPageSize*len(pages))
+	copy(data, sqliteMagic)
+	binary.BigEndian.PutUint16(data[16:18], testPageSize)
+	binary.BigEndian.PutUint32(data[56:60], 1)
+	for i, page := range pages {
+		start := i * testPageSize
+		if i == 0 {
+			start += 100
+		}
+		copy(data[start:], page)
+	}
+	return writeFile(t, dir, data)
+}
+
+func writeFile(t *testing.T, dir string, data []byte) string {
+	path := filepath.Join(dir, "backup.db")
+	assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+	return path
+}
+
+func walkAll(path string) error {
+	db, err := openDatabase(path)
+	if err != nil {
+		return err
+	}
+	return db.walk(1, func(rowid int64, values []interface{}) error { return nil })
+}
+
+func TestWalkTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mihome")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data, err := ioutil.ReadFile("miio2.example.db")
+	assert.NoError(t, err)
+
+	for _, length := range []int{0, 50, 100, 101, 108, 512, 1000, len(data) / 2, len(data) - 1} {
+		_, err = ReadAndroid(writeFile(t, dir, data[:length]))
+		assert.Error(t, err, "length %d", length)
+	}
+}
+
+func TestWalkCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mihome")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// An interior page whose right-most pointer refers back to itself.
+	interior := []byte{pageInteriorTable, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	err = walkAll(writeDatabase(t, dir, interior))
+	assert.EqualError(t, err, "Page 1 is referenced more than once")
+
+	// Two interior pages which refer to each other.
+	first := []byte{pageInteriorTable, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}
+	second := []byte{pageInteriorTable, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	err = walkAll(writeDatabase(t, dir, first, second))
+	assert.EqualError(t, err, "Page 1 is referenced more than once")
+}
+
+func TestWalkCellOutOfRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mihome")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A leaf page claiming more cells than fit in the page.
+	leaf := []byte{pageLeafTable, 0, 0, 0xff, 0xff, 0, 0, 0}
+	err = walkAll(writeDatabase(t, dir, leaf))
+	assert.EqualError(t, err, "Cell count 65535 out of range on page 1")
+
+	// A cell pointer past the end of the page.
+	leaf = []byte{pageLeafTable, 0, 0, 0, 1, 0, 0, 0, 0xff, 0xff}
+	err = walkAll(writeDatabase(t, dir, leaf))
+	assert.EqualError(t, err, "Cell offset out of range on page 1")
+
+	// An interior cell in the last bytes of the page.
+	interior := make([]byte, testPageSize)
+	copy(interior, []byte{pageInteriorTable, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xfe})
+	db, err := openDatabase(writeDatabase(t, dir, []byte{pageLeafTable}, interior))
+	assert.NoError(t, err)
+	err = db.walk(2, func(rowid int64, values []interface{}) error { return nil })
+	assert.EqualError(t, err, "Cell out of range on page 2")
+
+	// A leaf cell whose payload size runs past the end of the page.
+	leaf = make([]byte, testPageSize-100)
+	copy(leaf, []byte{pageLeafTable, 0, 0, 0, 1, 0, 0, 0, 0x01, 0x00})
+	copy(leaf[256-100:], []byte{0x83, 0x00, 0x01})
+	err = walkAll(writeDatabase(t, dir, leaf))
+	assert.EqualError(t, err, "Payload out of range")
+
+	// A record value whose size runs past the end of the payload.
+	copy(leaf[256-100:], []byte{0x03, 0x01, 0x02, 0x7f})
+	err = walkAll(writeDatabase(t, dir, leaf))
+	assert.EqualError(t, err, "Value out of range")
+}
+
+func TestOpenInvalidPageSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mihome")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, testPageSize)
+	copy(data, sqliteMagic)
+	_, err = openDatabase(writeFile(t, dir, data))
+	assert.Equal(t, ErrNotSQLite, err)
+}
+
+func TestOpenJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mihome")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data, err := ioutil.ReadFile("miio2.example.db")
+	assert.NoError(t, err)
+	path := writeFile(t, dir, data)
+
+	// Empty journals hold no changes.
+	for _, suffix := range []string{"-wal", "-journal"} {
+		assert.NoError(t, ioutil.WriteFile(path+suffix, nil, 0600))
+	}
+	_, err = ReadAndroid(path)
+	assert.NoError(t, err)
+
+	for _, suffix := range []string{"-wal", "-journal"} {
+		assert.NoError(t, ioutil.WriteFile(path+suffix, []byte{1}, 0600))
+		_, err = ReadAndroid(path)
+		assert.EqualError(t, err, "Database has uncommitted changes in "+path+suffix+". Close the app using it, "+
+			"or copy the database and open it with sqlite3 once to apply them, then try again")
+		assert.NoError(t, os.Remove(path+suffix))
+	}
+}
+
+func TestParseColumns(t *testing.T) {
+	columns, err := parseColumns(`CREATE TABLE "device (list)" (` +
+		`"_id" INTEGER PRIMARY KEY, [Device Name] TEXT DEFAULT 'a, b', "say ""hi""" TEXT, ` +
+		"`model,id` VARCHAR(10, 2), token TEXT, CONSTRAINT uniq UNIQUE (token))")
+	assert.NoError(t, err)
+	assert.Equal(t, []column{
+		{name: "_id", rowid: true},
+		{name: "device name"},
+		{name: `say "hi"`},
+		{name: "model,id"},
+		{name: "token"},
+	}, columns)
+}
+
+func TestParseColumnsWithoutRowid(t *testing.T) {
+	_, err := parseColumns("CREATE TABLE devices (did TEXT PRIMARY KEY, token TEXT) without  rowid")
+	assert.EqualError(t, err, "WITHOUT ROWID tables are not supported: "+
+		"CREATE TABLE devices (did TEXT PRIMARY KEY, token TEXT) without  rowid")
+
+	// The table name or a column may contain the phrase.
+	_, err = parseColumns(`CREATE TABLE "without rowid" ("without rowid" TEXT)`)
+	assert.NoError(t, err)
+}
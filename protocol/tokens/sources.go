@@ -0,0 +1,276 @@
+package tokens
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// TokenSource provides device tokens, but cannot store them. Every TokenStore
+// is also a TokenSource.
+type TokenSource interface {
+	GetToken(deviceId uint32) ([]byte, error)
+}
+
+// enumerableSource is implemented by sources which can list their devices.
+type enumerableSource interface {
+	Devices() []uint32
+}
+
+// metadataSource is implemented by sources which hold device metadata.
+type metadataSource interface {
+	GetMetadata(deviceId uint32) Metadata
+}
+
+const (
+	DefaultEnvPrefix      = "MIIO_TOKEN_"
+	DefaultCommandTimeout = time.Second * 10
+	// DefaultCommandRetryInterval is how long a failed command lookup is
+	// cached before the command is run again.
+	DefaultCommandRetryInterval = time.Minute
+	// DefaultCommandCacheTTL is how long a token found by a command is cached
+	// before the command is run again, so that rotated secrets are picked up.
+	DefaultCommandCacheTTL = time.Minute * 10
+
+	// TokenLength is the length of device tokens in bytes.
+	TokenLength = 16
+)
+
+func errNotFound(deviceId uint32) error {
+	return fmt.Errorf("Device ID %d does not exist in token store", deviceId)
+}
+
+// decodeToken decodes a hex token read from the named source.
+func decodeToken(deviceId uint32, value string, source string) ([]byte, error) {
+	token, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("Malformed token for device %d from %s: %s", deviceId, source, err)
+	}
+	if len(token) != TokenLength {
+		return nil, fmt.Errorf("Token for device %d from %s is %d bytes, expected %d", deviceId, source,
+			len(token), TokenLength)
+	}
+	return token, nil
+}
+
+type envSource struct {
+	prefix string
+}
+
+// NewEnvSource reads tokens from environment variables named with the prefix
+// followed by the device ID, e.g. MIIO_TOKEN_123456, containing a hex token.
+func NewEnvSource(prefix string) TokenSource {
+	return &envSource{prefix: prefix}
+}
+
+func (e *envSource) GetToken(deviceId uint32) ([]byte, error) {
+	name := fmt.Sprintf("%s%d", e.prefix, deviceId)
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, errNotFound(deviceId)
+	}
+	return decodeToken(deviceId, value, "environment variable "+name)
+}
+
+func (e *envSource) Devices() []uint32 {
+	var ids []uint32
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		if !strings.HasPrefix(name, e.prefix) {
+			continue
+		}
+		deviceId, err := strconv.ParseUint(strings.TrimPrefix(name, e.prefix), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(deviceId))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+type dirSource struct {
+	dir string
+}
+
+// NewDirSource reads tokens from files in a directory, named with the device
+// ID and containing a hex token, as is common for mounted secrets. Files are
+// read on each lookup, so updated secrets are picked up.
+func NewDirSource(dir string) TokenSource {
+	return &dirSource{dir: dir}
+}
+
+func (d *dirSource) GetToken(deviceId uint32) ([]byte, error) {
+	path := filepath.Join(d.dir, strconv.FormatUint(uint64(deviceId), 10))
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errNotFound(deviceId)
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeToken(deviceId, string(data), "file "+path)
+}
+
+func (d *dirSource) Devices() []uint32 {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil
+	}
+	var ids []uint32
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		deviceId, err := strconv.ParseUint(f.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(deviceId))
+	}
+	return ids
+}
+
+// CommandConfig holds optional command source configuration.
+type CommandConfig struct {
+	Timeout       time.Duration // Defaults to DefaultCommandTimeout.
+	RetryInterval time.Duration // Defaults to DefaultCommandRetryInterval.
+	CacheTTL      time.Duration // Defaults to DefaultCommandCacheTTL.
+	Clock         clock.Clock   // Defaults to the system clock.
+}
+
+type commandSource struct {
+	name   string
+	args   []string
+	config CommandConfig
+
+	mutex    sync.Mutex
+	tokens   map[uint32]cachedToken
+	failures map[uint32]failure
+	lookups  map[uint32]*lookup
+}
+
+// cachedToken is a cached successful lookup.
+type cachedToken struct {
+	token []byte
+	at    time.Time
+}
+
+// failure is a cached failed lookup.
+type failure struct {
+	err error
+	at  time.Time
+}
+
+// lookup is a lookup in progress, which concurrent callers wait for.
+type lookup struct {
+	done  chan struct{}
+	token []byte
+	err   error
+}
+
+// NewCommandSource runs a command, such as a secrets helper, to look up
+// tokens. The device ID is appended to the arguments and the command must
+// print the hex token. Tokens are cached for DefaultCommandCacheTTL once
+// found, and failed lookups are not retried for DefaultCommandRetryInterval.
+func NewCommandSource(name string, args ...string) TokenSource {
+	return NewCommandSourceWithConfig(CommandConfig{}, name, args...)
+}
+
+// NewCommandSourceWithTimeout runs the command with the given timeout, which
+// bounds how long a device's handshake can wait for its token.
+func NewCommandSourceWithTimeout(timeout time.Duration, name string, args ...string) TokenSource {
+	return NewCommandSourceWithConfig(CommandConfig{Timeout: timeout}, name, args...)
+}
+
+// NewCommandSourceWithConfig runs the command with the given configuration.
+func NewCommandSourceWithConfig(config CommandConfig, name string, args ...string) TokenSource {
+	if config.Timeout == 0 {
+		config.Timeout = DefaultCommandTimeout
+	}
+	if config.RetryInterval == 0 {
+		config.RetryInterval = DefaultCommandRetryInterval
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = DefaultCommandCacheTTL
+	}
+	if config.Clock == nil {
+		config.Clock = clock.New()
+	}
+	return &commandSource{
+		name:     name,
+		args:     args,
+		config:   config,
+		tokens:   make(map[uint32]cachedToken),
+		failures: make(map[uint32]failure),
+		lookups:  make(map[uint32]*lookup),
+	}
+}
+
+// GetToken returns a cached result if there is one. Otherwise the command is
+// run, with concurrent lookups for the same device sharing a single run.
+func (c *commandSource) GetToken(deviceId uint32) ([]byte, error) {
+	now := c.config.Clock.Now()
+	c.mutex.Lock()
+	if cached, ok := c.tokens[deviceId]; ok && now.Sub(cached.at) < c.config.CacheTTL {
+		c.mutex.Unlock()
+		return cached.token, nil
+	}
+	if f, ok := c.failures[deviceId]; ok && now.Sub(f.at) < c.config.RetryInterval {
+		c.mutex.Unlock()
+		return nil, f.err
+	}
+	if l, ok := c.lookups[deviceId]; ok {
+		c.mutex.Unlock()
+		<-l.done
+		return l.token, l.err
+	}
+	l := &lookup{done: make(chan struct{})}
+	c.lookups[deviceId] = l
+	c.mutex.Unlock()
+
+	l.token, l.err = c.run(deviceId)
+
+	c.mutex.Lock()
+	delete(c.lookups, deviceId)
+	if l.err != nil {
+		delete(c.tokens, deviceId)
+		c.failures[deviceId] = failure{err: l.err, at: c.config.Clock.Now()}
+	} else {
+		delete(c.failures, deviceId)
+		c.tokens[deviceId] = cachedToken{token: l.token, at: c.config.Clock.Now()}
+	}
+	c.mutex.Unlock()
+	close(l.done)
+	return l.token, l.err
+}
+
+func (c *commandSource) run(deviceId uint32) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.Timeout)
+	defer cancel()
+
+	args := append(append([]string{}, c.args...), strconv.FormatUint(uint64(deviceId), 10))
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Token command failed for device %d: %s: %s", deviceId, err,
+			strings.TrimSpace(stderr.String()))
+	}
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return nil, errNotFound(deviceId)
+	}
+	return decodeToken(deviceId, stdout.String(), "command "+c.name)
+}
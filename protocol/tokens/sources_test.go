@@ -0,0 +1,159 @@
+package tokens
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvSource(t *testing.T) {
+	os.Setenv("MIIO_TEST_TOKEN_10", "ffffffffffffffffffffffffffffffff")
+	os.Setenv("MIIO_TEST_TOKEN_invalid", "ffffffffffffffffffffffffffffffff")
+	defer os.Unsetenv("MIIO_TEST_TOKEN_10")
+	defer os.Unsetenv("MIIO_TEST_TOKEN_invalid")
+
+	source := NewEnvSource("MIIO_TEST_TOKEN_")
+	token, err := source.GetToken(10)
+	assert.NoError(t, err)
+	assert.Equal(t, "ffffffffffffffffffffffffffffffff", hex.EncodeToString(token))
+
+	_, err = source.GetToken(11)
+	assert.Error(t, err)
+	assert.Equal(t, []uint32{10}, source.(enumerableSource).Devices())
+}
+
+func TestDirSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "10"), []byte("badcafefffffffffffffffffffffffff\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("Not a token"), 0600))
+
+	source := NewDirSource(dir)
+	token, err := source.GetToken(10)
+	assert.NoError(t, err)
+	assert.Equal(t, "badcafefffffffffffffffffffffffff", hex.EncodeToString(token))
+
+	_, err = source.GetToken(11)
+	assert.Error(t, err)
+	assert.Equal(t, []uint32{10}, source.(enumerableSource).Devices())
+}
+
+// The device ID is passed to the command, which prints the token.
+func TestCommandSource(t *testing.T) {
+	source := NewCommandSource("sh", "-c", `[ "$0" = 10 ] && echo ffffffffffffffffffffffffffffffff`)
+
+	token, err := source.GetToken(10)
+	assert.NoError(t, err)
+	assert.Equal(t, "ffffffffffffffffffffffffffffffff", hex.EncodeToString(token))
+
+	_, err = source.GetToken(11)
+	assert.Error(t, err)
+}
+
+// Tokens which are not 16 bytes are rejected, naming the source.
+func TestSources_TokenLength(t *testing.T) {
+	os.Setenv("MIIO_TEST_TOKEN_10", "ffff")
+	defer os.Unsetenv("MIIO_TEST_TOKEN_10")
+	_, err := NewEnvSource("MIIO_TEST_TOKEN_").GetToken(10)
+	assert.EqualError(t, err, "Token for device 10 from environment variable MIIO_TEST_TOKEN_10 is 2 bytes, expected 16")
+
+	dir, err := ioutil.TempDir("", "tokens")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "10")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("ffffffffffffffffffffffffffffffffff\n"), 0600))
+	_, err = NewDirSource(dir).GetToken(10)
+	assert.EqualError(t, err, "Token for device 10 from file "+path+" is 17 bytes, expected 16")
+
+	_, err = NewCommandSource("echo", "ffff").GetToken(10)
+	assert.Error(t, err)
+}
+
+// Failed lookups are cached, and concurrent lookups share a single run.
+func TestCommandSource_Cached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	runs := filepath.Join(dir, "runs")
+
+	source := NewCommandSource("sh", "-c", `echo run >> "$0"; sleep 0.1; [ "$1" = 10 ] && echo ffffffffffffffffffffffffffffffff`, runs)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := source.GetToken(11)
+			assert.Error(t, err)
+		}()
+	}
+	wg.Wait()
+	_, err = source.GetToken(11)
+	assert.Error(t, err)
+
+	data, err := ioutil.ReadFile(runs)
+	assert.NoError(t, err)
+	assert.Equal(t, "run\n", string(data))
+}
+
+// Cached tokens expire, so that rotated secrets are read again.
+func TestCommandSource_CacheTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "secret")
+	assert.NoError(t, ioutil.WriteFile(secret, []byte("ffffffffffffffffffffffffffffffff\n"), 0600))
+
+	clk := clock.NewMock()
+	source := NewCommandSourceWithConfig(CommandConfig{CacheTTL: time.Minute, Clock: clk}, "sh", "-c", `cat "$0"`, secret)
+	token, err := source.GetToken(10)
+	assert.NoError(t, err)
+	assert.Equal(t, "ffffffffffffffffffffffffffffffff", hex.EncodeToString(token))
+
+	assert.NoError(t, ioutil.WriteFile(secret, []byte("00000000000000000000000000000000\n"), 0600))
+	token, err = source.GetToken(10)
+	assert.NoError(t, err)
+	assert.Equal(t, "ffffffffffffffffffffffffffffffff", hex.EncodeToString(token))
+
+	clk.Add(time.Minute)
+	token, err = source.GetToken(10)
+	assert.NoError(t, err)
+	assert.Equal(t, "00000000000000000000000000000000", hex.EncodeToString(token))
+}
+
+// Failed lookups are retried after the retry interval.
+func TestCommandSource_RetryInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "secret")
+
+	clk := clock.NewMock()
+	source := NewCommandSourceWithConfig(CommandConfig{RetryInterval: time.Minute, Clock: clk}, "sh", "-c", `cat "$0"`, secret)
+	_, err = source.GetToken(10)
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(secret, []byte("ffffffffffffffffffffffffffffffff\n"), 0600))
+	_, err = source.GetToken(10)
+	assert.Error(t, err)
+
+	clk.Add(time.Minute)
+	_, err = source.GetToken(10)
+	assert.NoError(t, err)
+}
+
+// Commands which do not finish in time fail.
+func TestCommandSource_Timeout(t *testing.T) {
+	source := NewCommandSourceWithTimeout(time.Millisecond*50, "sleep", "5")
+	start := time.Now()
+	_, err := source.GetToken(10)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
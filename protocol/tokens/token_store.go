@@ -2,11 +2,17 @@ package tokens
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/nickw444/miio-go/common"
 )
 
 type TokenStore interface {
@@ -15,15 +21,62 @@ type TokenStore interface {
 	GetToken(deviceId uint32) ([]byte, error)
 	AddDevice(deviceId uint32, token []byte) error
 	RemoveDevice(deviceId uint32)
+	// GetMetadata returns the metadata for the device, or the zero value if
+	// it has none.
+	GetMetadata(deviceId uint32) Metadata
+	SetMetadata(deviceId uint32, metadata Metadata)
+	// Devices returns the IDs of all devices with a token or metadata, in
+	// ascending order.
+	Devices() []uint32
+}
+
+// Metadata is user supplied information about a device. Metadata can only be
+// persisted in the JSON format.
+type Metadata struct {
+	Name     string `json:"name,omitempty"`
+	Room     string `json:"room,omitempty"`
+	StaticIP string `json:"static_ip,omitempty"`
+	// Model overrides the model reported by the device when classifying it.
+	Model string `json:"model,omitempty"`
+	Notes string `json:"notes,omitempty"`
+}
+
+// Format is the on-disk format of a token store.
+type Format int
+
+const (
+	// FormatLegacy is the original format of deviceID=hexToken lines.
+	FormatLegacy Format = iota
+	// FormatJSON is a JSON document which also holds device metadata.
+	FormatJSON
+)
+
+// layout holds the comments and blank lines of a loaded token file, so that
+// they can be written back around the sorted tokens.
+type layout struct {
+	// header is the lines before the first token, up to and including the
+	// last blank line before it.
+	header []string
+	// comments are the remaining lines above each token, back to the
+	// previous token. They move with the token when it is sorted.
+	comments map[uint32][]string
+	// footer is the lines after the last token.
+	footer []string
 }
 
 type tokenStore struct {
-	tokens map[uint32][]byte
+	mutex      sync.RWMutex
+	writeMutex sync.Mutex
+	format     Format
+	tokens     map[uint32][]byte
+	metadata   map[uint32]Metadata
+	layout     layout
 }
 
 func New() TokenStore {
 	return &tokenStore{
-		tokens: make(map[uint32][]byte),
+		tokens:   make(map[uint32][]byte),
+		metadata: make(map[uint32]Metadata),
 	}
 }
 
@@ -33,83 +86,224 @@ func FromFile(filePath string) (TokenStore, error) {
 	return store, err
 }
 
+// LoadFile loads tokens from either the legacy or JSON format, which is
+// detected from the file contents. Subsequent writes use the same format.
 func (t *tokenStore) LoadFile(inputPath string) error {
-	if _, err := os.Stat(inputPath); os.IsNotExist(err) {
+	data, err := ioutil.ReadFile(inputPath)
+	if os.IsNotExist(err) {
 		// File doesn't exist, so don't load anything.
 		return nil
+	} else if err != nil {
+		return err
 	}
 
-	f, err := os.Open(inputPath)
-	defer f.Close()
-
-	if err != nil {
-		return err
+	if _, ok := parseEnvelope(data); ok {
+		return ErrEncrypted
+	}
+	if isJSON(data) {
+		return t.loadJSON(data)
 	}
+	return t.loadLegacy(data)
+}
+
+func (t *tokenStore) loadLegacy(data []byte) error {
+	tokens := make(map[uint32][]byte)
+	l := layout{comments: make(map[uint32][]string)}
+	var pending []string
 
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	scanner.Split(bufio.ScanLines)
 
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
 
-		if len(line) == 0 {
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+			pending = append(pending, text)
 			continue
 		}
-
-		if strings.HasPrefix(line, "#") {
+		if !strings.Contains(trimmed, "=") {
+			// Keep unknown lines as comments so that they survive a rewrite.
+			// Lines which look like tokens but can't be parsed are errors.
+			common.Log.Warnf("Keeping unrecognised line in token store: %s", text)
+			pending = append(pending, text)
 			continue
 		}
 
-		splitLine := strings.Split(line, "=")
-		if len(splitLine) != 2 {
-			return fmt.Errorf("Malformed line: %s", line)
-		}
-
-		deviceId, err := strconv.ParseUint(splitLine[0], 10, 32)
+		deviceId, token, err := parseLine(trimmed)
 		if err != nil {
-			return fmt.Errorf("Malformed line: %s", line)
+			return err
 		}
 
-		token, err := hex.DecodeString(splitLine[1])
-		if err != nil {
-			return fmt.Errorf("Malformed line: %s", line)
+		if len(tokens) == 0 {
+			// Split the file's header from the first token's comments.
+			for i := len(pending) - 1; i >= 0; i-- {
+				if strings.TrimSpace(pending[i]) == "" {
+					l.header, pending = pending[:i+1], pending[i+1:]
+					break
+				}
+			}
 		}
-
-		t.tokens[uint32(deviceId)] = token
+		l.comments[deviceId] = append(l.comments[deviceId], pending...)
+		pending = nil
+		tokens[deviceId] = token
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		l.header = pending
+	} else {
+		l.footer = pending
 	}
 
+	t.mutex.Lock()
+	for deviceId, token := range tokens {
+		t.tokens[deviceId] = token
+	}
+	t.layout = l
+	t.format = FormatLegacy
+	t.mutex.Unlock()
 	return nil
 }
 
+func parseLine(text string) (uint32, []byte, error) {
+	splitLine := strings.Split(text, "=")
+	if len(splitLine) != 2 {
+		return 0, nil, fmt.Errorf("Malformed line: %s", text)
+	}
+
+	deviceId, err := strconv.ParseUint(strings.TrimSpace(splitLine[0]), 10, 32)
+	if err != nil {
+		return 0, nil, fmt.Errorf("Malformed line: %s", text)
+	}
+
+	token, err := hex.DecodeString(strings.TrimSpace(splitLine[1]))
+	if err != nil {
+		return 0, nil, fmt.Errorf("Malformed line: %s", text)
+	}
+
+	return uint32(deviceId), token, nil
+}
+
+// WriteFile atomically writes the store to the given path, in the format it
+// was loaded from. Stores with metadata are always written as JSON, as the
+// legacy format cannot hold it.
 func (t *tokenStore) WriteFile(outputPath string) error {
-	f, err := os.Create(outputPath)
+	t.mutex.RLock()
+	format := t.format
+	if len(t.metadata) > 0 {
+		format = FormatJSON
+	}
+	t.mutex.RUnlock()
+
+	return t.writeFormat(outputPath, format)
+}
+
+func (t *tokenStore) writeFormat(outputPath string, format Format) error {
+	// Serialise writes so that the most recent tokens are written last.
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+
+	var data []byte
+	var err error
+	if format == FormatJSON {
+		data, err = t.marshalJSON()
+	} else {
+		data = t.marshalLegacy()
+	}
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	return common.WriteFileAtomic(outputPath, data, 0600)
+}
 
-	for deviceId, tokenBytes := range t.tokens {
-		tokenStr := hex.EncodeToString(tokenBytes)
-		_, err := f.WriteString(fmt.Sprintf("%d=%s\n", deviceId, tokenStr))
-		if err != nil {
-			return err
-		}
+// marshalLegacy writes tokens sorted by device ID. Comments above a token in
+// the loaded file are written above it, and the file's header and footer are
+// kept in place. Comments for removed tokens are dropped.
+func (t *tokenStore) marshalLegacy() []byte {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	deviceIds := make([]uint32, 0, len(t.tokens))
+	for deviceId := range t.tokens {
+		deviceIds = append(deviceIds, deviceId)
 	}
-	return nil
+	sort.Slice(deviceIds, func(i, j int) bool { return deviceIds[i] < deviceIds[j] })
+
+	var buf bytes.Buffer
+	writeLines(&buf, t.layout.header)
+	for _, deviceId := range deviceIds {
+		writeLines(&buf, t.layout.comments[deviceId])
+		writeToken(&buf, deviceId, t.tokens[deviceId])
+	}
+	writeLines(&buf, t.layout.footer)
+	return buf.Bytes()
+}
+
+func writeLines(buf *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		buf.WriteString(line + "\n")
+	}
+}
+
+func writeToken(buf *bytes.Buffer, deviceId uint32, token []byte) {
+	buf.WriteString(fmt.Sprintf("%d=%s\n", deviceId, hex.EncodeToString(token)))
 }
 
 func (t *tokenStore) GetToken(deviceId uint32) ([]byte, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
 	if val, ok := t.tokens[deviceId]; ok {
 		return val, nil
 	}
-	return nil, fmt.Errorf("Device ID %d does not exist in token store", deviceId)
+	return nil, errNotFound(deviceId)
 }
 
 func (t *tokenStore) AddDevice(deviceId uint32, token []byte) error {
+	t.mutex.Lock()
 	t.tokens[deviceId] = token
+	t.mutex.Unlock()
 	return nil
 }
 
 func (t *tokenStore) RemoveDevice(deviceId uint32) {
+	t.mutex.Lock()
 	delete(t.tokens, deviceId)
+	t.mutex.Unlock()
+}
+
+func (t *tokenStore) GetMetadata(deviceId uint32) Metadata {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.metadata[deviceId]
+}
+
+func (t *tokenStore) SetMetadata(deviceId uint32, metadata Metadata) {
+	t.mutex.Lock()
+	if metadata == (Metadata{}) {
+		delete(t.metadata, deviceId)
+	} else {
+		t.metadata[deviceId] = metadata
+	}
+	t.mutex.Unlock()
+}
+
+func (t *tokenStore) Devices() []uint32 {
+	t.mutex.RLock()
+	seen := make(map[uint32]bool)
+	var ids []uint32
+	for deviceId := range t.tokens {
+		seen[deviceId] = true
+		ids = append(ids, deviceId)
+	}
+	for deviceId := range t.metadata {
+		if !seen[deviceId] {
+			ids = append(ids, deviceId)
+		}
+	}
+	t.mutex.RUnlock()
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
 }
@@ -1,6 +1,11 @@
 package tokens
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"encoding/hex"
@@ -18,3 +23,107 @@ func TestFromFile(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "badcafefffffffffffffffffffffffff", hex.EncodeToString(token))
 }
+
+// WriteFile sorts tokens by device ID, keeping the file's header and footer
+// in place and comments and unknown lines with the token below them.
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.txt")
+
+	original := "# Tokens\n" +
+		"\n" +
+		"# Living room\n" +
+		"123456=ffffffffffffffffffffffffffffffff\n" +
+		"# Bedroom\n" +
+		"not a token\n" +
+		"111222=badcafefffffffffffffffffffffffff\n" +
+		"# Removed\n" +
+		"333444=ffffffffffffffffffffffffffffffff\n" +
+		"\n" +
+		"# End\n"
+	assert.NoError(t, ioutil.WriteFile(path, []byte(original), 0600))
+
+	store, err := FromFile(path)
+	assert.NoError(t, err)
+	store.AddDevice(30, bytes.Repeat([]byte{0x01}, 16))
+	store.AddDevice(20, bytes.Repeat([]byte{0x02}, 16))
+	store.AddDevice(111222, bytes.Repeat([]byte{0xaa}, 16))
+	store.RemoveDevice(333444)
+	assert.NoError(t, store.WriteFile(path))
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "# Tokens\n"+
+		"\n"+
+		"20=02020202020202020202020202020202\n"+
+		"30=01010101010101010101010101010101\n"+
+		"# Bedroom\n"+
+		"not a token\n"+
+		"111222=aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa\n"+
+		"# Living room\n"+
+		"123456=ffffffffffffffffffffffffffffffff\n"+
+		"\n"+
+		"# End\n", string(data))
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1, "Temporary file was not cleaned up")
+}
+
+// Files written in map order by earlier versions are sorted when rewritten.
+func TestWriteFile_Unsorted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.txt")
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("30=01010101010101010101010101010101\n"+
+		"10=02020202020202020202020202020202\n"+
+		"20=03030303030303030303030303030303\n"), 0600))
+	store, err := FromFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, store.WriteFile(path))
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "10=02020202020202020202020202020202\n"+
+		"20=03030303030303030303030303030303\n"+
+		"30=01010101010101010101010101010101\n", string(data))
+}
+
+// Lines which look like tokens but are malformed fail to load, rather than
+// being silently dropped.
+func TestFromFile_Malformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tokens.txt")
+
+	for _, data := range []string{
+		"123456=zz\n",
+		"123456=ff=ff\n",
+		"abc=ffffffffffffffffffffffffffffffff\n",
+	} {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0600))
+		_, err := FromFile(path)
+		assert.Error(t, err, data)
+	}
+}
+
+// The store may be used from multiple goroutines.
+func TestTokenStore_Concurrent(t *testing.T) {
+	store := New()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id uint32) {
+			defer wg.Done()
+			store.AddDevice(id, bytes.Repeat([]byte{0xff}, 16))
+			store.GetToken(id)
+			store.RemoveDevice(id)
+		}(uint32(i))
+	}
+	wg.Wait()
+}
@@ -0,0 +1,212 @@
+package tokens
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/common"
+)
+
+const DefaultReloadInterval = time.Second * 5
+
+// Change describes a token which changed when a store was reloaded. OldToken
+// is nil for added tokens, and NewToken is nil for removed tokens.
+type Change struct {
+	DeviceID uint32
+	OldToken []byte
+	NewToken []byte
+}
+
+// Watcher polls a token file and reloads the store when it changes.
+type Watcher interface {
+	// Changes returns a channel of token changes. It is closed when the
+	// watcher is closed.
+	Changes() <-chan Change
+	Close()
+}
+
+// reloadable is implemented by file-backed stores. Reloading replaces the
+// contents of the store, returning the tokens before and after.
+type reloadable interface {
+	reload(path string) (previous map[uint32][]byte, current map[uint32][]byte, err error)
+}
+
+type watcher struct {
+	store    reloadable
+	path     string
+	interval time.Duration
+	clock    clock.Clock
+
+	// Hash of the file contents when last loaded. Modification times and
+	// sizes aren't enough to detect a token replaced by another of the same
+	// length, as some editors preserve the modification time.
+	hash [sha256.Size]byte
+
+	changes   chan Change
+	quitChan  chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Watch polls the file at path at the given interval, reloading the store
+// whenever the file is modified. The file is authoritative: tokens added to
+// the store but not written to the file are lost on reload. Chains are
+// watched via their writable store.
+func Watch(store TokenStore, path string, interval time.Duration, clk clock.Clock) (Watcher, error) {
+	if c, ok := store.(*chainStore); ok {
+		store = c.writable
+	}
+	r, ok := store.(reloadable)
+	if !ok {
+		return nil, fmt.Errorf("Token store %T cannot be reloaded", store)
+	}
+	if interval == 0 {
+		interval = DefaultReloadInterval
+	}
+	if clk == nil {
+		clk = clock.New()
+	}
+
+	w := &watcher{
+		store:    r,
+		path:     path,
+		interval: interval,
+		clock:    clk,
+		changes:  make(chan Change),
+		quitChan: make(chan struct{}),
+	}
+	w.hash = w.fingerprint()
+
+	ticker := clk.Ticker(interval)
+	w.wg.Add(1)
+	go w.run(ticker)
+	return w, nil
+}
+
+func (w *watcher) Changes() <-chan Change {
+	return w.changes
+}
+
+func (w *watcher) Close() {
+	w.closeOnce.Do(func() {
+		close(w.quitChan)
+		w.wg.Wait()
+		close(w.changes)
+	})
+}
+
+// fingerprint returns the hash of the file, or a zero hash if it can't be
+// read.
+func (w *watcher) fingerprint() [sha256.Size]byte {
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return [sha256.Size]byte{}
+	}
+	return sha256.Sum256(data)
+}
+
+func (w *watcher) run(ticker *clock.Ticker) {
+	defer w.wg.Done()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.quitChan:
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check reloads the store if the file has been modified since the last check.
+func (w *watcher) check() {
+	hash := w.fingerprint()
+	if hash == w.hash {
+		return
+	}
+	w.hash = hash
+
+	previous, current, err := w.store.reload(w.path)
+	if err != nil {
+		common.Log.Warnf("Unable to reload token store %s, keeping existing tokens: %s", w.path, err)
+		return
+	}
+	common.Log.Infof("Reloaded token store %s", w.path)
+
+	for _, change := range diff(previous, current) {
+		select {
+		case w.changes <- change:
+		case <-w.quitChan:
+			return
+		}
+	}
+}
+
+func diff(previous map[uint32][]byte, current map[uint32][]byte) []Change {
+	var changes []Change
+	for deviceId, newToken := range current {
+		if oldToken, ok := previous[deviceId]; !ok || !bytes.Equal(oldToken, newToken) {
+			changes = append(changes, Change{DeviceID: deviceId, OldToken: oldToken, NewToken: newToken})
+		}
+	}
+	for deviceId, oldToken := range previous {
+		if _, ok := current[deviceId]; !ok {
+			changes = append(changes, Change{DeviceID: deviceId, OldToken: oldToken})
+		}
+	}
+	return changes
+}
+
+func (t *tokenStore) reload(path string) (map[uint32][]byte, map[uint32][]byte, error) {
+	fresh := New().(*tokenStore)
+	if err := fresh.LoadFile(path); err != nil {
+		return nil, nil, err
+	}
+	return t.replace(fresh)
+}
+
+// replace swaps the contents of the store for those of another, returning
+// copies of the tokens before and after.
+func (t *tokenStore) replace(other *tokenStore) (map[uint32][]byte, map[uint32][]byte, error) {
+	current := copyTokens(other.tokens)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	previous := copyTokens(t.tokens)
+	t.tokens = other.tokens
+	t.metadata = other.metadata
+	t.layout = other.layout
+	t.format = other.format
+	return previous, current, nil
+}
+
+func copyTokens(tokens map[uint32][]byte) map[uint32][]byte {
+	c := make(map[uint32][]byte, len(tokens))
+	for deviceId, token := range tokens {
+		c[deviceId] = token
+	}
+	return c
+}
+
+func (e *encryptedStore) reload(path string) (map[uint32][]byte, map[uint32][]byte, error) {
+	fresh := NewEncrypted(e.secret).(*encryptedStore)
+	if err := fresh.LoadFile(path); err != nil {
+		return nil, nil, err
+	}
+
+	fresh.keyMutex.Lock()
+	e.keyMutex.Lock()
+	if fresh.key != nil {
+		e.n, e.r, e.p = fresh.n, fresh.r, fresh.p
+		e.salt, e.key = fresh.salt, fresh.key
+	}
+	e.keyMutex.Unlock()
+	fresh.keyMutex.Unlock()
+
+	return e.tokenStore.replace(fresh.tokenStore)
+}
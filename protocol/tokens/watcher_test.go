@@ -0,0 +1,109 @@
+package tokens
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Watcher_SetUp(t *testing.T, contents string) (tt struct {
+	clk     *clock.Mock
+	path    string
+	store   TokenStore
+	watcher Watcher
+	cleanup func()
+}) {
+	dir, err := ioutil.TempDir("", "tokens")
+	assert.NoError(t, err)
+	tt.path = filepath.Join(dir, "tokens.txt")
+	assert.NoError(t, ioutil.WriteFile(tt.path, []byte(contents), 0600))
+
+	tt.clk = clock.NewMock()
+	tt.store, err = FromFile(tt.path)
+	assert.NoError(t, err)
+	tt.watcher, err = Watch(tt.store, tt.path, time.Second, tt.clk)
+	assert.NoError(t, err)
+	tt.cleanup = func() {
+		tt.watcher.Close()
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+func Watcher_NextChanges(t *testing.T, w Watcher, n int) map[uint32]Change {
+	changes := make(map[uint32]Change)
+	for i := 0; i < n; i++ {
+		select {
+		case change := <-w.Changes():
+			changes[change.DeviceID] = change
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for token change")
+		}
+	}
+	return changes
+}
+
+// Added, changed and removed tokens are reported when the file changes.
+func TestWatcher(t *testing.T) {
+	tt := Watcher_SetUp(t, "10=01010101010101010101010101010101\n11=02020202020202020202020202020202\n")
+	defer tt.cleanup()
+
+	assert.NoError(t, ioutil.WriteFile(tt.path, []byte(
+		"10=0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a\n12=03030303030303030303030303030303\n# Comment\n"), 0600))
+	tt.clk.Add(time.Second)
+
+	changes := Watcher_NextChanges(t, tt.watcher, 3)
+	assert.NotNil(t, changes[10].OldToken)
+	assert.NotNil(t, changes[10].NewToken)
+	assert.Nil(t, changes[11].NewToken)
+	assert.Nil(t, changes[12].OldToken)
+
+	_, err := tt.store.GetToken(11)
+	assert.Error(t, err)
+	token, err := tt.store.GetToken(12)
+	assert.NoError(t, err)
+	assert.Equal(t, changes[12].NewToken, token)
+}
+
+// Malformed files are not loaded, and the existing tokens are kept.
+func TestWatcher_KeepsTokensOnMalformedFile(t *testing.T) {
+	tt := Watcher_SetUp(t, "10=01010101010101010101010101010101\n")
+	defer tt.cleanup()
+
+	assert.NoError(t, ioutil.WriteFile(tt.path, []byte(`{"version": 1, "devices": [{"id": 10, "token": "zz"}]}`), 0600))
+	tt.clk.Add(time.Second)
+	tt.watcher.Close()
+
+	_, ok := <-tt.watcher.Changes()
+	assert.False(t, ok)
+	_, err := tt.store.GetToken(10)
+	assert.NoError(t, err)
+}
+
+// Tokens replaced with others of the same length are detected, even if the
+// modification time is preserved.
+func TestWatcher_DetectsSameSizeChange(t *testing.T) {
+	tt := Watcher_SetUp(t, "10=01010101010101010101010101010101\n")
+	defer tt.cleanup()
+	info, err := os.Stat(tt.path)
+	assert.NoError(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(tt.path, []byte("10=0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a\n"), 0600))
+	assert.NoError(t, os.Chtimes(tt.path, info.ModTime(), info.ModTime()))
+	tt.clk.Add(time.Second)
+
+	changes := Watcher_NextChanges(t, tt.watcher, 1)
+	assert.Equal(t, "0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a", hex.EncodeToString(changes[10].NewToken))
+}
+
+// Only file-backed stores can be watched.
+func TestWatch(t *testing.T) {
+	_, err := Watch(NewChain(nil, NewEnvSource(DefaultEnvPrefix)), "tokens.txt", time.Second, clock.NewMock())
+	assert.Error(t, err)
+}
@@ -2,7 +2,9 @@ package transport
 
 import (
 	"net"
+	"sync"
 
+	"github.com/benbjohnson/clock"
 	"github.com/nickw444/miio-go/protocol/packet"
 )
 
@@ -20,7 +22,8 @@ type inbound struct {
 	socket   InboundConn
 	packets  chan *packet.Packet
 	quitChan chan struct{}
-	stopped  bool
+	stopOnce sync.Once
+	clock    clock.Clock
 }
 
 // InboundConn is an abstraction around net.UDPConn to allow
@@ -30,15 +33,15 @@ type InboundConn interface {
 }
 
 func NewInbound(socket InboundConn) Inbound {
-	return newInbound(socket)
+	return newInbound(socket, clock.New())
 }
 
-func newInbound(socket InboundConn) *inbound {
+func newInbound(socket InboundConn, clk clock.Clock) *inbound {
 	i := &inbound{
+		clock:    clk,
 		socket:   socket,
 		packets:  make(chan *packet.Packet),
 		quitChan: make(chan struct{}),
-		stopped:  false,
 	}
 	go i.reader()
 	return i
@@ -55,9 +58,11 @@ func (i *inbound) reader() {
 			buf := make([]byte, 1024)
 			n, addr, err := i.socket.ReadFromUDP(buf)
 
-			if i.stopped {
+			select {
+			case <-i.quitChan:
 				// No need to process this packet as we have been stopped.
 				return
+			default:
 			}
 
 			if err != nil {
@@ -66,14 +71,18 @@ func (i *inbound) reader() {
 				continue
 			}
 
-			pkt, err := packet.Decode(buf[:n], addr)
+			pkt, err := packet.DecodeAt(buf[:n], addr, i.clock.Now())
 			if err != nil {
 				// TODO NW remove panic
 				panic(err)
 				continue
 			}
 
-			i.packets <- pkt
+			select {
+			case <-i.quitChan:
+				return
+			case i.packets <- pkt:
+			}
 		}
 	}
 }
@@ -83,7 +92,8 @@ func (i *inbound) Packets() <-chan *packet.Packet {
 }
 
 func (i *inbound) Stop() error {
-	close(i.quitChan)
-	i.stopped = true
+	i.stopOnce.Do(func() {
+		close(i.quitChan)
+	})
 	return nil
 }
@@ -4,7 +4,10 @@ package mocks
 
 import (
 	packet "github.com/nickw444/miio-go/protocol/packet"
+
 	mock "github.com/stretchr/testify/mock"
+
+	net "net"
 )
 
 // Outbound is an autogenerated mock type for the Outbound type
@@ -49,6 +52,36 @@ func (_m *Outbound) CallAndDeserialize(method string, params interface{}, resp i
 	return r0
 }
 
+// Close provides a mock function with given fields:
+func (_m *Outbound) Close() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Dest provides a mock function with given fields:
+func (_m *Outbound) Dest() net.Addr {
+	ret := _m.Called()
+
+	var r0 net.Addr
+	if rf, ok := ret.Get(0).(func() net.Addr); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(net.Addr)
+		}
+	}
+
+	return r0
+}
+
 // Handle provides a mock function with given fields: pkt
 func (_m *Outbound) Handle(pkt *packet.Packet) error {
 	ret := _m.Called(pkt)
@@ -76,3 +109,13 @@ func (_m *Outbound) Send(_a0 *packet.Packet) error {
 
 	return r0
 }
+
+// SetCrypto provides a mock function with given fields: crypto
+func (_m *Outbound) SetCrypto(crypto packet.Crypto) {
+	_m.Called(crypto)
+}
+
+// SetDest provides a mock function with given fields: dest
+func (_m *Outbound) SetDest(dest net.Addr) {
+	_m.Called(dest)
+}
@@ -3,13 +3,15 @@
 package mocks
 
 import (
-	net "net"
-
-	mock "github.com/stretchr/testify/mock"
+	context "context"
 
 	packet "github.com/nickw444/miio-go/protocol/packet"
 
 	transport "github.com/nickw444/miio-go/protocol/transport"
+
+	mock "github.com/stretchr/testify/mock"
+
+	net "net"
 )
 
 // Transport is an autogenerated mock type for the Transport type
@@ -31,6 +33,20 @@ func (_m *Transport) Close() error {
 	return r0
 }
 
+// Drain provides a mock function with given fields: ctx
+func (_m *Transport) Drain(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Inbound provides a mock function with given fields:
 func (_m *Transport) Inbound() transport.Inbound {
 	ret := _m.Called()
@@ -1,19 +1,29 @@
 package transport
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
-	"time"
-
 	"sync"
+	"time"
 
 	"github.com/benbjohnson/clock"
 	"github.com/nickw444/miio-go/common"
 	"github.com/nickw444/miio-go/protocol/packet"
 )
 
+const (
+	defaultMaxRetries = 10
+	defaultTimeout    = time.Millisecond * 200
+)
+
+var (
+	ErrClosed = errors.New("Outbound is closed.")
+)
+
 type OutboundConn interface {
 	WriteTo([]byte, net.Addr) (int, error)
 }
@@ -31,25 +41,47 @@ type Outbound interface {
 	CallAndDeserialize(method string, params interface{}, resp interface{}) error
 	// Send will send a raw packet without waiting for a Response.
 	Send(packet *packet.Packet) error
+	// Dest returns the address packets are sent to.
+	Dest() net.Addr
+	// SetDest changes the address packets are sent to, e.g. when a device
+	// has been assigned a new IP address.
+	SetDest(dest net.Addr)
+	// SetCrypto replaces the crypto used for packets, e.g. when a device's
+	// token has changed.
+	SetCrypto(crypto packet.Crypto)
+	// Close aborts any calls waiting for a Response and causes subsequent
+	// calls to fail with ErrClosed.
+	Close() error
 }
 
 type outbound struct {
 	maxRetries int
 	timeout    time.Duration
 
-	clock  clock.Clock
-	crypto packet.Crypto
+	clock       clock.Clock
+	cryptoMutex sync.RWMutex
+	crypto      packet.Crypto
 
-	dest   net.Addr
-	socket OutboundConn
+	destMutex sync.RWMutex
+	dest      net.Addr
+	socket    OutboundConn
 
 	nextReqID          uint32
 	continuationsMutex sync.RWMutex
 	continuations      map[uint32]chan []byte
+
+	// Tracks in-flight calls so that they can be drained before closing.
+	callsMutex sync.Mutex
+	calls      int
+	idle       chan struct{}
+	quitChan   chan struct{}
+	closeOnce  sync.Once
+	// Called once when the outbound is closed.
+	onClose func()
 }
 
 func NewOutbound(crypto packet.Crypto, dest net.Addr, socket OutboundConn) Outbound {
-	return newOutbound(10, time.Millisecond*200, clock.New(), crypto, dest, socket)
+	return newOutbound(defaultMaxRetries, defaultTimeout, clock.New(), crypto, dest, socket)
 }
 
 func newOutbound(maxRetries int, timeout time.Duration, clock clock.Clock, crypto packet.Crypto,
@@ -64,22 +96,32 @@ func newOutbound(maxRetries int, timeout time.Duration, clock clock.Clock, crypt
 
 		nextReqID:     1,
 		continuations: make(map[uint32]chan []byte),
+		quitChan:      make(chan struct{}),
 	}
 }
 
 func (o *outbound) Handle(pkt *packet.Packet) error {
+	crypto := o.getCrypto()
 	if pkt.Header.Length <= 32 {
+		// A Hello response carries the device's current stamp, which is
+		// needed when the crypto was created without one. Hellos can't be
+		// verified, so only those from this device's address are used.
+		if crypto != nil && pkt.Header.DeviceID == crypto.DeviceID() && o.fromDest(pkt) {
+			crypto.SyncStamp(pkt.Header.Stamp, pkt.Meta.DecodeTime)
+		}
 		return nil
 	}
 
-	err := o.crypto.VerifyPacket(pkt)
+	// Packets may fail verification if the device's token has changed, so
+	// these are errors rather than panics.
+	err := crypto.VerifyPacket(pkt)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	data, err := o.crypto.Decrypt(pkt.Data)
+	data, err := crypto.Decrypt(pkt.Data)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	resp := Response{}
@@ -92,7 +134,14 @@ func (o *outbound) Handle(pkt *packet.Packet) error {
 	o.continuationsMutex.RLock()
 	if ch, ok := o.continuations[resp.ID]; ok {
 		common.Log.Debugf("Callback with ID %d was reconciled", resp.ID)
-		ch <- data
+		// Continuations are buffered for a single response, so this never
+		// blocks the caller waiting on a call which has given up.
+		select {
+		case ch <- data:
+		case <-o.quitChan:
+		default:
+			common.Log.Debugf("Dropping duplicate response for callback with ID %d", resp.ID)
+		}
 	} else {
 		common.Log.Debugf("Unable to reconcile callback for resp id %d", resp.ID)
 	}
@@ -102,11 +151,16 @@ func (o *outbound) Handle(pkt *packet.Packet) error {
 }
 
 func (o *outbound) Call(method string, params interface{}) ([]byte, error) {
+	if err := o.beginCall(); err != nil {
+		return nil, err
+	}
+	defer o.endCall()
+
 	// Setup a continuation channel
 	o.continuationsMutex.Lock()
 	requestId := o.nextReqID
 	o.nextReqID++
-	ch := make(chan []byte)
+	ch := make(chan []byte, 1)
 	o.continuations[requestId] = ch
 	o.continuationsMutex.Unlock()
 
@@ -128,13 +182,15 @@ func (o *outbound) Call(method string, params interface{}) ([]byte, error) {
 		select {
 		case data := <-ch:
 			return data, nil
+		case <-o.quitChan:
+			return nil, ErrClosed
 		case <-o.clock.After(o.timeout):
 			common.Log.Debugf("Timed out whilst waiting for Response.")
 			continue
 		}
 	}
 
-	err := fmt.Errorf("Max retries exceeded whilst sending Request to device %s", o.dest)
+	err := fmt.Errorf("Max retries exceeded whilst sending Request to device %s", o.Dest())
 	common.Log.Error(err)
 	return nil, err
 }
@@ -150,10 +206,94 @@ func (o *outbound) CallAndDeserialize(method string, params interface{}, ret int
 
 func (o *outbound) Send(packet *packet.Packet) error {
 	common.Log.Debugf("Sending packet with checksum: %s", hex.EncodeToString(packet.Header.Checksum))
-	_, err := o.socket.WriteTo(packet.Serialize(), o.dest)
+	_, err := o.socket.WriteTo(packet.Serialize(), o.Dest())
 	return err
 }
 
+func (o *outbound) Dest() net.Addr {
+	o.destMutex.RLock()
+	defer o.destMutex.RUnlock()
+	return o.dest
+}
+
+// fromDest reports whether the packet was received from the address packets
+// are sent to.
+func (o *outbound) fromDest(pkt *packet.Packet) bool {
+	dest := o.Dest()
+	return pkt.Meta.Addr != nil && dest != nil && pkt.Meta.Addr.String() == dest.String()
+}
+
+func (o *outbound) SetDest(dest net.Addr) {
+	o.destMutex.Lock()
+	o.dest = dest
+	o.destMutex.Unlock()
+}
+
+func (o *outbound) SetCrypto(crypto packet.Crypto) {
+	o.cryptoMutex.Lock()
+	o.crypto = crypto
+	o.cryptoMutex.Unlock()
+}
+
+func (o *outbound) getCrypto() packet.Crypto {
+	o.cryptoMutex.RLock()
+	defer o.cryptoMutex.RUnlock()
+	return o.crypto
+}
+
+func (o *outbound) Close() error {
+	o.closeOnce.Do(func() {
+		close(o.quitChan)
+		if o.onClose != nil {
+			o.onClose()
+		}
+	})
+	return nil
+}
+
+// Drain blocks until all in-flight calls have completed or the context is
+// done.
+func (o *outbound) Drain(ctx context.Context) error {
+	o.callsMutex.Lock()
+	if o.calls == 0 {
+		o.callsMutex.Unlock()
+		return nil
+	}
+	idle := o.idle
+	o.callsMutex.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (o *outbound) beginCall() error {
+	o.callsMutex.Lock()
+	defer o.callsMutex.Unlock()
+	select {
+	case <-o.quitChan:
+		return ErrClosed
+	default:
+	}
+	if o.calls == 0 {
+		o.idle = make(chan struct{})
+	}
+	o.calls++
+	return nil
+}
+
+func (o *outbound) endCall() {
+	o.callsMutex.Lock()
+	defer o.callsMutex.Unlock()
+	o.calls--
+	if o.calls == 0 {
+		close(o.idle)
+	}
+}
+
 // Call out to the device, but don't wait for a Response.
 func (o *outbound) call(requestId uint32, method string, params interface{}) (err error) {
 	data, err := json.Marshal(Request{
@@ -165,7 +305,7 @@ func (o *outbound) call(requestId uint32, method string, params interface{}) (er
 		return
 	}
 
-	p, err := o.crypto.NewPacket(data)
+	p, err := o.getCrypto().NewPacket(data)
 	if err != nil {
 		return
 	}
@@ -175,8 +315,32 @@ func (o *outbound) call(requestId uint32, method string, params interface{}) (er
 }
 
 type Response struct {
-	ID     uint32      `json:"id"`
-	Result interface{} `json:"result"`
+	ID     uint32         `json:"id"`
+	Result interface{}    `json:"result"`
+	Error  *ResponseError `json:"error,omitempty"`
+}
+
+// IsOK reports whether the result is "ok" or ["ok"], which devices reply with
+// to acknowledge a command.
+func (r *Response) IsOK() bool {
+	switch result := r.Result.(type) {
+	case string:
+		return result == "ok"
+	case []interface{}:
+		return len(result) == 1 && result[0] == "ok"
+	default:
+		return false
+	}
+}
+
+// ResponseError is an error returned by the device in place of a result.
+type ResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("Device returned error %d: %s", e.Code, e.Message)
 }
 
 type Request struct {
@@ -0,0 +1,158 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/nickw444/miio-go/protocol/packet"
+	packetMocks "github.com/nickw444/miio-go/protocol/packet/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type fakeConn struct {
+	sent chan []byte
+	addr net.Addr
+}
+
+func (f *fakeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	f.addr = addr
+	f.sent <- b
+	return len(b), nil
+}
+
+func Outbound_SetUp() (tt struct {
+	clk      *clock.Mock
+	crypto   *packetMocks.Crypto
+	socket   *fakeConn
+	outbound *outbound
+}) {
+	tt.clk = clock.NewMock()
+	tt.crypto = new(packetMocks.Crypto)
+	tt.socket = &fakeConn{sent: make(chan []byte, 1)}
+	tt.outbound = newOutbound(1, time.Second, tt.clk, tt.crypto, &net.UDPAddr{}, tt.socket)
+
+	tt.crypto.On("NewPacket", mock.Anything).Return(packet.New(1, make([]byte, 16), 1, nil), nil)
+	return
+}
+
+// Close aborts calls that are waiting for a response.
+func TestOutbound_Close(t *testing.T) {
+	tt := Outbound_SetUp()
+
+	errs := make(chan error)
+	go func() {
+		_, err := tt.outbound.Call("get_prop", nil)
+		errs <- err
+	}()
+
+	// Wait for the request to be sent.
+	<-tt.socket.sent
+
+	assert.NoError(t, tt.outbound.Close())
+	assert.Equal(t, ErrClosed, <-errs)
+}
+
+// Calls fail after the outbound is closed.
+func TestOutbound_Close2(t *testing.T) {
+	tt := Outbound_SetUp()
+
+	assert.NoError(t, tt.outbound.Close())
+	assert.NoError(t, tt.outbound.Close())
+	_, err := tt.outbound.Call("get_prop", nil)
+	assert.Equal(t, ErrClosed, err)
+}
+
+// Drain waits for in-flight calls and respects the context.
+func TestOutbound_Drain(t *testing.T) {
+	tt := Outbound_SetUp()
+	assert.NoError(t, tt.outbound.Drain(context.Background()))
+
+	assert.NoError(t, tt.outbound.beginCall())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, tt.outbound.Drain(ctx))
+
+	tt.outbound.endCall()
+	assert.NoError(t, tt.outbound.Drain(context.Background()))
+}
+
+// Packets are sent to the updated destination after SetDest.
+func TestOutbound_SetDest(t *testing.T) {
+	tt := Outbound_SetUp()
+	dest := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 54321}
+
+	tt.outbound.SetDest(dest)
+	assert.Equal(t, dest, tt.outbound.Dest())
+
+	assert.NoError(t, tt.outbound.Send(packet.NewHello()))
+	<-tt.socket.sent
+	assert.Equal(t, dest, tt.socket.addr)
+}
+
+// Hello responses synchronise the stamp of the current crypto.
+func TestOutbound_SetCrypto(t *testing.T) {
+	tt := Outbound_SetUp()
+	crypto := new(packetMocks.Crypto)
+	crypto.On("DeviceID").Return(uint32(1))
+	tt.outbound.SetCrypto(crypto)
+
+	pkt := packet.New(1, make([]byte, 16), 100, nil)
+	pkt.Meta.Addr = &net.UDPAddr{}
+	crypto.On("SyncStamp", uint32(100), pkt.Meta.DecodeTime).Once()
+
+	assert.NoError(t, tt.outbound.Handle(pkt))
+	crypto.AssertExpectations(t)
+	tt.crypto.AssertNotCalled(t, "SyncStamp", mock.Anything, mock.Anything)
+}
+
+// Hellos from other devices or addresses don't synchronise the stamp.
+func TestOutbound_Handle2(t *testing.T) {
+	tt := Outbound_SetUp()
+	tt.crypto.On("DeviceID").Return(uint32(1))
+
+	otherDevice := packet.New(2, make([]byte, 16), 100, nil)
+	otherDevice.Meta.Addr = &net.UDPAddr{}
+	assert.NoError(t, tt.outbound.Handle(otherDevice))
+
+	otherAddr := packet.New(1, make([]byte, 16), 100, nil)
+	otherAddr.Meta.Addr = &net.UDPAddr{IP: net.IPv4(192, 168, 1, 66), Port: 54321}
+	assert.NoError(t, tt.outbound.Handle(otherAddr))
+
+	tt.crypto.AssertNotCalled(t, "SyncStamp", mock.Anything, mock.Anything)
+}
+
+// Packets which fail verification are returned as errors.
+func TestOutbound_Handle(t *testing.T) {
+	tt := Outbound_SetUp()
+	pkt := packet.New(1, make([]byte, 16), 100, make([]byte, 32))
+	tt.crypto.On("VerifyPacket", pkt).Return(errors.New("Checksum mismatch"))
+
+	assert.Error(t, tt.outbound.Handle(pkt))
+}
+
+// Responses for calls which are not waiting don't block handling.
+func TestOutbound_HandleDuplicate(t *testing.T) {
+	tt := Outbound_SetUp()
+	tt.outbound.continuations[5] = make(chan []byte, 1)
+	pkt := packet.New(1, make([]byte, 16), 100, make([]byte, 32))
+	tt.crypto.On("VerifyPacket", pkt).Return(nil)
+	tt.crypto.On("Decrypt", pkt.Data).Return([]byte(`{"id": 5, "result": ["ok"]}`), nil)
+
+	assert.NoError(t, tt.outbound.Handle(pkt))
+	assert.NoError(t, tt.outbound.Handle(pkt))
+	assert.Len(t, tt.outbound.continuations[5], 1)
+}
+
+func TestResponse_IsOK(t *testing.T) {
+	assert.True(t, (&Response{Result: "ok"}).IsOK())
+	assert.True(t, (&Response{Result: []interface{}{"ok"}}).IsOK())
+	assert.False(t, (&Response{Result: []interface{}{}}).IsOK())
+	assert.False(t, (&Response{Result: "error"}).IsOK())
+	assert.False(t, (&Response{}).IsOK())
+	assert.False(t, (&Response{Result: float64(0)}).IsOK())
+}
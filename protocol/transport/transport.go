@@ -1,11 +1,18 @@
 package transport
 
 import (
+	"context"
 	"net"
+	"sync"
+	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/nickw444/miio-go/protocol/packet"
 )
 
+// DevicePort is the UDP port miIO devices listen on.
+const DevicePort = 54321
+
 type Conn interface {
 	InboundConn
 	OutboundConn
@@ -15,39 +22,114 @@ type Conn interface {
 type Transport interface {
 	Inbound() Inbound
 	NewOutbound(crypto packet.Crypto, dest net.Addr) Outbound
+	// Drain blocks until in-flight calls on all outbounds have completed or
+	// the context is done.
+	Drain(ctx context.Context) error
+	// Close stops the inbound, closes all outbounds and releases the
+	// underlying socket.
 	Close() error
 }
 
+// RetryPolicy controls how outbound calls are retried when a device does not
+// respond.
+type RetryPolicy struct {
+	MaxRetries int           // Number of retries after the initial attempt.
+	Timeout    time.Duration // How long to wait for a response to each attempt.
+}
+
+// DefaultRetryPolicy is used by NewTransport.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: defaultMaxRetries,
+	Timeout:    defaultTimeout,
+}
+
+// Config holds optional transport configuration.
+type Config struct {
+	RetryPolicy RetryPolicy // Defaults to DefaultRetryPolicy.
+	Clock       clock.Clock // Defaults to the system clock.
+}
+
 type transport struct {
+	mutex     sync.Mutex
 	inbound   Inbound
-	outbounds []Outbound
+	outbounds map[*outbound]struct{}
 	socket    Conn
+	config    Config
 }
 
 func NewTransport(socket Conn) Transport {
+	return NewTransportWithConfig(socket, Config{})
+}
+
+func NewTransportWithConfig(socket Conn, config Config) Transport {
+	if config.RetryPolicy == (RetryPolicy{}) {
+		config.RetryPolicy = DefaultRetryPolicy
+	}
+	if config.Clock == nil {
+		config.Clock = clock.New()
+	}
 	return &transport{
-		socket: socket,
+		outbounds: make(map[*outbound]struct{}),
+		socket:    socket,
+		config:    config,
 	}
 }
 
 func (t *transport) Inbound() Inbound {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	if t.inbound == nil {
-		t.inbound = NewInbound(t.socket)
+		t.inbound = newInbound(t.socket, t.config.Clock)
 	}
 	return t.inbound
 }
 
 func (t *transport) NewOutbound(crypto packet.Crypto, dest net.Addr) Outbound {
-	o := NewOutbound(crypto, dest, t.socket)
-	t.outbounds = append(t.outbounds, o)
+	o := newOutbound(t.config.RetryPolicy.MaxRetries, t.config.RetryPolicy.Timeout, t.config.Clock, crypto, dest,
+		t.socket)
+	// Outbounds unregister themselves when closed, so that those of expired
+	// devices and handshakes don't accumulate.
+	o.onClose = func() {
+		t.mutex.Lock()
+		delete(t.outbounds, o)
+		t.mutex.Unlock()
+	}
+	t.mutex.Lock()
+	t.outbounds[o] = struct{}{}
+	t.mutex.Unlock()
 	return o
 }
 
+func (t *transport) Drain(ctx context.Context) error {
+	t.mutex.Lock()
+	outbounds := make([]*outbound, 0, len(t.outbounds))
+	for o := range t.outbounds {
+		outbounds = append(outbounds, o)
+	}
+	t.mutex.Unlock()
+
+	for _, o := range outbounds {
+		if err := o.Drain(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (t *transport) Close() error {
-	err := t.inbound.Stop()
-	if err != nil {
-		return err
+	t.mutex.Lock()
+	inbound := t.inbound
+	outbounds := t.outbounds
+	t.outbounds = make(map[*outbound]struct{})
+	t.mutex.Unlock()
+
+	for o := range outbounds {
+		o.Close()
+	}
+	if inbound != nil {
+		if err := inbound.Stop(); err != nil {
+			return err
+		}
 	}
-	err = t.socket.Close()
-	return err
+	return t.socket.Close()
 }
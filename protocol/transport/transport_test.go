@@ -0,0 +1,36 @@
+package transport
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSocket struct {
+	fakeConn
+}
+
+func (f *fakeSocket) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {}
+}
+
+func (f *fakeSocket) Close() error {
+	return nil
+}
+
+// Closed outbounds are no longer tracked by the transport.
+func TestTransport_NewOutbound(t *testing.T) {
+	tr := NewTransport(&fakeSocket{}).(*transport)
+
+	first := tr.NewOutbound(nil, &net.UDPAddr{})
+	second := tr.NewOutbound(nil, &net.UDPAddr{})
+	assert.Len(t, tr.outbounds, 2)
+
+	assert.NoError(t, first.Close())
+	assert.Len(t, tr.outbounds, 1)
+	assert.Contains(t, tr.outbounds, second.(*outbound))
+
+	assert.NoError(t, tr.Close())
+	assert.Len(t, tr.outbounds, 0)
+}
@@ -0,0 +1,54 @@
+package capability
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// WiFiConfig holds the parameters of a miIO.config_router call.
+type WiFiConfig struct {
+	SSID          string `json:"ssid"`
+	Password      string `json:"passwd"`
+	UID           int64  `json:"uid"`
+	CountryDomain string `json:"country_domain"`
+	Timezone      string `json:"tz"`
+	GMTOffset     int    `json:"gmt_offset"`
+	WiFiConfig    struct {
+		CountryCode string `json:"cc"`
+	} `json:"wifi_config"`
+}
+
+// AccessPoint emulates a device in AP mode, accepting Wi-Fi credentials for
+// the home network.
+type AccessPoint struct {
+	// OnConfigured is called when the device has been configured.
+	OnConfigured func(config WiFiConfig)
+}
+
+func (a *AccessPoint) MaybeGetProp(propName string) (handled bool, value interface{}, err error) {
+	return false, nil, nil
+}
+
+func (a *AccessPoint) MaybeHandle(method string, params interface{}) (handled bool, data interface{}, err error) {
+	if method != "miIO.config_router" {
+		return false, nil, nil
+	}
+
+	// Round trip the params to decode them into the config.
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return true, nil, err
+	}
+	config := WiFiConfig{}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return true, nil, err
+	}
+	if config.SSID == "" {
+		return true, nil, errors.New("miIO.config_router requires an ssid")
+	}
+
+	if a.OnConfigured != nil {
+		a.OnConfigured(config)
+	}
+	return true, "ok", nil
+}
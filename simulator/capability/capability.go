@@ -1,5 +1,9 @@
 package capability
 
+import "github.com/sirupsen/logrus"
+
+var log = logrus.New()
+
 type Capability interface {
 	MaybeGetProp(propName string) (handled bool, value interface{}, err error)
 	MaybeHandle(method string, params interface{}) (handled bool, data interface{}, err error)
@@ -1,24 +1,56 @@
 package capability
 
-import "github.com/nickw444/miio-go/common"
+import (
+	"time"
+
+	"github.com/nickw444/miio-go/common"
+)
 
 type Info struct {
 	Model string
+	// FirmwareVersion defaults to SIM_0.
+	FirmwareVersion string
 }
 
+// started is used to report the device uptime.
+var started = time.Now()
+
 func (i *Info) MaybeGetProp(propName string) (handled bool, value interface{}, err error) {
 	return false, nil, nil
 }
 
 func (i *Info) MaybeHandle(method string, params interface{}) (handled bool, data interface{}, err error) {
-	if method == "miIO.info" {
+	switch method {
+	case "miIO.info":
+		firmwareVersion := i.FirmwareVersion
+		if firmwareVersion == "" {
+			firmwareVersion = "SIM_0"
+		}
 		info := common.DeviceInfo{
-			Model:           i.Model,
-			FirmwareVersion: "SIM_0",
-			MacAddress:      "00:00:00:00:00:00",
-			HardwareVersion: "SIM_0",
+			Model:               i.Model,
+			FirmwareVersion:     firmwareVersion,
+			MacAddress:          "00:00:00:00:00:00",
+			HardwareVersion:     "SIM_0",
+			WiFiFirmwareVersion: "SIM_0",
+			Life:                int64(time.Since(started) / time.Second),
+			MemoryFree:          32768,
+			AccessPoint: common.AccessPointInfo{
+				SSID:  "simulator",
+				BSSID: "00:00:00:00:00:00",
+				RSSI:  -50,
+			},
+			Network: common.NetworkInfo{
+				LocalIP: "127.0.0.1",
+				Mask:    "255.0.0.0",
+				Gateway: "127.0.0.1",
+			},
+			OT:      "otu",
+			OTUStat: []int{0, 0, 0, 0, 0, 0},
 		}
 		return true, info, nil
+
+	case "miIO.wifi_assoc_state":
+		return true, common.WiFiAssocState{State: "ONLINE", ConnSuccessCount: 1}, nil
 	}
 
 	return false, nil, nil
@@ -1,18 +1,31 @@
 package capability
 
+import "fmt"
+
+// Light reports values as strings, as Yeelight firmware does.
 type Light struct {
 	brightness int
-	color      int
+	colorMode  int
+	rgb        int
+	hue        int
+	saturation int
+	ct         int
 }
 
 func (l *Light) MaybeGetProp(propName string) (handled bool, value interface{}, err error) {
 	switch propName {
 	case "bright":
-		return true, l.brightness, nil
-	case "hsv":
-		return true, 0, nil
+		return true, fmt.Sprint(l.brightness), nil
+	case "color_mode":
+		return true, fmt.Sprint(l.colorMode), nil
 	case "rgb":
-		return true, 0, nil
+		return true, fmt.Sprint(l.rgb), nil
+	case "hue":
+		return true, fmt.Sprint(l.hue), nil
+	case "sat":
+		return true, fmt.Sprint(l.saturation), nil
+	case "ct":
+		return true, fmt.Sprint(l.ct), nil
 	default:
 		return false, nil, nil
 	}
@@ -21,12 +34,23 @@ func (l *Light) MaybeGetProp(propName string) (handled bool, value interface{},
 func (l *Light) MaybeHandle(method string, params interface{}) (handled bool, data interface{}, err error) {
 	switch method {
 	case "set_bright":
-		return true, nil, nil
+		l.brightness = intParam(params, 0)
 	case "set_rgb":
-		return true, nil, nil
+		l.rgb = intParam(params, 0)
+		l.colorMode = 1
 	case "set_hsv":
-		return true, nil, nil
+		l.hue = intParam(params, 0)
+		l.saturation = intParam(params, 1)
+		l.colorMode = 3
+	case "set_ct_abx":
+		l.ct = intParam(params, 0)
+		l.colorMode = 2
 	default:
 		return false, nil, nil
 	}
+	return true, []string{"ok"}, nil
+}
+
+func intParam(params interface{}, i int) int {
+	return int(params.([]interface{})[i].(float64))
 }
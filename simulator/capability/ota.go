@@ -0,0 +1,123 @@
+package capability
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/nickw444/miio-go/common"
+)
+
+// otaStep is how far each status poll advances the download.
+const otaStep = 25
+
+// OTA emulates firmware updates with a state machine which advances each time
+// the state is polled: the firmware is downloaded and verified, then installed,
+// then the device returns to idle. The firmware file contains the new firmware
+// version as text.
+type OTA struct {
+	Info *Info
+
+	state    common.OTAState
+	progress int
+	url      string
+	md5      string
+	version  string
+}
+
+type otaRequest struct {
+	AppURL  string `json:"app_url"`
+	FileMD5 string `json:"file_md5"`
+}
+
+func (o *OTA) MaybeGetProp(propName string) (handled bool, value interface{}, err error) {
+	return false, nil, nil
+}
+
+func (o *OTA) MaybeHandle(method string, params interface{}) (handled bool, data interface{}, err error) {
+	switch method {
+	case "miIO.ota":
+		raw, err := json.Marshal(params)
+		if err != nil {
+			return true, nil, err
+		}
+		req := otaRequest{}
+		if err := json.Unmarshal(raw, &req); err != nil {
+			return true, nil, err
+		}
+		if req.AppURL == "" || req.FileMD5 == "" {
+			return true, nil, errors.New("miIO.ota requires app_url and file_md5")
+		}
+		if o.state == common.OTAStateDownloading || o.state == common.OTAStateInstalling {
+			return true, []string{"busy"}, nil
+		}
+		o.url, o.md5 = req.AppURL, req.FileMD5
+		o.state, o.progress = common.OTAStateDownloading, 0
+		return true, []string{"ok"}, nil
+
+	case "miIO.get_ota_state":
+		o.advance()
+		return true, []common.OTAState{o.getState()}, nil
+
+	case "miIO.get_ota_progress":
+		return true, []int{o.progress}, nil
+	}
+	return false, nil, nil
+}
+
+func (o *OTA) getState() common.OTAState {
+	if o.state == "" {
+		return common.OTAStateIdle
+	}
+	return o.state
+}
+
+func (o *OTA) advance() {
+	switch o.state {
+	case common.OTAStateDownloading:
+		if o.progress == 0 {
+			version, err := o.download()
+			if err != nil {
+				log.Warnf("Firmware download failed: %s", err)
+				o.state = common.OTAStateFailed
+				return
+			}
+			o.version = version
+		}
+		o.progress += otaStep
+		if o.progress >= 100 {
+			o.progress = 100
+			o.state = common.OTAStateInstalling
+		}
+	case common.OTAStateInstalling:
+		log.Infof("Installed firmware version %s", o.version)
+		o.Info.FirmwareVersion = o.version
+		o.state = common.OTAStateIdle
+	}
+}
+
+// download fetches and verifies the firmware, returning its version.
+func (o *OTA) download() (string, error) {
+	resp, err := http.Get(o.url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+	firmware, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	sum := md5.Sum(firmware)
+	if hex.EncodeToString(sum[:]) != o.md5 {
+		return "", errors.New("MD5 mismatch")
+	}
+	return string(bytes.TrimSpace(firmware)), nil
+}
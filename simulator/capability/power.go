@@ -26,7 +26,7 @@ func (p *Power) MaybeHandle(method string, params interface{}) (handled bool, da
 		} else if value == "off" {
 			p.power = false
 		}
-		return true, nil, nil
+		return true, []string{"ok"}, nil
 	}
 	return false, nil, nil
 }
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/benbjohnson/clock"
@@ -26,6 +28,10 @@ type BaseDevice struct {
 	deviceToken  []byte
 	deviceID     uint32
 	revealToken  bool
+
+	mutex      sync.Mutex
+	apMode     bool
+	wifiConfig *capability.WiFiConfig
 }
 
 func NewBaseDevice(deviceID uint32, deviceToken []byte, revealToken bool) (*BaseDevice, error) {
@@ -69,8 +75,12 @@ func (b *BaseDevice) PackResponse(response interface{}) (*packet.Packet, error)
 }
 
 func (b *BaseDevice) HandleDiscover(pkt *packet.Packet) (*packet.Packet, error) {
+	b.mutex.Lock()
+	reveal := b.revealToken || b.apMode
+	b.mutex.Unlock()
+
 	var checksumValue []byte
-	if b.revealToken {
+	if reveal {
 		checksumValue = b.deviceToken
 	} else {
 		checksumValue = bytes.Repeat([]byte{0x00}, 16)
@@ -144,3 +154,65 @@ func (b *BaseDevice) HandlePacket(pkt *packet.Packet) (*packet.Packet, error) {
 func (b *BaseDevice) AddCapability(c capability.Capability) {
 	b.capabilities = append(b.capabilities, c)
 }
+
+// EnableAPMode emulates a fresh or reset device hosting its own access point.
+// The device reveals its token until it is configured with Wi-Fi credentials
+// using miIO.config_router.
+func (b *BaseDevice) EnableAPMode() {
+	b.mutex.Lock()
+	b.apMode = true
+	b.mutex.Unlock()
+
+	b.AddCapability(&capability.AccessPoint{
+		OnConfigured: func(config capability.WiFiConfig) {
+			log.Infof("Configured to join Wi-Fi network %s", config.SSID)
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			b.apMode = false
+			b.wifiConfig = &config
+		},
+	})
+}
+
+// WiFiConfig returns the Wi-Fi configuration received in AP mode, or nil if
+// the device has not been configured.
+func (b *BaseDevice) WiFiConfig() *capability.WiFiConfig {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.wifiConfig
+}
+
+// Serve responds to packets received on the socket until quit is closed. The
+// socket must only be closed once Serve has returned.
+func Serve(s *net.UDPConn, dev SimulatedDevice, quit <-chan struct{}) error {
+	inbound := transport.NewInbound(s)
+	defer inbound.Stop()
+
+	for {
+		var pkt *packet.Packet
+		select {
+		case <-quit:
+			return nil
+		case pkt = <-inbound.Packets():
+		}
+
+		var resp *packet.Packet
+		var err error
+		if pkt.Header.DeviceID == 0xffffffff {
+			log.Info("Discovery packet received")
+			resp, err = dev.HandleDiscover(pkt)
+		} else {
+			resp, err = dev.HandlePacket(pkt)
+		}
+
+		if err != nil {
+			log.Warnf("Unable to handle packet: %s", err)
+			continue
+		}
+		if resp != nil {
+			if _, err := s.WriteToUDP(resp.Serialize(), pkt.Meta.Addr); err != nil {
+				return err
+			}
+		}
+	}
+}
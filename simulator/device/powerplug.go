@@ -9,9 +9,11 @@ type SimulatedPowerPlug struct {
 }
 
 func NewSimulatedPowerPlug(baseDevice *BaseDevice) *SimulatedPowerPlug {
-	baseDevice.AddCapability(&capability.Info{
+	info := &capability.Info{
 		Model: "chuangmi.plug.m1",
-	})
+	}
+	baseDevice.AddCapability(info)
+	baseDevice.AddCapability(&capability.OTA{Info: info})
 	baseDevice.AddCapability(&capability.Power{})
 	return &SimulatedPowerPlug{
 		BaseDevice: baseDevice,
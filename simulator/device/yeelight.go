@@ -9,9 +9,11 @@ type SimulatedYeelight struct {
 }
 
 func NewSimulatedYeelight(baseDevice *BaseDevice) *SimulatedYeelight {
-	baseDevice.AddCapability(&capability.Info{
+	info := &capability.Info{
 		Model: "yeelink.light.color1",
-	})
+	}
+	baseDevice.AddCapability(info)
+	baseDevice.AddCapability(&capability.OTA{Info: info})
 	baseDevice.AddCapability(&capability.Power{})
 	baseDevice.AddCapability(&capability.Light{})
 
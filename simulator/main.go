@@ -6,8 +6,6 @@ import (
 	"net"
 
 	"github.com/alecthomas/kingpin"
-	"github.com/nickw444/miio-go/protocol/packet"
-	"github.com/nickw444/miio-go/protocol/transport"
 	"github.com/nickw444/miio-go/simulator/device"
 	"github.com/sirupsen/logrus"
 )
@@ -21,6 +19,7 @@ func main() {
 		deviceId    = kingpin.Flag("device-id", "Device ID for the simulated device").Default("12341234").Uint32()
 		deviceToken = kingpin.Flag("device-token", "The device token to use for encrypted payloads").Default(hex.EncodeToString(defaultToken)).HexBytes()
 		revealToken = kingpin.Flag("reveal-token", "Whether or not to reveal the device token").Default("true").Bool()
+		apMode      = kingpin.Flag("ap-mode", "Emulate a fresh device in AP mode, which reveals its token until Wi-Fi is configured").Bool()
 	)
 
 	kingpin.Parse()
@@ -31,7 +30,6 @@ func main() {
 		panic(err)
 	}
 
-	inbound := transport.NewInbound(s)
 	log.Infof("Creating device with id=%d token=%s revealToken=%t",
 		*deviceId, hex.EncodeToString(*deviceToken), *revealToken)
 	baseDev, err := device.NewBaseDevice(*deviceId, *deviceToken, *revealToken)
@@ -47,22 +45,11 @@ func main() {
 	} else {
 		panic("Unknown device type.")
 	}
+	if *apMode {
+		baseDev.EnableAPMode()
+	}
 
-	for pkt := range inbound.Packets() {
-		var resp *packet.Packet
-		var err error
-		if pkt.Header.DeviceID == 0xffffffff {
-			log.Info("Discovery packet received")
-			resp, err = dev.HandleDiscover(pkt)
-		} else {
-			resp, err = dev.HandlePacket(pkt)
-		}
-
-		if err != nil {
-			panic(err)
-		}
-		if resp != nil {
-			s.WriteToUDP(resp.Serialize(), pkt.Meta.Addr)
-		}
+	if err := device.Serve(s, dev, nil); err != nil {
+		panic(err)
 	}
 }
@@ -1,6 +1,7 @@
 package subscription
 
 import (
+	"github.com/benbjohnson/clock"
 	"github.com/nickw444/miio-go/subscription/common"
 	"github.com/nickw444/miio-go/subscription/target"
 )
@@ -9,5 +10,9 @@ func NewTarget() common.SubscriptionTarget {
 	return target.NewTarget()
 }
 
+func NewTargetWithClock(clk clock.Clock) common.SubscriptionTarget {
+	return target.NewTargetWithClock(clk)
+}
+
 type SubscriptionTarget = common.SubscriptionTarget
 type Subscription = common.Subscription
@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/nickw444/miio-go/subscription/common"
 	"github.com/satori/go.uuid"
 )
@@ -25,14 +26,22 @@ type subscription struct {
 	quitChan chan struct{}
 	events   chan interface{}
 	target   common.SubscriptionTarget
+	clock    clock.Clock
 }
 
 func NewSubscription(target common.SubscriptionTarget) common.Subscription {
+	return NewSubscriptionWithClock(target, clock.New())
+}
+
+// NewSubscriptionWithClock creates a subscription which uses the given clock
+// to time out slow writes.
+func NewSubscriptionWithClock(target common.SubscriptionTarget, clk clock.Clock) common.Subscription {
 	return &subscription{
 		id:       uuid.NewV4(),
 		events:   make(chan interface{}, chanSize),
 		quitChan: make(chan struct{}),
 		target:   target,
+		clock:    clk,
 	}
 }
 
@@ -47,7 +56,7 @@ func (s *subscription) Events() <-chan interface{} {
 func (s *subscription) Write(event interface{}) error {
 	s.wg.Add(1)
 	defer s.wg.Done()
-	timeout := time.After(defaultTimeout)
+	timeout := s.clock.After(defaultTimeout)
 	select {
 	case <-s.quitChan:
 		return ErrClosed
@@ -1,26 +1,52 @@
 package target
 
 import (
+	"sync"
+
+	"github.com/benbjohnson/clock"
 	"github.com/nickw444/miio-go/subscription/common"
 	"github.com/nickw444/miio-go/subscription/subscription"
 )
 
 type subscriptionTarget struct {
+	mutex         sync.RWMutex
 	subscriptions map[string]common.Subscription
+	clock         clock.Clock
 }
 
 func NewTarget() common.SubscriptionTarget {
+	return NewTargetWithClock(clock.New())
+}
+
+// NewTargetWithClock creates a target whose subscriptions use the given
+// clock.
+func NewTargetWithClock(clk clock.Clock) common.SubscriptionTarget {
 	return &subscriptionTarget{
 		subscriptions: make(map[string]common.Subscription),
+		clock:         clk,
 	}
 }
 
 func (t *subscriptionTarget) HasSubscribers() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
 	return len(t.subscriptions) > 0
 }
 
-func (t *subscriptionTarget) Publish(event interface{}) error {
+// snapshot returns a copy of the current subscriptions so that they can be
+// written to without holding the lock.
+func (t *subscriptionTarget) snapshot() []common.Subscription {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	subs := make([]common.Subscription, 0, len(t.subscriptions))
 	for _, sub := range t.subscriptions {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+func (t *subscriptionTarget) Publish(event interface{}) error {
+	for _, sub := range t.snapshot() {
 		err := sub.Write(event)
 		if err != nil {
 			return err
@@ -30,18 +56,22 @@ func (t *subscriptionTarget) Publish(event interface{}) error {
 }
 
 func (t *subscriptionTarget) NewSubscription() (common.Subscription, error) {
-	sub := subscription.NewSubscription(t)
+	sub := subscription.NewSubscriptionWithClock(t, t.clock)
+	t.mutex.Lock()
 	t.subscriptions[sub.ID()] = sub
+	t.mutex.Unlock()
 	return sub, nil
 }
 
 func (t *subscriptionTarget) RemoveSubscription(s common.Subscription) error {
+	t.mutex.Lock()
 	delete(t.subscriptions, s.ID())
+	t.mutex.Unlock()
 	return nil
 }
 
 func (t *subscriptionTarget) CloseAllSubscriptions() error {
-	for _, sub := range t.subscriptions {
+	for _, sub := range t.snapshot() {
 		err := t.RemoveSubscription(sub)
 		if err != nil {
 			return err
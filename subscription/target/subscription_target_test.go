@@ -3,6 +3,7 @@ package target
 import (
 	"testing"
 
+	"github.com/benbjohnson/clock"
 	"github.com/nickw444/miio-go/subscription/common"
 	"github.com/nickw444/miio-go/subscription/common/mocks"
 	"github.com/stretchr/testify/assert"
@@ -14,6 +15,7 @@ func SubscriptionTarget_Setup() (tt struct {
 }) {
 	tt.target = &subscriptionTarget{
 		subscriptions: make(map[string]common.Subscription),
+		clock:         clock.NewMock(),
 	}
 	return
 }
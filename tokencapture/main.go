@@ -2,12 +2,15 @@ package main
 
 import (
 	"net"
+	"os"
 
 	"time"
 
 	"flag"
 
+	"bytes"
 	"encoding/hex"
+	"sync"
 
 	"github.com/nickw444/miio-go/common"
 	"github.com/nickw444/miio-go/device"
@@ -19,6 +22,7 @@ import (
 
 var (
 	log            = logrus.New()
+	ignoredMutex   sync.Mutex
 	ignoredDevices = make(map[uint32]bool)
 	t              transport.Transport
 	quitChan       chan struct{}
@@ -26,6 +30,8 @@ var (
 	tokenStore     tokens.TokenStore
 
 	tokenStoreFile = flag.String("file", "tokens.txt", "Path to the token store to update")
+	keyFile        = flag.String("key-file", "", "Path to the key file for an encrypted token store. "+
+		"Alternatively, set MIIO_TOKEN_PASSPHRASE")
 )
 
 func main() {
@@ -39,7 +45,7 @@ func main() {
 	}
 
 	var err error
-	tokenStore, err = tokens.FromFile(*tokenStoreFile)
+	tokenStore, err = loadTokenStore()
 	if err != nil {
 		log.Panic(err)
 	}
@@ -77,6 +83,22 @@ func main() {
 	}
 }
 
+// loadTokenStore loads an encrypted token store if a key file or passphrase
+// is provided, otherwise a plaintext one.
+func loadTokenStore() (tokens.TokenStore, error) {
+	if *keyFile != "" {
+		secret, err := tokens.ReadKeyFile(*keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return tokens.EncryptedFromFile(*tokenStoreFile, secret)
+	}
+	if passphrase := os.Getenv("MIIO_TOKEN_PASSPHRASE"); passphrase != "" {
+		return tokens.EncryptedFromFile(*tokenStoreFile, []byte(passphrase))
+	}
+	return tokens.FromFile(*tokenStoreFile)
+}
+
 func dispatcher() {
 	pkts := t.Inbound().Packets()
 	for {
@@ -96,16 +118,26 @@ func dispatcher() {
 }
 
 func process(pkt *packet.Packet) {
-	if _, ok := ignoredDevices[pkt.Header.DeviceID]; ok {
+	ignoredMutex.Lock()
+	_, ignored := ignoredDevices[pkt.Header.DeviceID]
+	ignoredMutex.Unlock()
+	if ignored {
 		return
 	}
 
 	if pkt.DataLength() == 0 {
 		if pkt.HasZeroChecksum() {
 			log.Warnf("Device with Id %d is not revealing its token. Reset this device and connect to its network to retrieve the token. Ignoring it.", pkt.Header.DeviceID)
+			ignoredMutex.Lock()
 			ignoredDevices[pkt.Header.DeviceID] = true
+			ignoredMutex.Unlock()
 			return
 		} else {
+			// Devices reply to every discovery, so only write when the token
+			// is new or has changed.
+			if token, err := tokenStore.GetToken(pkt.Header.DeviceID); err == nil && bytes.Equal(token, pkt.Header.Checksum) {
+				return
+			}
 			tokenStore.AddDevice(pkt.Header.DeviceID, pkt.Header.Checksum)
 			err := tokenStore.WriteFile(*tokenStoreFile)
 			if err != nil {